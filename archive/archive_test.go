@@ -1,7 +1,23 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
 package archive
 
 import (
+	bigquery "code.google.com/p/ox-google-api-go-client/bigquery/v2"
 	"github.com/getlantern/statshub/statshub"
+	"strings"
 	"testing"
 )
 
@@ -30,9 +46,9 @@ func TestSchema(t *testing.T) {
 			},
 		},
 	}
-	schemaA := schemaForStats(statsA)
-	schemaB := schemaForStats(statsB)
-	consolidatedFields := consolidateFields(schemaA.Fields, schemaB.Fields)
+	schemaA := schemaForStats("country", statsA, nil)
+	schemaB := schemaForStats("country", statsB, nil)
+	consolidatedFields, changes := evolveFields(schemaA.Fields, schemaB.Fields, "")
 	if len(consolidatedFields) != 4 {
 		t.Errorf("Should have 4 consolidated fields, only got %d", len(consolidatedFields))
 	}
@@ -44,4 +60,104 @@ func TestSchema(t *testing.T) {
 	if len(consolidatedGauges) != 4 {
 		t.Errorf("Should have 4 consolidated gauges, only got %d", len(consolidatedGauges))
 	}
+	if len(changes) != 4 || len(schemaAdditions(changes)) != 4 {
+		t.Errorf("Should have added 4 fields: %v", FormatSchemaChanges(changes))
+	}
+	if len(schemaA.Fields[2].Fields) != 2 {
+		t.Errorf("Existing schema shouldn't be modified")
+	}
+}
+
+func TestSchemaConflicts(t *testing.T) {
+	existing := []*bigquery.TableFieldSchema{
+		&bigquery.TableFieldSchema{Name: _dim, Type: STRING},
+		&bigquery.TableFieldSchema{Name: _ts, Type: TIMESTAMP},
+		&bigquery.TableFieldSchema{Name: "legacy", Type: STRING},
+		&bigquery.TableFieldSchema{Name: counter, Type: RECORD, Fields: []*bigquery.TableFieldSchema{
+			&bigquery.TableFieldSchema{Name: "bytesGiven", Type: STRING},
+		}},
+		&bigquery.TableFieldSchema{Name: gauge, Type: INTEGER},
+	}
+	dimStats := map[string]*statshub.Stats{
+		"es": &statshub.Stats{
+			Counters: map[string]int64{"bytesGiven": 5, "bytesGotten": 6},
+		},
+		"total": &statshub.Stats{
+			Counters: map[string]int64{"bytesGotten": 6},
+			Gauges:   map[string]int64{"online": 2},
+		},
+	}
+	merged, changes := evolveFields(existing, schemaForStats("country", dimStats, nil).Fields, "")
+
+	expected := "! counter.bytesGiven STRING (needs INTEGER, rows are quarantined)\n" +
+		"+ counter.bytesGotten INTEGER\n" +
+		"! gauge INTEGER (needs RECORD, rows are quarantined)"
+	if FormatSchemaChanges(changes) != expected {
+		t.Errorf("Wrong diff.  Expected:\n%s\nGot:\n%s", expected, FormatSchemaChanges(changes))
+	}
+	if len(merged) != 5 || merged[2].Name != "legacy" || merged[3].Fields[0].Type != STRING || len(merged[3].Fields) != 2 || merged[4].Type != INTEGER {
+		t.Errorf("Fields should only have been added")
+	}
+
+	conflicts := schemaConflicts(changes)
+	es := rowFromStats(_dim, "es", recordsFor(dimStats["es"], nil), archiveTs)
+	total := rowFromStats(_dim, "total", recordsFor(dimStats["total"], nil), archiveTs)
+	if reasons := conflictsIn(es, conflicts); len(reasons) != 2 {
+		// Even an empty gauge record can't go into an INTEGER field
+		t.Errorf("es should conflict on counter.bytesGiven and gauge: %v", reasons)
+	}
+	if reasons := conflictsIn(total, conflicts); len(reasons) != 1 {
+		t.Errorf("total should conflict on gauge: %v", reasons)
+	}
+	quarantined := quarantineRow(_dim, "es", es, conflictsIn(es, conflicts), archiveTs)
+	if quarantined["row"] != `{"_dim":"es","_ts":1398945600,"counter":{"bytesGiven":5,"bytesGotten":6},"gauge":{}}` {
+		t.Errorf("Wrong quarantined row: %v", quarantined)
+	}
+}
+
+func TestFailedRows(t *testing.T) {
+	rows := []*bigquery.TableDataInsertAllRequestRows{
+		&bigquery.TableDataInsertAllRequestRows{InsertId: "es|1398945600"},
+		&bigquery.TableDataInsertAllRequestRows{InsertId: "total|1398945600"},
+	}
+	failed := failedRows(rows, []*bigquery.TableDataInsertAllResponseInsertErrors{
+		&bigquery.TableDataInsertAllResponseInsertErrors{
+			Index:  1,
+			Errors: []*bigquery.ErrorProto{&bigquery.ErrorProto{Reason: "invalid", Message: "no such field"}},
+		},
+	})
+	if len(failed) != 1 || failed[0].InsertId != "total|1398945600" {
+		t.Fatalf("Wrong failed rows: %v", failed)
+	}
+	err := &InsertError{TableId: "country", Rows: failed}
+	if err.Error() != "Unable to insert 1 rows into country: total|1398945600 (invalid: no such field)" {
+		t.Errorf("Wrong error: %s", err)
+	}
+}
+
+func TestRollupQuery(t *testing.T) {
+	fields := schemaForStats("country", snapshotForArchive("bytesGiven", archiveTs).Dims["country"], nil).Fields
+	sources := rollupSources(fields)
+	if strings.Join(sources, ",") != "counter.bytesGiven,gauge.online" {
+		t.Fatalf("Wrong sources: %v", sources)
+	}
+	columns := rollupColumns(sources)
+	expected := `SELECT _dim, SEC_TO_TIMESTAMP(period * 3600) AS _ts, counter_bytesGiven, gauge_online
+FROM (
+  SELECT _dim, INTEGER(TIMESTAMP_TO_SEC(_ts) / 3600) AS period, MAX(counter.bytesGiven) AS counter_bytesGiven, MAX(gauge.online) AS gauge_online
+  FROM [statshub.country_20140501]
+  GROUP BY _dim, period)`
+	if query := rollupQuery("statshub", "country_20140501", _dim, sources, columns, ONE_HOUR_SECS); query != expected {
+		t.Errorf("Wrong hourly query.  Expected:\n%s\nGot:\n%s", expected, query)
+	}
+
+	// Daily rollups read the flattened columns of the hourly ones
+	hourlyFields := []*bigquery.TableFieldSchema{
+		&bigquery.TableFieldSchema{Name: _dim, Type: STRING},
+		&bigquery.TableFieldSchema{Name: _ts, Type: TIMESTAMP},
+		&bigquery.TableFieldSchema{Name: "counter_bytesGiven", Type: INTEGER},
+	}
+	if sources := rollupSources(hourlyFields); strings.Join(sources, ",") != "counter_bytesGiven" {
+		t.Errorf("Wrong sources for hourly rollups: %v", sources)
+	}
 }
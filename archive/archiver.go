@@ -0,0 +1,175 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package archive
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/getlantern/statshub/statshub"
+)
+
+// IdsDim is the pseudo-dimension under which the detail stats of every id are
+// archived.  Its rows are keyed by _id rather than _dim.
+const IdsDim = "_ids"
+
+// Snapshot is the stats of some dimensions as of a timestamp
+type Snapshot struct {
+	Ts   time.Time                             `json:"ts"`
+	Dims map[string]map[string]*statshub.Stats `json:"dims"`
+
+	// Members lists the stats whose Gauges are really member cardinalities,
+	// which are archived as member.* rather than gauge.*
+	Members []string `json:"members,omitempty"`
+}
+
+// memberSet returns the Members as a set
+func (snapshot *Snapshot) memberSet() map[string]bool {
+	members := make(map[string]bool)
+	for _, name := range snapshot.Members {
+		members[name] = true
+	}
+	return members
+}
+
+// Archiver archives Snapshots.  Every key of every dimension becomes a row
+// shaped like the ones produced by rowFromStats, with _dim (or _id) set to the
+// key and _ts to the timestamp.
+type Archiver interface {
+	Archive(snapshot *Snapshot) error
+}
+
+// MultiArchiver archives to each of its Archivers in turn
+type MultiArchiver []Archiver
+
+func (archivers MultiArchiver) Archive(snapshot *Snapshot) error {
+	var failures []string
+	for _, archiver := range archivers {
+		if err := archiver.Archive(snapshot); err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("Unable to archive to %d of %d sinks: %s", len(failures), len(archivers), strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// recordNames are the records of a row, in the order in which they're
+// flattened into columns
+var recordNames = []string{counter, gauge, gaugeCurrent, member}
+
+// recordsFor splits stats into the records of a row, keyed by record name.
+// Gauges that are members go into the member record.
+func recordsFor(stats *statshub.Stats, members map[string]bool) map[string]map[string]int64 {
+	records := map[string]map[string]int64{
+		counter:      stats.Counters,
+		gauge:        make(map[string]int64),
+		gaugeCurrent: stats.GaugesCurrent,
+		member:       make(map[string]int64),
+	}
+	for name, val := range stats.Gauges {
+		if members[name] {
+			records[member][name] = val
+		} else {
+			records[gauge][name] = val
+		}
+	}
+	return records
+}
+
+// keyColumn returns the column that holds the key of each row for the given
+// dimension
+func keyColumn(dimName string) string {
+	if dimName == IdsDim {
+		return _id
+	}
+	return _dim
+}
+
+// columnsFor returns the flattened columns for the given stats, which are
+// the key column and _ts followed by counter.*, gauge.*, gaugeCurrent.* and
+// member.*, each in alphabetical order.  The columns are the union of those
+// of every key, not just the total.
+func columnsFor(dimName string, dimStats map[string]*statshub.Stats, members map[string]bool) []string {
+	names := make(map[string]map[string]bool)
+	for _, stats := range dimStats {
+		for record, values := range recordsFor(stats, members) {
+			if names[record] == nil {
+				names[record] = make(map[string]bool)
+			}
+			for name := range values {
+				names[record][name] = true
+			}
+		}
+	}
+	columns := []string{keyColumn(dimName), _ts}
+	for _, record := range recordNames {
+		for _, name := range sortedNames(names[record]) {
+			columns = append(columns, record+"."+name)
+		}
+	}
+	return columns
+}
+
+// flatValues returns the values of a row for the given columns, with nil for
+// stats that the row doesn't have.
+func flatValues(columns []string, key string, records map[string]map[string]int64, ts time.Time) []interface{} {
+	values := make([]interface{}, len(columns))
+	for i, column := range columns {
+		switch column {
+		case _dim, _id:
+			values[i] = key
+		case _ts:
+			values[i] = ts.Unix()
+		default:
+			// Record names don't contain dots but stat names might
+			parts := strings.SplitN(column, ".", 2)
+			if len(parts) == 2 {
+				if val, found := records[parts[0]][parts[1]]; found {
+					values[i] = val
+				}
+			}
+		}
+	}
+	return values
+}
+
+// sortedKeys returns the keys of a dimension in alphabetical order, with the
+// total last.
+func sortedKeys(dimStats map[string]*statshub.Stats) []string {
+	keys := make([]string, 0, len(dimStats))
+	for key := range dimStats {
+		if key != "total" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if _, hasTotal := dimStats["total"]; hasTotal {
+		keys = append(keys, "total")
+	}
+	return keys
+}
+
+func sortedNames(names map[string]bool) []string {
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
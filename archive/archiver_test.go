@@ -0,0 +1,185 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package archive
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getlantern/statshub/statshub"
+)
+
+var archiveTs = time.Date(2014, 5, 1, 12, 0, 0, 0, time.UTC)
+
+func snapshotForArchive(counterName string, ts time.Time) *Snapshot {
+	return &Snapshot{Ts: ts, Dims: map[string]map[string]*statshub.Stats{
+		"country": map[string]*statshub.Stats{
+			"es": &statshub.Stats{
+				Counters: map[string]int64{counterName: 5},
+				Gauges:   map[string]int64{"online": 2},
+			},
+			"total": &statshub.Stats{
+				Counters: map[string]int64{counterName: 5},
+				Gauges:   map[string]int64{"online": 2},
+			},
+		},
+	}}
+}
+
+func TestNDJSONArchiver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statshub-archive")
+	if err != nil {
+		t.Fatalf("Unable to create dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	archiver := &NDJSONArchiver{Dir: dir, Rotation: 24 * time.Hour}
+	if err := archiver.Archive(snapshotForArchive("bytesGiven", archiveTs)); err != nil {
+		t.Fatalf("Unable to archive: %s", err)
+	}
+	if err := archiver.Archive(snapshotForArchive("bytesGiven", archiveTs.Add(time.Hour))); err != nil {
+		t.Fatalf("Unable to archive: %s", err)
+	}
+
+	file, err := os.Open(filepath.Join(dir, "country-20140501T000000Z.ndjson"))
+	if err != nil {
+		t.Fatalf("Unable to open archive: %s", err)
+	}
+	defer file.Close()
+	var rows []map[string]interface{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		row := make(map[string]interface{})
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			t.Fatalf("Unable to decode row: %s", err)
+		}
+		rows = append(rows, row)
+	}
+	if len(rows) != 4 {
+		t.Fatalf("Expected 4 rows in the same rotation, got %d", len(rows))
+	}
+	if rows[0][_dim] != "es" || rows[1][_dim] != "total" || rows[0][_ts] != float64(archiveTs.Unix()) {
+		t.Errorf("Wrong first rows: %v", rows[:2])
+	}
+	if rows[0][counter].(map[string]interface{})["bytesGiven"] != float64(5) {
+		t.Errorf("Wrong counters: %v", rows[0])
+	}
+}
+
+func TestCSVArchiverStartsNewFileForNewColumns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statshub-archive")
+	if err != nil {
+		t.Fatalf("Unable to create dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	archiver := &CSVArchiver{Dir: dir, Rotation: 24 * time.Hour}
+	archiver.Archive(snapshotForArchive("bytesGiven", archiveTs))
+	archiver.Archive(snapshotForArchive("bytesGiven", archiveTs.Add(time.Hour)))
+	if err := archiver.Archive(snapshotForArchive("bytesGotten", archiveTs.Add(2*time.Hour))); err != nil {
+		t.Fatalf("Unable to archive: %s", err)
+	}
+
+	first, err := ioutil.ReadFile(filepath.Join(dir, "country-20140501T000000Z.csv"))
+	if err != nil {
+		t.Fatalf("Unable to read first file: %s", err)
+	}
+	expected := "_dim,_ts,counter.bytesGiven,gauge.online\n" +
+		"es,1398945600,5,2\n" +
+		"total,1398945600,5,2\n" +
+		"es,1398949200,5,2\n" +
+		"total,1398949200,5,2\n"
+	if string(first) != expected {
+		t.Errorf("Wrong first file.  Expected:\n%s\nGot:\n%s", expected, first)
+	}
+
+	second, err := ioutil.ReadFile(filepath.Join(dir, "country-20140501T000000Z-1.csv"))
+	if err != nil {
+		t.Fatalf("Unable to read second file: %s", err)
+	}
+	if !strings.HasPrefix(string(second), "_dim,_ts,counter.bytesGotten,gauge.online\n") {
+		t.Errorf("Wrong second file: %s", second)
+	}
+}
+
+func TestSQLStatements(t *testing.T) {
+	columns := columnsFor("country", snapshotForArchive("bytesGiven", archiveTs).Dims["country"], nil)
+
+	statements := schemaStatements("country", nil, columns)
+	if len(statements) != 1 || statements[0] != `CREATE TABLE "country" ("_dim" TEXT, "_ts" BIGINT, "counter.bytesGiven" BIGINT, "gauge.online" BIGINT)` {
+		t.Errorf("Wrong create statement: %v", statements)
+	}
+
+	statements = schemaStatements("country", []string{"_dim", "_ts", "counter.bytesGiven"}, columns)
+	if len(statements) != 1 || statements[0] != `ALTER TABLE "country" ADD COLUMN "gauge.online" BIGINT` {
+		t.Errorf("Wrong alter statements: %v", statements)
+	}
+
+	insert := (&SQLArchiver{Driver: "sqlite3"}).insertStatement(`we"ird`, columns)
+	if insert != `INSERT INTO "we""ird" ("_dim", "_ts", "counter.bytesGiven", "gauge.online") VALUES (?, ?, ?, ?)` {
+		t.Errorf("Wrong insert statement: %s", insert)
+	}
+	insert = (&SQLArchiver{Driver: "postgres"}).insertStatement(`we"ird`, columns)
+	if insert != `INSERT INTO "we""ird" ("_dim", "_ts", "counter.bytesGiven", "gauge.online") VALUES ($1, $2, $3, $4)` {
+		t.Errorf("Wrong postgres insert statement: %s", insert)
+	}
+}
+
+func TestColumnsAreUnionOfKeys(t *testing.T) {
+	dimStats := map[string]*statshub.Stats{
+		"es": &statshub.Stats{
+			Counters:      map[string]int64{"onlyInEs": 1},
+			Gauges:        map[string]int64{"online": 2, "users": 3},
+			GaugesCurrent: map[string]int64{"online": 4},
+		},
+		"total": &statshub.Stats{
+			Counters: map[string]int64{"bytesGiven": 5},
+		},
+	}
+	members := map[string]bool{"users": true}
+	columns := columnsFor(IdsDim, dimStats, members)
+	expected := "_id,_ts,counter.bytesGiven,counter.onlyInEs,gauge.online,gaugeCurrent.online,member.users"
+	if strings.Join(columns, ",") != expected {
+		t.Errorf("Wrong columns.  Expected %s, got %s", expected, strings.Join(columns, ","))
+	}
+
+	values := flatValues(columns, "es", recordsFor(dimStats["es"], members), archiveTs)
+	if values[0] != "es" || values[2] != nil || values[3] != int64(1) || values[5] != int64(4) || values[6] != int64(3) {
+		t.Errorf("Wrong values: %v", values)
+	}
+
+	schema := schemaForStats("country", dimStats, members)
+	var names []string
+	for _, field := range schema.Fields {
+		names = append(names, field.Name)
+	}
+	if strings.Join(names, ",") != "_dim,_ts,counter,gauge,gaugeCurrent,member" || len(schema.Fields[2].Fields) != 2 {
+		t.Errorf("Schema should include the stats of every key: %v", names)
+	}
+
+	row := rowFromStats(_dim, "total", recordsFor(dimStats["total"], members), archiveTs)
+	if _, found := row[gaugeCurrent]; found {
+		t.Errorf("Empty gaugeCurrent shouldn't be in row: %v", row)
+	}
+	if _, found := row[gauge]; !found {
+		t.Errorf("gauge should always be in row: %v", row)
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package archive
+
+import (
+	"log"
+
+	shbq "github.com/getlantern/statshub/bigquery"
+)
+
+// BigQueryArchiver archives to a BigQuery dataset, with one StatsTable per
+// dimension per day.  Table schemas only ever gain fields.  Changes to them are
+// recorded in the SCHEMA_HISTORY_TABLE and rows with stats whose types
+// conflict with the existing schema go to a quarantine table.
+type BigQueryArchiver struct {
+	ProjectId string
+	DatasetId string
+
+	// DryRun logs the schema changes that archiving would make instead of
+	// making them, and doesn't insert any rows
+	DryRun bool
+
+	// Rollups maintains hourly and daily rollup tables after every run
+	Rollups bool
+
+	// Client is the BigQuery client to archive with.  If nil, the shared
+	// BigQuery service is used (see bigquery.OpenClient).
+	Client shbq.Client
+}
+
+func (archiver *BigQueryArchiver) Archive(snapshot *Snapshot) error {
+	client := archiver.Client
+	if client == nil {
+		var err error
+		if client, err = shbq.OpenClient(); err != nil {
+			return err
+		}
+	}
+	members := snapshot.memberSet()
+	for dimName, dimStats := range snapshot.Dims {
+		log.Printf("Archiving dim %s to BigQuery", dimName)
+		statsTable, err := NewStatsTable(client, archiver.ProjectId, archiver.DatasetId, dimName, snapshot.Ts)
+		if err != nil {
+			return err
+		}
+		statsTable.dryRun = archiver.DryRun
+		if err := statsTable.WriteStats(dimStats, members, snapshot.Ts); err != nil {
+			return err
+		}
+		if archiver.Rollups && !archiver.DryRun {
+			// The rows are archived, so don't fail (and retry them) just
+			// because of the rollups, which are recomputed on the next run
+			if err := statsTable.rollup(); err != nil {
+				log.Printf("Unable to roll up dim %s: %s", dimName, err)
+			}
+		}
+	}
+	return nil
+}
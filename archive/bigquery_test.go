@@ -0,0 +1,122 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package archive
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	shbq "github.com/getlantern/statshub/bigquery"
+	"github.com/getlantern/statshub/bigquery/fake"
+)
+
+func snapshotWithBytesGiven(esBytesGiven int64, ts time.Time) *Snapshot {
+	snapshot := snapshotForArchive("bytesGiven", ts)
+	snapshot.Dims["country"]["es"].Counters["bytesGiven"] = esBytesGiven
+	return snapshot
+}
+
+// TestBigQueryRoundTrip archives stats to a fake BigQuery and reads their
+// history back the way streaming clients do.
+func TestBigQueryRoundTrip(t *testing.T) {
+	client := fake.New()
+	archiver := &BigQueryArchiver{ProjectId: "statshub-test", DatasetId: shbq.DATASET_ID, Rollups: true, Client: client}
+	// 12:00 and 12:30 in the first hour, 13:20 in the second
+	for _, snapshot := range []*Snapshot{
+		snapshotWithBytesGiven(5, archiveTs),
+		snapshotWithBytesGiven(10, archiveTs.Add(30*time.Minute)),
+		snapshotWithBytesGiven(7, archiveTs.Add(80*time.Minute)),
+	} {
+		if err := archiver.Archive(snapshot); err != nil {
+			t.Fatalf("Unable to archive: %s", err)
+		}
+	}
+	// The next day, with a stat that the schema doesn't know yet
+	if err := archiver.Archive(snapshotForArchive("bytesGotten", archiveTs.Add(24*time.Hour))); err != nil {
+		t.Fatalf("Unable to archive new stat: %s", err)
+	}
+
+	tables := client.TableIds(shbq.DATASET_ID)
+	expectedTables := []string{
+		"_schema_history",
+		"country_20140501", "country_20140502",
+		"country_daily_20140501", "country_daily_20140502",
+		"country_hourly_20140501", "country_hourly_20140502",
+	}
+	if len(tables) != len(expectedTables) {
+		t.Fatalf("Wrong tables: %v", tables)
+	}
+	for i, table := range expectedTables {
+		if tables[i] != table {
+			t.Errorf("Wrong tables: %v", tables)
+		}
+	}
+	history, _ := client.Rows(shbq.DATASET_ID, SCHEMA_HISTORY_TABLE)
+	if last := history[len(history)-1]; last["table"] != "country_20140502" || last["field"] != "counter.bytesGotten" {
+		t.Errorf("Wrong schema history: %v", history)
+	}
+	table, _ := client.GetTable("statshub-test", shbq.DATASET_ID, "country_20140502")
+	if counters := table.Schema.Fields[2].Fields; len(counters) != 2 || counters[0].Name != "bytesGiven" {
+		t.Errorf("Next day's table should keep the previous day's fields: %v", counters)
+	}
+
+	end := archiveTs.Add(3 * time.Hour)
+	for _, test := range []struct {
+		resolution  time.Duration
+		aggregation string
+		expected    map[int64]int64
+	}{
+		{time.Hour, shbq.MAX, map[int64]int64{388596: 10, 388597: 7}},
+		{time.Hour, shbq.MIN, map[int64]int64{388596: 5, 388597: 7}},
+		{24 * time.Hour, shbq.MAX, map[int64]int64{16191: 10}},
+		{24 * time.Hour, shbq.SUM, map[int64]int64{16191: 22}},
+	} {
+		q := &shbq.HistoryQuery{
+			DimName:     "country",
+			DimKey:      "es",
+			StatType:    "counter",
+			StatName:    "bytesGiven",
+			Aggregation: test.aggregation,
+			Start:       end.Add(-24 * time.Hour),
+			End:         end,
+			Resolution:  test.resolution,
+		}
+		queryString, err := q.SQL()
+		if err != nil {
+			t.Fatalf("Unable to build query: %s", err)
+		}
+		rows, err := shbq.Query(client, queryString, 1000)
+		if err != nil {
+			t.Fatalf("Unable to query history: %s", err)
+		}
+		values := make(map[int64]int64)
+		for _, row := range rows {
+			if row[1] != "es" {
+				t.Errorf("Got history for %s", row[1])
+			}
+			period, _ := strconv.ParseInt(row[0].(string), 10, 64)
+			values[period], _ = strconv.ParseInt(row[2].(string), 10, 64)
+		}
+		if len(values) != len(test.expected) {
+			t.Errorf("Wrong %s per %s: %v", test.aggregation, test.resolution, values)
+		}
+		for period, value := range test.expected {
+			if values[period] != value {
+				t.Errorf("Wrong %s per %s: %v", test.aggregation, test.resolution, values)
+			}
+		}
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package archive
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getlantern/statshub/statshub"
+)
+
+const (
+	DefaultRotation = 24 * time.Hour
+
+	rotationFormat = "20060102T150405Z"
+)
+
+// NDJSONArchiver archives to newline-delimited JSON files in Dir, one file per
+// dimension per Rotation.  Each line is a row like the ones produced by
+// rowFromStats.
+type NDJSONArchiver struct {
+	Dir      string
+	Rotation time.Duration
+}
+
+func (archiver *NDJSONArchiver) Archive(snapshot *Snapshot) error {
+	members := snapshot.memberSet()
+	for dimName, dimStats := range snapshot.Dims {
+		filename := rotatedFilename(archiver.Dir, dimName, snapshot.Ts, archiver.Rotation, 0, "ndjson")
+		if err := archiver.archiveDim(filename, dimName, dimStats, members, snapshot.Ts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (archiver *NDJSONArchiver) archiveDim(filename string, dimName string, dimStats map[string]*statshub.Stats, members map[string]bool, ts time.Time) error {
+	file, err := openForAppend(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	out := bufio.NewWriter(file)
+	encoder := json.NewEncoder(out)
+	for _, key := range sortedKeys(dimStats) {
+		if err := encoder.Encode(rowFromStats(keyColumn(dimName), key, recordsFor(dimStats[key], members), ts)); err != nil {
+			return fmt.Errorf("Unable to write to %s: %s", filename, err)
+		}
+	}
+	if err := out.Flush(); err != nil {
+		return fmt.Errorf("Unable to write to %s: %s", filename, err)
+	}
+	return nil
+}
+
+// CSVArchiver archives to CSV files in Dir, one file per dimension per
+// Rotation.  The columns are those of columnsFor.  Because the columns of a
+// CSV file are fixed by its header, stats with new columns are written to a
+// new file with a numeric suffix.
+type CSVArchiver struct {
+	Dir      string
+	Rotation time.Duration
+}
+
+func (archiver *CSVArchiver) Archive(snapshot *Snapshot) error {
+	members := snapshot.memberSet()
+	for dimName, dimStats := range snapshot.Dims {
+		if err := archiver.archiveDim(dimName, dimStats, members, snapshot.Ts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (archiver *CSVArchiver) archiveDim(dimName string, dimStats map[string]*statshub.Stats, members map[string]bool, ts time.Time) error {
+	columns := columnsFor(dimName, dimStats, members)
+
+	// Find the first file for this rotation that's either new or has the same
+	// columns
+	var filename string
+	var isNew bool
+	for n := 0; ; n++ {
+		filename = rotatedFilename(archiver.Dir, dimName, ts, archiver.Rotation, n, "csv")
+		header, err := readCSVHeader(filename)
+		if err != nil {
+			return err
+		}
+		if header == nil {
+			isNew = true
+			break
+		}
+		if strings.Join(header, ",") == strings.Join(columns, ",") {
+			break
+		}
+	}
+
+	file, err := openForAppend(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	out := csv.NewWriter(file)
+	if isNew {
+		out.Write(columns)
+	}
+	for _, key := range sortedKeys(dimStats) {
+		values := flatValues(columns, key, recordsFor(dimStats[key], members), ts)
+		record := make([]string, len(values))
+		for i, value := range values {
+			switch v := value.(type) {
+			case string:
+				record[i] = v
+			case int64:
+				record[i] = strconv.FormatInt(v, 10)
+			}
+		}
+		out.Write(record)
+	}
+	out.Flush()
+	if err := out.Error(); err != nil {
+		return fmt.Errorf("Unable to write to %s: %s", filename, err)
+	}
+	return nil
+}
+
+// readCSVHeader reads the header of the given CSV file, returning nil if the
+// file doesn't exist or is empty.
+func readCSVHeader(filename string) ([]string, error) {
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open %s: %s", filename, err)
+	}
+	defer file.Close()
+	header, err := csv.NewReader(file).Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read header of %s: %s", filename, err)
+	}
+	return header, nil
+}
+
+// rotatedFilename returns the name of the file in dir for the given dimension
+// and the rotation containing ts, e.g. country-20140501T000000Z.ndjson, with a
+// numeric suffix if n > 0.
+func rotatedFilename(dir string, dimName string, ts time.Time, rotation time.Duration, n int, ext string) string {
+	if rotation <= 0 {
+		rotation = DefaultRotation
+	}
+	name := safeFilename(dimName) + "-" + ts.UTC().Truncate(rotation).Format(rotationFormat)
+	if n > 0 {
+		name += fmt.Sprintf("-%d", n)
+	}
+	return filepath.Join(dir, name+"."+ext)
+}
+
+// safeFilename replaces characters that don't belong in a filename
+func safeFilename(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '.' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+func openForAppend(filename string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return nil, fmt.Errorf("Unable to create directory for %s: %s", filename, err)
+	}
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open %s: %s", filename, err)
+	}
+	return file, nil
+}
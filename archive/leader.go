@@ -0,0 +1,308 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package archive
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/getlantern/statshub/statshub"
+)
+
+const (
+	DefaultLeaderKey = "archive:leader"
+	DefaultLeaderTTL = 30 * time.Second
+)
+
+var (
+	// renewScript extends the lease only if it's still held by the given id
+	renewScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+
+	// releaseScript deletes the lease only if it's still held by the given id
+	releaseScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+)
+
+// LeaderOptions configures a Leader.  Zero values are replaced with defaults.
+type LeaderOptions struct {
+	// Key is the key of the lease in the store
+	Key string
+
+	// Id identifies this instance, defaults to hostname:pid
+	Id string
+
+	// TTL is how long the lease lasts without being renewed, which is how long
+	// it takes to fail over when the leader dies
+	TTL time.Duration
+
+	// RenewInterval is how frequently the lease is renewed (or, by followers,
+	// acquired), defaults to a third of TTL
+	RenewInterval time.Duration
+}
+
+// LeaderStatus is the leader election status as seen by one instance
+type LeaderStatus struct {
+	// Id is the id of this instance
+	Id string `json:"id"`
+
+	// Leader is the id of the current leader, if any
+	Leader string `json:"leader"`
+
+	// IsLeader indicates whether this instance is the leader
+	IsLeader bool `json:"isLeader"`
+
+	// ExpiresIn is how long the current lease has left
+	ExpiresIn string `json:"expiresIn,omitempty"`
+
+	// LeaderSince is when this instance became the leader
+	LeaderSince *time.Time `json:"leaderSince,omitempty"`
+
+	LastError string `json:"lastError,omitempty"`
+}
+
+// lease is a lease held in a shared store
+type lease interface {
+	// acquire acquires the lease for id if nobody holds it
+	acquire(id string, ttl time.Duration) (bool, error)
+
+	// renew extends the lease if id holds it
+	renew(id string, ttl time.Duration) (bool, error)
+
+	// release gives up the lease if id holds it
+	release(id string) error
+
+	// holder returns who holds the lease and for how much longer
+	holder() (string, time.Duration, error)
+}
+
+// Leader elects a single leader among instances that share a store, using a
+// lease that the leader keeps renewing.  If the leader dies, its lease expires
+// and another instance takes over.
+type Leader struct {
+	opts     LeaderOptions
+	lease    lease
+	now      func() time.Time
+	mutex    sync.Mutex
+	since    *time.Time
+	expires  time.Time
+	lastErr  error
+	stop     chan bool
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// NewLeader constructs a Leader that holds its lease in the given store, which
+// needs to support SET NX PX and EVAL (any Redis >= 2.6.12 does).
+func NewLeader(store statshub.Store, opts LeaderOptions) *Leader {
+	leader := newLeader(nil, opts)
+	leader.lease = &redisLease{store, leader.opts.Key}
+	return leader
+}
+
+func newLeader(l lease, opts LeaderOptions) *Leader {
+	if opts.Key == "" {
+		opts.Key = DefaultLeaderKey
+	}
+	if opts.Id == "" {
+		hostname, _ := os.Hostname()
+		opts.Id = fmt.Sprintf("%s:%d", hostname, os.Getpid())
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = DefaultLeaderTTL
+	}
+	if opts.RenewInterval <= 0 {
+		opts.RenewInterval = opts.TTL / 3
+	}
+	return &Leader{
+		opts:  opts,
+		lease: l,
+		now:   time.Now,
+		stop:  make(chan bool),
+	}
+}
+
+// Start starts campaigning for leadership
+func (leader *Leader) Start() {
+	leader.campaign()
+	leader.wg.Add(1)
+	go leader.campaignPeriodically()
+}
+
+// Stop stops campaigning and gives up the lease, if held, so that another
+// instance can take over without waiting for it to expire.
+func (leader *Leader) Stop() {
+	leader.stopOnce.Do(func() {
+		close(leader.stop)
+	})
+	leader.wg.Wait()
+
+	leader.mutex.Lock()
+	wasLeader := leader.since != nil
+	leader.since = nil
+	leader.mutex.Unlock()
+	if wasLeader {
+		if err := leader.lease.release(leader.opts.Id); err != nil {
+			log.Printf("Unable to release archive leadership: %s", err)
+		}
+	}
+}
+
+func (leader *Leader) campaignPeriodically() {
+	defer leader.wg.Done()
+	for {
+		select {
+		case <-time.After(leader.opts.RenewInterval):
+			leader.campaign()
+		case <-leader.stop:
+			return
+		}
+	}
+}
+
+// campaign renews the lease if this instance is the leader, or tries to
+// acquire it otherwise.
+func (leader *Leader) campaign() {
+	start := leader.now()
+	leader.mutex.Lock()
+	wasLeader := leader.since != nil && start.Before(leader.expires)
+	leader.mutex.Unlock()
+
+	var held bool
+	var err error
+	if wasLeader {
+		held, err = leader.lease.renew(leader.opts.Id, leader.opts.TTL)
+	} else {
+		held, err = leader.lease.acquire(leader.opts.Id, leader.opts.TTL)
+	}
+
+	leader.mutex.Lock()
+	defer leader.mutex.Unlock()
+	leader.lastErr = err
+	if err != nil {
+		// Leave things as they are.  If we were the leader, we stay the leader
+		// until our lease would have expired.
+		log.Printf("Unable to campaign for archive leadership: %s", err)
+		return
+	}
+	if held {
+		if !wasLeader {
+			log.Printf("%s is now the archive leader", leader.opts.Id)
+			leader.since = &start
+		}
+		// Measure from before the request so that we never think we hold the
+		// lease for longer than the store does
+		leader.expires = start.Add(leader.opts.TTL)
+	} else if leader.since != nil {
+		log.Printf("%s is no longer the archive leader", leader.opts.Id)
+		leader.since = nil
+	}
+}
+
+// IsLeader indicates whether this instance currently holds the lease
+func (leader *Leader) IsLeader() bool {
+	leader.mutex.Lock()
+	defer leader.mutex.Unlock()
+	return leader.since != nil && leader.now().Before(leader.expires)
+}
+
+// Status returns the leader election status as seen by this instance
+func (leader *Leader) Status() *LeaderStatus {
+	status := &LeaderStatus{Id: leader.opts.Id, IsLeader: leader.IsLeader()}
+	leader.mutex.Lock()
+	if status.IsLeader {
+		since := *leader.since
+		status.LeaderSince = &since
+	}
+	if leader.lastErr != nil {
+		status.LastError = leader.lastErr.Error()
+	}
+	leader.mutex.Unlock()
+
+	holder, ttl, err := leader.lease.holder()
+	if err != nil {
+		status.LastError = fmt.Sprintf("Unable to get archive leader: %s", err)
+	} else if holder != "" {
+		status.Leader = holder
+		status.ExpiresIn = ttl.String()
+	}
+	return status
+}
+
+// redisLease is a lease held in a Redis key whose value is the id of the
+// holder.
+type redisLease struct {
+	store statshub.Store
+	key   string
+}
+
+func (l *redisLease) acquire(id string, ttl time.Duration) (bool, error) {
+	conn := l.store.Get()
+	defer conn.Close()
+	reply, err := conn.Do("SET", l.key, id, "NX", "PX", int64(ttl/time.Millisecond))
+	if err != nil {
+		return false, err
+	}
+	// SET NX replies nil if the key already exists
+	return reply != nil, nil
+}
+
+func (l *redisLease) renew(id string, ttl time.Duration) (bool, error) {
+	conn := l.store.Get()
+	defer conn.Close()
+	renewed, err := redis.Int(renewScript.Do(conn, l.key, id, int64(ttl/time.Millisecond)))
+	return renewed == 1, err
+}
+
+func (l *redisLease) release(id string) error {
+	conn := l.store.Get()
+	defer conn.Close()
+	_, err := releaseScript.Do(conn, l.key, id)
+	return err
+}
+
+func (l *redisLease) holder() (string, time.Duration, error) {
+	conn := l.store.Get()
+	defer conn.Close()
+	conn.Send("MULTI")
+	conn.Send("GET", l.key)
+	conn.Send("PTTL", l.key)
+	values, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return "", 0, err
+	}
+	if values[0] == nil {
+		return "", 0, nil
+	}
+	id, err := redis.String(values[0], nil)
+	if err != nil {
+		return "", 0, err
+	}
+	ttl, err := redis.Int64(values[1], nil)
+	if err != nil {
+		return "", 0, err
+	}
+	return id, time.Duration(ttl) * time.Millisecond, nil
+}
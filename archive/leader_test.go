@@ -0,0 +1,151 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package archive
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// fakeLease is a lease held in memory, expiring according to a fake clock
+type fakeLease struct {
+	now     *time.Time
+	id      string
+	expires time.Time
+	down    bool
+}
+
+func (l *fakeLease) held() bool {
+	return l.id != "" && l.now.Before(l.expires)
+}
+
+func (l *fakeLease) acquire(id string, ttl time.Duration) (bool, error) {
+	if l.down {
+		return false, fmt.Errorf("Connection refused")
+	}
+	if l.held() {
+		return false, nil
+	}
+	l.id, l.expires = id, l.now.Add(ttl)
+	return true, nil
+}
+
+func (l *fakeLease) renew(id string, ttl time.Duration) (bool, error) {
+	if l.down {
+		return false, fmt.Errorf("Connection refused")
+	}
+	if !l.held() || l.id != id {
+		return false, nil
+	}
+	l.expires = l.now.Add(ttl)
+	return true, nil
+}
+
+func (l *fakeLease) release(id string) error {
+	if l.id == id {
+		l.id = ""
+	}
+	return nil
+}
+
+func (l *fakeLease) holder() (string, time.Duration, error) {
+	if !l.held() {
+		return "", 0, nil
+	}
+	return l.id, l.expires.Sub(*l.now), nil
+}
+
+func TestLeaderFailover(t *testing.T) {
+	now := time.Date(2014, 5, 1, 12, 0, 0, 0, time.UTC)
+	l := &fakeLease{now: &now}
+	clock := func() time.Time { return now }
+	a := newLeader(l, LeaderOptions{Id: "a", TTL: 30 * time.Second})
+	b := newLeader(l, LeaderOptions{Id: "b", TTL: 30 * time.Second})
+	a.now, b.now = clock, clock
+
+	a.campaign()
+	b.campaign()
+	if !a.IsLeader() || b.IsLeader() {
+		t.Fatalf("a should be the only leader")
+	}
+	status := b.Status()
+	if status.Id != "b" || status.Leader != "a" || status.IsLeader || status.ExpiresIn != "30s" {
+		t.Errorf("Wrong status: %v", status)
+	}
+
+	// a keeps renewing
+	now = now.Add(20 * time.Second)
+	a.campaign()
+	now = now.Add(20 * time.Second)
+	a.campaign()
+	b.campaign()
+	if !a.IsLeader() || b.IsLeader() {
+		t.Fatalf("a should still be the only leader after renewing")
+	}
+
+	// a dies and b takes over once the lease expires
+	now = now.Add(20 * time.Second)
+	b.campaign()
+	if b.IsLeader() {
+		t.Fatalf("b shouldn't lead before the lease expires")
+	}
+	now = now.Add(20 * time.Second)
+	b.campaign()
+	if a.IsLeader() || !b.IsLeader() {
+		t.Fatalf("b should have taken over")
+	}
+
+	// If the store goes away, b stops leading when its lease would expire
+	l.down = true
+	now = now.Add(20 * time.Second)
+	b.campaign()
+	if !b.IsLeader() {
+		t.Errorf("b should lead until its lease expires")
+	}
+	now = now.Add(20 * time.Second)
+	if b.IsLeader() {
+		t.Errorf("b shouldn't lead after its lease expires")
+	}
+	if b.Status().LastError != "Connection refused" {
+		t.Errorf("Error should be reported")
+	}
+}
+
+func TestSchedulerOnlyArchivesOnLeader(t *testing.T) {
+	now := time.Date(2014, 5, 1, 12, 0, 0, 0, time.UTC)
+	l := &fakeLease{now: &now, id: "other", expires: now.Add(time.Minute)}
+	leader := newLeader(l, LeaderOptions{Id: "me"})
+	leader.now = func() time.Time { return now }
+	leader.campaign()
+
+	archived := 0
+	scheduler := NewScheduler(&fakeSource{}, Plan{}, archiverFunc(func(snapshot *Snapshot) error {
+		archived++
+		return nil
+	}))
+	scheduler.RequireLeadership(leader)
+	scheduler.runOnce("country", time.Hour)
+	if archived != 0 {
+		t.Errorf("Followers shouldn't archive")
+	}
+
+	now = now.Add(2 * time.Minute)
+	leader.campaign()
+	scheduler.runOnce("country", time.Hour)
+	if archived != 1 {
+		t.Errorf("Leaders should archive")
+	}
+}
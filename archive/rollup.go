@@ -0,0 +1,111 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package archive
+
+import (
+	"fmt"
+	"strings"
+
+	bigquery "code.google.com/p/ox-google-api-go-client/bigquery/v2"
+
+	shbq "github.com/getlantern/statshub/bigquery"
+)
+
+const (
+	ONE_HOUR_SECS = 60 * 60
+	ONE_DAY_SECS  = 24 * ONE_HOUR_SECS
+)
+
+// Rollups are tables that hold the maximum value of every stat for every key
+// of a dimension per hour or per day, computed from the archived rows.  They
+// have one table per day, like the archive tables themselves.  Rollups can't
+// hold nested records, so their stat columns are flattened, e.g.
+// counter_bytesGiven instead of counter.bytesGiven.
+
+// rollup (re)computes the hourly and daily rollups for the table's day from
+// its archived rows.  Rollups replace the previous ones for the same day, so
+// running them after every archive run keeps them up to date.
+func (statsTable *StatsTable) rollup() error {
+	ref := statsTable.table.TableReference
+	keyName := keyColumn(statsTable.dimName)
+	var sources []string
+	if statsTable.table.Schema != nil {
+		sources = rollupSources(statsTable.table.Schema.Fields)
+	}
+	if len(sources) == 0 {
+		return nil
+	}
+	columns := rollupColumns(sources)
+
+	hourlyId := shbq.DayTable(shbq.RollupPrefix(statsTable.dimName, shbq.HOURLY), statsTable.day)
+	hourly := rollupQuery(ref.DatasetId, ref.TableId, keyName, sources, columns, ONE_HOUR_SECS)
+	if err := statsTable.client.QueryInto(ref.ProjectId, ref.DatasetId, hourly, hourlyId); err != nil {
+		return err
+	}
+
+	// Daily rollups are computed from the hourly ones, which are much smaller
+	dailyId := shbq.DayTable(shbq.RollupPrefix(statsTable.dimName, shbq.DAILY), statsTable.day)
+	daily := rollupQuery(ref.DatasetId, hourlyId, keyName, columns, columns, ONE_DAY_SECS)
+	return statsTable.client.QueryInto(ref.ProjectId, ref.DatasetId, daily, dailyId)
+}
+
+// rollupSources returns the stat columns of an archive or rollup table, which
+// are the fields of its records (e.g. counter.bytesGiven) or, for rollups,
+// its flattened INTEGER fields (e.g. counter_bytesGiven).
+func rollupSources(fields []*bigquery.TableFieldSchema) []string {
+	var sources []string
+	for _, field := range fields {
+		switch field.Type {
+		case RECORD:
+			for _, nested := range field.Fields {
+				if nested.Type == INTEGER {
+					sources = append(sources, field.Name+"."+nested.Name)
+				}
+			}
+		case INTEGER:
+			sources = append(sources, field.Name)
+		}
+	}
+	return sources
+}
+
+// rollupColumns returns the flattened names of the given stat columns
+func rollupColumns(sources []string) []string {
+	columns := make([]string, len(sources))
+	for i, source := range sources {
+		columns[i] = strings.Replace(source, ".", "_", -1)
+	}
+	return columns
+}
+
+// rollupQuery returns a query that aggregates the source columns of the
+// given table into the given columns for every key and period of periodSecs.
+// Every row's _ts is the start of its period.  Table and column names come
+// from BigQuery schemas, so they're valid identifiers.
+func rollupQuery(datasetId string, tableId string, keyName string, sources []string, columns []string, periodSecs int) string {
+	aggregates := make([]string, len(sources))
+	for i, source := range sources {
+		aggregates[i] = fmt.Sprintf("MAX(%s) AS %s", source, columns[i])
+	}
+	return fmt.Sprintf(`SELECT %s, SEC_TO_TIMESTAMP(period * %d) AS _ts, %s
+FROM (
+  SELECT %s, INTEGER(TIMESTAMP_TO_SEC(_ts) / %d) AS period, %s
+  FROM [%s.%s]
+  GROUP BY %s, period)`,
+		keyName, periodSecs, strings.Join(columns, ", "),
+		keyName, periodSecs, strings.Join(aggregates, ", "),
+		datasetId, tableId,
+		keyName)
+}
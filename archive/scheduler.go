@@ -0,0 +1,338 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package archive
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/getlantern/statshub/statshub"
+)
+
+const (
+	DefaultInterval          = 1 * time.Hour
+	DefaultDiscoveryInterval = 10 * time.Minute
+)
+
+// Plan says which dimensions to archive, how often and what to include
+type Plan struct {
+	// AllDims archives every known dimension, not just those in Intervals
+	AllDims bool
+
+	// DefaultInterval is the interval for dimensions that were discovered
+	// because of AllDims
+	DefaultInterval time.Duration
+
+	// Intervals maps dimension names to the interval at which they're
+	// archived, overriding DefaultInterval
+	Intervals map[string]time.Duration
+
+	// Exclude lists dimensions that are never archived
+	Exclude []string
+
+	// DiscoveryInterval is how frequently new dimensions are discovered when
+	// AllDims is set
+	DiscoveryInterval time.Duration
+
+	// IdsInterval is the interval at which the detail stats of every id are
+	// archived as IdsDim.  Zero doesn't archive them.
+	IdsInterval time.Duration
+
+	// GaugesCurrent archives the gauges of the current period as
+	// gaugeCurrent.*, alongside those of the prior period
+	GaugesCurrent bool
+
+	// Members archives member cardinalities as member.* rather than gauge.*
+	Members bool
+}
+
+// dimsFor returns the dimensions to archive and their intervals, given the
+// known dimensions.
+func (plan *Plan) dimsFor(known []string) map[string]time.Duration {
+	dims := make(map[string]time.Duration)
+	for dim, interval := range plan.Intervals {
+		dims[dim] = interval
+	}
+	if plan.AllDims {
+		for _, dim := range known {
+			if _, found := dims[dim]; !found {
+				dims[dim] = plan.DefaultInterval
+			}
+		}
+	}
+	if plan.IdsInterval > 0 {
+		dims[IdsDim] = plan.IdsInterval
+	}
+	for _, dim := range plan.Exclude {
+		delete(dims, dim)
+	}
+	return dims
+}
+
+// DimStatus is the archiving status of a single dimension
+type DimStatus struct {
+	Dim         string     `json:"dim"`
+	Interval    string     `json:"interval"`
+	NextRun     *time.Time `json:"nextRun,omitempty"`
+	LastRun     *time.Time `json:"lastRun,omitempty"`
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+	LastErrorAt *time.Time `json:"lastErrorAt,omitempty"`
+}
+
+// StatusResponse is the Response from the archive status endpoint
+type StatusResponse struct {
+	statshub.Response
+	Leader *LeaderStatus `json:"leader,omitempty"`
+	Dims   []*DimStatus  `json:"dims"`
+}
+
+// Scheduler archives dimensions from a Source according to a Plan.  It is an
+// http.Handler that reports the status of each dimension.
+type Scheduler struct {
+	source   Source
+	plan     Plan
+	archiver Archiver
+	leader   *Leader
+	mutex    sync.Mutex
+	statuses map[string]*DimStatus
+	stop     chan bool
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// NewScheduler constructs a Scheduler that archives from source to archiver
+// according to plan.
+func NewScheduler(source Source, plan Plan, archiver Archiver) *Scheduler {
+	if plan.DefaultInterval <= 0 {
+		plan.DefaultInterval = DefaultInterval
+	}
+	if plan.DiscoveryInterval <= 0 {
+		plan.DiscoveryInterval = DefaultDiscoveryInterval
+	}
+	return &Scheduler{
+		source:   source,
+		plan:     plan,
+		archiver: archiver,
+		statuses: make(map[string]*DimStatus),
+		stop:     make(chan bool),
+	}
+}
+
+// RequireLeadership makes the Scheduler archive only while leader is the
+// leader, so that only one of several instances sharing a store archives.  It
+// must be called before Start.
+func (scheduler *Scheduler) RequireLeadership(leader *Leader) {
+	scheduler.leader = leader
+}
+
+// Start starts archiving.  If the plan includes all dims, new dimensions are
+// discovered every DiscoveryInterval.
+func (scheduler *Scheduler) Start() {
+	scheduler.schedule()
+	if scheduler.plan.AllDims {
+		scheduler.wg.Add(1)
+		go scheduler.discoverPeriodically()
+	}
+}
+
+// Stop stops archiving, waiting for any archive runs in progress to finish.
+func (scheduler *Scheduler) Stop() {
+	scheduler.stopOnce.Do(func() {
+		close(scheduler.stop)
+	})
+	scheduler.wg.Wait()
+}
+
+func (scheduler *Scheduler) discoverPeriodically() {
+	defer scheduler.wg.Done()
+	for {
+		select {
+		case <-time.After(scheduler.plan.DiscoveryInterval):
+			scheduler.schedule()
+		case <-scheduler.stop:
+			return
+		}
+	}
+}
+
+// schedule starts archiving any dimensions in the plan that aren't already
+// being archived.
+func (scheduler *Scheduler) schedule() {
+	var known []string
+	if scheduler.plan.AllDims {
+		var err error
+		if known, err = scheduler.source.DimNames(); err != nil {
+			log.Printf("Unable to discover dims to archive: %s", err)
+		}
+	}
+
+	for dim, interval := range scheduler.plan.dimsFor(known) {
+		scheduler.mutex.Lock()
+		_, scheduled := scheduler.statuses[dim]
+		if !scheduled {
+			scheduler.statuses[dim] = &DimStatus{Dim: dim, Interval: interval.String()}
+		}
+		scheduler.mutex.Unlock()
+
+		if !scheduled {
+			log.Printf("Archiving dim %s every %s", dim, interval)
+			scheduler.wg.Add(1)
+			go scheduler.archivePeriodically(dim, interval)
+		}
+	}
+}
+
+func (scheduler *Scheduler) archivePeriodically(dim string, interval time.Duration) {
+	defer scheduler.wg.Done()
+	for {
+		nextInterval := time.Now().Truncate(interval).Add(interval)
+		waitTime := nextInterval.Sub(time.Now())
+		scheduler.updateStatus(dim, func(status *DimStatus) {
+			status.NextRun = &nextInterval
+		})
+		select {
+		case <-time.After(waitTime):
+			scheduler.runOnce(dim, interval)
+		case <-scheduler.stop:
+			return
+		}
+	}
+}
+
+// runOnce archives dim, recording the outcome in its status.  Followers don't
+// archive.
+func (scheduler *Scheduler) runOnce(dim string, interval time.Duration) {
+	if scheduler.leader != nil && !scheduler.leader.IsLeader() {
+		return
+	}
+	start := time.Now()
+	scheduler.updateStatus(dim, func(status *DimStatus) {
+		status.LastRun = &start
+	})
+	err := scheduler.archive(dim, start.Truncate(interval))
+	end := time.Now()
+	scheduler.updateStatus(dim, func(status *DimStatus) {
+		if err != nil {
+			status.LastError = err.Error()
+			status.LastErrorAt = &end
+		} else {
+			status.LastSuccess = &end
+		}
+	})
+	if err != nil {
+		log.Printf("Unable to archive dimension %s: %s", dim, err)
+	}
+}
+
+// archive queries dim (or the ids for IdsDim) and archives it as of ts
+func (scheduler *Scheduler) archive(dim string, ts time.Time) error {
+	snapshot, err := scheduler.snapshot(dim, ts)
+	if err != nil {
+		return err
+	}
+	return scheduler.archiver.Archive(snapshot)
+}
+
+// snapshot queries a Snapshot of dim with the contents given by the plan
+func (scheduler *Scheduler) snapshot(dim string, ts time.Time) (*Snapshot, error) {
+	snapshot := &Snapshot{Ts: ts}
+	if dim == IdsDim {
+		statsById, err := scheduler.source.QueryIds(nil)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to query ids: %s", err)
+		}
+		snapshot.Dims = map[string]map[string]*statshub.Stats{IdsDim: statsById}
+	} else {
+		var err error
+		if snapshot.Dims, err = scheduler.source.QueryDims([]string{dim}); err != nil {
+			return nil, fmt.Errorf("Unable to query dim %s: %s", dim, err)
+		}
+	}
+
+	if !scheduler.plan.GaugesCurrent {
+		for _, dimStats := range snapshot.Dims {
+			for _, stats := range dimStats {
+				stats.GaugesCurrent = nil
+			}
+		}
+	}
+	if scheduler.plan.Members {
+		var err error
+		if snapshot.Members, err = scheduler.source.MemberNames(); err != nil {
+			return nil, fmt.Errorf("Unable to list members: %s", err)
+		}
+		sort.Strings(snapshot.Members)
+	}
+	return snapshot, nil
+}
+
+func (scheduler *Scheduler) updateStatus(dim string, update func(status *DimStatus)) {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	status := scheduler.statuses[dim]
+	if status == nil {
+		status = &DimStatus{Dim: dim}
+		scheduler.statuses[dim] = status
+	}
+	update(status)
+}
+
+// Status returns a copy of the status of each scheduled dimension, ordered by
+// dimension name.
+func (scheduler *Scheduler) Status() []*DimStatus {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	dims := make([]string, 0, len(scheduler.statuses))
+	for dim := range scheduler.statuses {
+		dims = append(dims, dim)
+	}
+	sort.Strings(dims)
+	statuses := make([]*DimStatus, len(dims))
+	for i, dim := range dims {
+		copied := *scheduler.statuses[dim]
+		statuses[i] = &copied
+	}
+	return statuses
+}
+
+// ServeHTTP reports the status of each scheduled dimension as JSON
+func (scheduler *Scheduler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if "GET" != r.Method {
+		w.WriteHeader(405)
+		return
+	}
+	resp := &StatusResponse{
+		Response: statshub.Response{Succeeded: true},
+		Dims:     scheduler.Status(),
+	}
+	if scheduler.leader != nil {
+		resp.Leader = scheduler.leader.Status()
+	}
+	bytes, err := json.Marshal(resp)
+	if err != nil {
+		log.Printf("Unable to respond to client: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(200)
+	w.Write(bytes)
+}
@@ -0,0 +1,162 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package archive
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/getlantern/statshub/statshub"
+)
+
+type fakeSource struct {
+	dims []string
+}
+
+func (source *fakeSource) DimNames() ([]string, error) {
+	return source.dims, nil
+}
+
+func (source *fakeSource) QueryDims(dimNames []string) (map[string]map[string]*statshub.Stats, error) {
+	statsByDim := make(map[string]map[string]*statshub.Stats)
+	for _, dimName := range dimNames {
+		statsByDim[dimName] = map[string]*statshub.Stats{
+			"total": &statshub.Stats{
+				Counters:      map[string]int64{"bytesGiven": 5},
+				Gauges:        map[string]int64{"online": 2, "users": 1},
+				GaugesCurrent: map[string]int64{"online": 3},
+			},
+		}
+	}
+	return statsByDim, nil
+}
+
+func (source *fakeSource) QueryIds(ids []string) (map[string]*statshub.Stats, error) {
+	return map[string]*statshub.Stats{
+		"myid1": &statshub.Stats{Counters: map[string]int64{"bytesGiven": 5}},
+	}, nil
+}
+
+func (source *fakeSource) MemberNames() ([]string, error) {
+	return []string{"users"}, nil
+}
+
+// archiverFunc adapts a function to an Archiver
+type archiverFunc func(snapshot *Snapshot) error
+
+func (fn archiverFunc) Archive(snapshot *Snapshot) error {
+	return fn(snapshot)
+}
+
+func TestPlanDims(t *testing.T) {
+	plan := &Plan{
+		AllDims:         true,
+		DefaultInterval: time.Hour,
+		Intervals: map[string]time.Duration{
+			"fallback": 10 * time.Minute,
+			"host":     time.Hour,
+		},
+		Exclude: []string{"host", "user"},
+	}
+	dims := plan.dimsFor([]string{"country", "fallback", "host", "user"})
+	expected := map[string]time.Duration{
+		"country":  time.Hour,
+		"fallback": 10 * time.Minute,
+	}
+	if len(dims) != len(expected) {
+		t.Fatalf("Wrong dims: %v", dims)
+	}
+	for dim, interval := range expected {
+		if dims[dim] != interval {
+			t.Errorf("Wrong interval for %s: %s", dim, dims[dim])
+		}
+	}
+
+	plan.AllDims = false
+	dims = plan.dimsFor([]string{"country"})
+	if len(dims) != 1 || dims["fallback"] != 10*time.Minute {
+		t.Errorf("Only scheduled dims should be archived without AllDims: %v", dims)
+	}
+}
+
+func TestSnapshotContents(t *testing.T) {
+	scheduler := NewScheduler(&fakeSource{}, Plan{IdsInterval: 24 * time.Hour}, MultiArchiver{})
+	if scheduler.plan.dimsFor(nil)[IdsDim] != 24*time.Hour {
+		t.Errorf("Ids should be scheduled")
+	}
+
+	snapshot, err := scheduler.snapshot("country", archiveTs)
+	if err != nil {
+		t.Fatalf("Unable to snapshot: %s", err)
+	}
+	if snapshot.Dims["country"]["total"].GaugesCurrent != nil || snapshot.Members != nil {
+		t.Errorf("GaugesCurrent and members should be left out by default: %v", snapshot)
+	}
+
+	scheduler.plan.GaugesCurrent = true
+	scheduler.plan.Members = true
+	snapshot, _ = scheduler.snapshot("country", archiveTs)
+	if snapshot.Dims["country"]["total"].GaugesCurrent["online"] != 3 || len(snapshot.Members) != 1 {
+		t.Errorf("GaugesCurrent and members should be included: %v", snapshot)
+	}
+
+	snapshot, _ = scheduler.snapshot(IdsDim, archiveTs)
+	if snapshot.Dims[IdsDim]["myid1"].Counters["bytesGiven"] != 5 {
+		t.Errorf("Ids should be snapshotted: %v", snapshot.Dims)
+	}
+}
+
+func TestSchedulerStatus(t *testing.T) {
+	archiver := archiverFunc(func(snapshot *Snapshot) error {
+		if snapshot.Dims["user"] != nil {
+			return fmt.Errorf("Table not found")
+		}
+		return nil
+	})
+	scheduler := NewScheduler(&fakeSource{[]string{"country", "user"}}, Plan{AllDims: true, DefaultInterval: time.Hour}, archiver)
+	scheduler.Start()
+	defer scheduler.Stop()
+	scheduler.runOnce("country", time.Hour)
+	scheduler.runOnce("user", time.Hour)
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/admin/archive", nil)
+	scheduler.ServeHTTP(w, r)
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+	resp := &StatusResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil {
+		t.Fatalf("Unable to decode response: %s", err)
+	}
+	if len(resp.Dims) != 2 {
+		t.Fatalf("Expected 2 dims, got %d", len(resp.Dims))
+	}
+
+	country, user := resp.Dims[0], resp.Dims[1]
+	if country.Dim != "country" || country.Interval != "1h0m0s" {
+		t.Errorf("Wrong status for country: %v", country)
+	}
+	if country.LastRun == nil || country.LastSuccess == nil || country.LastError != "" {
+		t.Errorf("country should have succeeded: %v", country)
+	}
+	if user.LastRun == nil || user.LastSuccess != nil || user.LastError != "Table not found" || user.LastErrorAt == nil {
+		t.Errorf("user should have failed: %v", user)
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package archive
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	bigquery "code.google.com/p/ox-google-api-go-client/bigquery/v2"
+)
+
+const (
+	// SchemaAdd is a field that's added to a schema
+	SchemaAdd = "add"
+
+	// SchemaConflict is a field whose type in the existing schema differs
+	// from the type that the stats need.  The existing type is kept.
+	SchemaConflict = "conflict"
+)
+
+// SchemaChange is a difference between the schema of a table and the schema
+// that the stats being archived to it need.  Field is the dotted path of the
+// field, e.g. counter.bytesGiven.
+type SchemaChange struct {
+	Field   string `json:"field"`
+	Change  string `json:"change"`
+	OldType string `json:"oldType,omitempty"`
+	NewType string `json:"newType"`
+}
+
+func (change *SchemaChange) String() string {
+	if change.Change == SchemaConflict {
+		return fmt.Sprintf("! %s %s (needs %s, rows are quarantined)", change.Field, change.OldType, change.NewType)
+	}
+	return fmt.Sprintf("+ %s %s", change.Field, change.NewType)
+}
+
+// FormatSchemaChanges formats changes as a diff, one per line
+func FormatSchemaChanges(changes []*SchemaChange) string {
+	lines := make([]string, len(changes))
+	for i, change := range changes {
+		lines[i] = change.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// evolveFields merges desired into existing without ever removing a field or
+// changing its type.  Existing fields keep their order and new ones are
+// appended.  It returns the merged fields along with the fields that were
+// added and those whose types conflict, whose dotted paths start with prefix.
+// Neither existing nor desired are modified.
+func evolveFields(existing []*bigquery.TableFieldSchema, desired []*bigquery.TableFieldSchema, prefix string) (merged []*bigquery.TableFieldSchema, changes []*SchemaChange) {
+	byName := make(map[string]int)
+	merged = make([]*bigquery.TableFieldSchema, len(existing))
+	for i, field := range existing {
+		copied := *field
+		merged[i] = &copied
+		byName[field.Name] = i
+	}
+
+	for _, field := range desired {
+		path := prefix + field.Name
+		i, found := byName[field.Name]
+		switch {
+		case !found:
+			merged = append(merged, field)
+			changes = append(changes, &SchemaChange{Field: path, Change: SchemaAdd, NewType: field.Type})
+		case merged[i].Type != field.Type:
+			changes = append(changes, &SchemaChange{Field: path, Change: SchemaConflict, OldType: merged[i].Type, NewType: field.Type})
+		case field.Type == RECORD:
+			var recordChanges []*SchemaChange
+			merged[i].Fields, recordChanges = evolveFields(merged[i].Fields, field.Fields, path+".")
+			changes = append(changes, recordChanges...)
+		}
+	}
+	return
+}
+
+func schemaAdditions(changes []*SchemaChange) []*SchemaChange {
+	return filterSchemaChanges(changes, SchemaAdd)
+}
+
+func schemaConflicts(changes []*SchemaChange) []*SchemaChange {
+	return filterSchemaChanges(changes, SchemaConflict)
+}
+
+func filterSchemaChanges(changes []*SchemaChange, kind string) []*SchemaChange {
+	var filtered []*SchemaChange
+	for _, change := range changes {
+		if change.Change == kind {
+			filtered = append(filtered, change)
+		}
+	}
+	return filtered
+}
+
+// conflictsIn returns the conflicts for which the given row (as built by
+// rowFromStats) has values.
+func conflictsIn(row map[string]interface{}, conflicts []*SchemaChange) []string {
+	var reasons []string
+	for _, conflict := range conflicts {
+		parts := strings.SplitN(conflict.Field, ".", 2)
+		value, found := row[parts[0]]
+		if !found {
+			continue
+		}
+		if len(parts) == 2 {
+			// Stats are nested one level deep, within their record
+			if record, ok := value.(map[string]int64); ok {
+				_, found = record[parts[1]]
+			}
+		}
+		if found {
+			reasons = append(reasons, conflict.String())
+		}
+	}
+	return reasons
+}
+
+// quarantineSchema is the schema of a quarantine table, which holds rows that
+// conflict with the schema of their table as JSON.
+func quarantineSchema(keyName string) *bigquery.TableSchema {
+	return &bigquery.TableSchema{
+		Fields: []*bigquery.TableFieldSchema{
+			&bigquery.TableFieldSchema{Name: keyName, Type: STRING},
+			&bigquery.TableFieldSchema{Name: _ts, Type: TIMESTAMP},
+			&bigquery.TableFieldSchema{Name: "reasons", Type: STRING},
+			&bigquery.TableFieldSchema{Name: "row", Type: STRING},
+		},
+	}
+}
+
+func quarantineRow(keyName string, key string, row map[string]interface{}, reasons []string, now time.Time) map[string]interface{} {
+	// Rows only hold strings, integers and maps of integers, so they always
+	// encode
+	encoded, _ := json.Marshal(row)
+	return map[string]interface{}{
+		keyName:   key,
+		_ts:       now.Unix(),
+		"reasons": strings.Join(reasons, "; "),
+		"row":     string(encoded),
+	}
+}
+
+// schemaHistorySchema is the schema of the schema history table, which has a
+// row for every change to the schema of every table.
+func schemaHistorySchema() *bigquery.TableSchema {
+	return &bigquery.TableSchema{
+		Fields: []*bigquery.TableFieldSchema{
+			&bigquery.TableFieldSchema{Name: "table", Type: STRING},
+			&bigquery.TableFieldSchema{Name: _ts, Type: TIMESTAMP},
+			&bigquery.TableFieldSchema{Name: "field", Type: STRING},
+			&bigquery.TableFieldSchema{Name: "change", Type: STRING},
+			&bigquery.TableFieldSchema{Name: "oldType", Type: STRING},
+			&bigquery.TableFieldSchema{Name: "newType", Type: STRING},
+		},
+	}
+}
+
+func schemaHistoryRow(tableId string, change *SchemaChange, now time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"table":   tableId,
+		_ts:       now.Unix(),
+		"field":   change.Field,
+		"change":  change.Change,
+		"oldType": change.OldType,
+		"newType": change.NewType,
+	}
+}
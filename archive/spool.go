@@ -0,0 +1,420 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package archive
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/statshub/statshub"
+)
+
+const (
+	DefaultSpoolMaxRetries     = 5
+	DefaultSpoolInitialBackoff = 1 * time.Second
+	DefaultSpoolMaxBackoff     = 1 * time.Minute
+	DefaultSpoolReplayInterval = 5 * time.Minute
+
+	spoolExt = ".json"
+)
+
+// SpoolOptions configures a Spool.  Zero values of everything but Dir are
+// replaced with defaults.
+type SpoolOptions struct {
+	// Dir is where snapshots are spooled
+	Dir string
+
+	// MaxRetries is how many times shipping a snapshot is retried before it's
+	// left in the spool for the next replay.  Negative disables retries.
+	MaxRetries int
+
+	// InitialBackoff is how long to wait before the first retry, doubling on
+	// every subsequent retry up to MaxBackoff
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// ReplayInterval is how frequently snapshots left in the spool are replayed
+	ReplayInterval time.Duration
+}
+
+// Spool is an Archiver that durably spools every snapshot to a local directory
+// before shipping it to another Archiver, retrying with backoff.  Snapshots
+// that still can't be shipped stay in the spool and are replayed periodically
+// (or on demand), so an outage of the other Archiver doesn't lose intervals.
+// Replayed snapshots keep their original timestamp, so BigQuery InsertIds are
+// unchanged and rows that made it in before a failure aren't duplicated.
+//
+// Spool is also an http.Handler.  GET lists the spooled snapshots and POST
+// replays them.
+type Spool struct {
+	opts     SpoolOptions
+	archiver Archiver
+	sleep    func(time.Duration)
+	mutex    sync.Mutex
+	shipping map[string]bool
+	stop     chan bool
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// ReplayResponse is the Response to a replay of the spool.  Failures reports
+// the error for each snapshot that couldn't be shipped, which for BigQuery
+// includes the InsertIds of any rejected rows.
+type ReplayResponse struct {
+	statshub.Response
+	Replayed int               `json:"replayed"`
+	Pending  []string          `json:"pending"`
+	Failures map[string]string `json:"failures,omitempty"`
+}
+
+// NewSpool constructs a Spool that ships snapshots to archiver
+func NewSpool(archiver Archiver, opts SpoolOptions) (*Spool, error) {
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = DefaultSpoolMaxRetries
+	}
+	if opts.InitialBackoff <= 0 {
+		opts.InitialBackoff = DefaultSpoolInitialBackoff
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = DefaultSpoolMaxBackoff
+	}
+	if opts.ReplayInterval <= 0 {
+		opts.ReplayInterval = DefaultSpoolReplayInterval
+	}
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("Unable to create spool directory %s: %s", opts.Dir, err)
+	}
+	return &Spool{
+		opts:     opts,
+		archiver: archiver,
+		sleep:    time.Sleep,
+		shipping: make(map[string]bool),
+		stop:     make(chan bool),
+	}, nil
+}
+
+// Start starts periodically replaying the spool
+func (spool *Spool) Start() {
+	spool.wg.Add(1)
+	go spool.replayPeriodically()
+}
+
+// Stop stops replaying the spool
+func (spool *Spool) Stop() {
+	spool.stopOnce.Do(func() {
+		close(spool.stop)
+	})
+	spool.wg.Wait()
+}
+
+func (spool *Spool) replayPeriodically() {
+	defer spool.wg.Done()
+	for {
+		select {
+		case <-time.After(spool.opts.ReplayInterval):
+			if resp := spool.Replay(); len(resp.Failures) > 0 {
+				log.Printf("Unable to replay %d spooled snapshots", len(resp.Failures))
+			}
+		case <-spool.stop:
+			return
+		}
+	}
+}
+
+// Archive spools the snapshot and then ships it.  If shipping fails, the
+// snapshot stays in the spool and the error is returned.
+func (spool *Spool) Archive(snapshot *Snapshot) error {
+	filename, err := spool.write(snapshot)
+	if err != nil {
+		return err
+	}
+	return spool.ship(filename)
+}
+
+// write atomically writes a snapshot to the spool, returning its filename
+func (spool *Spool) write(snapshot *Snapshot) (string, error) {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return "", fmt.Errorf("Unable to encode snapshot: %s", err)
+	}
+
+	dimNames := make([]string, 0, len(snapshot.Dims))
+	for dimName := range snapshot.Dims {
+		dimNames = append(dimNames, safeFilename(dimName))
+	}
+	sort.Strings(dimNames)
+	// Zero-padding the timestamp makes the spool sort by time
+	filename := filepath.Join(spool.opts.Dir, fmt.Sprintf("%020d-%s%s", snapshot.Ts.UnixNano(), strings.Join(dimNames, "_"), spoolExt))
+
+	tmp, err := ioutil.TempFile(spool.opts.Dir, ".spooling")
+	if err != nil {
+		return "", fmt.Errorf("Unable to spool snapshot: %s", err)
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmp.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("Unable to spool snapshot: %s", err)
+	}
+	return filename, nil
+}
+
+// ship ships a spooled snapshot with retries, removing it from the spool once
+// it has been shipped.
+func (spool *Spool) ship(filename string) error {
+	spool.mutex.Lock()
+	if spool.shipping[filename] {
+		spool.mutex.Unlock()
+		return fmt.Errorf("%s is already being shipped", filepath.Base(filename))
+	}
+	spool.shipping[filename] = true
+	spool.mutex.Unlock()
+	defer func() {
+		spool.mutex.Lock()
+		delete(spool.shipping, filename)
+		spool.mutex.Unlock()
+	}()
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("Unable to read spooled snapshot: %s", err)
+	}
+	snapshot := &Snapshot{}
+	if err := json.Unmarshal(data, snapshot); err != nil {
+		return fmt.Errorf("Unable to decode spooled snapshot %s: %s", filepath.Base(filename), err)
+	}
+
+	backoff := spool.opts.InitialBackoff
+	for attempt := 0; ; attempt++ {
+		err = spool.archiver.Archive(snapshot)
+		if err == nil {
+			break
+		}
+		if attempt >= spool.opts.MaxRetries {
+			return fmt.Errorf("Unable to ship %s after %d attempts, leaving it spooled: %s", filepath.Base(filename), attempt+1, err)
+		}
+		log.Printf("Unable to ship %s, retrying in %s: %s", filepath.Base(filename), backoff, err)
+		spool.sleep(backoff)
+		backoff *= 2
+		if backoff > spool.opts.MaxBackoff {
+			backoff = spool.opts.MaxBackoff
+		}
+	}
+
+	if err := os.Remove(filename); err != nil {
+		return fmt.Errorf("Shipped %s but unable to remove it from the spool: %s", filepath.Base(filename), err)
+	}
+	return nil
+}
+
+// Pending lists the snapshots in the spool, oldest first
+func (spool *Spool) Pending() ([]string, error) {
+	filenames, err := filepath.Glob(filepath.Join(spool.opts.Dir, "*"+spoolExt))
+	if err != nil {
+		return nil, err
+	}
+	pending := make([]string, len(filenames))
+	for i, filename := range filenames {
+		pending[i] = filepath.Base(filename)
+	}
+	sort.Strings(pending)
+	return pending, nil
+}
+
+// Replay ships every snapshot in the spool, oldest first
+func (spool *Spool) Replay() *ReplayResponse {
+	resp := &ReplayResponse{Failures: make(map[string]string)}
+	pending, err := spool.Pending()
+	if err != nil {
+		resp.Error = fmt.Sprintf("Unable to list spool: %s", err)
+		return resp
+	}
+	for _, name := range pending {
+		if err := spool.ship(filepath.Join(spool.opts.Dir, name)); err != nil {
+			resp.Failures[name] = err.Error()
+		} else {
+			resp.Replayed++
+		}
+	}
+	resp.Pending, _ = spool.Pending()
+	resp.Succeeded = len(resp.Failures) == 0
+	if !resp.Succeeded {
+		resp.Error = fmt.Sprintf("Unable to replay %d of %d snapshots", len(resp.Failures), len(pending))
+	}
+	return resp
+}
+
+// ServeHTTP lists the spooled snapshots on GET and replays them on POST
+func (spool *Spool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	serveReplays(w, r, spool)
+}
+
+// replayer is a spool that can be listed and replayed over HTTP
+type replayer interface {
+	Pending() ([]string, error)
+	Replay() *ReplayResponse
+}
+
+// serveReplays lists the snapshots of spool on GET and replays them on POST
+func serveReplays(w http.ResponseWriter, r *http.Request, spool replayer) {
+	w.Header().Set("Content-Type", "application/json")
+	var resp *ReplayResponse
+	switch r.Method {
+	case "GET":
+		resp = &ReplayResponse{}
+		pending, err := spool.Pending()
+		if err != nil {
+			resp.Error = fmt.Sprintf("Unable to list spool: %s", err)
+		} else {
+			resp.Succeeded = true
+			resp.Pending = pending
+		}
+	case "POST":
+		resp = spool.Replay()
+	default:
+		w.WriteHeader(405)
+		return
+	}
+
+	bytes, err := json.Marshal(resp)
+	if err != nil {
+		log.Printf("Unable to respond to client: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	if resp.Succeeded {
+		w.WriteHeader(200)
+	} else {
+		w.WriteHeader(500)
+	}
+	w.Write(bytes)
+}
+
+// Spools is an Archiver that gives each of several Archivers its own Spool, in
+// a subdirectory of the spool directory named after the Archiver.  A snapshot
+// that fails to ship to one Archiver is only retried and replayed against that
+// one, so Archivers that don't dedupe rows (like the file and sql ones) don't
+// get them again because another Archiver failed.
+//
+// Spools is also an http.Handler like Spool, with the snapshots of each
+// Archiver prefixed by its name (e.g. bigquery/...).
+type Spools struct {
+	names  []string
+	spools map[string]*Spool
+}
+
+// NewSpools constructs Spools that ship snapshots to each of archivers, keyed
+// by name
+func NewSpools(archivers map[string]Archiver, opts SpoolOptions) (*Spools, error) {
+	spools := &Spools{spools: make(map[string]*Spool)}
+	for name, archiver := range archivers {
+		spoolOpts := opts
+		spoolOpts.Dir = filepath.Join(opts.Dir, safeFilename(name))
+		spool, err := NewSpool(archiver, spoolOpts)
+		if err != nil {
+			return nil, err
+		}
+		spools.names = append(spools.names, name)
+		spools.spools[name] = spool
+	}
+	sort.Strings(spools.names)
+	return spools, nil
+}
+
+// Start starts periodically replaying every spool
+func (spools *Spools) Start() {
+	for _, name := range spools.names {
+		spools.spools[name].Start()
+	}
+}
+
+// Stop stops replaying every spool
+func (spools *Spools) Stop() {
+	for _, name := range spools.names {
+		spools.spools[name].Stop()
+	}
+}
+
+// Archive spools and ships the snapshot separately for each Archiver
+func (spools *Spools) Archive(snapshot *Snapshot) error {
+	var failures []string
+	for _, name := range spools.names {
+		if err := spools.spools[name].Archive(snapshot); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", name, err))
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("Unable to archive to %d of %d sinks: %s", len(failures), len(spools.names), strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// Pending lists the snapshots in every spool, prefixed by the name of its
+// Archiver
+func (spools *Spools) Pending() ([]string, error) {
+	pending := []string{}
+	for _, name := range spools.names {
+		spoolPending, err := spools.spools[name].Pending()
+		if err != nil {
+			return nil, err
+		}
+		for _, snapshot := range spoolPending {
+			pending = append(pending, name+"/"+snapshot)
+		}
+	}
+	return pending, nil
+}
+
+// Replay replays every spool
+func (spools *Spools) Replay() *ReplayResponse {
+	resp := &ReplayResponse{Succeeded: true, Pending: []string{}, Failures: make(map[string]string)}
+	var errors []string
+	for _, name := range spools.names {
+		spoolResp := spools.spools[name].Replay()
+		resp.Replayed += spoolResp.Replayed
+		for _, snapshot := range spoolResp.Pending {
+			resp.Pending = append(resp.Pending, name+"/"+snapshot)
+		}
+		for snapshot, failure := range spoolResp.Failures {
+			resp.Failures[name+"/"+snapshot] = failure
+		}
+		if !spoolResp.Succeeded {
+			resp.Succeeded = false
+			errors = append(errors, fmt.Sprintf("%s: %s", name, spoolResp.Error))
+		}
+	}
+	resp.Error = strings.Join(errors, "; ")
+	return resp
+}
+
+// ServeHTTP lists the spooled snapshots on GET and replays them on POST
+func (spools *Spools) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	serveReplays(w, r, spools)
+}
@@ -0,0 +1,152 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package archive
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSpoolRetriesAndReplays(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statshub-spool")
+	if err != nil {
+		t.Fatalf("Unable to create dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	failuresLeft := 5
+	var shipped []time.Time
+	archiver := archiverFunc(func(snapshot *Snapshot) error {
+		if failuresLeft > 0 {
+			failuresLeft--
+			return fmt.Errorf("BigQuery is down")
+		}
+		if snapshot.Dims["country"]["es"].Counters["bytesGiven"] != 5 {
+			t.Errorf("Wrong stats shipped: %v", snapshot.Dims)
+		}
+		shipped = append(shipped, snapshot.Ts)
+		return nil
+	})
+	spool, err := NewSpool(archiver, SpoolOptions{Dir: dir, MaxRetries: 2, InitialBackoff: time.Second, MaxBackoff: 1500 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Unable to create spool: %s", err)
+	}
+	var backoffs []time.Duration
+	spool.sleep = func(d time.Duration) {
+		backoffs = append(backoffs, d)
+	}
+
+	// 3 attempts fail, leaving the snapshot spooled
+	if err := spool.Archive(snapshotForArchive("bytesGiven", archiveTs)); err == nil {
+		t.Fatalf("Archiving should have failed")
+	}
+	if len(backoffs) != 2 || backoffs[0] != time.Second || backoffs[1] != 1500*time.Millisecond {
+		t.Errorf("Wrong backoffs: %v", backoffs)
+	}
+	pending, _ := spool.Pending()
+	if len(pending) != 1 {
+		t.Fatalf("Expected 1 spooled snapshot, got %v", pending)
+	}
+
+	// A second snapshot succeeds on its last retry
+	if err := spool.Archive(snapshotForArchive("bytesGiven", archiveTs.Add(time.Hour))); err != nil {
+		t.Fatalf("Archiving should have succeeded after retrying: %s", err)
+	}
+	pending, _ = spool.Pending()
+	if len(pending) != 1 {
+		t.Fatalf("Shipped snapshot should have been removed from the spool: %v", pending)
+	}
+
+	// Replaying ships the first snapshot with its original timestamp
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "/admin/archive/spool", nil)
+	spool.ServeHTTP(w, r)
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	resp := &ReplayResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil {
+		t.Fatalf("Unable to decode response: %s", err)
+	}
+	if resp.Replayed != 1 || len(resp.Pending) != 0 {
+		t.Errorf("Wrong replay response: %v", resp)
+	}
+	if len(shipped) != 2 || !shipped[1].Equal(archiveTs) {
+		t.Errorf("Replayed snapshot should keep its timestamp: %v", shipped)
+	}
+}
+
+func TestSpoolsOnlyRetryFailingSinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statshub-spools")
+	if err != nil {
+		t.Fatalf("Unable to create dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ndjsonShipped := 0
+	bigqueryDown := true
+	bigqueryShipped := 0
+	spools, err := NewSpools(map[string]Archiver{
+		"ndjson": archiverFunc(func(snapshot *Snapshot) error {
+			ndjsonShipped++
+			return nil
+		}),
+		"bigquery": archiverFunc(func(snapshot *Snapshot) error {
+			if bigqueryDown {
+				return fmt.Errorf("BigQuery is down")
+			}
+			bigqueryShipped++
+			return nil
+		}),
+	}, SpoolOptions{Dir: dir, MaxRetries: 2})
+	if err != nil {
+		t.Fatalf("Unable to create spools: %s", err)
+	}
+	for _, name := range spools.names {
+		spools.spools[name].sleep = func(time.Duration) {}
+	}
+
+	if err := spools.Archive(snapshotForArchive("bytesGiven", archiveTs)); err == nil {
+		t.Fatalf("Archiving should have failed")
+	}
+	if ndjsonShipped != 1 {
+		t.Errorf("ndjson shouldn't have been retried, shipped %d times", ndjsonShipped)
+	}
+	pending, _ := spools.Pending()
+	if len(pending) != 1 || !strings.HasPrefix(pending[0], "bigquery/") {
+		t.Fatalf("Only the bigquery snapshot should be spooled: %v", pending)
+	}
+
+	resp := spools.Replay()
+	if resp.Succeeded || len(resp.Failures) != 1 {
+		t.Errorf("Replay should have failed for bigquery: %v", resp)
+	}
+
+	bigqueryDown = false
+	resp = spools.Replay()
+	if !resp.Succeeded || resp.Replayed != 1 || len(resp.Pending) != 0 {
+		t.Errorf("Wrong replay response: %v", resp)
+	}
+	if bigqueryShipped != 1 || ndjsonShipped != 1 {
+		t.Errorf("Replay should only have shipped to bigquery, shipped to bigquery %d and ndjson %d times", bigqueryShipped, ndjsonShipped)
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package archive
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/getlantern/statshub/statshub"
+)
+
+// SQLArchiver archives to a SQL database through database/sql, with one table
+// per dimension whose columns are those of columnsFor.  It uses only portable
+// SQL apart from the placeholder syntax, which depends on Driver.
+//
+// The statshub binary links the PostgreSQL driver github.com/lib/pq; programs
+// that use another database need to import its driver themselves, for example:
+//
+//	import _ "github.com/mattn/go-sqlite3"
+//
+//	db, err := sql.Open("sqlite3", "/var/lib/statshub/archive.db")
+//	archiver := &archive.SQLArchiver{DB: db, Driver: "sqlite3"}
+type SQLArchiver struct {
+	DB *sql.DB
+
+	// Driver is the name of the database/sql driver that DB was opened with.
+	// postgres uses numbered placeholders ($1), all others use ?.
+	Driver string
+}
+
+func (archiver *SQLArchiver) Archive(snapshot *Snapshot) error {
+	members := snapshot.memberSet()
+	for dimName, dimStats := range snapshot.Dims {
+		if err := archiver.archiveDim(dimName, dimStats, members, snapshot.Ts); err != nil {
+			return fmt.Errorf("Unable to archive dim %s: %s", dimName, err)
+		}
+	}
+	return nil
+}
+
+func (archiver *SQLArchiver) archiveDim(dimName string, dimStats map[string]*statshub.Stats, members map[string]bool, ts time.Time) error {
+	columns := columnsFor(dimName, dimStats, members)
+	existing, err := archiver.existingColumns(dimName)
+	if err != nil {
+		return err
+	}
+
+	tx, err := archiver.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, statement := range schemaStatements(dimName, existing, columns) {
+		if _, err := tx.Exec(statement); err != nil {
+			return fmt.Errorf("Unable to update schema with %s: %s", statement, err)
+		}
+	}
+
+	// Replace any rows for this timestamp so that archiving is idempotent
+	if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s = %s", quoteIdentifier(dimName), quoteIdentifier(_ts), archiver.placeholder(1)), ts.Unix()); err != nil {
+		return err
+	}
+	insert := archiver.insertStatement(dimName, columns)
+	for _, key := range sortedKeys(dimStats) {
+		if _, err := tx.Exec(insert, flatValues(columns, key, recordsFor(dimStats[key], members), ts)...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// existingColumns returns the columns of the table for the given dimension, or
+// nil if it doesn't exist yet.
+func (archiver *SQLArchiver) existingColumns(dimName string) ([]string, error) {
+	rows, err := archiver.DB.Query(fmt.Sprintf("SELECT * FROM %s WHERE 1 = 0", quoteIdentifier(dimName)))
+	if err != nil {
+		if isMissingTable(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Unable to read columns of %s: %s", dimName, err)
+	}
+	defer rows.Close()
+	return rows.Columns()
+}
+
+// isMissingTable indicates whether an error means that a table doesn't exist.
+// database/sql has no portable error for this, so this recognizes the messages
+// of SQLite ("no such table"), PostgreSQL ("does not exist") and MySQL
+// ("doesn't exist").
+func isMissingTable(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "no such table") || strings.Contains(msg, "does not exist") || strings.Contains(msg, "doesn't exist")
+}
+
+// schemaStatements returns the statements that create the table for the given
+// dimension or add any columns that it's missing.  Columns are never removed.
+func schemaStatements(dimName string, existing []string, columns []string) []string {
+	table := quoteIdentifier(dimName)
+	if existing == nil {
+		definitions := make([]string, len(columns))
+		for i, column := range columns {
+			definitions[i] = quoteIdentifier(column) + " " + sqlTypeFor(column)
+		}
+		return []string{fmt.Sprintf("CREATE TABLE %s (%s)", table, strings.Join(definitions, ", "))}
+	}
+
+	have := make(map[string]bool)
+	for _, column := range existing {
+		have[column] = true
+	}
+	var statements []string
+	for _, column := range columns {
+		if !have[column] {
+			statements = append(statements, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, quoteIdentifier(column), sqlTypeFor(column)))
+		}
+	}
+	return statements
+}
+
+func (archiver *SQLArchiver) insertStatement(dimName string, columns []string) string {
+	quoted := make([]string, len(columns))
+	placeholders := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = quoteIdentifier(column)
+		placeholders[i] = archiver.placeholder(i + 1)
+	}
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", quoteIdentifier(dimName), strings.Join(quoted, ", "), strings.Join(placeholders, ", "))
+}
+
+// placeholder returns the placeholder for the nth (1-based) query argument
+func (archiver *SQLArchiver) placeholder(n int) string {
+	if archiver.Driver == "postgres" {
+		return fmt.Sprintf("$%d", n)
+	}
+	return "?"
+}
+
+// sqlTypeFor returns the type of a column.  Stats are BIGINT because
+// PostgreSQL's INTEGER is only 32 bits wide.
+func sqlTypeFor(column string) string {
+	if column == _dim || column == _id {
+		return "TEXT"
+	}
+	return "BIGINT"
+}
+
+// quoteIdentifier quotes a table or column name, which may contain any
+// character (stat names like counter.bytesGiven contain dots).
+func quoteIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
@@ -0,0 +1,202 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package archive
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDB is an in-memory database that understands just the statements that
+// SQLArchiver uses
+type fakeDB struct {
+	mutex   sync.Mutex
+	columns map[string][]string
+	rows    map[string][]map[string]driver.Value
+	err     error // if set, every query fails with it
+}
+
+var (
+	fakeDBs     = make(map[string]*fakeDB)
+	fakeDBMutex sync.Mutex
+
+	identifierRegex = regexp.MustCompile(`"((?:[^"]|"")*)"`)
+)
+
+func init() {
+	sql.Register("fake", fakeDriver{})
+}
+
+func openFakeDB(t *testing.T) (*sql.DB, *fakeDB) {
+	name := t.Name()
+	fake := &fakeDB{
+		columns: make(map[string][]string),
+		rows:    make(map[string][]map[string]driver.Value),
+	}
+	fakeDBMutex.Lock()
+	fakeDBs[name] = fake
+	fakeDBMutex.Unlock()
+	db, err := sql.Open("fake", name)
+	if err != nil {
+		t.Fatalf("Unable to open db: %s", err)
+	}
+	return db, fake
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	fakeDBMutex.Lock()
+	defer fakeDBMutex.Unlock()
+	return &fakeConn{fakeDBs[name]}, nil
+}
+
+type fakeConn struct {
+	db *fakeDB
+}
+
+func (conn *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{conn.db, query}, nil
+}
+
+func (conn *fakeConn) Close() error              { return nil }
+func (conn *fakeConn) Begin() (driver.Tx, error) { return conn, nil }
+func (conn *fakeConn) Commit() error             { return nil }
+func (conn *fakeConn) Rollback() error           { return nil }
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (stmt *fakeStmt) Close() error  { return nil }
+func (stmt *fakeStmt) NumInput() int { return -1 }
+
+func (stmt *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	db := stmt.db
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	identifiers := identifiersIn(stmt.query)
+	table := identifiers[0]
+	switch {
+	case strings.HasPrefix(stmt.query, "CREATE TABLE"):
+		db.columns[table] = identifiers[1:]
+	case strings.HasPrefix(stmt.query, "ALTER TABLE"):
+		db.columns[table] = append(db.columns[table], identifiers[1])
+	case strings.HasPrefix(stmt.query, "DELETE FROM"):
+		var kept []map[string]driver.Value
+		for _, row := range db.rows[table] {
+			if row[identifiers[1]] != args[0] {
+				kept = append(kept, row)
+			}
+		}
+		db.rows[table] = kept
+	case strings.HasPrefix(stmt.query, "INSERT INTO"):
+		row := make(map[string]driver.Value)
+		for i, column := range identifiers[1:] {
+			row[column] = args[i]
+		}
+		db.rows[table] = append(db.rows[table], row)
+	default:
+		return nil, fmt.Errorf("unsupported statement %s", stmt.query)
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (stmt *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	db := stmt.db
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.err != nil {
+		return nil, db.err
+	}
+	table := identifiersIn(stmt.query)[0]
+	columns, ok := db.columns[table]
+	if !ok {
+		return nil, fmt.Errorf("no such table: %s", table)
+	}
+	return &fakeRows{columns}, nil
+}
+
+func identifiersIn(query string) []string {
+	var identifiers []string
+	for _, match := range identifierRegex.FindAllStringSubmatch(query, -1) {
+		identifiers = append(identifiers, strings.Replace(match[1], `""`, `"`, -1))
+	}
+	return identifiers
+}
+
+// fakeRows are the (empty) results of a query for a table's columns
+type fakeRows struct {
+	columns []string
+}
+
+func (rows *fakeRows) Columns() []string              { return rows.columns }
+func (rows *fakeRows) Close() error                   { return nil }
+func (rows *fakeRows) Next(dest []driver.Value) error { return errors.New("EOF") }
+
+func TestSQLArchiver(t *testing.T) {
+	db, fake := openFakeDB(t)
+	defer db.Close()
+
+	archiver := &SQLArchiver{DB: db}
+	if err := archiver.Archive(snapshotForArchive("bytesGiven", archiveTs)); err != nil {
+		t.Fatalf("Unable to archive: %s", err)
+	}
+	// Archiving the same time again replaces its rows
+	if err := archiver.Archive(snapshotForArchive("bytesGiven", archiveTs)); err != nil {
+		t.Fatalf("Unable to archive again: %s", err)
+	}
+	if err := archiver.Archive(snapshotForArchive("bytesGotten", archiveTs.Add(time.Hour))); err != nil {
+		t.Fatalf("Unable to archive new stat: %s", err)
+	}
+
+	expectedColumns := []string{"_dim", "_ts", "counter.bytesGiven", "gauge.online", "counter.bytesGotten"}
+	if strings.Join(fake.columns["country"], ",") != strings.Join(expectedColumns, ",") {
+		t.Errorf("Wrong columns: %v", fake.columns["country"])
+	}
+	rows := fake.rows["country"]
+	if len(rows) != 4 {
+		t.Fatalf("Expected 4 rows, got %d: %v", len(rows), rows)
+	}
+	if rows[0]["_dim"] != "es" || rows[0]["_ts"] != archiveTs.Unix() || rows[0]["counter.bytesGiven"] != int64(5) {
+		t.Errorf("Wrong first row: %v", rows[0])
+	}
+	if rows[3]["_dim"] != "total" || rows[3]["counter.bytesGotten"] != int64(5) {
+		t.Errorf("Wrong last row: %v", rows[3])
+	}
+}
+
+func TestSQLArchiverReturnsQueryErrors(t *testing.T) {
+	db, fake := openFakeDB(t)
+	defer db.Close()
+	fake.err = errors.New("connection refused")
+
+	archiver := &SQLArchiver{DB: db}
+	err := archiver.Archive(snapshotForArchive("bytesGiven", archiveTs))
+	if err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Errorf("Expected error reading columns, got %v", err)
+	}
+	if len(fake.columns) != 0 {
+		t.Errorf("Shouldn't have created a table: %v", fake.columns)
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"log"
 	"sort"
+	"strings"
 	"time"
 
 	bigquery "code.google.com/p/ox-google-api-go-client/bigquery/v2"
@@ -27,177 +28,307 @@ import (
 )
 
 const (
-	TIMESTAMP = "TIMESTAMP"
-	RECORD    = "RECORD"
-	INTEGER   = "INTEGER"
-	STRING    = "STRING"
-	global    = "global"
-	counter   = "counter"
-	gauge     = "gauge"
-	_ts       = "_ts"
-	_dim      = "_dim"
+	TIMESTAMP    = "TIMESTAMP"
+	RECORD       = "RECORD"
+	INTEGER      = "INTEGER"
+	STRING       = "STRING"
+	global       = "global"
+	counter      = "counter"
+	gauge        = "gauge"
+	gaugeCurrent = "gaugeCurrent"
+	member       = "member"
+	_ts          = "_ts"
+	_dim         = "_dim"
+	_id          = "_id"
 
 	ROWS_PER_INSERT = 1000
+
+	// SCHEMA_HISTORY_TABLE records every change to the schema of every table
+	SCHEMA_HISTORY_TABLE = "_schema_history"
+
+	// QUARANTINE_SUFFIX is appended to the name of a table to get the name of
+	// the table where its quarantined rows go
+	QUARANTINE_SUFFIX = "_quarantine"
 )
 
-// StatsTable is a table that holds statistics from statshub
+// StatsTable is a table that holds one day's statistics for a dimension from
+// statshub, e.g. country_20140501
 type StatsTable struct {
-	service   *bigquery.Service
-	tables    *bigquery.TablesService
-	tabledata *bigquery.TabledataService
-	dataset   *bigquery.Dataset
-	table     *bigquery.Table
+	client  shbq.Client
+	dataset *bigquery.Dataset
+	table   *bigquery.Table
+	dimName string
+	day     time.Time
+	dryRun  bool
 }
 
-func NewStatsTable(projectId string, datasetId string, tableId string) (statsTable *StatsTable, err error) {
+// NewStatsTable constructs a StatsTable for the given dimension and day, which
+// is read and written with the given client
+func NewStatsTable(client shbq.Client, projectId string, datasetId string, dimName string, day time.Time) (statsTable *StatsTable, err error) {
 	statsTable = &StatsTable{
+		client: client,
 		table: &bigquery.Table{
 			TableReference: &bigquery.TableReference{
 				ProjectId: projectId,
 				DatasetId: datasetId,
-				TableId:   tableId,
+				TableId:   shbq.DayTable(dimName, day),
 			},
 		},
+		dimName: dimName,
+		day:     day,
 	}
-	if statsTable.service, err = shbq.Connect(); err != nil {
-		return
-	} else {
-		statsTable.tables = bigquery.NewTablesService(statsTable.service)
-		statsTable.tabledata = bigquery.NewTabledataService(statsTable.service)
-		datasets := bigquery.NewDatasetsService(statsTable.service)
-		statsTable.dataset, err = datasets.Get(projectId, datasetId).Do()
-		return
-	}
+	statsTable.dataset, err = statsTable.client.GetDataset(projectId, datasetId)
+	return
 }
 
-func (statsTable *StatsTable) WriteStats(dimStats map[string]*statshub.Stats, now time.Time) (err error) {
-	if err = statsTable.createOrUpdateSchema(dimStats); err != nil {
+// WriteStats writes the given stats for the table's dimension as of now.
+// Gauges named in members are written as member cardinalities.  The schema
+// only ever gains fields, rows with stats whose type conflicts with the
+// existing schema are written to the quarantine table instead.  In dry run
+// mode, the schema changes are logged and nothing is written.
+func (statsTable *StatsTable) WriteStats(dimStats map[string]*statshub.Stats, members map[string]bool, now time.Time) (err error) {
+	var changes []*SchemaChange
+	if changes, err = statsTable.createOrUpdateSchema(dimStats, members, now); err != nil {
+		return
+	}
+	if statsTable.dryRun {
 		return
 	}
-	err = statsTable.insertRows(dimStats, now)
+	err = statsTable.insertRows(dimStats, members, now, schemaConflicts(changes))
 	return
 }
 
-func (statsTable *StatsTable) createOrUpdateSchema(dimStats map[string]*statshub.Stats) (err error) {
-	var originalTable *bigquery.Table
-	statsTable.table.Schema = schemaForStats(dimStats)
-	if originalTable, err = statsTable.tables.Get(
-		statsTable.table.TableReference.ProjectId,
-		statsTable.table.TableReference.DatasetId,
-		statsTable.table.TableReference.TableId,
-	).Do(); err != nil {
-		log.Printf("Creating table: %s", statsTable.table.TableReference.TableId)
+// createOrUpdateSchema creates the table or adds any fields that it's
+// missing, returning all of the changes that the stats need, including
+// conflicts.  New tables start with the schema of the previous day's table, so
+// that fields are never dropped from one day to the next.
+func (statsTable *StatsTable) createOrUpdateSchema(dimStats map[string]*statshub.Stats, members map[string]bool, now time.Time) (changes []*SchemaChange, err error) {
+	ref := statsTable.table.TableReference
+	schema := schemaForStats(statsTable.dimName, dimStats, members)
 
-		if statsTable.table, err = statsTable.tables.Insert(
-			statsTable.table.TableReference.ProjectId,
-			statsTable.table.TableReference.DatasetId,
-			statsTable.table).Do(); err != nil {
-			log.Printf("Error creating table: %s", err)
-			return
+	var originalFields []*bigquery.TableFieldSchema
+	originalTable, err := statsTable.client.GetTable(ref.ProjectId, ref.DatasetId, ref.TableId)
+	creating := err != nil
+	if !creating {
+		statsTable.table = originalTable
+		if originalTable.Schema != nil {
+			originalFields = originalTable.Schema.Fields
 		}
 	} else {
-		// TODO: the patch should only apply new columns, not remove old ones
-		log.Printf("Patching table schema: %s", statsTable.table.TableReference.TableId)
-		statsTable.mergeSchema(originalTable.Schema)
+		previousId := shbq.DayTable(statsTable.dimName, statsTable.day.Add(-24*time.Hour))
+		if previous, err := statsTable.client.GetTable(ref.ProjectId, ref.DatasetId, previousId); err == nil && previous.Schema != nil {
+			originalFields = previous.Schema.Fields
+		}
+	}
+	var fields []*bigquery.TableFieldSchema
+	fields, changes = evolveFields(originalFields, schema.Fields, "")
+
+	if statsTable.dryRun {
+		if creating {
+			log.Printf("Dry run, would create table %s:\n%s", ref.TableId, FormatSchemaChanges(changes))
+		} else if len(changes) > 0 {
+			log.Printf("Dry run, would change schema of %s:\n%s", ref.TableId, FormatSchemaChanges(changes))
+		}
+		return changes, nil
+	}
 
-		if statsTable.table, err = statsTable.tables.Patch(
-			statsTable.table.TableReference.ProjectId,
-			statsTable.table.TableReference.DatasetId,
-			statsTable.table.TableReference.TableId,
-			statsTable.table).Do(); err != nil {
+	for _, conflict := range schemaConflicts(changes) {
+		log.Printf("Quarantining rows of %s: %s", ref.TableId, conflict)
+	}
+	additions := schemaAdditions(changes)
+	table := &bigquery.Table{
+		TableReference: ref,
+		Schema:         &bigquery.TableSchema{Fields: fields},
+	}
+	if creating {
+		log.Printf("Creating table: %s", ref.TableId)
+		if statsTable.table, err = statsTable.client.InsertTable(ref.ProjectId, ref.DatasetId, table); err != nil {
+			log.Printf("Error creating table: %s", err)
+			return
+		}
+	} else if len(additions) > 0 {
+		log.Printf("Adding %d fields to table schema: %s", len(additions), ref.TableId)
+		if statsTable.table, err = statsTable.client.PatchTable(ref.ProjectId, ref.DatasetId, ref.TableId, table); err != nil {
 			log.Printf("Error patching table: %s", err)
 			return
 		}
 	}
-
-	return
+	return changes, statsTable.recordSchemaHistory(ref.TableId, additions, now)
 }
 
-func (statsTable *StatsTable) mergeSchema(schema *bigquery.TableSchema) {
-	statsTable.table.Schema.Fields = consolidateFields(statsTable.table.Schema.Fields, schema.Fields)
+// ensureTable creates the table with the given id and schema in the same
+// dataset as the StatsTable, unless it already exists.
+func (statsTable *StatsTable) ensureTable(tableId string, schema *bigquery.TableSchema) error {
+	ref := statsTable.table.TableReference
+	if _, err := statsTable.client.GetTable(ref.ProjectId, ref.DatasetId, tableId); err == nil {
+		return nil
+	}
+	log.Printf("Creating table: %s", tableId)
+	_, err := statsTable.client.InsertTable(ref.ProjectId, ref.DatasetId, &bigquery.Table{
+		TableReference: &bigquery.TableReference{
+			ProjectId: ref.ProjectId,
+			DatasetId: ref.DatasetId,
+			TableId:   tableId,
+		},
+		Schema: schema,
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to create table %s: %s", tableId, err)
+	}
+	return nil
 }
 
-func (statsTable *StatsTable) insertRows(dimStats map[string]*statshub.Stats, now time.Time) error {
-	doInsert := func(rows []*bigquery.TableDataInsertAllRequestRows) error {
-		insertRequest := &bigquery.TableDataInsertAllRequest{Rows: rows}
-		_, err := statsTable.tabledata.InsertAll(
-			statsTable.table.TableReference.ProjectId,
-			statsTable.table.TableReference.DatasetId,
-			statsTable.table.TableReference.TableId,
-			insertRequest).Do()
-		if err == nil {
-			log.Printf("Inserted %d rows into: %s", len(rows), statsTable.table.TableReference.TableId)
-		}
+// recordSchemaHistory records schema changes to the history table
+func (statsTable *StatsTable) recordSchemaHistory(tableId string, changes []*SchemaChange, now time.Time) error {
+	if len(changes) == 0 {
 		return nil
 	}
+	if err := statsTable.ensureTable(SCHEMA_HISTORY_TABLE, schemaHistorySchema()); err != nil {
+		return err
+	}
+	rows := make([]*bigquery.TableDataInsertAllRequestRows, len(changes))
+	for i, change := range changes {
+		rows[i] = &bigquery.TableDataInsertAllRequestRows{
+			InsertId: fmt.Sprintf("%s|%s|%d", tableId, change.Field, now.Unix()),
+			Json:     schemaHistoryRow(tableId, change, now),
+		}
+	}
+	return statsTable.insertAll(SCHEMA_HISTORY_TABLE, rows)
+}
 
-	rows := make([]*bigquery.TableDataInsertAllRequestRows, ROWS_PER_INSERT)
-	i := 0
+// InsertError reports the rows that BigQuery rejected in an insert
+type InsertError struct {
+	TableId string
+	Rows    []*FailedRow
+}
+
+// FailedRow is a row that BigQuery rejected, identified by its InsertId
+type FailedRow struct {
+	InsertId string
+	Reasons  []string
+}
+
+func (e *InsertError) Error() string {
+	failures := make([]string, len(e.Rows))
+	for i, row := range e.Rows {
+		failures[i] = fmt.Sprintf("%s (%s)", row.InsertId, strings.Join(row.Reasons, ", "))
+	}
+	return fmt.Sprintf("Unable to insert %d rows into %s: %s", len(e.Rows), e.TableId, strings.Join(failures, "; "))
+}
 
-	// Set up
-	for dim, stats := range dimStats {
+// insertRows inserts a row for every key, except for rows that have values
+// for conflicting fields, which go to the quarantine table.
+func (statsTable *StatsTable) insertRows(dimStats map[string]*statshub.Stats, members map[string]bool, now time.Time, conflicts []*SchemaChange) error {
+	tableId := statsTable.table.TableReference.TableId
+	var rows, quarantined []*bigquery.TableDataInsertAllRequestRows
+	for _, dim := range sortedKeys(dimStats) {
 		// Rows are identified by a unique InsertId to prevent duplicates for any given dim + ts
-		rows[i] = &bigquery.TableDataInsertAllRequestRows{
-			InsertId: fmt.Sprintf("%s|%d", dim, now.Unix()),
-			Json:     rowFromStats(dim, stats, now),
+		insertId := fmt.Sprintf("%s|%d", dim, now.Unix())
+		row := rowFromStats(keyColumn(statsTable.dimName), dim, recordsFor(dimStats[dim], members), now)
+		if reasons := conflictsIn(row, conflicts); len(reasons) > 0 {
+			quarantined = append(quarantined, &bigquery.TableDataInsertAllRequestRows{
+				InsertId: insertId,
+				Json:     quarantineRow(keyColumn(statsTable.dimName), dim, row, reasons, now),
+			})
+		} else {
+			rows = append(rows, &bigquery.TableDataInsertAllRequestRows{
+				InsertId: insertId,
+				Json:     row,
+			})
 		}
-		i++
-		if i == ROWS_PER_INSERT {
-			// To deal with rate limiting, insert every 1000 rows
-			if err := doInsert(rows); err != nil {
-				return err
-			}
-			i = 0
+	}
+
+	if len(quarantined) > 0 {
+		quarantineId := tableId + QUARANTINE_SUFFIX
+		if err := statsTable.ensureTable(quarantineId, quarantineSchema(keyColumn(statsTable.dimName))); err != nil {
+			return err
+		}
+		if err := statsTable.insertAll(quarantineId, quarantined); err != nil {
+			return err
 		}
 	}
+	return statsTable.insertAll(tableId, rows)
+}
 
-	if i != 0 {
-		// Insert the remaining rows
-		return doInsert(rows[0:i])
-	} else {
-		return nil
+// insertAll inserts rows into the given table in batches of ROWS_PER_INSERT,
+// returning an *InsertError if any rows were rejected.
+func (statsTable *StatsTable) insertAll(tableId string, rows []*bigquery.TableDataInsertAllRequestRows) error {
+	ref := statsTable.table.TableReference
+	insertError := &InsertError{TableId: tableId}
+	for start := 0; start < len(rows); start += ROWS_PER_INSERT {
+		// To deal with rate limiting, insert at most 1000 rows at a time
+		end := start + ROWS_PER_INSERT
+		if end > len(rows) {
+			end = len(rows)
+		}
+		batch := rows[start:end]
+		resp, err := statsTable.client.InsertAll(ref.ProjectId, ref.DatasetId, tableId, &bigquery.TableDataInsertAllRequest{Rows: batch})
+		if err != nil {
+			return fmt.Errorf("Unable to insert rows into %s: %s", tableId, err)
+		}
+		insertError.Rows = append(insertError.Rows, failedRows(batch, resp.InsertErrors)...)
+		log.Printf("Inserted %d rows into: %s", len(batch)-len(resp.InsertErrors), tableId)
+	}
+	if len(insertError.Rows) > 0 {
+		return insertError
+	}
+	return nil
+}
+
+// failedRows matches the InsertErrors from an InsertAll response to the rows
+// that were inserted.
+func failedRows(rows []*bigquery.TableDataInsertAllRequestRows, insertErrors []*bigquery.TableDataInsertAllResponseInsertErrors) []*FailedRow {
+	failed := make([]*FailedRow, 0, len(insertErrors))
+	for _, insertError := range insertErrors {
+		row := &FailedRow{InsertId: "unknown"}
+		if insertError.Index >= 0 && insertError.Index < int64(len(rows)) {
+			row.InsertId = rows[insertError.Index].InsertId
+		}
+		for _, e := range insertError.Errors {
+			row.Reasons = append(row.Reasons, e.Reason+": "+e.Message)
+		}
+		failed = append(failed, row)
 	}
+	return failed
 }
 
-func schemaForStats(dimStats map[string]*statshub.Stats) *bigquery.TableSchema {
+// schemaForStats builds the schema for the given dimension from the union of
+// the stats of all of its keys.
+func schemaForStats(dimName string, dimStats map[string]*statshub.Stats, members map[string]bool) *bigquery.TableSchema {
 	fields := make([]*bigquery.TableFieldSchema, 2)
 	fields[0] = &bigquery.TableFieldSchema{
 		Type: STRING,
-		Name: _dim,
+		Name: keyColumn(dimName),
 	}
 	fields[1] = &bigquery.TableFieldSchema{
 		Type: TIMESTAMP,
 		Name: _ts,
 	}
-	// Build fields based on stats for total
-	dimFields := fieldsForStats(dimStats["total"])
-	for _, dimField := range dimFields {
-		fields = append(fields, dimField)
+	union := make(map[string]map[string]int64)
+	for _, stats := range dimStats {
+		for record, values := range recordsFor(stats, members) {
+			if union[record] == nil {
+				union[record] = make(map[string]int64)
+			}
+			for name, val := range values {
+				union[record][name] = val
+			}
+		}
+	}
+	for _, record := range recordNames {
+		if len(union[record]) > 0 {
+			fields = append(fields, &bigquery.TableFieldSchema{
+				Type:   RECORD,
+				Name:   record,
+				Fields: fieldsFor(union[record]),
+			})
+		}
 	}
 	return &bigquery.TableSchema{
 		Fields: fields,
 	}
 }
 
-func fieldsForStats(stats *statshub.Stats) (fields []*bigquery.TableFieldSchema) {
-	fields = make([]*bigquery.TableFieldSchema, 0)
-	if len(stats.Counters) > 0 {
-		fields = append(fields, &bigquery.TableFieldSchema{
-			Type:   RECORD,
-			Name:   counter,
-			Fields: fieldsFor(stats.Counters),
-		})
-	}
-	if len(stats.Gauges) > 0 {
-		fields = append(fields, &bigquery.TableFieldSchema{
-			Type:   RECORD,
-			Name:   gauge,
-			Fields: fieldsFor(stats.Gauges),
-		})
-	}
-	return
-}
-
 func fieldsFor(m map[string]int64) (fields []*bigquery.TableFieldSchema) {
 	keys := make([]string, len(m))
 	i := 0
@@ -217,53 +348,17 @@ func fieldsFor(m map[string]int64) (fields []*bigquery.TableFieldSchema) {
 	return
 }
 
-// consolidateFields consolidates two lists of TableFieldSchemas into a single list
-func consolidateFields(a []*bigquery.TableFieldSchema, b []*bigquery.TableFieldSchema) (consolidated []*bigquery.TableFieldSchema) {
-	allFields := make(map[string]*bigquery.TableFieldSchema)
-
-	for _, field := range a {
-		allFields[field.Name] = field
-	}
-	for _, field := range b {
-		matching, found := allFields[field.Name]
-		if found {
-			if matching.Type == RECORD {
-				// For RECORD fields, consolidate their lists of fields
-				matching.Fields = consolidateFields(field.Fields, matching.Fields)
-			}
-		} else {
-			// No matching field found, add field
-			allFields[field.Name] = field
+// rowFromStats builds a row from the records of the stats for the given key.
+// The counter and gauge records are always present, gaugeCurrent and member
+// only if they have any stats.
+func rowFromStats(keyName string, key string, records map[string]map[string]int64, now time.Time) (row map[string]interface{}) {
+	row = make(map[string]interface{})
+	for _, record := range recordNames {
+		if values := records[record]; len(values) > 0 || record == counter || record == gauge {
+			row[record] = values
 		}
 	}
-
-	keys := make([]string, len(allFields))
-	i := 0
-	for key, _ := range allFields {
-		keys[i] = key
-		i++
-	}
-
-	// Sort keys alphabetically
-	sort.Strings(keys)
-	consolidated = make([]*bigquery.TableFieldSchema, len(keys))
-	for i, key := range keys {
-		consolidated[i] = allFields[key]
-	}
-
-	return
-}
-
-func rowFromStats(dim string, stats *statshub.Stats, now time.Time) (row map[string]interface{}) {
-	row = statsAsMap(stats)
 	row[_ts] = now.Unix()
-	row[_dim] = dim
-	return
-}
-
-func statsAsMap(stats *statshub.Stats) (m map[string]interface{}) {
-	m = make(map[string]interface{})
-	m[counter] = stats.Counters
-	m[gauge] = stats.Gauges
+	row[keyName] = key
 	return
 }
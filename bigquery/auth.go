@@ -0,0 +1,145 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package bigquery
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	goauth "code.google.com/p/goauth2/oauth"
+	"code.google.com/p/goauth2/oauth/jwt"
+	"github.com/oxtoacart/oauther/oauth"
+)
+
+const (
+	BIGQUERY_SCOPE = "https://www.googleapis.com/auth/bigquery"
+
+	// tokenRefreshMargin is how long before they expire access tokens are
+	// refreshed, so that requests never go out with an expired one
+	tokenRefreshMargin = 5 * time.Minute
+)
+
+// ServiceAccountKey is the key of a Google service account, in the JSON format
+// that the Google Developers Console downloads.
+type ServiceAccountKey struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// ParseServiceAccountKey parses and checks a JSON service account key
+func ParseServiceAccountKey(jsonKey []byte) (*ServiceAccountKey, error) {
+	key := &ServiceAccountKey{}
+	if err := json.Unmarshal(jsonKey, key); err != nil {
+		return nil, fmt.Errorf("Unable to parse service account key: %s", err)
+	}
+	if key.ClientEmail == "" {
+		return nil, fmt.Errorf("Service account key has no client_email")
+	}
+	if key.PrivateKey == "" {
+		return nil, fmt.Errorf("Service account key has no private_key")
+	}
+	// Sign a token to check the private key, without sending it anywhere
+	if _, err := jwt.NewToken(key.ClientEmail, BIGQUERY_SCOPE, []byte(key.PrivateKey)).Encode(); err != nil {
+		return nil, fmt.Errorf("Service account key has an invalid private_key: %s", err)
+	}
+	return key, nil
+}
+
+// tokenSource obtains a new access token
+type tokenSource func() (*goauth.Token, error)
+
+// serviceAccountSource obtains access tokens for a service account by sending
+// signed JWT assertions
+func serviceAccountSource(key *ServiceAccountKey) tokenSource {
+	return func() (*goauth.Token, error) {
+		token := jwt.NewToken(key.ClientEmail, BIGQUERY_SCOPE, []byte(key.PrivateKey))
+		if key.TokenURI != "" {
+			token.ClaimSet.Aud = key.TokenURI
+		}
+		return token.Assert(&http.Client{})
+	}
+}
+
+// oauthSource obtains access tokens with the refresh token in an OAuth config
+func oauthSource(oauther *oauth.OAuther) tokenSource {
+	return func() (*goauth.Token, error) {
+		transport := oauther.Transport()
+		if transport.Token == nil || transport.Token.RefreshToken == "" {
+			return nil, fmt.Errorf("OAuth config has no refresh token")
+		}
+		// Refresh updates the token in place, so work on a copy
+		token := *transport.Token
+		transport.Token = &token
+		if err := transport.Refresh(); err != nil {
+			return nil, err
+		}
+		return transport.Token, nil
+	}
+}
+
+// cachingTransport is an http.RoundTripper that authorizes requests with an
+// access token, which it caches until shortly before it expires.  Unlike the
+// transports in goauth2, it's safe for concurrent use.
+type cachingTransport struct {
+	source tokenSource
+	base   http.RoundTripper
+	now    func() time.Time
+	mutex  sync.Mutex
+	token  *goauth.Token
+}
+
+func newCachingTransport(source tokenSource, token *goauth.Token) *cachingTransport {
+	return &cachingTransport{
+		source: source,
+		base:   http.DefaultTransport,
+		now:    time.Now,
+		token:  token,
+	}
+}
+
+// accessToken returns the cached access token, first obtaining a new one if
+// there isn't one or it's about to expire
+func (t *cachingTransport) accessToken() (string, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.token == nil || t.token.AccessToken == "" || (!t.token.Expiry.IsZero() && t.token.Expiry.Before(t.now().Add(tokenRefreshMargin))) {
+		token, err := t.source()
+		if err != nil {
+			return "", fmt.Errorf("Unable to obtain access token: %s", err)
+		}
+		t.token = token
+	}
+	return t.token.AccessToken, nil
+}
+
+func (t *cachingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	accessToken, err := t.accessToken()
+	if err != nil {
+		return nil, err
+	}
+	// RoundTrippers mustn't modify the request, so authorize a copy
+	authorized := new(http.Request)
+	*authorized = *req
+	authorized.Header = make(http.Header)
+	for k, v := range req.Header {
+		authorized.Header[k] = v
+	}
+	authorized.Header.Set("Authorization", "Bearer "+accessToken)
+	return t.base.RoundTrip(authorized)
+}
@@ -0,0 +1,116 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package bigquery
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	goauth "code.google.com/p/goauth2/oauth"
+)
+
+func testServiceAccountKey(t *testing.T, tokenURI string) []byte {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("Unable to generate key: %s", err)
+	}
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
+	jsonKey, _ := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": "statshub@developer.gserviceaccount.com",
+		"private_key":  string(pemKey),
+		"token_uri":    tokenURI,
+	})
+	return jsonKey
+}
+
+func TestParseServiceAccountKey(t *testing.T) {
+	if _, err := ParseServiceAccountKey(testServiceAccountKey(t, "")); err != nil {
+		t.Errorf("Unable to parse key: %s", err)
+	}
+	for _, bad := range []string{
+		`{"private_key": "x"}`,
+		`{"client_email": "statshub@developer.gserviceaccount.com"}`,
+		`{"client_email": "statshub@developer.gserviceaccount.com", "private_key": "not a key"}`,
+		`not json`,
+	} {
+		if _, err := ParseServiceAccountKey([]byte(bad)); err == nil {
+			t.Errorf("Key should have been rejected: %s", bad)
+		}
+	}
+}
+
+func TestServiceAccountTokensAreCached(t *testing.T) {
+	assertions := 0
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertions++
+		if r.FormValue("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" || len(strings.Split(r.FormValue("assertion"), ".")) != 3 {
+			w.WriteHeader(400)
+			return
+		}
+		fmt.Fprintf(w, `{"access_token": "token%d", "token_type": "Bearer", "expires_in": 3600}`, assertions)
+	}))
+	defer tokenServer.Close()
+	var authorizations []string
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorizations = append(authorizations, r.Header.Get("Authorization"))
+	}))
+	defer apiServer.Close()
+
+	key, err := ParseServiceAccountKey(testServiceAccountKey(t, tokenServer.URL))
+	if err != nil {
+		t.Fatalf("Unable to parse key: %s", err)
+	}
+	transport := newCachingTransport(serviceAccountSource(key), nil)
+	now := time.Now()
+	transport.now = func() time.Time { return now }
+	client := &http.Client{Transport: transport}
+	for i := 0; i < 3; i++ {
+		if i == 2 {
+			// Tokens are refreshed shortly before they expire
+			now = now.Add(56 * time.Minute)
+		}
+		resp, err := client.Get(apiServer.URL)
+		if err != nil {
+			t.Fatalf("Unable to make request: %s", err)
+		}
+		resp.Body.Close()
+	}
+	if strings.Join(authorizations, ",") != "Bearer token1,Bearer token1,Bearer token2" {
+		t.Errorf("Wrong authorizations: %v", authorizations)
+	}
+}
+
+func TestCachingTransportErrors(t *testing.T) {
+	transport := newCachingTransport(func() (*goauth.Token, error) {
+		return nil, fmt.Errorf("no refresh token")
+	}, nil)
+	req, _ := http.NewRequest("GET", "http://localhost/", nil)
+	if _, err := transport.RoundTrip(req); err == nil || err.Error() != "Unable to obtain access token: no refresh token" {
+		t.Errorf("Wrong error: %v", err)
+	}
+	if req.Header.Get("Authorization") != "" {
+		t.Errorf("Request shouldn't be modified")
+	}
+}
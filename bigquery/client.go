@@ -0,0 +1,174 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package bigquery
+
+import (
+	"fmt"
+	"time"
+
+	bigquery "code.google.com/p/ox-google-api-go-client/bigquery/v2"
+)
+
+const (
+	jobPollInterval = 1 * time.Second
+
+	// jobTimeout is how long QueryInto waits for a job, which is longer than
+	// queries wait because rollups can scan a whole day of rows
+	jobTimeout = 30 * time.Minute
+)
+
+// Client is the part of the BigQuery API that statshub uses.  NewClient
+// implements it with the BigQuery service and the fake package implements it
+// in memory for tests.
+type Client interface {
+	GetDataset(projectId string, datasetId string) (*bigquery.Dataset, error)
+
+	GetTable(projectId string, datasetId string, tableId string) (*bigquery.Table, error)
+
+	InsertTable(projectId string, datasetId string, table *bigquery.Table) (*bigquery.Table, error)
+
+	PatchTable(projectId string, datasetId string, tableId string, table *bigquery.Table) (*bigquery.Table, error)
+
+	InsertAll(projectId string, datasetId string, tableId string, req *bigquery.TableDataInsertAllRequest) (*bigquery.TableDataInsertAllResponse, error)
+
+	// StartQuery starts running a query against the given dataset, waiting up
+	// to timeout for it to complete and returning the first page of results
+	// if it does.
+	StartQuery(projectId string, datasetId string, queryString string, pageSize int64, timeout time.Duration) (*bigquery.GetQueryResultsResponse, error)
+
+	// GetQueryResults gets the page of results with the given token (the
+	// first page for "") of a query started with StartQuery, waiting up to
+	// timeout for it to complete.
+	GetQueryResults(projectId string, jobId string, pageToken string, pageSize int64, timeout time.Duration) (*bigquery.GetQueryResultsResponse, error)
+
+	// QueryInto runs a query against the given dataset, replacing the contents
+	// of the destination table in the same dataset with its result, and waits
+	// for it to finish.
+	QueryInto(projectId string, datasetId string, queryString string, destinationTableId string) error
+}
+
+// OpenClient returns a Client for the shared BigQuery service
+func OpenClient() (Client, error) {
+	service, err := Connect()
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(service), nil
+}
+
+// NewClient constructs a Client for the given BigQuery service
+func NewClient(service *bigquery.Service) Client {
+	return &serviceClient{
+		datasets:  bigquery.NewDatasetsService(service),
+		tables:    bigquery.NewTablesService(service),
+		tabledata: bigquery.NewTabledataService(service),
+		jobs:      bigquery.NewJobsService(service),
+	}
+}
+
+type serviceClient struct {
+	datasets  *bigquery.DatasetsService
+	tables    *bigquery.TablesService
+	tabledata *bigquery.TabledataService
+	jobs      *bigquery.JobsService
+}
+
+func (c *serviceClient) GetDataset(projectId string, datasetId string) (*bigquery.Dataset, error) {
+	return c.datasets.Get(projectId, datasetId).Do()
+}
+
+func (c *serviceClient) GetTable(projectId string, datasetId string, tableId string) (*bigquery.Table, error) {
+	return c.tables.Get(projectId, datasetId, tableId).Do()
+}
+
+func (c *serviceClient) InsertTable(projectId string, datasetId string, table *bigquery.Table) (*bigquery.Table, error) {
+	return c.tables.Insert(projectId, datasetId, table).Do()
+}
+
+func (c *serviceClient) PatchTable(projectId string, datasetId string, tableId string, table *bigquery.Table) (*bigquery.Table, error) {
+	return c.tables.Patch(projectId, datasetId, tableId, table).Do()
+}
+
+func (c *serviceClient) InsertAll(projectId string, datasetId string, tableId string, req *bigquery.TableDataInsertAllRequest) (*bigquery.TableDataInsertAllResponse, error) {
+	return c.tabledata.InsertAll(projectId, datasetId, tableId, req).Do()
+}
+
+func (c *serviceClient) StartQuery(projectId string, datasetId string, queryString string, pageSize int64, timeout time.Duration) (*bigquery.GetQueryResultsResponse, error) {
+	resp, err := c.jobs.Query(projectId, &bigquery.QueryRequest{
+		DefaultDataset: &bigquery.DatasetReference{
+			DatasetId: datasetId,
+			ProjectId: projectId,
+		},
+		Query:      queryString,
+		Kind:       "json",
+		MaxResults: pageSize,
+		TimeoutMs:  int64(timeout / time.Millisecond),
+	}).Do()
+	if err != nil {
+		return nil, err
+	}
+	return &bigquery.GetQueryResultsResponse{
+		JobComplete:  resp.JobComplete,
+		JobReference: resp.JobReference,
+		PageToken:    resp.PageToken,
+		Rows:         resp.Rows,
+		Schema:       resp.Schema,
+		TotalRows:    resp.TotalRows,
+	}, nil
+}
+
+func (c *serviceClient) GetQueryResults(projectId string, jobId string, pageToken string, pageSize int64, timeout time.Duration) (*bigquery.GetQueryResultsResponse, error) {
+	call := c.jobs.GetQueryResults(projectId, jobId).MaxResults(pageSize).TimeoutMs(int64(timeout / time.Millisecond))
+	if pageToken != "" {
+		call = call.PageToken(pageToken)
+	}
+	return call.Do()
+}
+
+func (c *serviceClient) QueryInto(projectId string, datasetId string, queryString string, destinationTableId string) error {
+	job, err := c.jobs.Insert(projectId, &bigquery.Job{
+		Configuration: &bigquery.JobConfiguration{
+			Query: &bigquery.JobConfigurationQuery{
+				Query: queryString,
+				DestinationTable: &bigquery.TableReference{
+					ProjectId: projectId,
+					DatasetId: datasetId,
+					TableId:   destinationTableId,
+				},
+				CreateDisposition: "CREATE_IF_NEEDED",
+				WriteDisposition:  "WRITE_TRUNCATE",
+				AllowLargeResults: true,
+			},
+		},
+	}).Do()
+	if err != nil {
+		return fmt.Errorf("Unable to start query into %s: %s", destinationTableId, err)
+	}
+
+	deadline := time.Now().Add(jobTimeout)
+	for job.Status == nil || job.Status.State != "DONE" {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Query into %s timed out after %s", destinationTableId, jobTimeout)
+		}
+		time.Sleep(jobPollInterval)
+		if job, err = c.jobs.Get(projectId, job.JobReference.JobId).Do(); err != nil {
+			return fmt.Errorf("Unable to check on query into %s: %s", destinationTableId, err)
+		}
+	}
+	if job.Status.ErrorResult != nil {
+		return fmt.Errorf("Unable to query into %s: %s", destinationTableId, job.Status.ErrorResult.Message)
+	}
+	return nil
+}
@@ -15,7 +15,9 @@
 package bigquery
 
 import (
-	"os"
+	"fmt"
+	"net/http"
+	"sync"
 
 	// Note - I'm using a patched version of the google-api-go-client library
 	// because of this bug -
@@ -26,23 +28,70 @@ import (
 )
 
 const (
-	GOOGLE_PROJECT = "GOOGLE_PROJECT"
-	OAUTH_CONFIG   = "OAUTH_CONFIG"
-	DATASET_ID     = "statshub"
+	DATASET_ID = "statshub"
 )
 
 var (
-	ProjectId = os.Getenv(GOOGLE_PROJECT)
+	ProjectId         string
+	oauthConfig       string
+	serviceAccountKey *ServiceAccountKey
+
+	// service is shared by everything that connects, so that access tokens
+	// are reused until they expire
+	service      *bigquery.Service
+	serviceMutex sync.Mutex
 )
 
-// Connect authenticates using OAuth and returns a bigquery.Service which can be
-// used by the bigquery APIs.
-func Connect() (service *bigquery.Service, err error) {
-	var oauther *oauth.OAuther
-	oauther, err = oauth.FromJSON([]byte(os.Getenv(OAUTH_CONFIG)))
+// Configure sets the Google project containing the statshub dataset and the
+// JSON encoded OAuth config used to authenticate.
+func Configure(projectId string, jsonOAuthConfig string) {
+	serviceMutex.Lock()
+	defer serviceMutex.Unlock()
+	ProjectId = projectId
+	oauthConfig = jsonOAuthConfig
+	serviceAccountKey = nil
+	service = nil
+}
+
+// ConfigureServiceAccount sets the Google project containing the statshub
+// dataset and the JSON key of the service account used to authenticate.
+func ConfigureServiceAccount(projectId string, jsonKey []byte) error {
+	key, err := ParseServiceAccountKey(jsonKey)
 	if err != nil {
-		return
+		return err
+	}
+	serviceMutex.Lock()
+	defer serviceMutex.Unlock()
+	ProjectId = projectId
+	oauthConfig = ""
+	serviceAccountKey = key
+	service = nil
+	return nil
+}
+
+// Connect returns a bigquery.Service which can be used by the bigquery APIs,
+// authenticated as the configured service account or with the configured
+// OAuth config.  The service is created once and then reused.
+func Connect() (*bigquery.Service, error) {
+	serviceMutex.Lock()
+	defer serviceMutex.Unlock()
+	if service != nil {
+		return service, nil
+	}
+
+	var transport http.RoundTripper
+	if serviceAccountKey != nil {
+		transport = newCachingTransport(serviceAccountSource(serviceAccountKey), nil)
+	} else {
+		oauther, err := oauth.FromJSON([]byte(oauthConfig))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse OAuth config: %s", err)
+		}
+		transport = newCachingTransport(oauthSource(oauther), oauther.Token)
+	}
+	var err error
+	if service, err = bigquery.New(&http.Client{Transport: transport}); err != nil {
+		return nil, err
 	}
-	service, err = bigquery.New(oauther.Transport().Client())
-	return
+	return service, nil
 }
@@ -0,0 +1,400 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package fake provides an in-memory stand-in for BigQuery, so that archiving
+// and history queries can be tested without a Google project:
+//
+//	client := fake.New()
+//	server := statshub.NewServer(statshub.Options{Store: store, BigQuery: client})
+package fake
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bigquery "code.google.com/p/ox-google-api-go-client/bigquery/v2"
+)
+
+// Client is an in-memory implementation of statshub's bigquery.Client.  Every
+// dataset exists, tables hold their rows in memory and queries complete
+// immediately.  Like BigQuery, tables reject rows that don't match their
+// schemas, ignore rows whose InsertIds they've already seen and refuse
+// patches that remove fields or change their types.
+type Client struct {
+	mutex     sync.Mutex
+	tables    map[string]*table
+	jobs      map[string]*relation
+	nextJobId int
+	queries   []string
+}
+
+type table struct {
+	table     *bigquery.Table
+	data      *relation
+	insertIds map[string]bool
+}
+
+// New constructs an empty Client
+func New() *Client {
+	return &Client{
+		tables: make(map[string]*table),
+		jobs:   make(map[string]*relation),
+	}
+}
+
+// Rows returns the rows of a table, with the fields of records named like
+// counter.bytesGiven and timestamps as seconds since the epoch.
+func (c *Client) Rows(datasetId string, tableId string) ([]map[string]interface{}, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	t := c.tables[datasetId+"."+tableId]
+	if t == nil {
+		return nil, notFound(datasetId, tableId)
+	}
+	rows := make([]map[string]interface{}, len(t.data.rows))
+	for i, row := range t.data.rows {
+		rows[i] = make(map[string]interface{})
+		for name, value := range row {
+			rows[i][name] = value
+		}
+	}
+	return rows, nil
+}
+
+// TableIds lists the ids of the tables in a dataset
+func (c *Client) TableIds(datasetId string) []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var ids []string
+	for key, _ := range c.tables {
+		if strings.HasPrefix(key, datasetId+".") {
+			ids = append(ids, key[len(datasetId)+1:])
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Queries returns every query that's been run, in order
+func (c *Client) Queries() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]string(nil), c.queries...)
+}
+
+func (c *Client) GetDataset(projectId string, datasetId string) (*bigquery.Dataset, error) {
+	return &bigquery.Dataset{
+		Id: projectId + ":" + datasetId,
+		DatasetReference: &bigquery.DatasetReference{
+			ProjectId: projectId,
+			DatasetId: datasetId,
+		},
+	}, nil
+}
+
+func (c *Client) GetTable(projectId string, datasetId string, tableId string) (*bigquery.Table, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	t := c.tables[datasetId+"."+tableId]
+	if t == nil {
+		return nil, notFound(datasetId, tableId)
+	}
+	return copyTable(t.table), nil
+}
+
+func (c *Client) InsertTable(projectId string, datasetId string, tbl *bigquery.Table) (*bigquery.Table, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if tbl.TableReference == nil {
+		return nil, fmt.Errorf("Table has no reference")
+	}
+	tableId := tbl.TableReference.TableId
+	if c.tables[datasetId+"."+tableId] != nil {
+		return nil, fmt.Errorf("Already Exists: Table %s.%s", datasetId, tableId)
+	}
+	t := &table{table: copyTable(tbl), insertIds: make(map[string]bool)}
+	t.table.Id = fmt.Sprintf("%s:%s.%s", projectId, datasetId, tableId)
+	t.data = &relation{types: make(map[string]string)}
+	if t.table.Schema != nil {
+		t.data.names = flattenFields(t.table.Schema.Fields, "", t.data.types)
+	}
+	c.tables[datasetId+"."+tableId] = t
+	return copyTable(t.table), nil
+}
+
+func (c *Client) PatchTable(projectId string, datasetId string, tableId string, tbl *bigquery.Table) (*bigquery.Table, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	t := c.tables[datasetId+"."+tableId]
+	if t == nil {
+		return nil, notFound(datasetId, tableId)
+	}
+	if tbl.Schema != nil {
+		types := make(map[string]string)
+		names := flattenFields(tbl.Schema.Fields, "", types)
+		for _, name := range t.data.names {
+			if types[name] != t.data.types[name] {
+				return nil, fmt.Errorf("Provided Schema does not match Table %s.%s. Field %s has changed type or is missing", datasetId, tableId, name)
+			}
+		}
+		t.table.Schema = copyTable(tbl).Schema
+		t.data.names = names
+		t.data.types = types
+	}
+	return copyTable(t.table), nil
+}
+
+func (c *Client) InsertAll(projectId string, datasetId string, tableId string, req *bigquery.TableDataInsertAllRequest) (*bigquery.TableDataInsertAllResponse, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	t := c.tables[datasetId+"."+tableId]
+	if t == nil {
+		return nil, notFound(datasetId, tableId)
+	}
+	resp := &bigquery.TableDataInsertAllResponse{}
+	for i, r := range req.Rows {
+		if r.InsertId != "" && t.insertIds[r.InsertId] {
+			continue
+		}
+		row, err := t.data.rowFromJSON(r.Json)
+		if err != nil {
+			resp.InsertErrors = append(resp.InsertErrors, &bigquery.TableDataInsertAllResponseInsertErrors{
+				Index:  int64(i),
+				Errors: []*bigquery.ErrorProto{&bigquery.ErrorProto{Reason: "invalid", Message: err.Error()}},
+			})
+			continue
+		}
+		if r.InsertId != "" {
+			t.insertIds[r.InsertId] = true
+		}
+		t.data.rows = append(t.data.rows, row)
+	}
+	return resp, nil
+}
+
+func (c *Client) StartQuery(projectId string, datasetId string, queryString string, pageSize int64, timeout time.Duration) (*bigquery.GetQueryResultsResponse, error) {
+	result, err := c.run(datasetId, queryString)
+	if err != nil {
+		return nil, err
+	}
+	c.mutex.Lock()
+	c.nextJobId++
+	jobId := fmt.Sprintf("job_%d", c.nextJobId)
+	c.jobs[jobId] = result
+	c.mutex.Unlock()
+	return c.GetQueryResults(projectId, jobId, "", pageSize, timeout)
+}
+
+func (c *Client) GetQueryResults(projectId string, jobId string, pageToken string, pageSize int64, timeout time.Duration) (*bigquery.GetQueryResultsResponse, error) {
+	c.mutex.Lock()
+	result := c.jobs[jobId]
+	c.mutex.Unlock()
+	if result == nil {
+		return nil, fmt.Errorf("Not found: Job %s", jobId)
+	}
+
+	start := 0
+	if pageToken != "" {
+		var err error
+		if start, err = strconv.Atoi(pageToken); err != nil {
+			return nil, fmt.Errorf("Invalid page token %s", pageToken)
+		}
+	}
+	end := len(result.rows)
+	if pageSize > 0 && start+int(pageSize) < end {
+		end = start + int(pageSize)
+	}
+	resp := &bigquery.GetQueryResultsResponse{
+		JobComplete:  true,
+		JobReference: &bigquery.JobReference{ProjectId: projectId, JobId: jobId},
+		Schema:       &bigquery.TableSchema{},
+		TotalRows:    uint64(len(result.rows)),
+	}
+	for _, name := range result.names {
+		resp.Schema.Fields = append(resp.Schema.Fields, &bigquery.TableFieldSchema{Name: name, Type: result.types[name]})
+	}
+	if start < end {
+		for _, row := range result.rows[start:end] {
+			cells := make([]*bigquery.TableCell, len(result.names))
+			for i, name := range result.names {
+				cells[i] = &bigquery.TableCell{V: formatValue(row[name])}
+			}
+			resp.Rows = append(resp.Rows, &bigquery.TableRow{F: cells})
+		}
+	}
+	if end < len(result.rows) {
+		resp.PageToken = strconv.Itoa(end)
+	}
+	return resp, nil
+}
+
+func (c *Client) QueryInto(projectId string, datasetId string, queryString string, destinationTableId string) error {
+	result, err := c.run(datasetId, queryString)
+	if err != nil {
+		return fmt.Errorf("Unable to query into %s: %s", destinationTableId, err)
+	}
+	schema := &bigquery.TableSchema{}
+	for _, name := range result.names {
+		schema.Fields = append(schema.Fields, &bigquery.TableFieldSchema{Name: name, Type: result.types[name]})
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	// WRITE_TRUNCATE replaces the table, schema and all
+	c.tables[datasetId+"."+destinationTableId] = &table{
+		table: &bigquery.Table{
+			Id: fmt.Sprintf("%s:%s.%s", projectId, datasetId, destinationTableId),
+			TableReference: &bigquery.TableReference{
+				ProjectId: projectId,
+				DatasetId: datasetId,
+				TableId:   destinationTableId,
+			},
+			Schema: schema,
+		},
+		data:      result,
+		insertIds: make(map[string]bool),
+	}
+	return nil
+}
+
+func (c *Client) run(datasetId string, queryString string) (*relation, error) {
+	q, err := parse(queryString)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse query: %s", err)
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.queries = append(c.queries, queryString)
+	return q.run(datasetId, func(datasetId string, tableId string) *relation {
+		if t := c.tables[datasetId+"."+tableId]; t != nil {
+			return t.data
+		}
+		return nil
+	})
+}
+
+// flattenFields records the types of the given fields and their nested fields
+// by dotted name and returns the names of the fields that hold values.
+func flattenFields(fields []*bigquery.TableFieldSchema, prefix string, types map[string]string) []string {
+	var names []string
+	for _, field := range fields {
+		name := prefix + field.Name
+		if field.Type == RECORD {
+			names = append(names, flattenFields(field.Fields, name+".", types)...)
+			continue
+		}
+		types[name] = field.Type
+		names = append(names, name)
+	}
+	return names
+}
+
+// rowFromJSON converts a row from an insert to the relation's representation,
+// checking it against the relation's types.
+func (rel *relation) rowFromJSON(value interface{}) (map[string]interface{}, error) {
+	// Round trip through JSON to get the same values that BigQuery would see
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.UseNumber()
+	var decoded map[string]interface{}
+	if err := decoder.Decode(&decoded); err != nil {
+		return nil, fmt.Errorf("Row is not a JSON object")
+	}
+	row := make(map[string]interface{})
+	return row, rel.flattenRow(decoded, "", row)
+}
+
+func (rel *relation) flattenRow(values map[string]interface{}, prefix string, row map[string]interface{}) error {
+	for name, value := range values {
+		name = prefix + name
+		if record, ok := value.(map[string]interface{}); ok {
+			if err := rel.flattenRow(record, name+".", row); err != nil {
+				return err
+			}
+			continue
+		}
+		t, found := rel.types[name]
+		if !found {
+			return fmt.Errorf("no such field: %s", name)
+		}
+		if value == nil {
+			continue
+		}
+		converted, err := convertValue(value, t)
+		if err != nil {
+			return fmt.Errorf("Invalid value for %s: %s", name, err)
+		}
+		row[name] = converted
+	}
+	return nil
+}
+
+func convertValue(value interface{}, t string) (interface{}, error) {
+	number, isNumber := value.(json.Number)
+	str, isString := value.(string)
+	switch t {
+	case STRING:
+		if isString {
+			return str, nil
+		}
+	case INTEGER:
+		if isNumber {
+			return number.Int64()
+		}
+		if isString {
+			return strconv.ParseInt(str, 10, 64)
+		}
+	case FLOAT:
+		if isNumber {
+			return number.Float64()
+		}
+		if isString {
+			return strconv.ParseFloat(str, 64)
+		}
+	case TIMESTAMP:
+		if isNumber {
+			f, err := number.Float64()
+			return int64(f), err
+		}
+		if isString {
+			return parseTimestamp(str)
+		}
+	case BOOLEAN:
+		if b, ok := value.(bool); ok {
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("%v is not a valid %s", value, t)
+}
+
+func copyTable(t *bigquery.Table) *bigquery.Table {
+	// Tables are plain data, so they always round trip
+	encoded, _ := json.Marshal(t)
+	copied := &bigquery.Table{}
+	json.Unmarshal(encoded, copied)
+	return copied
+}
+
+func notFound(datasetId string, tableId string) error {
+	return fmt.Errorf("Not found: Table %s.%s", datasetId, tableId)
+}
@@ -0,0 +1,150 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package fake
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	bigquery "code.google.com/p/ox-google-api-go-client/bigquery/v2"
+)
+
+func statsTable() *bigquery.Table {
+	return &bigquery.Table{
+		TableReference: &bigquery.TableReference{ProjectId: "p", DatasetId: "statshub", TableId: "country_20140501"},
+		Schema: &bigquery.TableSchema{Fields: []*bigquery.TableFieldSchema{
+			&bigquery.TableFieldSchema{Name: "_dim", Type: STRING},
+			&bigquery.TableFieldSchema{Name: "_ts", Type: TIMESTAMP},
+			&bigquery.TableFieldSchema{Name: "counter", Type: RECORD, Fields: []*bigquery.TableFieldSchema{
+				&bigquery.TableFieldSchema{Name: "bytesGiven", Type: INTEGER},
+			}},
+		}},
+	}
+}
+
+func insert(t *testing.T, c *Client, rows ...map[string]interface{}) *bigquery.TableDataInsertAllResponse {
+	req := &bigquery.TableDataInsertAllRequest{}
+	for _, row := range rows {
+		req.Rows = append(req.Rows, &bigquery.TableDataInsertAllRequestRows{
+			InsertId: fmt.Sprintf("%s|%d", row["_dim"], row["_ts"]),
+			Json:     row,
+		})
+	}
+	resp, err := c.InsertAll("p", "statshub", "country_20140501", req)
+	if err != nil {
+		t.Fatalf("Unable to insert: %s", err)
+	}
+	return resp
+}
+
+func TestTables(t *testing.T) {
+	c := New()
+	if _, err := c.GetTable("p", "statshub", "country_20140501"); err == nil {
+		t.Errorf("Table shouldn't exist yet")
+	}
+	if _, err := c.InsertTable("p", "statshub", statsTable()); err != nil {
+		t.Fatalf("Unable to create table: %s", err)
+	}
+	if _, err := c.InsertTable("p", "statshub", statsTable()); err == nil {
+		t.Errorf("Table shouldn't be created twice")
+	}
+
+	resp := insert(t, c,
+		map[string]interface{}{"_dim": "es", "_ts": int64(1398945600), "counter": map[string]int64{"bytesGiven": 5}},
+		map[string]interface{}{"_dim": "es", "_ts": int64(1398945600), "counter": map[string]int64{"bytesGiven": 5}},
+		map[string]interface{}{"_dim": "de", "_ts": int64(1398945600), "counter": map[string]int64{"bytesGotten": 5}},
+		map[string]interface{}{"_dim": "fr", "_ts": int64(1398945600), "counter": map[string]interface{}{"bytesGiven": "lots"}})
+	if len(resp.InsertErrors) != 2 || resp.InsertErrors[0].Index != 2 || resp.InsertErrors[0].Errors[0].Message != "no such field: counter.bytesGotten" || resp.InsertErrors[1].Index != 3 {
+		t.Errorf("Wrong insert errors: %v", resp.InsertErrors)
+	}
+	rows, _ := c.Rows("statshub", "country_20140501")
+	if len(rows) != 1 || rows[0]["counter.bytesGiven"] != int64(5) {
+		t.Errorf("Should have inserted one row, duplicates are ignored: %v", rows)
+	}
+
+	patched := statsTable()
+	patched.Schema.Fields[2].Fields = append(patched.Schema.Fields[2].Fields, &bigquery.TableFieldSchema{Name: "bytesGotten", Type: INTEGER})
+	if _, err := c.PatchTable("p", "statshub", "country_20140501", patched); err != nil {
+		t.Fatalf("Unable to add a field: %s", err)
+	}
+	patched.Schema.Fields = patched.Schema.Fields[:2]
+	if _, err := c.PatchTable("p", "statshub", "country_20140501", patched); err == nil {
+		t.Errorf("Shouldn't be able to remove fields")
+	}
+	if resp := insert(t, c, map[string]interface{}{"_dim": "de", "_ts": int64(1398945601), "counter": map[string]int64{"bytesGotten": 5}}); len(resp.InsertErrors) != 0 {
+		t.Errorf("Should be able to insert into added field: %v", resp.InsertErrors[0].Errors[0])
+	}
+}
+
+func TestQueries(t *testing.T) {
+	c := New()
+	c.InsertTable("p", "statshub", statsTable())
+	insert(t, c,
+		map[string]interface{}{"_dim": "es", "_ts": int64(1398945600), "counter": map[string]int64{"bytesGiven": 5}},
+		map[string]interface{}{"_dim": "es", "_ts": int64(1398947400), "counter": map[string]int64{"bytesGiven": 7}},
+		map[string]interface{}{"_dim": "de", "_ts": int64(1398949200), "counter": map[string]int64{"bytesGiven": 1}},
+		map[string]interface{}{"_dim": "de", "_ts": int64(1398949201)})
+
+	resp, err := c.StartQuery("p", "statshub", `
+SELECT INTEGER(TIMESTAMP_TO_SEC(_ts) / 3600) AS period, _dim, MAX(counter.bytesGiven) AS value, COUNT(*) AS n
+FROM (TABLE_DATE_RANGE([statshub.country_], SEC_TO_TIMESTAMP(1398902400), TIMESTAMP('2014-05-02')))
+WHERE _ts > SEC_TO_TIMESTAMP(1398902400) AND _dim != 'fr'
+GROUP BY period, _dim
+ORDER BY period, _dim DESC`, 2, 0)
+	if err != nil {
+		t.Fatalf("Unable to query: %s", err)
+	}
+	if resp.TotalRows != 2 || resp.PageToken != "" || len(resp.Rows) != 2 {
+		t.Fatalf("Wrong number of rows: %v", resp)
+	}
+	var values []string
+	for _, row := range resp.Rows {
+		var cells []string
+		for _, cell := range row.F {
+			cells = append(cells, cell.V.(string))
+		}
+		values = append(values, strings.Join(cells, ","))
+	}
+	if strings.Join(values, " ") != "388596,es,7,2 388597,de,1,2" {
+		t.Errorf("Wrong results: %v", values)
+	}
+
+	if err := c.QueryInto("p", "statshub", `SELECT _dim, SEC_TO_TIMESTAMP(period * 3600) AS _ts, total
+FROM (SELECT _dim, INTEGER(TIMESTAMP_TO_SEC(_ts) / 3600) AS period, SUM(counter.bytesGiven) AS total
+  FROM [statshub.country_20140501]
+  GROUP BY _dim, period)`, "totals"); err != nil {
+		t.Fatalf("Unable to query into table: %s", err)
+	}
+	table, _ := c.GetTable("p", "statshub", "totals")
+	if f := table.Schema.Fields; len(f) != 3 || f[1].Type != TIMESTAMP || f[2].Type != INTEGER {
+		t.Errorf("Wrong schema of results: %v", f)
+	}
+	rows, _ := c.Rows("statshub", "totals")
+	if len(rows) != 2 || rows[0]["_ts"] != int64(1398945600) || rows[0]["total"] != int64(12) {
+		t.Errorf("Wrong rows: %v", rows)
+	}
+
+	for _, bad := range []string{
+		"SELECT _dim FROM [statshub.nothing]",
+		"SELECT _dim, MAX(counter.bytesGiven) FROM [statshub.country_20140501]",
+		"SELECT _dim FROM [statshub.country_20140501] ORDER BY nothing",
+		"DROP TABLE [statshub.country_20140501]",
+	} {
+		if _, err := c.StartQuery("p", "statshub", bad, 0, 0); err == nil {
+			t.Errorf("Query should have failed: %s", bad)
+		}
+	}
+}
@@ -0,0 +1,1017 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package fake
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The fake understands the subset of legacy BigQuery SQL that statshub uses:
+//
+//     SELECT expr [AS name], ...
+//     FROM [dataset.table] | (subquery) | (TABLE_DATE_RANGE([dataset.prefix], start, end))
+//     [WHERE expr]
+//     [GROUP BY name, ...]
+//     [ORDER BY name [ASC|DESC], ...]
+//
+// Expressions can use columns (nested ones as record.field), integer, float
+// and string literals, arithmetic, comparisons, AND, the aggregations MAX, MIN,
+// SUM, AVG and COUNT and the functions INTEGER, TIMESTAMP, TIMESTAMP_TO_SEC
+// and SEC_TO_TIMESTAMP.  Timestamps are held as seconds since the epoch.
+
+const (
+	INTEGER   = "INTEGER"
+	FLOAT     = "FLOAT"
+	STRING    = "STRING"
+	TIMESTAMP = "TIMESTAMP"
+	BOOLEAN   = "BOOLEAN"
+	RECORD    = "RECORD"
+)
+
+const (
+	tokIdent = iota
+	tokNumber
+	tokString
+	tokTable
+	tokSymbol
+	tokEOF
+)
+
+var aggregations = map[string]bool{"MAX": true, "MIN": true, "SUM": true, "AVG": true, "COUNT": true}
+
+type token struct {
+	kind int
+	text string
+}
+
+func tokenize(queryString string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(queryString); {
+		c := queryString[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case isIdentStart(c):
+			j := i + 1
+			for j < len(queryString) && (isIdentStart(queryString[j]) || isDigit(queryString[j]) || queryString[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, token{tokIdent, queryString[i:j]})
+			i = j
+		case isDigit(c):
+			j := i + 1
+			for j < len(queryString) && (isDigit(queryString[j]) || queryString[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, token{tokNumber, queryString[i:j]})
+			i = j
+		case c == '\'' || c == '"':
+			value := make([]byte, 0)
+			j := i + 1
+			for ; j < len(queryString) && queryString[j] != c; j++ {
+				if queryString[j] == '\\' && j+1 < len(queryString) {
+					j++
+				}
+				value = append(value, queryString[j])
+			}
+			if j == len(queryString) {
+				return nil, fmt.Errorf("Unterminated string at %d", i)
+			}
+			tokens = append(tokens, token{tokString, string(value)})
+			i = j + 1
+		case c == '[':
+			j := strings.IndexByte(queryString[i:], ']')
+			if j < 0 {
+				return nil, fmt.Errorf("Unterminated table name at %d", i)
+			}
+			tokens = append(tokens, token{tokTable, queryString[i+1 : i+j]})
+			i += j + 1
+		case i+1 < len(queryString) && (queryString[i:i+2] == "<=" || queryString[i:i+2] == ">=" || queryString[i:i+2] == "!="):
+			tokens = append(tokens, token{tokSymbol, queryString[i : i+2]})
+			i += 2
+		case strings.IndexByte("(),*/+-=<>", c) >= 0:
+			tokens = append(tokens, token{tokSymbol, string(c)})
+			i++
+		default:
+			return nil, fmt.Errorf("Unexpected character %q at %d", c, i)
+		}
+	}
+	return append(tokens, token{tokEOF, ""}), nil
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// query is a parsed SELECT
+type query struct {
+	items   []*selectItem
+	from    source
+	where   expr
+	groupBy []string
+	orderBy []*ordering
+}
+
+// selectItem is an expression in a SELECT.  Aggregations are only supported at
+// the top of the expression, in which case agg is the aggregation and expr its
+// argument.
+type selectItem struct {
+	expr expr
+	agg  string
+	name string
+}
+
+type ordering struct {
+	name string
+	desc bool
+}
+
+// source is what a query selects from: a tableSource, a query or a
+// dateRangeSource
+type source interface{}
+
+type tableSource struct {
+	datasetId string
+	tableId   string
+}
+
+type dateRangeSource struct {
+	datasetId string
+	prefix    string
+	start     expr
+	end       expr
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func parse(queryString string) (*query, error) {
+	tokens, err := tokenize(queryString)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	q, err := p.query()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokEOF {
+		return nil, fmt.Errorf("Unexpected %q after query", p.peek().text)
+	}
+	return q, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// keyword consumes the given keyword if it's next
+func (p *parser) keyword(keyword string) bool {
+	if t := p.peek(); t.kind == tokIdent && strings.EqualFold(t.text, keyword) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// symbol consumes the given symbol if it's next
+func (p *parser) symbol(symbol string) bool {
+	if t := p.peek(); t.kind == tokSymbol && t.text == symbol {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expectKeyword(keyword string) error {
+	if !p.keyword(keyword) {
+		return fmt.Errorf("Expected %s, found %q", keyword, p.peek().text)
+	}
+	return nil
+}
+
+func (p *parser) expectSymbol(symbol string) error {
+	if !p.symbol(symbol) {
+		return fmt.Errorf("Expected %s, found %q", symbol, p.peek().text)
+	}
+	return nil
+}
+
+func (p *parser) name() (string, error) {
+	t := p.next()
+	if t.kind != tokIdent {
+		return "", fmt.Errorf("Expected a name, found %q", t.text)
+	}
+	return t.text, nil
+}
+
+func (p *parser) query() (q *query, err error) {
+	q = &query{}
+	if err = p.expectKeyword("SELECT"); err != nil {
+		return
+	}
+	for i := 0; i == 0 || p.symbol(","); i++ {
+		var item *selectItem
+		if item, err = p.selectItem(i); err != nil {
+			return
+		}
+		q.items = append(q.items, item)
+	}
+	if err = p.expectKeyword("FROM"); err != nil {
+		return
+	}
+	if q.from, err = p.source(); err != nil {
+		return
+	}
+	if p.keyword("WHERE") {
+		if q.where, err = p.expr(); err != nil {
+			return
+		}
+	}
+	if p.keyword("GROUP") {
+		if err = p.expectKeyword("BY"); err != nil {
+			return
+		}
+		for i := 0; i == 0 || p.symbol(","); i++ {
+			var name string
+			if name, err = p.name(); err != nil {
+				return
+			}
+			q.groupBy = append(q.groupBy, name)
+		}
+	}
+	if p.keyword("ORDER") {
+		if err = p.expectKeyword("BY"); err != nil {
+			return
+		}
+		for i := 0; i == 0 || p.symbol(","); i++ {
+			o := &ordering{}
+			if o.name, err = p.name(); err != nil {
+				return
+			}
+			if p.keyword("DESC") {
+				o.desc = true
+			} else {
+				p.keyword("ASC")
+			}
+			q.orderBy = append(q.orderBy, o)
+		}
+	}
+	return
+}
+
+func (p *parser) selectItem(i int) (item *selectItem, err error) {
+	item = &selectItem{}
+	if item.expr, err = p.expr(); err != nil {
+		return
+	}
+	if c, ok := item.expr.(*call); ok && aggregations[c.fn] {
+		if len(c.args) != 1 {
+			return nil, fmt.Errorf("%s takes 1 argument", c.fn)
+		}
+		item.agg, item.expr = c.fn, c.args[0]
+	}
+	if p.keyword("AS") {
+		item.name, err = p.name()
+	} else if col, ok := item.expr.(column); ok && item.agg == "" {
+		// Legacy SQL flattens the names of nested columns
+		item.name = strings.Replace(string(col), ".", "_", -1)
+	} else {
+		item.name = fmt.Sprintf("f%d_", i)
+	}
+	return
+}
+
+func (p *parser) source() (source, error) {
+	if t := p.peek(); t.kind == tokTable {
+		p.next()
+		return parseTableName(t.text), nil
+	}
+	if err := p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+	var s source
+	var err error
+	if p.keyword("TABLE_DATE_RANGE") {
+		s, err = p.dateRange()
+	} else {
+		s, err = p.query()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, p.expectSymbol(")")
+}
+
+func (p *parser) dateRange() (s *dateRangeSource, err error) {
+	if err = p.expectSymbol("("); err != nil {
+		return
+	}
+	t := p.next()
+	if t.kind != tokTable {
+		return nil, fmt.Errorf("Expected a table prefix, found %q", t.text)
+	}
+	prefix := parseTableName(t.text)
+	s = &dateRangeSource{datasetId: prefix.datasetId, prefix: prefix.tableId}
+	if err = p.expectSymbol(","); err != nil {
+		return
+	}
+	if s.start, err = p.expr(); err != nil {
+		return
+	}
+	if err = p.expectSymbol(","); err != nil {
+		return
+	}
+	if s.end, err = p.expr(); err != nil {
+		return
+	}
+	err = p.expectSymbol(")")
+	return
+}
+
+// parseTableName parses [project:dataset.table] or [dataset.table] or [table]
+func parseTableName(name string) *tableSource {
+	if i := strings.Index(name, ":"); i >= 0 {
+		name = name[i+1:]
+	}
+	if i := strings.Index(name, "."); i >= 0 {
+		return &tableSource{name[:i], name[i+1:]}
+	}
+	return &tableSource{"", name}
+}
+
+func (p *parser) expr() (e expr, err error) {
+	if e, err = p.comparison(); err != nil {
+		return
+	}
+	for p.keyword("AND") {
+		var right expr
+		if right, err = p.comparison(); err != nil {
+			return
+		}
+		e = &binary{"AND", e, right}
+	}
+	return
+}
+
+func (p *parser) comparison() (e expr, err error) {
+	if e, err = p.sum(); err != nil {
+		return
+	}
+	for _, op := range []string{"<=", ">=", "!=", "=", "<", ">"} {
+		if p.symbol(op) {
+			var right expr
+			if right, err = p.sum(); err != nil {
+				return
+			}
+			return &binary{op, e, right}, nil
+		}
+	}
+	return
+}
+
+func (p *parser) sum() (e expr, err error) {
+	if e, err = p.product(); err != nil {
+		return
+	}
+	for {
+		op := p.peek().text
+		if p.peek().kind != tokSymbol || (op != "+" && op != "-") {
+			return
+		}
+		p.next()
+		var right expr
+		if right, err = p.product(); err != nil {
+			return
+		}
+		e = &binary{op, e, right}
+	}
+}
+
+func (p *parser) product() (e expr, err error) {
+	if e, err = p.unary(); err != nil {
+		return
+	}
+	for {
+		op := p.peek().text
+		if p.peek().kind != tokSymbol || (op != "*" && op != "/") {
+			return
+		}
+		p.next()
+		var right expr
+		if right, err = p.unary(); err != nil {
+			return
+		}
+		e = &binary{op, e, right}
+	}
+}
+
+func (p *parser) unary() (expr, error) {
+	t := p.next()
+	switch t.kind {
+	case tokNumber:
+		if strings.Contains(t.text, ".") {
+			f, err := strconv.ParseFloat(t.text, 64)
+			return &literal{f}, err
+		}
+		i, err := strconv.ParseInt(t.text, 10, 64)
+		return &literal{i}, err
+	case tokString:
+		return &literal{t.text}, nil
+	case tokIdent:
+		if !p.symbol("(") {
+			return column(t.text), nil
+		}
+		c := &call{fn: strings.ToUpper(t.text)}
+		if p.symbol("*") {
+			// COUNT(*)
+			c.args = append(c.args, &literal{int64(1)})
+			return c, p.expectSymbol(")")
+		}
+		for !p.symbol(")") {
+			if len(c.args) > 0 {
+				if err := p.expectSymbol(","); err != nil {
+					return nil, err
+				}
+			}
+			arg, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			c.args = append(c.args, arg)
+		}
+		return c, nil
+	case tokSymbol:
+		switch t.text {
+		case "(":
+			e, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			return e, p.expectSymbol(")")
+		case "-":
+			e, err := p.unary()
+			return &binary{"-", &literal{int64(0)}, e}, err
+		}
+	}
+	return nil, fmt.Errorf("Unexpected %q", t.text)
+}
+
+// expr is an expression that's evaluated against a row, whose values are held
+// in a map by column name.
+type expr interface {
+	eval(row map[string]interface{}) (interface{}, error)
+
+	// typeIn returns the type of the expression given the types of the columns
+	typeIn(types map[string]string) string
+}
+
+type column string
+
+func (c column) eval(row map[string]interface{}) (interface{}, error) {
+	return row[string(c)], nil
+}
+
+func (c column) typeIn(types map[string]string) string {
+	return types[string(c)]
+}
+
+type literal struct {
+	value interface{}
+}
+
+func (l *literal) eval(row map[string]interface{}) (interface{}, error) {
+	return l.value, nil
+}
+
+func (l *literal) typeIn(types map[string]string) string {
+	return typeOf(l.value)
+}
+
+type binary struct {
+	op    string
+	left  expr
+	right expr
+}
+
+func (b *binary) eval(row map[string]interface{}) (interface{}, error) {
+	left, err := b.left.eval(row)
+	if err != nil {
+		return nil, err
+	}
+	right, err := b.right.eval(row)
+	if err != nil {
+		return nil, err
+	}
+	switch b.op {
+	case "AND":
+		return left == true && right == true, nil
+	case "=", "!=", "<", "<=", ">", ">=":
+		if left == nil || right == nil {
+			return false, nil
+		}
+		c := compareValues(left, right)
+		switch b.op {
+		case "=":
+			return c == 0, nil
+		case "!=":
+			return c != 0, nil
+		case "<":
+			return c < 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">":
+			return c > 0, nil
+		default:
+			return c >= 0, nil
+		}
+	}
+
+	if left == nil || right == nil {
+		return nil, nil
+	}
+	li, lInt := left.(int64)
+	ri, rInt := right.(int64)
+	if lInt && rInt && b.op != "/" {
+		switch b.op {
+		case "+":
+			return li + ri, nil
+		case "-":
+			return li - ri, nil
+		default:
+			return li * ri, nil
+		}
+	}
+	lf, lok := toFloat(left)
+	rf, rok := toFloat(right)
+	if !lok || !rok {
+		return nil, fmt.Errorf("Unable to apply %s to %v and %v", b.op, left, right)
+	}
+	switch b.op {
+	case "+":
+		return lf + rf, nil
+	case "-":
+		return lf - rf, nil
+	case "*":
+		return lf * rf, nil
+	default:
+		if rf == 0 {
+			return nil, fmt.Errorf("Division by zero")
+		}
+		return lf / rf, nil
+	}
+}
+
+func (b *binary) typeIn(types map[string]string) string {
+	switch b.op {
+	case "AND", "=", "!=", "<", "<=", ">", ">=":
+		return BOOLEAN
+	case "/":
+		return FLOAT
+	}
+	if isInteger(b.left.typeIn(types)) && isInteger(b.right.typeIn(types)) {
+		return INTEGER
+	}
+	return FLOAT
+}
+
+func isInteger(t string) bool {
+	return t == INTEGER || t == TIMESTAMP
+}
+
+type call struct {
+	fn   string
+	args []expr
+}
+
+func (c *call) eval(row map[string]interface{}) (interface{}, error) {
+	if aggregations[c.fn] {
+		return nil, fmt.Errorf("%s is only supported at the top of a selected expression", c.fn)
+	}
+	if len(c.args) != 1 {
+		return nil, fmt.Errorf("%s takes 1 argument", c.fn)
+	}
+	arg, err := c.args[0].eval(row)
+	if err != nil || arg == nil {
+		return nil, err
+	}
+	switch c.fn {
+	case "INTEGER", "TIMESTAMP_TO_SEC", "SEC_TO_TIMESTAMP":
+		if s, ok := arg.(string); ok {
+			return strconv.ParseInt(s, 10, 64)
+		}
+		f, ok := toFloat(arg)
+		if !ok {
+			return nil, fmt.Errorf("Unable to apply %s to %v", c.fn, arg)
+		}
+		return int64(f), nil
+	case "TIMESTAMP":
+		s, ok := arg.(string)
+		if !ok {
+			return nil, fmt.Errorf("Unable to apply TIMESTAMP to %v", arg)
+		}
+		return parseTimestamp(s)
+	}
+	return nil, fmt.Errorf("Unknown function %s", c.fn)
+}
+
+func (c *call) typeIn(types map[string]string) string {
+	switch c.fn {
+	case "TIMESTAMP", "SEC_TO_TIMESTAMP":
+		return TIMESTAMP
+	}
+	return INTEGER
+}
+
+func parseTimestamp(s string) (interface{}, error) {
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02", time.RFC3339} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.Unix(), nil
+		}
+	}
+	return nil, fmt.Errorf("Unable to parse timestamp %q", s)
+}
+
+func typeOf(value interface{}) string {
+	switch value.(type) {
+	case int64:
+		return INTEGER
+	case float64:
+		return FLOAT
+	case bool:
+		return BOOLEAN
+	}
+	return STRING
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// compareValues orders nil before numbers before strings
+func compareValues(a interface{}, b interface{}) int {
+	rank := func(v interface{}) int {
+		switch v.(type) {
+		case nil:
+			return 0
+		case int64, float64:
+			return 1
+		}
+		return 2
+	}
+	if ra, rb := rank(a), rank(b); ra != rb {
+		return ra - rb
+	}
+	switch av := a.(type) {
+	case nil:
+		return 0
+	case string:
+		return strings.Compare(av, b.(string))
+	}
+	af, _ := toFloat(a)
+	bf, _ := toFloat(b)
+	switch {
+	case af < bf:
+		return -1
+	case af > bf:
+		return 1
+	}
+	return 0
+}
+
+// relation is a set of rows with typed columns
+type relation struct {
+	names []string
+	types map[string]string
+	rows  []map[string]interface{}
+}
+
+// tableFunc gets the relation held in a table, returning nil if it doesn't
+// exist
+type tableFunc func(datasetId string, tableId string) *relation
+
+func (q *query) run(defaultDatasetId string, table tableFunc) (*relation, error) {
+	from, err := q.fromRelation(defaultDatasetId, table)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := from.rows
+	if q.where != nil {
+		rows = nil
+		for _, row := range from.rows {
+			matches, err := q.where.eval(row)
+			if err != nil {
+				return nil, err
+			}
+			if matches == true {
+				rows = append(rows, row)
+			}
+		}
+	}
+
+	result := &relation{types: make(map[string]string)}
+	aggregating := len(q.groupBy) > 0
+	for _, item := range q.items {
+		result.names = append(result.names, item.name)
+		switch item.agg {
+		case "":
+			result.types[item.name] = item.expr.typeIn(from.types)
+		case "AVG":
+			result.types[item.name] = FLOAT
+			aggregating = true
+		case "COUNT":
+			result.types[item.name] = INTEGER
+			aggregating = true
+		default:
+			result.types[item.name] = item.expr.typeIn(from.types)
+			aggregating = true
+		}
+	}
+
+	if aggregating {
+		result.rows, err = q.aggregate(rows)
+	} else {
+		result.rows, err = q.project(rows)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range q.orderBy {
+		if _, found := result.types[o.name]; !found {
+			return nil, fmt.Errorf("Unknown column %s in ORDER BY", o.name)
+		}
+	}
+	sort.Stable(&sortedRows{result.rows, q.orderBy})
+	return result, nil
+}
+
+func (q *query) fromRelation(defaultDatasetId string, table tableFunc) (*relation, error) {
+	switch from := q.from.(type) {
+	case *query:
+		return from.run(defaultDatasetId, table)
+	case *tableSource:
+		datasetId := from.datasetId
+		if datasetId == "" {
+			datasetId = defaultDatasetId
+		}
+		if rel := table(datasetId, from.tableId); rel != nil {
+			return rel, nil
+		}
+		return nil, fmt.Errorf("Not found: Table %s.%s", datasetId, from.tableId)
+	case *dateRangeSource:
+		return from.union(defaultDatasetId, table)
+	}
+	return nil, fmt.Errorf("Unknown source %v", q.from)
+}
+
+// union combines the tables for every day in the range
+func (s *dateRangeSource) union(defaultDatasetId string, table tableFunc) (*relation, error) {
+	var bounds [2]int64
+	for i, e := range []expr{s.start, s.end} {
+		value, err := e.eval(nil)
+		if err != nil {
+			return nil, err
+		}
+		secs, ok := value.(int64)
+		if !ok {
+			return nil, fmt.Errorf("TABLE_DATE_RANGE needs timestamps, got %v", value)
+		}
+		bounds[i] = secs
+	}
+	datasetId := s.datasetId
+	if datasetId == "" {
+		datasetId = defaultDatasetId
+	}
+
+	union := &relation{types: make(map[string]string)}
+	start := time.Unix(bounds[0], 0).In(time.UTC).Truncate(24 * time.Hour)
+	found := false
+	for day := start; day.Unix() <= bounds[1]; day = day.Add(24 * time.Hour) {
+		rel := table(datasetId, s.prefix+day.Format("20060102"))
+		if rel == nil {
+			continue
+		}
+		found = true
+		for _, name := range rel.names {
+			if _, seen := union.types[name]; !seen {
+				union.names = append(union.names, name)
+				union.types[name] = rel.types[name]
+			}
+		}
+		union.rows = append(union.rows, rel.rows...)
+	}
+	if !found {
+		return nil, fmt.Errorf("FROM clause with table wildcards matches no table: %s.%s", datasetId, s.prefix)
+	}
+	return union, nil
+}
+
+func (q *query) project(rows []map[string]interface{}) ([]map[string]interface{}, error) {
+	projected := make([]map[string]interface{}, len(rows))
+	for i, row := range rows {
+		projected[i] = make(map[string]interface{})
+		for _, item := range q.items {
+			value, err := item.expr.eval(row)
+			if err != nil {
+				return nil, err
+			}
+			projected[i][item.name] = value
+		}
+	}
+	return projected, nil
+}
+
+// group accumulates the rows that share the values of the GROUP BY columns
+type group struct {
+	row    map[string]interface{}
+	sums   map[string]float64
+	counts map[string]int64
+}
+
+func (q *query) aggregate(rows []map[string]interface{}) ([]map[string]interface{}, error) {
+	byName := make(map[string]*selectItem)
+	for _, item := range q.items {
+		byName[item.name] = item
+	}
+	for _, item := range q.items {
+		if item.agg != "" {
+			continue
+		}
+		col, isColumn := item.expr.(column)
+		if !containsString(q.groupBy, item.name) && !(isColumn && containsString(q.groupBy, string(col))) {
+			return nil, fmt.Errorf("Expression %s is neither grouped nor aggregated", item.name)
+		}
+	}
+
+	var groups []*group
+	groupsByKey := make(map[string]*group)
+	for _, row := range rows {
+		values := make(map[string]interface{})
+		for _, item := range q.items {
+			value, err := item.expr.eval(row)
+			if err != nil {
+				return nil, err
+			}
+			values[item.name] = value
+		}
+
+		keyValues := make([]interface{}, len(q.groupBy))
+		for i, name := range q.groupBy {
+			if item, found := byName[name]; found && item.agg == "" {
+				keyValues[i] = values[name]
+			} else {
+				keyValues[i] = row[name]
+			}
+		}
+		key := fmt.Sprintf("%#v", keyValues)
+		g := groupsByKey[key]
+		if g == nil {
+			g = &group{row: make(map[string]interface{}), sums: make(map[string]float64), counts: make(map[string]int64)}
+			for _, item := range q.items {
+				if item.agg == "" {
+					g.row[item.name] = values[item.name]
+				}
+			}
+			groupsByKey[key] = g
+			groups = append(groups, g)
+		}
+
+		for _, item := range q.items {
+			value := values[item.name]
+			if item.agg == "" || value == nil {
+				continue
+			}
+			current := g.row[item.name]
+			switch item.agg {
+			case "MAX":
+				if current == nil || compareValues(value, current) > 0 {
+					g.row[item.name] = value
+				}
+			case "MIN":
+				if current == nil || compareValues(value, current) < 0 {
+					g.row[item.name] = value
+				}
+			case "SUM":
+				ci, cInt := current.(int64)
+				vi, vInt := value.(int64)
+				if vInt && (current == nil || cInt) {
+					g.row[item.name] = ci + vi
+				} else {
+					cf, _ := toFloat(current)
+					vf, _ := toFloat(value)
+					g.row[item.name] = cf + vf
+				}
+			case "AVG":
+				f, _ := toFloat(value)
+				g.sums[item.name] += f
+				g.counts[item.name]++
+				g.row[item.name] = g.sums[item.name] / float64(g.counts[item.name])
+			case "COUNT":
+				g.counts[item.name]++
+				g.row[item.name] = g.counts[item.name]
+			}
+		}
+	}
+
+	aggregated := make([]map[string]interface{}, len(groups))
+	for i, g := range groups {
+		for _, item := range q.items {
+			if item.agg == "COUNT" && g.row[item.name] == nil {
+				g.row[item.name] = int64(0)
+			}
+		}
+		aggregated[i] = g.row
+	}
+	return aggregated, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+type sortedRows struct {
+	rows     []map[string]interface{}
+	ordering []*ordering
+}
+
+func (s *sortedRows) Len() int {
+	return len(s.rows)
+}
+
+func (s *sortedRows) Swap(i, j int) {
+	s.rows[i], s.rows[j] = s.rows[j], s.rows[i]
+}
+
+func (s *sortedRows) Less(i, j int) bool {
+	for _, o := range s.ordering {
+		c := compareValues(s.rows[i][o.name], s.rows[j][o.name])
+		if o.desc {
+			c = -c
+		}
+		if c != 0 {
+			return c < 0
+		}
+	}
+	return false
+}
+
+// formatValue formats a value the way the BigQuery API returns it, as a string
+func formatValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1e15 {
+			return strconv.FormatFloat(v, 'f', 1, 64)
+		}
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return fmt.Sprintf("%v", value)
+}
@@ -0,0 +1,219 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package bigquery
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// Aggregations of history queries
+	MAX = "MAX"
+	MIN = "MIN"
+	AVG = "AVG"
+	SUM = "SUM"
+
+	HISTORY_QUERY_TEMPL = `
+SELECT
+    INTEGER(TIMESTAMP_TO_SEC(_ts) / %s) AS period,
+	_dim,
+	%s(%s) AS value
+FROM %s
+WHERE
+	_ts > SEC_TO_TIMESTAMP(%s)
+    AND _ts <= SEC_TO_TIMESTAMP(%s)
+    %s
+GROUP BY period, _dim
+ORDER BY period`
+
+	DIM_WHERE_TEMPL = "AND _dim = %s"
+
+	DAY_TABLES_TEMPL   = "(TABLE_DATE_RANGE([%s.%s_], SEC_TO_TIMESTAMP(%s), SEC_TO_TIMESTAMP(%s)))"
+	LEGACY_TABLE_TEMPL = "[%s.%s]"
+
+	LEGACY_END_QUERY_TEMPL = "SELECT MAX(TIMESTAMP_TO_SEC(_ts)) AS last FROM [%s.%s]"
+)
+
+var (
+	// Aggregations are the supported aggregations of history queries
+	Aggregations = []string{MAX, MIN, AVG, SUM}
+
+	// StatTypes are the types of stats that history queries can read, which
+	// are the records of the archived rows
+	StatTypes = []string{"counter", "gauge", "gaugeCurrent", "member"}
+
+	identifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// HistoryQuery is a query for the aggregated value of a stat for every period
+// of Resolution in the time range (Start, End], for either a single key of a
+// dimension or, if DimKey is empty, all of them.
+//
+// Legacy BigQuery SQL doesn't support query parameters, so SQL validates every
+// identifier and encodes every value as a literal.  Values from clients never
+// make it into the query any other way.
+type HistoryQuery struct {
+	DimName     string
+	DimKey      string
+	StatType    string
+	StatName    string
+	Aggregation string
+	Start       time.Time
+	End         time.Time
+	Resolution  time.Duration
+
+	// Rollups indicates that the archive maintains rollup tables, which MAX
+	// queries read when they can (see archive-rollups)
+	Rollups bool
+
+	// Legacy makes the query read the legacy table named after the dimension,
+	// which archives wrote to before they used day tables, instead of the day
+	// tables.  Legacy queries never read rollups.
+	Legacy bool
+}
+
+// Validate checks that the query is well-formed, returning an error that's
+// suitable for clients if it's not.
+func (q *HistoryQuery) Validate() error {
+	if !identifierPattern.MatchString(q.DimName) {
+		return fmt.Errorf("Invalid dimension name %q, expected letters, digits and underscores", q.DimName)
+	}
+	if !identifierPattern.MatchString(q.StatName) {
+		return fmt.Errorf("Invalid stat name %q, expected letters, digits and underscores", q.StatName)
+	}
+	if !contains(StatTypes, q.StatType) {
+		return fmt.Errorf("Unknown stat type %q, expected one of %s", q.StatType, strings.Join(StatTypes, ", "))
+	}
+	if !contains(Aggregations, q.aggregation()) {
+		return fmt.Errorf("Unknown aggregation %q, expected one of %s", q.Aggregation, strings.Join(Aggregations, ", "))
+	}
+	if q.Resolution < time.Second || q.Resolution%time.Second != 0 {
+		return fmt.Errorf("Invalid resolution %s, expected a whole number of seconds", q.Resolution)
+	}
+	if !q.End.After(q.Start) {
+		return fmt.Errorf("Invalid time range, %s is not after %s", q.End, q.Start)
+	}
+	if _, err := stringLiteral(q.DimKey); err != nil {
+		return fmt.Errorf("Invalid dimension key: %s", err)
+	}
+	return nil
+}
+
+// SQL validates the query and builds its SQL
+func (q *HistoryQuery) SQL() (string, error) {
+	if err := q.Validate(); err != nil {
+		return "", err
+	}
+
+	additionalWhereClause := ""
+	if q.DimKey != "" {
+		dimKey, _ := stringLiteral(q.DimKey)
+		additionalWhereClause = fmt.Sprintf(DIM_WHERE_TEMPL, dimKey)
+	}
+	prefix, column := q.source()
+	start, end := integerLiteral(q.Start.Unix()), integerLiteral(q.End.Unix())
+	// The day tables that might hold rows in the range
+	from := fmt.Sprintf(DAY_TABLES_TEMPL, DATASET_ID, prefix, start, end)
+	if q.Legacy {
+		from = fmt.Sprintf(LEGACY_TABLE_TEMPL, DATASET_ID, prefix)
+	}
+	return fmt.Sprintf(
+		HISTORY_QUERY_TEMPL,
+		integerLiteral(int64(q.Resolution/time.Second)),
+		q.aggregation(),
+		column,
+		from,
+		start,
+		end,
+		additionalWhereClause), nil
+}
+
+// LegacyEndSQL builds the query for the time (in seconds) of the last row in
+// the legacy table of the given dimension.  Archives stopped writing to it
+// when they moved to day tables, so history before that time is only in the
+// legacy table.
+func LegacyEndSQL(dimName string) (string, error) {
+	if !identifierPattern.MatchString(dimName) {
+		return "", fmt.Errorf("Invalid dimension name %q, expected letters, digits and underscores", dimName)
+	}
+	return fmt.Sprintf(LEGACY_END_QUERY_TEMPL, DATASET_ID, dimName), nil
+}
+
+func (q *HistoryQuery) aggregation() string {
+	if q.Aggregation == "" {
+		return MAX
+	}
+	return strings.ToUpper(q.Aggregation)
+}
+
+// ReadsRollups indicates whether the query reads rollup tables rather than the
+// archived rows
+func (q *HistoryQuery) ReadsRollups() bool {
+	prefix, _ := q.source()
+	return prefix != q.DimName
+}
+
+// source returns the prefix of the day tables (or the legacy table) and the
+// column that the query should read.  Rollups hold the maximum for every period, so if there are
+// rollups, queries for the maximum read the coarsest rollup whose periods
+// evenly divide the resolution.  Other queries read the archived rows.
+func (q *HistoryQuery) source() (prefix string, column string) {
+	if q.Rollups && !q.Legacy && q.aggregation() == MAX {
+		switch {
+		case q.Resolution%(24*time.Hour) == 0:
+			return RollupPrefix(q.DimName, DAILY), q.StatType + "_" + q.StatName
+		case q.Resolution%time.Hour == 0:
+			return RollupPrefix(q.DimName, HOURLY), q.StatType + "_" + q.StatName
+		}
+	}
+	return q.DimName, q.StatType + "." + q.StatName
+}
+
+// IsMissingTables indicates whether an error from running a query means that
+// the tables that it reads don't exist
+func IsMissingTables(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "matches no table") || strings.Contains(msg, "Not found: Table")
+}
+
+// stringLiteral encodes a string as a BigQuery string literal, rejecting
+// control characters, which legacy SQL can't escape.
+func stringLiteral(value string) (string, error) {
+	for _, r := range value {
+		if unicode.IsControl(r) || r == unicode.ReplacementChar {
+			return "", fmt.Errorf("%q contains invalid characters", value)
+		}
+	}
+	escaped := strings.Replace(value, `\`, `\\`, -1)
+	escaped = strings.Replace(escaped, `'`, `\'`, -1)
+	return "'" + escaped + "'", nil
+}
+
+func integerLiteral(value int64) string {
+	return fmt.Sprintf("%d", value)
+}
+
+func contains(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
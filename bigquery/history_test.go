@@ -0,0 +1,128 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package bigquery
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+var historyEnd = time.Date(2014, 5, 8, 0, 0, 0, 0, time.UTC)
+
+func historyQuery() *HistoryQuery {
+	return &HistoryQuery{
+		DimName:    "country",
+		StatType:   "counter",
+		StatName:   "bytesGiven",
+		Start:      historyEnd.Add(-7 * 24 * time.Hour),
+		End:        historyEnd,
+		Resolution: time.Hour,
+		Rollups:    true,
+	}
+}
+
+func TestDayTables(t *testing.T) {
+	day := time.Date(2014, 5, 1, 23, 0, 0, 0, time.FixedZone("PDT", -7*60*60))
+	if table := DayTable(RollupPrefix("country", HOURLY), day); table != "country_hourly_20140502" {
+		t.Errorf("Day tables should use UTC dates: %s", table)
+	}
+}
+
+func TestHistoryQuery(t *testing.T) {
+	q := historyQuery()
+	q.DimKey = `es' OR 'a' = 'a`
+	query, err := q.SQL()
+	if err != nil {
+		t.Fatalf("Unable to build query: %s", err)
+	}
+	expected := `
+SELECT
+    INTEGER(TIMESTAMP_TO_SEC(_ts) / 3600) AS period,
+	_dim,
+	MAX(counter_bytesGiven) AS value
+FROM (TABLE_DATE_RANGE([statshub.country_hourly_], SEC_TO_TIMESTAMP(1398902400), SEC_TO_TIMESTAMP(1399507200)))
+WHERE
+	_ts > SEC_TO_TIMESTAMP(1398902400)
+    AND _ts <= SEC_TO_TIMESTAMP(1399507200)
+    AND _dim = 'es\' OR \'a\' = \'a'
+GROUP BY period, _dim
+ORDER BY period`
+	if query != expected {
+		t.Errorf("Wrong query.  Expected:%s\nGot:%s", expected, query)
+	}
+}
+
+func TestHistoryQueryUsesCoarsestRollup(t *testing.T) {
+	for _, test := range []struct {
+		resolution  time.Duration
+		aggregation string
+		expected    string
+	}{
+		{7 * 24 * time.Hour, "", "MAX(counter_bytesGiven) AS value\nFROM (TABLE_DATE_RANGE([statshub.country_daily_]"},
+		{24 * time.Hour, "max", "MAX(counter_bytesGiven) AS value\nFROM (TABLE_DATE_RANGE([statshub.country_daily_]"},
+		{time.Hour, MAX, "MAX(counter_bytesGiven) AS value\nFROM (TABLE_DATE_RANGE([statshub.country_hourly_]"},
+		{5 * time.Minute, MAX, "MAX(counter.bytesGiven) AS value\nFROM (TABLE_DATE_RANGE([statshub.country_]"},
+		{24 * time.Hour, AVG, "AVG(counter.bytesGiven) AS value\nFROM (TABLE_DATE_RANGE([statshub.country_]"},
+	} {
+		q := historyQuery()
+		q.Resolution = test.resolution
+		q.Aggregation = test.aggregation
+		query, err := q.SQL()
+		if err != nil {
+			t.Fatalf("Unable to build query: %s", err)
+		}
+		if !strings.Contains(query, test.expected) {
+			t.Errorf("Wrong table for %s %s: %s", test.aggregation, test.resolution, query)
+		}
+		if q.ReadsRollups() != strings.Contains(test.expected, "ly_") {
+			t.Errorf("Wrong ReadsRollups for %s %s", test.aggregation, test.resolution)
+		}
+	}
+
+	// Without rollups, every query reads the archived rows
+	q := historyQuery()
+	q.Rollups = false
+	query, _ := q.SQL()
+	if !strings.Contains(query, "MAX(counter.bytesGiven) AS value\nFROM (TABLE_DATE_RANGE([statshub.country_]") || q.ReadsRollups() {
+		t.Errorf("Query without rollups shouldn't read them: %s", query)
+	}
+
+	// Legacy queries read the legacy table, even with rollups
+	q = historyQuery()
+	q.Legacy = true
+	query, _ = q.SQL()
+	if !strings.Contains(query, "MAX(counter.bytesGiven) AS value\nFROM [statshub.country]\n") || q.ReadsRollups() {
+		t.Errorf("Legacy query should read the legacy table: %s", query)
+	}
+}
+
+func TestInvalidHistoryQueries(t *testing.T) {
+	for expected, modify := range map[string]func(q *HistoryQuery){
+		`Invalid dimension name "country]"`:      func(q *HistoryQuery) { q.DimName = "country]" },
+		`Invalid stat name "a.b"`:                func(q *HistoryQuery) { q.StatName = "a.b" },
+		`Unknown stat type "ids"`:                func(q *HistoryQuery) { q.StatType = "ids" },
+		`Unknown aggregation "DROP"`:             func(q *HistoryQuery) { q.Aggregation = "DROP" },
+		`Invalid resolution 1.5s`:                func(q *HistoryQuery) { q.Resolution = 1500 * time.Millisecond },
+		`Invalid time range`:                     func(q *HistoryQuery) { q.Start = q.End },
+		`Invalid dimension key: "es\n" contains`: func(q *HistoryQuery) { q.DimKey = "es\n" },
+	} {
+		q := historyQuery()
+		modify(q)
+		if _, err := q.SQL(); err == nil || !strings.HasPrefix(err.Error(), expected) {
+			t.Errorf("Expected error starting with %s, got %v", expected, err)
+		}
+	}
+}
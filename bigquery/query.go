@@ -1,46 +1,230 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
 package bigquery
 
 import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
 	bigquery "code.google.com/p/ox-google-api-go-client/bigquery/v2"
 )
 
-// Query runs the given queryString and returns the result rows
-func Query(queryString string, maxResults int64) (rows [][]interface{}, err error) {
-	var service *bigquery.Service
-	service, err = Connect()
+const (
+	DefaultPageSize     = 10000
+	DefaultQueryTimeout = 5 * time.Minute
+	DefaultPollTimeout  = 10 * time.Second
+)
+
+var (
+	// ErrQueryCanceled is the error of queries that were canceled.  The
+	// vendored BigQuery API can't cancel jobs, so canceled queries still run to
+	// completion, their results just aren't read.
+	ErrQueryCanceled = errors.New("Query canceled")
+)
+
+// QueryOptions configures a query.  Zero values are replaced with defaults.
+type QueryOptions struct {
+	// PageSize is the maximum number of rows fetched per request
+	PageSize int64
+
+	// MaxRows limits the number of rows read, 0 reads them all
+	MaxRows int64
+
+	// Timeout is how long the query, including reading all of its results, is
+	// allowed to take
+	Timeout time.Duration
+
+	// PollTimeout is how long each request waits for an incomplete query to
+	// complete before polling again
+	PollTimeout time.Duration
+
+	// Cancel cancels the query when it's closed
+	Cancel <-chan bool
+}
+
+// resultsFunc fetches the page of results with the given token (the first
+// page for ""), waiting up to timeout for the query to complete.
+type resultsFunc func(pageToken string, timeout time.Duration) (*bigquery.GetQueryResultsResponse, error)
+
+// Rows iterates over the results of a query, polling until the query completes
+// and then fetching one page at a time:
+//
+//	rows, err := QueryRows(client, query, QueryOptions{})
+//	...
+//	defer rows.Close()
+//	for rows.Next() {
+//	    row := rows.Row()
+//	    ...
+//	}
+//	if rows.Err() != nil {
+//	    ...
+//	}
+type Rows struct {
+	opts      QueryOptions
+	results   resultsFunc
+	now       func() time.Time
+	deadline  time.Time
+	closed    chan bool
+	closeOnce sync.Once
+	complete  bool
+	page      []*bigquery.TableRow
+	pos       int
+	pageToken string
+	row       []interface{}
+	read      int64
+	err       error
+}
+
+// QueryRows starts running the given query against the statshub dataset with
+// the given Client and returns an iterator over its results.
+func QueryRows(c Client, queryString string, opts QueryOptions) (*Rows, error) {
+	rows := newRows(nil, opts)
+	rows.results = clientResults(c, queryString, rows.opts.PageSize)
+	return rows, nil
+}
+
+// Query runs the given query against the statshub dataset with the given
+// Client and returns up to maxResults of its rows.
+func Query(c Client, queryString string, maxResults int64) (rows [][]interface{}, err error) {
+	var it *Rows
+	it, err = QueryRows(c, queryString, QueryOptions{MaxRows: maxResults})
 	if err != nil {
 		return
 	}
+	defer it.Close()
+	for it.Next() {
+		rows = append(rows, it.Row())
+	}
+	err = it.Err()
+	return
+}
 
-	req := &bigquery.QueryRequest{
-		DefaultDataset: &bigquery.DatasetReference{
-			DatasetId: DATASET_ID,
-			ProjectId: ProjectId,
-		},
-		Query:      queryString,
-		Kind:       "json",
-		MaxResults: maxResults,
+func newRows(results resultsFunc, opts QueryOptions) *Rows {
+	if opts.PageSize <= 0 {
+		opts.PageSize = DefaultPageSize
 	}
-	jobsService := bigquery.NewJobsService(service)
-	var resp *bigquery.QueryResponse
-	resp, err = jobsService.Query(ProjectId, req).Do()
-	if err != nil {
-		return
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultQueryTimeout
+	}
+	if opts.PollTimeout <= 0 {
+		opts.PollTimeout = DefaultPollTimeout
+	}
+	rows := &Rows{
+		opts:    opts,
+		results: results,
+		now:     time.Now,
+		closed:  make(chan bool),
 	}
+	rows.deadline = rows.now().Add(opts.Timeout)
+	return rows
+}
 
-	numRows := int(resp.TotalRows)
-	if numRows > int(maxResults) {
-		numRows = int(maxResults)
+// clientResults fetches results using the given Client.  The first request
+// starts the query and later ones read the results of its job.
+func clientResults(c Client, queryString string, pageSize int64) resultsFunc {
+	var jobId string
+	return func(pageToken string, timeout time.Duration) (*bigquery.GetQueryResultsResponse, error) {
+		if jobId != "" {
+			return c.GetQueryResults(ProjectId, jobId, pageToken, pageSize, timeout)
+		}
+		resp, err := c.StartQuery(ProjectId, DATASET_ID, queryString, pageSize, timeout)
+		if err == nil && resp.JobReference != nil {
+			jobId = resp.JobReference.JobId
+		}
+		return resp, err
+	}
+}
+
+// Next advances to the next row, returning false when there are no more rows
+// or reading them failed, in which case Err returns the error.
+func (rows *Rows) Next() bool {
+	if rows.err != nil || (rows.opts.MaxRows > 0 && rows.read >= rows.opts.MaxRows) {
+		return false
+	}
+	select {
+	case <-rows.closed:
+		return false
+	default:
 	}
-	rows = make([][]interface{}, numRows)
-	for r := 0; r < int(numRows); r++ {
-		numColumns := len(resp.Schema.Fields)
-		dataRow := resp.Rows[r]
-		row := make([]interface{}, numColumns)
-		for c := 0; c < numColumns; c++ {
-			row[c] = dataRow.F[c].V
+	for rows.pos >= len(rows.page) {
+		if rows.complete && rows.pageToken == "" {
+			return false
+		}
+		if rows.err = rows.fetch(); rows.err != nil {
+			return false
 		}
-		rows[r] = row
 	}
-	return
+
+	dataRow := rows.page[rows.pos]
+	rows.row = make([]interface{}, len(dataRow.F))
+	for c, cell := range dataRow.F {
+		rows.row[c] = cell.V
+	}
+	rows.pos++
+	rows.read++
+	return true
+}
+
+// fetch fetches the next page of results, or polls the query once if it
+// hasn't completed yet.
+func (rows *Rows) fetch() error {
+	select {
+	case <-rows.opts.Cancel:
+		return ErrQueryCanceled
+	default:
+	}
+	remaining := rows.deadline.Sub(rows.now())
+	if remaining <= 0 {
+		return fmt.Errorf("Query timed out after %s", rows.opts.Timeout)
+	}
+	wait := rows.opts.PollTimeout
+	if wait > remaining {
+		wait = remaining
+	}
+
+	resp, err := rows.results(rows.pageToken, wait)
+	if err != nil {
+		return fmt.Errorf("Unable to get query results: %s", err)
+	}
+	if !resp.JobComplete {
+		return nil
+	}
+	rows.complete = true
+	rows.page = resp.Rows
+	rows.pos = 0
+	rows.pageToken = resp.PageToken
+	return nil
+}
+
+// Row returns the values of the current row
+func (rows *Rows) Row() []interface{} {
+	return rows.row
+}
+
+// Err returns the error, if any, that stopped the iteration.  Stopping early
+// because of MaxRows isn't an error.
+func (rows *Rows) Err() error {
+	return rows.err
+}
+
+// Close stops the iteration, after which Next returns false.  Use
+// QueryOptions.Cancel to cancel a query from another goroutine.
+func (rows *Rows) Close() {
+	rows.closeOnce.Do(func() {
+		close(rows.closed)
+	})
 }
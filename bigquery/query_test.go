@@ -0,0 +1,120 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package bigquery
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	bigquery "code.google.com/p/ox-google-api-go-client/bigquery/v2"
+)
+
+// pagedResults returns results that are incomplete for the given number of
+// polls and then come in the given pages
+func pagedResults(incompletePolls int, pages ...[]string) (resultsFunc, *[]string) {
+	var requests []string
+	return func(pageToken string, timeout time.Duration) (*bigquery.GetQueryResultsResponse, error) {
+		requests = append(requests, pageToken)
+		if incompletePolls > 0 {
+			incompletePolls--
+			return &bigquery.GetQueryResultsResponse{}, nil
+		}
+		page := 0
+		if pageToken != "" {
+			page = int(pageToken[0] - '0')
+		}
+		resp := &bigquery.GetQueryResultsResponse{JobComplete: true, TotalRows: 100}
+		for _, value := range pages[page] {
+			resp.Rows = append(resp.Rows, &bigquery.TableRow{F: []*bigquery.TableCell{&bigquery.TableCell{V: value}}})
+		}
+		if page < len(pages)-1 {
+			resp.PageToken = string('0' + byte(page+1))
+		}
+		return resp, nil
+	}, &requests
+}
+
+func readAll(rows *Rows) []string {
+	var values []string
+	for rows.Next() {
+		values = append(values, rows.Row()[0].(string))
+	}
+	return values
+}
+
+func TestRowsPollAndPage(t *testing.T) {
+	results, requests := pagedResults(2, []string{"a", "b"}, []string{}, []string{"c"})
+	rows := newRows(results, QueryOptions{})
+	values := readAll(rows)
+	if rows.Err() != nil {
+		t.Fatalf("Unexpected error: %s", rows.Err())
+	}
+	if strings.Join(values, ",") != "a,b,c" {
+		t.Errorf("Wrong rows, TotalRows shouldn't matter: %v", values)
+	}
+	if strings.Join(*requests, ",") != ",,,1,2" {
+		t.Errorf("Should have polled twice and then fetched 3 pages: %v", *requests)
+	}
+}
+
+func TestRowsMaxRows(t *testing.T) {
+	results, requests := pagedResults(0, []string{"a", "b"}, []string{"c"})
+	rows := newRows(results, QueryOptions{MaxRows: 2})
+	if values := readAll(rows); strings.Join(values, ",") != "a,b" || rows.Err() != nil {
+		t.Errorf("Should have stopped after 2 rows: %v %v", values, rows.Err())
+	}
+	if len(*requests) != 1 {
+		t.Errorf("Shouldn't have fetched the second page")
+	}
+}
+
+func TestRowsTimeout(t *testing.T) {
+	results, _ := pagedResults(1000, []string{"a"})
+	rows := newRows(results, QueryOptions{Timeout: time.Minute})
+	start := rows.now()
+	polls := 0
+	rows.now = func() time.Time {
+		polls++
+		return start.Add(time.Duration(polls) * 10 * time.Second)
+	}
+	if rows.Next() {
+		t.Fatalf("Shouldn't have gotten a row")
+	}
+	if rows.Err() == nil || rows.Err().Error() != "Query timed out after 1m0s" {
+		t.Errorf("Wrong error: %v", rows.Err())
+	}
+}
+
+func TestRowsCancel(t *testing.T) {
+	cancel := make(chan bool)
+	results, _ := pagedResults(0, []string{"a"}, []string{"b"})
+	rows := newRows(results, QueryOptions{Cancel: cancel})
+	if !rows.Next() {
+		t.Fatalf("Should have gotten the first row: %v", rows.Err())
+	}
+	close(cancel)
+	if rows.Next() || rows.Err() != ErrQueryCanceled {
+		t.Errorf("Should have been canceled: %v", rows.Err())
+	}
+
+	results, _ = pagedResults(0, []string{"a", "b"})
+	rows = newRows(results, QueryOptions{})
+	rows.Next()
+	rows.Close()
+	if rows.Next() {
+		t.Errorf("Shouldn't get rows after closing")
+	}
+}
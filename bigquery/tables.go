@@ -0,0 +1,41 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package bigquery
+
+import (
+	"time"
+)
+
+const (
+	// HOURLY and DAILY are the resolutions of the rollup tables
+	HOURLY = "hourly"
+	DAILY  = "daily"
+
+	dayFormat = "20060102"
+)
+
+// DayTable returns the name of the table that holds the rows for the given
+// day of the given table prefix, e.g. country_20140501.  Prefixes are either
+// dimension names, whose tables hold archived rows, or the RollupPrefix of a
+// dimension.  Day tables can be queried together with TABLE_DATE_RANGE.
+func DayTable(prefix string, day time.Time) string {
+	return prefix + "_" + day.UTC().Format(dayFormat)
+}
+
+// RollupPrefix returns the prefix of the tables that hold the rollups of the
+// given dimension at the given resolution, e.g. country_hourly.
+func RollupPrefix(dimName string, resolution string) string {
+	return dimName + "_" + resolution
+}
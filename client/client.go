@@ -0,0 +1,420 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package client is a client for statshub.  It buffers stats updates locally
+// and posts them in batches, retrying with backoff if statshub can't be
+// reached.
+//
+// Example:
+//
+//	c := client.New(&client.Options{Addr: "http://localhost:9000", Id: "myid1"})
+//	defer c.Close()
+//	dims := map[string]string{"country": "es"}
+//	c.Increment(dims, "requests", 1)
+//	c.SetGauge(dims, "online", 5)
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/statshub/statshub"
+)
+
+const (
+	DefaultFlushInterval  = 1 * time.Minute
+	DefaultMaxPending     = 1000
+	DefaultMaxRetries     = 3
+	DefaultInitialBackoff = 1 * time.Second
+	DefaultMaxBackoff     = 30 * time.Second
+	DefaultTimeout        = 30 * time.Second
+)
+
+// Options configures a Client.  Zero values are replaced with defaults.
+type Options struct {
+	// Addr is the base URL of statshub, e.g. http://localhost:9000
+	Addr string
+
+	// Id is the stat id under which this client's stats are posted
+	Id string
+
+	// FlushInterval is how frequently buffered stats are posted
+	FlushInterval time.Duration
+
+	// MaxPending is the number of buffered stat values that triggers a flush
+	// before the FlushInterval is up
+	MaxPending int
+
+	// MaxRetries is how many times a failed post is retried.  Only posts that
+	// provably weren't applied, because statshub couldn't be connected to, are
+	// retried, unless RetryServerErrors is set.
+	MaxRetries int
+
+	// RetryServerErrors also retries posts that failed with a server error or
+	// after they were sent.  statshub may already have applied those, so
+	// retrying them can count Increments twice: they're delivered at least
+	// once rather than at most once.
+	RetryServerErrors bool
+
+	// InitialBackoff is how long to wait before the first retry, doubling on
+	// every subsequent retry up to MaxBackoff
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// HTTPClient is the http.Client used to talk to statshub
+	HTTPClient *http.Client
+
+	// AdminToken is sent as the bearer token of requests made with Do, which
+	// the admin endpoints require
+	AdminToken string
+}
+
+// Client posts stats to and queries stats from statshub
+type Client struct {
+	opts       Options
+	mutex      sync.Mutex
+	pending    map[string]*statshub.StatsUpdate
+	numPending int
+	flushNow   chan bool
+	closed     chan bool
+	done       chan bool
+	closeOnce  sync.Once
+}
+
+// New creates a Client and starts flushing buffered stats in the background.
+func New(opts *Options) *Client {
+	client := &Client{
+		opts:     *opts,
+		pending:  make(map[string]*statshub.StatsUpdate),
+		flushNow: make(chan bool, 1),
+		closed:   make(chan bool),
+		done:     make(chan bool),
+	}
+	client.opts.Addr = strings.TrimRight(client.opts.Addr, "/")
+	if client.opts.FlushInterval <= 0 {
+		client.opts.FlushInterval = DefaultFlushInterval
+	}
+	if client.opts.MaxPending <= 0 {
+		client.opts.MaxPending = DefaultMaxPending
+	}
+	if client.opts.MaxRetries < 0 {
+		client.opts.MaxRetries = 0
+	} else if client.opts.MaxRetries == 0 {
+		client.opts.MaxRetries = DefaultMaxRetries
+	}
+	if client.opts.InitialBackoff <= 0 {
+		client.opts.InitialBackoff = DefaultInitialBackoff
+	}
+	if client.opts.MaxBackoff <= 0 {
+		client.opts.MaxBackoff = DefaultMaxBackoff
+	}
+	if client.opts.HTTPClient == nil {
+		client.opts.HTTPClient = &http.Client{Timeout: DefaultTimeout}
+	}
+	go client.flushPeriodically()
+	return client
+}
+
+// Increment increments the named counter by delta
+func (client *Client) Increment(dims map[string]string, name string, delta int64) {
+	client.record(dims, func(update *statshub.StatsUpdate) bool {
+		_, existed := update.Increments[name]
+		update.Increments[name] += delta
+		return !existed
+	})
+}
+
+// SetCounter sets the named counter to val
+func (client *Client) SetCounter(dims map[string]string, name string, val int64) {
+	client.record(dims, func(update *statshub.StatsUpdate) bool {
+		_, existed := update.Counters[name]
+		update.Counters[name] = val
+		return !existed
+	})
+}
+
+// SetGauge sets the named gauge to val
+func (client *Client) SetGauge(dims map[string]string, name string, val int64) {
+	client.record(dims, func(update *statshub.StatsUpdate) bool {
+		_, existed := update.Gauges[name]
+		update.Gauges[name] = val
+		return !existed
+	})
+}
+
+// AddMember records member as a member of the named set
+func (client *Client) AddMember(dims map[string]string, name string, member string) {
+	client.record(dims, func(update *statshub.StatsUpdate) bool {
+		for _, existing := range update.MultiMembers[name] {
+			if existing == member {
+				return false
+			}
+		}
+		update.MultiMembers[name] = append(update.MultiMembers[name], member)
+		return true
+	})
+}
+
+// record applies a change to the buffered update for the given dims.  change
+// returns true if it added a new value to the buffer.
+func (client *Client) record(dims map[string]string, change func(update *statshub.StatsUpdate) bool) {
+	client.mutex.Lock()
+	key := dimsKey(dims)
+	update := client.pending[key]
+	if update == nil {
+		update = &statshub.StatsUpdate{
+			Dims: copyDims(dims),
+			Stats: statshub.Stats{
+				Counters:     make(map[string]int64),
+				Increments:   make(map[string]int64),
+				Gauges:       make(map[string]int64),
+				MultiMembers: make(map[string][]string),
+			},
+		}
+		client.pending[key] = update
+	}
+	if change(update) {
+		client.numPending++
+	}
+	full := client.numPending >= client.opts.MaxPending
+	client.mutex.Unlock()
+
+	if full {
+		select {
+		case client.flushNow <- true:
+		default:
+			// Flush already requested
+		}
+	}
+}
+
+// Flush immediately posts all buffered stats.  Updates that still fail after
+// retrying are dropped and reported in the returned error.
+func (client *Client) Flush() error {
+	client.mutex.Lock()
+	pending := client.pending
+	client.pending = make(map[string]*statshub.StatsUpdate)
+	client.numPending = 0
+	client.mutex.Unlock()
+
+	var failures []string
+	for _, update := range pending {
+		if err := client.Post(client.opts.Id, update); err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("Unable to post %d of %d updates: %s", len(failures), len(pending), strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// Close stops the background flushing and flushes any remaining stats.
+func (client *Client) Close() error {
+	client.closeOnce.Do(func() {
+		close(client.closed)
+	})
+	<-client.done
+	return client.Flush()
+}
+
+func (client *Client) flushPeriodically() {
+	defer close(client.done)
+	for {
+		select {
+		case <-time.After(client.opts.FlushInterval):
+		case <-client.flushNow:
+		case <-client.closed:
+			return
+		}
+		if err := client.Flush(); err != nil {
+			log.Printf("Unable to flush stats: %s", err)
+		}
+	}
+}
+
+// Post posts a single StatsUpdate for the given id, retrying with backoff if
+// statshub couldn't be connected to (and on any network or server error with
+// RetryServerErrors).
+func (client *Client) Post(id string, update *statshub.StatsUpdate) error {
+	body, err := json.Marshal(update)
+	if err != nil {
+		return fmt.Errorf("Unable to encode update: %s", err)
+	}
+	statsURL := client.opts.Addr + "/stats/" + escapePath(id)
+
+	backoff := client.opts.InitialBackoff
+	for attempt := 0; ; attempt++ {
+		var retryable bool
+		retryable, err = client.doPost(statsURL, body)
+		if err == nil || !retryable || attempt >= client.opts.MaxRetries {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > client.opts.MaxBackoff {
+			backoff = client.opts.MaxBackoff
+		}
+	}
+}
+
+func (client *Client) doPost(statsURL string, body []byte) (retryable bool, err error) {
+	resp, err := client.opts.HTTPClient.Post(statsURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return isDialError(err) || client.opts.RetryServerErrors, fmt.Errorf("Unable to post to %s: %s", statsURL, err)
+	}
+	defer resp.Body.Close()
+
+	result := &statshub.Response{}
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	if err := json.Unmarshal(respBody, result); err != nil {
+		result.Error = strings.TrimSpace(string(respBody))
+	}
+	if resp.StatusCode != 200 {
+		return resp.StatusCode >= 500 && client.opts.RetryServerErrors, fmt.Errorf("Unexpected status %d posting to %s: %s", resp.StatusCode, statsURL, result.Error)
+	}
+	if !result.Succeeded {
+		return false, fmt.Errorf("Unable to post to %s: %s", statsURL, result.Error)
+	}
+	return false, nil
+}
+
+// isDialError indicates whether an error from an http.Client means that it
+// couldn't connect, in which case the request can't have been applied.
+func isDialError(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	opErr, ok := err.(*net.OpError)
+	return ok && opErr.Op == "dial"
+}
+
+// Query queries the stats for the given dimension (or all dimensions if dim
+// is empty).
+func (client *Client) Query(dim string) (map[string]map[string]*statshub.Stats, error) {
+	queryURL := client.opts.Addr + "/stats/" + escapePath(dim)
+	resp, err := client.opts.HTTPClient.Get(queryURL)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to query %s: %s", queryURL, err)
+	}
+	defer resp.Body.Close()
+
+	result := &statshub.ClientQueryResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return nil, fmt.Errorf("Unable to decode response from %s (status %d): %s", queryURL, resp.StatusCode, err)
+	}
+	if !result.Succeeded {
+		return nil, fmt.Errorf("Query of %s failed: %s", queryURL, result.Error)
+	}
+	return result.Dims, nil
+}
+
+// QueryIds queries the detail stats for the given id (or all ids if id is
+// empty).
+func (client *Client) QueryIds(id string) (map[string]*statshub.Stats, error) {
+	queryURL := client.opts.Addr + "/ids/" + escapePath(id)
+	resp, err := client.opts.HTTPClient.Get(queryURL)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to query %s: %s", queryURL, err)
+	}
+	defer resp.Body.Close()
+
+	result := &statshub.IdQueryResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return nil, fmt.Errorf("Unable to decode response from %s (status %d): %s", queryURL, resp.StatusCode, err)
+	}
+	if !result.Succeeded {
+		return nil, fmt.Errorf("Query of %s failed: %s", queryURL, result.Error)
+	}
+	return result.Ids, nil
+}
+
+// Export queries the stats for the given dimension (or all dimensions if dim
+// is empty) in the given format (csv or ndjson), copying the result to out.
+func (client *Client) Export(dim string, format string, out io.Writer) error {
+	exportURL := client.opts.Addr + "/stats/" + escapePath(dim) + "?format=" + url.QueryEscape(format)
+	resp, err := client.opts.HTTPClient.Get(exportURL)
+	if err != nil {
+		return fmt.Errorf("Unable to query %s: %s", exportURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		result := &statshub.Response{}
+		json.NewDecoder(resp.Body).Decode(result)
+		return fmt.Errorf("Unexpected status %d querying %s: %s", resp.StatusCode, exportURL, result.Error)
+	}
+	_, err = io.Copy(out, resp.Body)
+	return err
+}
+
+// Do sends a request without a body to the given path of statshub (e.g.
+// /admin/archive/spool) and decodes its JSON response into result.
+func (client *Client) Do(method string, path string, result interface{}) error {
+	reqURL := client.opts.Addr + path
+	req, err := http.NewRequest(method, reqURL, nil)
+	if err != nil {
+		return fmt.Errorf("Unable to build request for %s: %s", reqURL, err)
+	}
+	if client.opts.AdminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+client.opts.AdminToken)
+	}
+	resp, err := client.opts.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("Unable to %s %s: %s", method, reqURL, err)
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("Unable to decode response from %s (status %d): %s", reqURL, resp.StatusCode, err)
+	}
+	return nil
+}
+
+func dimsKey(dims map[string]string) string {
+	names := make([]string, 0, len(dims))
+	for name := range dims {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = name + "=" + dims[name]
+	}
+	return strings.Join(parts, "|")
+}
+
+func copyDims(dims map[string]string) map[string]string {
+	copied := make(map[string]string)
+	for name, value := range dims {
+		copied[name] = value
+	}
+	return copied
+}
+
+// escapePath escapes a single path segment
+func escapePath(segment string) string {
+	return strings.Replace(url.QueryEscape(segment), "+", "%20", -1)
+}
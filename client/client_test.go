@@ -0,0 +1,315 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"code.google.com/p/go.net/websocket"
+
+	"github.com/getlantern/statshub/statshub"
+)
+
+func TestFlushBatchesAndRetries(t *testing.T) {
+	var mutex sync.Mutex
+	attempts := 0
+	var received []*statshub.StatsUpdate
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if r.URL.Path != "/stats/myid1" {
+			t.Errorf("Wrong path: %s", r.URL.Path)
+		}
+		attempts++
+		if attempts == 1 {
+			// Fail the first attempt to force a retry
+			w.WriteHeader(500)
+			json.NewEncoder(w).Encode(&statshub.Response{Error: "Unavailable"})
+			return
+		}
+		update := &statshub.StatsUpdate{}
+		if err := json.NewDecoder(r.Body).Decode(update); err != nil {
+			t.Errorf("Unable to decode update: %s", err)
+		}
+		received = append(received, update)
+		json.NewEncoder(w).Encode(&statshub.Response{Succeeded: true})
+	}))
+	defer server.Close()
+
+	c := New(&Options{
+		Addr:              server.URL,
+		Id:                "myid1",
+		FlushInterval:     time.Hour,
+		InitialBackoff:    time.Millisecond,
+		RetryServerErrors: true,
+	})
+	dims := map[string]string{"country": "es"}
+	c.Increment(dims, "requests", 2)
+	c.Increment(dims, "requests", 3)
+	c.SetGauge(dims, "online", 5)
+	c.AddMember(dims, "users", "bob")
+	c.AddMember(dims, "users", "bob")
+	if err := c.Close(); err != nil {
+		t.Fatalf("Unable to close: %s", err)
+	}
+
+	if attempts != 2 {
+		t.Errorf("Expected 2 attempts, got %d", attempts)
+	}
+	if len(received) != 1 {
+		t.Fatalf("Expected 1 update, got %d", len(received))
+	}
+	update := received[0]
+	if update.Dims["country"] != "es" {
+		t.Errorf("Wrong dims: %v", update.Dims)
+	}
+	if update.Increments["requests"] != 5 {
+		t.Errorf("Wrong increments: %v", update.Increments)
+	}
+	if update.Gauges["online"] != 5 {
+		t.Errorf("Wrong gauges: %v", update.Gauges)
+	}
+	if len(update.MultiMembers["users"]) != 1 {
+		t.Errorf("Wrong members: %v", update.MultiMembers)
+	}
+}
+
+func TestFlushOnMaxPending(t *testing.T) {
+	posted := make(chan bool, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&statshub.Response{Succeeded: true})
+		posted <- true
+	}))
+	defer server.Close()
+
+	c := New(&Options{
+		Addr:          server.URL,
+		Id:            "myid1",
+		FlushInterval: time.Hour,
+		MaxPending:    2,
+	})
+	defer c.Close()
+	c.SetCounter(map[string]string{"country": "es"}, "bytes", 1)
+	c.SetCounter(map[string]string{"country": "de"}, "bytes", 1)
+
+	select {
+	case <-posted:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Reaching MaxPending should have triggered a flush")
+	}
+}
+
+func TestNoRetryOnClientError(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(&statshub.Response{Error: "Bad request"})
+	}))
+	defer server.Close()
+
+	c := New(&Options{Addr: server.URL, Id: "myid1", InitialBackoff: time.Millisecond})
+	defer c.Close()
+	if err := c.Post("myid1", &statshub.StatsUpdate{}); err == nil {
+		t.Errorf("Post should have failed")
+	}
+	if attempts != 1 {
+		t.Errorf("Client errors should not be retried, got %d attempts", attempts)
+	}
+}
+
+// countingTransport counts the requests that it's asked to make
+type countingTransport struct {
+	attempts int
+}
+
+func (transport *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport.attempts++
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestRetryOnlyUnappliedPosts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(500)
+		json.NewEncoder(w).Encode(&statshub.Response{Error: "Unavailable"})
+	}))
+	defer server.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	for _, test := range []struct {
+		addr              string
+		retryServerErrors bool
+		expectedAttempts  int
+	}{
+		// The update may have been applied
+		{server.URL, false, 1},
+		{server.URL, true, 3},
+		// Nothing was sent
+		{closed.URL, false, 3},
+	} {
+		transport := &countingTransport{}
+		c := New(&Options{
+			Addr:              test.addr,
+			Id:                "myid1",
+			MaxRetries:        2,
+			InitialBackoff:    time.Millisecond,
+			HTTPClient:        &http.Client{Transport: transport},
+			RetryServerErrors: test.retryServerErrors,
+		})
+		if err := c.Post("myid1", &statshub.StatsUpdate{}); err == nil {
+			t.Errorf("Post to %s should have failed", test.addr)
+		}
+		if transport.attempts != test.expectedAttempts {
+			t.Errorf("Expected %d attempts to %s with RetryServerErrors %v, got %d", test.expectedAttempts, test.addr, test.retryServerErrors, transport.attempts)
+		}
+		c.Close()
+	}
+}
+
+func TestQuery(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/stats/country" {
+			t.Errorf("Wrong path: %s", r.URL.Path)
+		}
+		json.NewEncoder(w).Encode(&statshub.ClientQueryResponse{
+			Response: statshub.Response{Succeeded: true},
+			Dims: map[string]map[string]*statshub.Stats{
+				"country": map[string]*statshub.Stats{
+					"es": &statshub.Stats{Counters: map[string]int64{"bytes": 5}},
+				},
+			},
+		})
+	}))
+	defer server.Close()
+
+	c := New(&Options{Addr: server.URL, Id: "myid1"})
+	defer c.Close()
+	dims, err := c.Query("country")
+	if err != nil {
+		t.Fatalf("Unable to query: %s", err)
+	}
+	if dims["country"]["es"].Counters["bytes"] != 5 {
+		t.Errorf("Wrong result: %v", dims)
+	}
+}
+
+func TestDo(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/admin/archive/spool" || r.Header.Get("Authorization") != "Bearer secret" {
+			t.Errorf("Wrong request: %s %s %s", r.Method, r.URL.Path, r.Header.Get("Authorization"))
+		}
+		json.NewEncoder(w).Encode(&statshub.Response{Succeeded: true})
+	}))
+	defer server.Close()
+
+	c := New(&Options{Addr: server.URL + "/", Id: "myid1", AdminToken: "secret"})
+	defer c.Close()
+	result := &statshub.Response{}
+	if err := c.Do("POST", "/admin/archive/spool", result); err != nil {
+		t.Fatalf("Unable to do request: %s", err)
+	}
+	if !result.Succeeded {
+		t.Errorf("Wrong result: %v", result)
+	}
+}
+
+func TestStreamMulti(t *testing.T) {
+	// Answers requests the way the server does
+	server := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		if ws.Request().URL.Path != "/stream/" {
+			t.Errorf("Wrong path: %s", ws.Request().URL.Path)
+		}
+		for {
+			req := &statshub.StreamingRequest{}
+			if err := websocket.JSON.Receive(ws, req); err != nil {
+				return
+			}
+			msg := &statshub.StreamingMessage{Id: req.Id}
+			msg.Succeeded = true
+			switch {
+			case req.Type == "subscribe" && req.Dim == "":
+				msg.Type = "error"
+				msg.Succeeded = false
+				msg.Error = "Unknown dimension"
+			case req.Type == "subscribe":
+				msg.Type = "history"
+				msg.Intervals = []statshub.StreamingQueryResponseInterval{
+					statshub.StreamingQueryResponseInterval{AsOfSeconds: 5, Values: map[string]int64{req.Key: 1}},
+				}
+				websocket.JSON.Send(ws, msg)
+				msg = &statshub.StreamingMessage{Type: "update", Id: req.Id}
+				msg.Succeeded = true
+				msg.Intervals = []statshub.StreamingQueryResponseInterval{
+					statshub.StreamingQueryResponseInterval{AsOfSeconds: 10, Values: map[string]int64{req.Key: 2}},
+				}
+			case req.Type == "unsubscribe":
+				msg.Type = "unsubscribed"
+			case req.Type == "ping":
+				msg.Type = "pong"
+			}
+			websocket.JSON.Send(ws, msg)
+		}
+	}))
+	defer server.Close()
+
+	c := New(&Options{Addr: server.URL, Id: "myid1"})
+	defer c.Close()
+	stream, err := c.StreamMulti()
+	if err != nil {
+		t.Fatalf("Unable to stream: %s", err)
+	}
+	defer stream.Close()
+
+	if err := stream.Subscribe(&statshub.StreamingRequest{Id: "a", Dim: "country", Key: "es"}); err != nil {
+		t.Fatalf("Unable to subscribe: %s", err)
+	}
+	msg, err := stream.Next()
+	if err != nil {
+		t.Fatalf("Unable to receive: %s", err)
+	}
+	if msg.Type != "history" || msg.Id != "a" || msg.Intervals[0].Values["es"] != 1 {
+		t.Errorf("Wrong history: %v", msg)
+	}
+	if msg, err = stream.Next(); err != nil || msg.Type != "update" || msg.Id != "a" || msg.Intervals[0].Values["es"] != 2 {
+		t.Errorf("Wrong update: %v %v", msg, err)
+	}
+
+	stream.Ping("b")
+	if msg, err = stream.Next(); err != nil || msg.Type != "pong" || msg.Id != "b" {
+		t.Errorf("Wrong pong: %v %v", msg, err)
+	}
+
+	// Failed requests are messages, not errors
+	if err := stream.Subscribe(&statshub.StreamingRequest{Id: "c"}); err != nil {
+		t.Fatalf("Unable to subscribe: %s", err)
+	}
+	if msg, err = stream.Next(); err != nil || msg.Type != "error" || msg.Id != "c" || msg.Succeeded || msg.Error == "" {
+		t.Errorf("Wrong error: %v %v", msg, err)
+	}
+
+	if err := stream.Unsubscribe("a"); err != nil {
+		t.Fatalf("Unable to unsubscribe: %s", err)
+	}
+	if msg, err = stream.Next(); err != nil || msg.Type != "unsubscribed" || msg.Id != "a" {
+		t.Errorf("Wrong unsubscribed: %v %v", msg, err)
+	}
+}
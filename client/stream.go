@@ -0,0 +1,122 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package client
+
+import (
+	"fmt"
+	"strings"
+
+	"code.google.com/p/go.net/websocket"
+
+	"github.com/getlantern/statshub/statshub"
+)
+
+// Stream is a streaming query against statshub's /stream endpoint
+type Stream struct {
+	ws *websocket.Conn
+}
+
+// Stream opens a streaming query for the given dimension name and key (or
+// statshub.ANY), stat type (counter or gauge) and stat name.  The first
+// response contains history, subsequent responses contain live updates.
+func (client *Client) Stream(dimName string, dimKey string, statType string, statName string) (*Stream, error) {
+	ws, err := client.dialStream("/stream/" + strings.Join([]string{
+		escapePath(dimName),
+		escapePath(dimKey),
+		escapePath(statType),
+		escapePath(statName),
+	}, "/"))
+	if err != nil {
+		return nil, err
+	}
+	return &Stream{ws}, nil
+}
+
+// dialStream opens a websocket to the given path
+func (client *Client) dialStream(path string) (*websocket.Conn, error) {
+	streamURL := client.opts.Addr + path
+	wsURL := strings.Replace(strings.Replace(streamURL, "https://", "wss://", 1), "http://", "ws://", 1)
+	ws, err := websocket.Dial(wsURL, "", client.opts.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to %s: %s", wsURL, err)
+	}
+	return ws, nil
+}
+
+// Next blocks until the next response is received
+func (stream *Stream) Next() (*statshub.StreamingQueryResponse, error) {
+	resp := &statshub.StreamingQueryResponse{}
+	if err := websocket.JSON.Receive(stream.ws, resp); err != nil {
+		return nil, err
+	}
+	if !resp.Succeeded {
+		return nil, fmt.Errorf("Streaming query failed: %s", resp.Error)
+	}
+	return resp, nil
+}
+
+// Close closes the stream
+func (stream *Stream) Close() error {
+	return stream.ws.Close()
+}
+
+// MultiStream is a multiplexed streaming query against statshub's /stream
+// endpoint, which subscribes to any number of stats over one connection
+type MultiStream struct {
+	ws *websocket.Conn
+}
+
+// StreamMulti opens a multiplexed streaming query, which streams nothing until
+// it subscribes to stats
+func (client *Client) StreamMulti() (*MultiStream, error) {
+	ws, err := client.dialStream("/stream/")
+	if err != nil {
+		return nil, err
+	}
+	return &MultiStream{ws}, nil
+}
+
+// Subscribe subscribes to the stat given by req under req.Id.  Its history
+// and updates are received from Next.
+func (stream *MultiStream) Subscribe(req *statshub.StreamingRequest) error {
+	req.Type = "subscribe"
+	return websocket.JSON.Send(stream.ws, req)
+}
+
+// Unsubscribe ends the subscription with the given id
+func (stream *MultiStream) Unsubscribe(id string) error {
+	return websocket.JSON.Send(stream.ws, &statshub.StreamingRequest{Type: "unsubscribe", Id: id})
+}
+
+// Ping asks statshub for a pong with the given id, to keep the connection
+// alive
+func (stream *MultiStream) Ping(id string) error {
+	return websocket.JSON.Send(stream.ws, &statshub.StreamingRequest{Type: "ping", Id: id})
+}
+
+// Next blocks until the next message is received.  Failed requests are
+// received as messages of type "error", not returned as errors.
+func (stream *MultiStream) Next() (*statshub.StreamingMessage, error) {
+	msg := &statshub.StreamingMessage{}
+	if err := websocket.JSON.Receive(stream.ws, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// Close closes the stream
+func (stream *MultiStream) Close() error {
+	return stream.ws.Close()
+}
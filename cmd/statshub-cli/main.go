@@ -0,0 +1,430 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// statshub-cli is a command-line tool for posting to, querying and tailing
+// statshub.
+//
+// Usage:
+//
+//	statshub-cli [-addr http://localhost:9000] [-admin-token token] <command> [flags] [args]
+//
+// Commands:
+//
+//	post -id myid1 -dim country=es -counter counterA=50 -increment counterB=500 -gauge gaugeA=5000 -member gaugeB=item1
+//	query [-format table|csv|json] [dim]
+//	tail [-history] <dim> <key|*> <counter|gauge> <stat>
+//	ids [-format table|json] [id]
+//	import <file.jsonl>
+//	replay [-list]
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/getlantern/statshub/archive"
+	"github.com/getlantern/statshub/client"
+	"github.com/getlantern/statshub/statshub"
+)
+
+var (
+	addr       = flag.String("addr", "http://localhost:9000", "base URL of statshub")
+	adminToken = flag.String("admin-token", os.Getenv("ADMIN_TOKEN"), "token for the admin endpoints used by replay (also ADMIN_TOKEN)")
+
+	// stdout is where commands write their output
+	stdout io.Writer = os.Stdout
+)
+
+type command struct {
+	usage string
+	run   func(c *client.Client, args []string) error
+}
+
+var commands = map[string]*command{
+	"post":   &command{"post -id <id> [-dim name=key]... [-counter name=val]... [-increment name=val]... [-gauge name=val]... [-member name=member]...", post},
+	"query":  &command{"query [-format table|csv|json] [dim]", query},
+	"tail":   &command{"tail [-history] <dim> <key|*> <counter|gauge> <stat>", tail},
+	"ids":    &command{"ids [-format table|json] [id]", ids},
+	"import": &command{"import <file.jsonl>", importUpdates},
+	"replay": &command{"replay [-list]", replay},
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd := commands[flag.Arg(0)]
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+
+	c := client.New(&client.Options{Addr: *addr, AdminToken: *adminToken})
+	if err := cmd.run(c, flag.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: statshub-cli [-addr url] <command> [flags] [args]\n\nCommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+// post posts a single update built from flags
+func post(c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("post", flag.ExitOnError)
+	id := fs.String("id", "", "stat id")
+	dims := stringsFlag{}
+	counters := intsFlag{}
+	increments := intsFlag{}
+	gauges := intsFlag{}
+	members := stringsFlag{}
+	fs.Var(dims, "dim", "dimension as name=key (repeatable)")
+	fs.Var(counters, "counter", "counter as name=value (repeatable)")
+	fs.Var(increments, "increment", "increment as name=value (repeatable)")
+	fs.Var(gauges, "gauge", "gauge as name=value (repeatable)")
+	fs.Var(members, "member", "member as name=member (repeatable)")
+	fs.Parse(args)
+	if *id == "" {
+		return fmt.Errorf("-id is required")
+	}
+
+	return c.Post(*id, &statshub.StatsUpdate{
+		Dims: dims,
+		Stats: statshub.Stats{
+			Counters:   counters,
+			Increments: increments,
+			Gauges:     gauges,
+			Members:    members,
+		},
+	})
+}
+
+// query queries a dimension (or all dimensions)
+func query(c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	format := fs.String("format", "table", "output format: table, csv or json")
+	fs.Parse(args)
+	dim := fs.Arg(0)
+
+	switch *format {
+	case "csv":
+		return c.Export(dim, "csv", stdout)
+	case "json":
+		statsByDim, err := c.Query(dim)
+		if err != nil {
+			return err
+		}
+		return printJSON(statsByDim)
+	case "table":
+		statsByDim, err := c.Query(dim)
+		if err != nil {
+			return err
+		}
+		dimNames := make([]string, 0, len(statsByDim))
+		for dimName := range statsByDim {
+			dimNames = append(dimNames, dimName)
+		}
+		sort.Strings(dimNames)
+		for i, dimName := range dimNames {
+			if i > 0 {
+				fmt.Fprintln(stdout)
+			}
+			fmt.Fprintf(stdout, "%s\n", dimName)
+			printTable(dimName, statsByDim[dimName])
+		}
+		return nil
+	default:
+		return fmt.Errorf("Unknown format %s", *format)
+	}
+}
+
+// tail streams updates for a stat
+func tail(c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("tail", flag.ExitOnError)
+	history := fs.Bool("history", false, "print history before live updates")
+	fs.Parse(args)
+	if fs.NArg() != 4 {
+		return fmt.Errorf("Expected 4 arguments: <dim> <key|*> <counter|gauge> <stat>")
+	}
+
+	stream, err := c.Stream(fs.Arg(0), fs.Arg(1), fs.Arg(2), fs.Arg(3))
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	for first := true; ; first = false {
+		resp, err := stream.Next()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if first && !*history {
+			// The first response is history
+			continue
+		}
+		for _, interval := range resp.Intervals {
+			asOf := time.Unix(interval.AsOfSeconds, 0).Format(time.RFC3339)
+			keys := make([]string, 0, len(interval.Values))
+			for key := range interval.Values {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				fmt.Fprintf(stdout, "%s\t%s\t%d\n", asOf, key, interval.Values[key])
+			}
+		}
+	}
+}
+
+// ids shows the detail stats for an id (or all ids)
+func ids(c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("ids", flag.ExitOnError)
+	format := fs.String("format", "table", "output format: table or json")
+	fs.Parse(args)
+
+	statsById, err := c.QueryIds(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	switch *format {
+	case "json":
+		return printJSON(statsById)
+	case "table":
+		printTable("id", statsById)
+		return nil
+	default:
+		return fmt.Errorf("Unknown format %s", *format)
+	}
+}
+
+// importLine is a single line of an import file, which is a StatsUpdate along
+// with the id to which it should be posted.
+type importLine struct {
+	Id string `json:"id"`
+	statshub.StatsUpdate
+}
+
+// importUpdates replays a file of updates, one JSON encoded importLine per
+// line.
+func importUpdates(c *client.Client, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Expected 1 argument: <file.jsonl>")
+	}
+	file, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNum, posted, failed := 0, 0, 0
+	for scanner.Scan() {
+		lineNum++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		line := &importLine{}
+		if err := json.Unmarshal([]byte(text), line); err != nil {
+			fmt.Fprintf(os.Stderr, "Line %d: unable to decode: %s\n", lineNum, err)
+			failed++
+			continue
+		}
+		if line.Id == "" {
+			fmt.Fprintf(os.Stderr, "Line %d: missing id\n", lineNum)
+			failed++
+			continue
+		}
+		if err := c.Post(line.Id, &line.StatsUpdate); err != nil {
+			fmt.Fprintf(os.Stderr, "Line %d: %s\n", lineNum, err)
+			failed++
+			continue
+		}
+		posted++
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Posted %d updates, %d failed\n", posted, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d updates failed", failed)
+	}
+	return nil
+}
+
+// replay replays the snapshots in the archive spool, for example after an
+// outage of BigQuery, or just lists them with -list.
+func replay(c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	list := fs.Bool("list", false, "only list the spooled snapshots")
+	fs.Parse(args)
+
+	method := "POST"
+	if *list {
+		method = "GET"
+	}
+	result := &archive.ReplayResponse{}
+	if err := c.Do(method, "/admin/archive/spool", result); err != nil {
+		return err
+	}
+	if err := printJSON(result); err != nil {
+		return err
+	}
+	if !result.Succeeded {
+		return fmt.Errorf("Replay failed: %s", result.Error)
+	}
+	return nil
+}
+
+// printTable prints stats as a table with a row per key and a column per stat
+func printTable(keyHeader string, statsByKey map[string]*statshub.Stats) {
+	counters := make(map[string]bool)
+	gauges := make(map[string]bool)
+	gaugesCurrent := make(map[string]bool)
+	keys := make([]string, 0, len(statsByKey))
+	for key, stats := range statsByKey {
+		if key != "total" {
+			keys = append(keys, key)
+		}
+		for name := range stats.Counters {
+			counters[name] = true
+		}
+		for name := range stats.Gauges {
+			gauges[name] = true
+		}
+		for name := range stats.GaugesCurrent {
+			gaugesCurrent[name] = true
+		}
+	}
+	sort.Strings(keys)
+	if _, hasTotal := statsByKey["total"]; hasTotal {
+		keys = append(keys, "total")
+	}
+
+	counterNames, gaugeNames, gaugeCurrentNames := sorted(counters), sorted(gauges), sorted(gaugesCurrent)
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	header := []string{keyHeader}
+	for _, name := range counterNames {
+		header = append(header, "counter."+name)
+	}
+	for _, name := range gaugeNames {
+		header = append(header, "gauge."+name)
+	}
+	for _, name := range gaugeCurrentNames {
+		header = append(header, "gaugeCurrent."+name)
+	}
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, key := range keys {
+		stats := statsByKey[key]
+		row := []string{key}
+		row = appendValues(row, stats.Counters, counterNames)
+		row = appendValues(row, stats.Gauges, gaugeNames)
+		row = appendValues(row, stats.GaugesCurrent, gaugeCurrentNames)
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	w.Flush()
+}
+
+func appendValues(row []string, values map[string]int64, names []string) []string {
+	for _, name := range names {
+		if val, found := values[name]; found {
+			row = append(row, strconv.FormatInt(val, 10))
+		} else {
+			row = append(row, "-")
+		}
+	}
+	return row
+}
+
+func sorted(names map[string]bool) []string {
+	result := make([]string, 0, len(names))
+	for name := range names {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func printJSON(data interface{}) error {
+	bytes, err := json.MarshalIndent(data, "", "    ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, string(bytes))
+	return nil
+}
+
+// stringsFlag is a repeatable flag of name=value pairs
+type stringsFlag map[string]string
+
+func (f stringsFlag) String() string {
+	return fmt.Sprintf("%v", map[string]string(f))
+}
+
+func (f stringsFlag) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("expected name=value, got %s", value)
+	}
+	f[parts[0]] = parts[1]
+	return nil
+}
+
+// intsFlag is a repeatable flag of name=value pairs with integer values
+type intsFlag map[string]int64
+
+func (f intsFlag) String() string {
+	return fmt.Sprintf("%v", map[string]int64(f))
+}
+
+func (f intsFlag) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("expected name=value, got %s", value)
+	}
+	val, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("expected an integer value, got %s", parts[1])
+	}
+	f[parts[0]] = val
+	return nil
+}
@@ -0,0 +1,72 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/getlantern/statshub/client"
+)
+
+func TestQueryAllDims(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		if r.URL.Path != "/stats/" {
+			w.Write([]byte(`{"succeeded": true, "dims": {}}`))
+			return
+		}
+		if r.URL.Query().Get("format") == "csv" {
+			w.Write([]byte("dim,key,counter.bytesGiven\ncountry,total,5\nuser,total,5\n"))
+			return
+		}
+		w.Write([]byte(`{"succeeded": true, "dims": {
+			"country": {"es": {"counters": {"bytesGiven": 5}}, "total": {"counters": {"bytesGiven": 5}}},
+			"user": {"bob": {"counters": {"bytesGiven": 5}}, "total": {"counters": {"bytesGiven": 5}}}
+		}}`))
+	}))
+	defer server.Close()
+	c := client.New(&client.Options{Addr: server.URL})
+
+	var out bytes.Buffer
+	stdout = &out
+	defer func() { stdout = os.Stdout }()
+
+	if err := query(c, nil); err != nil {
+		t.Fatalf("Unable to query: %s", err)
+	}
+	for _, expected := range []string{"country\n", "es ", "user\n", "bob "} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Output should contain %q:\n%s", expected, out.String())
+		}
+	}
+
+	out.Reset()
+	if err := query(c, []string{"-format", "csv"}); err != nil {
+		t.Fatalf("Unable to export: %s", err)
+	}
+	if !strings.Contains(out.String(), "user,total,5") {
+		t.Errorf("CSV should include every dim:\n%s", out.String())
+	}
+
+	if len(paths) != 2 || paths[0] != "/stats/" || paths[1] != "/stats/" {
+		t.Errorf("Wrong paths queried: %v", paths)
+	}
+}
@@ -0,0 +1,664 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package config holds the configuration of a statshub server.
+//
+// Configuration is layered, with each layer overriding the one before it:
+//
+//  1. defaults
+//  2. a JSON config file, given by -config or STATSHUB_CONFIG
+//  3. environment variables
+//  4. command-line flags
+//
+// Every setting has a flag (e.g. -redis-addr) and a corresponding environment
+// variable named by upper-casing the flag and replacing dashes with
+// underscores (e.g. REDIS_ADDR).
+package config
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	STATSHUB_CONFIG = "STATSHUB_CONFIG"
+
+	redacted = "REDACTED"
+)
+
+// Config is the configuration of a statshub server
+type Config struct {
+	Port                  string   `json:"port"`
+	CachedDims            []string `json:"cachedDims"`
+	CacheExpiration       Duration `json:"cacheExpiration"`
+	StreamingInterval     Duration `json:"streamingInterval"`
+	StreamingQueueSize    int      `json:"streamingQueueSize"`
+	StreamingQueuePolicy  string   `json:"streamingQueuePolicy"`
+	StreamingWriteTimeout Duration `json:"streamingWriteTimeout"`
+	StreamingMaxOverflows int      `json:"streamingMaxOverflows"`
+	PushInterval          Duration `json:"pushInterval"`
+	LocalChangesOnly      bool     `json:"localChangesOnly"`
+
+	// AdminToken is the bearer token required by the admin endpoints under
+	// /admin, which are disabled without one
+	AdminToken string `json:"adminToken"`
+
+	Redis    RedisConfig    `json:"redis"`
+	Metrics  MetricsConfig  `json:"metrics"`
+	Statsd   StatsdConfig   `json:"statsd"`
+	Influx   InfluxConfig   `json:"influx"`
+	BigQuery BigQueryConfig `json:"bigQuery"`
+	Archive  ArchiveConfig  `json:"archive"`
+
+	// PrintConfig indicates that the effective configuration should be printed
+	// instead of running the server.  It can only be set by flag.
+	PrintConfig bool `json:"-"`
+}
+
+type RedisConfig struct {
+	Addr        string   `json:"addr"`
+	Password    string   `json:"password"`
+	MaxIdle     int      `json:"maxIdle"`
+	MaxActive   int      `json:"maxActive"`
+	IdleTimeout Duration `json:"idleTimeout"`
+}
+
+type MetricsConfig struct {
+	Dims            []string `json:"dims"`
+	MaxSeries       int      `json:"maxSeries"`
+	CacheExpiration Duration `json:"cacheExpiration"`
+}
+
+type StatsdConfig struct {
+	Addr          string   `json:"addr"`
+	IdTag         string   `json:"idTag"`
+	FlushInterval Duration `json:"flushInterval"`
+}
+
+type InfluxConfig struct {
+	IdTag string `json:"idTag"`
+}
+
+type BigQueryConfig struct {
+	Project     string `json:"project"`
+	OAuthConfig string `json:"oauthConfig"`
+
+	// ServiceAccount is the JSON key of a service account, which is used
+	// instead of OAuthConfig.  ServiceAccountFile is the path of one.
+	ServiceAccount     string `json:"serviceAccount"`
+	ServiceAccountFile string `json:"serviceAccountFile"`
+}
+
+type ArchiveConfig struct {
+	// Enabled turns on archiving to the configured Sinks
+	Enabled bool `json:"enabled"`
+
+	// Schedule maps dimension names to the interval at which they're archived
+	Schedule Schedule `json:"schedule"`
+
+	// AllDims archives every known dimension, with those not in Schedule
+	// archived every DefaultInterval
+	AllDims         bool     `json:"allDims"`
+	DefaultInterval Duration `json:"defaultInterval"`
+
+	// Exclude lists dimensions that are never archived
+	Exclude []string `json:"exclude"`
+
+	// DiscoveryInterval is how frequently new dimensions are discovered when
+	// archiving all dims
+	DiscoveryInterval Duration `json:"discoveryInterval"`
+
+	// IdsInterval is the interval at which the detail stats of every id are
+	// archived, zero to not archive them.  GaugesCurrent archives the gauges
+	// of the current period and Members archives member cardinalities
+	// separately from gauges.
+	IdsInterval   Duration `json:"idsInterval"`
+	GaugesCurrent bool     `json:"gaugesCurrent"`
+	Members       bool     `json:"members"`
+
+	// Sinks are where stats are archived to: bigquery, ndjson, csv or sql
+	Sinks []string `json:"sinks"`
+
+	// Rollups maintains hourly and daily rollup tables in BigQuery, which
+	// history queries read
+	Rollups bool `json:"rollups"`
+
+	// SchemaDryRun logs the schema changes that archiving to BigQuery would
+	// make instead of making them
+	SchemaDryRun bool `json:"schemaDryRun"`
+
+	// Dir is the directory of the ndjson and csv sinks, which start a new file
+	// every Rotation
+	Dir      string   `json:"dir"`
+	Rotation Duration `json:"rotation"`
+
+	// SQLDriver and SQLDSN are the database/sql driver and data source of the
+	// sql sink.  The driver needs to be linked into the binary; the statshub
+	// binary links postgres.
+	SQLDriver string `json:"sqlDriver"`
+	SQLDSN    string `json:"sqlDSN"`
+
+	// SpoolDir is where snapshots are spooled before they're shipped to the
+	// sinks.  Empty disables spooling.
+	SpoolDir string `json:"spoolDir"`
+
+	// MaxRetries, InitialBackoff and MaxBackoff control how shipping a
+	// spooled snapshot is retried before it's left for the next replay, which
+	// happens every ReplayInterval.
+	MaxRetries     int      `json:"maxRetries"`
+	InitialBackoff Duration `json:"initialBackoff"`
+	MaxBackoff     Duration `json:"maxBackoff"`
+	ReplayInterval Duration `json:"replayInterval"`
+
+	// LeaderElection makes only one of the instances that share a Redis
+	// archive, holding a lease for LeaderTTL.  InstanceId identifies this
+	// instance and defaults to hostname:pid.
+	LeaderElection bool     `json:"leaderElection"`
+	LeaderTTL      Duration `json:"leaderTTL"`
+	InstanceId     string   `json:"instanceId"`
+}
+
+// StreamingQueuePolicies are the supported values of
+// Config.StreamingQueuePolicy
+var StreamingQueuePolicies = []string{"coalesce", "drop"}
+
+// ArchiveSinks are the supported values of ArchiveConfig.Sinks
+var ArchiveSinks = []string{"bigquery", "ndjson", "csv", "sql"}
+
+// HasSink indicates whether the named sink is configured
+func (cfg *ArchiveConfig) HasSink(name string) bool {
+	for _, sink := range cfg.Sinks {
+		if sink == name {
+			return true
+		}
+	}
+	return false
+}
+
+// driverLinked indicates whether the named database/sql driver is registered
+func driverLinked(name string) bool {
+	for _, driver := range sql.Drivers() {
+		if driver == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Default returns the default configuration
+func Default() *Config {
+	return &Config{
+		Port:                  "9000",
+		CachedDims:            []string{"country"},
+		CacheExpiration:       Duration(1 * time.Minute),
+		StreamingInterval:     Duration(30 * time.Second),
+		StreamingQueueSize:    10,
+		StreamingQueuePolicy:  "coalesce",
+		StreamingWriteTimeout: Duration(10 * time.Second),
+		StreamingMaxOverflows: 3,
+		PushInterval:          Duration(1 * time.Second),
+		Redis: RedisConfig{
+			MaxIdle:     100,
+			MaxActive:   1000,
+			IdleTimeout: Duration(240 * time.Second),
+		},
+		Metrics: MetricsConfig{
+			Dims:            []string{"country"},
+			MaxSeries:       10000,
+			CacheExpiration: Duration(15 * time.Second),
+		},
+		Statsd: StatsdConfig{
+			IdTag:         "id",
+			FlushInterval: Duration(10 * time.Second),
+		},
+		Influx: InfluxConfig{
+			IdTag: "id",
+		},
+		Archive: ArchiveConfig{
+			Schedule: Schedule{
+				"fallback":                 Duration(10 * time.Minute),
+				"flserver":                 Duration(1 * time.Hour),
+				"country":                  Duration(1 * time.Hour),
+				"user":                     Duration(24 * time.Hour),
+				"destport":                 Duration(1 * time.Hour),
+				"answerercountry":          Duration(1 * time.Hour),
+				"offereranswerercountries": Duration(1 * time.Hour),
+				"operatingsystem":          Duration(1 * time.Hour),
+			},
+			DefaultInterval:   Duration(1 * time.Hour),
+			DiscoveryInterval: Duration(10 * time.Minute),
+			Sinks:             []string{"bigquery"},
+			Dir:               "archive",
+			Rotation:          Duration(24 * time.Hour),
+			MaxRetries:        5,
+			InitialBackoff:    Duration(1 * time.Second),
+			MaxBackoff:        Duration(1 * time.Minute),
+			ReplayInterval:    Duration(5 * time.Minute),
+			Rollups:           true,
+			LeaderTTL:         Duration(30 * time.Second),
+		},
+	}
+}
+
+// Load loads the configuration from the defaults, config file, environment and
+// the given command-line arguments (excluding the program name), in that order,
+// and validates it.  If -print-config was given, the configuration is returned
+// without being validated.
+func Load(args []string) (*Config, error) {
+	return load(args, os.Getenv)
+}
+
+func load(args []string, getenv func(string) string) (*Config, error) {
+	cfg := Default()
+
+	configFile := getenv(STATSHUB_CONFIG)
+	if fromArgs, found := configFileFromArgs(args); found {
+		configFile = fromArgs
+	}
+	if configFile != "" {
+		if err := cfg.loadFile(configFile); err != nil {
+			return nil, err
+		}
+	}
+
+	fs := cfg.flagSet()
+	var envErrors []string
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" || f.Name == "print-config" {
+			return
+		}
+		envName := EnvName(f.Name)
+		if val := getenv(envName); val != "" {
+			if err := f.Value.Set(val); err != nil {
+				envErrors = append(envErrors, fmt.Sprintf("%s: %s", envName, err))
+			}
+		}
+	})
+	if len(envErrors) > 0 {
+		return nil, fmt.Errorf("Invalid environment: %s", strings.Join(envErrors, "; "))
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("Unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	if cfg.PrintConfig {
+		// Let the caller print the configuration, even if it's invalid
+		return cfg, nil
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// EnvName returns the environment variable corresponding to the given flag
+func EnvName(flagName string) string {
+	return strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// flagSet returns a FlagSet whose flags are bound to the fields of cfg, with
+// their current values as defaults.
+func (cfg *Config) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("statshub", flag.ContinueOnError)
+	fs.String("config", "", "path to a JSON config file (also "+STATSHUB_CONFIG+")")
+	fs.BoolVar(&cfg.PrintConfig, "print-config", false, "print the effective configuration (with secrets redacted) and exit")
+
+	fs.StringVar(&cfg.Port, "port", cfg.Port, "port at which to listen for HTTP")
+	fs.Var((*listValue)(&cfg.CachedDims), "cached-dims", "comma-separated dimensions whose queries are cached")
+	fs.Var(&cfg.CacheExpiration, "cache-expiration", "how frequently cached queries are refreshed")
+	fs.Var(&cfg.StreamingInterval, "streaming-interval", "how frequently updates are sent to streaming clients")
+	fs.IntVar(&cfg.StreamingQueueSize, "streaming-queue-size", cfg.StreamingQueueSize, "how many updates are queued for each streaming client")
+	fs.StringVar(&cfg.StreamingQueuePolicy, "streaming-queue-policy", cfg.StreamingQueuePolicy, "what happens to updates for streaming clients whose queues are full: "+strings.Join(StreamingQueuePolicies, " or "))
+	fs.Var(&cfg.StreamingWriteTimeout, "streaming-write-timeout", "how long a write to a streaming client may take")
+	fs.IntVar(&cfg.StreamingMaxOverflows, "streaming-max-overflows", cfg.StreamingMaxOverflows, "how many updates in a row may overflow a streaming client's queue before it's evicted")
+	fs.Var(&cfg.PushInterval, "push-interval", "how long writes are collected before streaming clients are pushed the stats they changed")
+	fs.BoolVar(&cfg.LocalChangesOnly, "local-changes-only", cfg.LocalChangesOnly, "only push the writes of this instance, instead of those of all instances over redis pub/sub")
+	fs.StringVar(&cfg.AdminToken, "admin-token", cfg.AdminToken, "bearer token required by the admin endpoints, which are disabled without one")
+
+	fs.StringVar(&cfg.Redis.Addr, "redis-addr", cfg.Redis.Addr, "host:port of redis")
+	fs.StringVar(&cfg.Redis.Password, "redis-pass", cfg.Redis.Password, "redis password")
+	fs.IntVar(&cfg.Redis.MaxIdle, "redis-max-idle", cfg.Redis.MaxIdle, "maximum idle redis connections")
+	fs.IntVar(&cfg.Redis.MaxActive, "redis-max-active", cfg.Redis.MaxActive, "maximum active redis connections")
+	fs.Var(&cfg.Redis.IdleTimeout, "redis-idle-timeout", "how long idle redis connections are kept")
+
+	fs.Var((*listValue)(&cfg.Metrics.Dims), "metrics-dims", "comma-separated dimensions exposed at /metrics (none if empty)")
+	fs.IntVar(&cfg.Metrics.MaxSeries, "metrics-max-series", cfg.Metrics.MaxSeries, "maximum series exposed at /metrics")
+	fs.Var(&cfg.Metrics.CacheExpiration, "metrics-cache-expiration", "how long /metrics results are cached")
+
+	fs.StringVar(&cfg.Statsd.Addr, "statsd-addr", cfg.Statsd.Addr, "address at which to listen for StatsD (disabled if empty)")
+	fs.StringVar(&cfg.Statsd.IdTag, "statsd-id-tag", cfg.Statsd.IdTag, "StatsD tag that supplies the stat id")
+	fs.Var(&cfg.Statsd.FlushInterval, "statsd-flush-interval", "how frequently aggregated StatsD metrics are written")
+
+	fs.StringVar(&cfg.Influx.IdTag, "influx-id-tag", cfg.Influx.IdTag, "line protocol tag that supplies the stat id")
+
+	fs.StringVar(&cfg.BigQuery.Project, "google-project", cfg.BigQuery.Project, "Google project containing the BigQuery dataset")
+	fs.StringVar(&cfg.BigQuery.OAuthConfig, "oauth-config", cfg.BigQuery.OAuthConfig, "JSON encoded OAuth config for BigQuery")
+	fs.StringVar(&cfg.BigQuery.ServiceAccount, "google-service-account", cfg.BigQuery.ServiceAccount, "JSON key of the service account used for BigQuery instead of oauth-config")
+	fs.StringVar(&cfg.BigQuery.ServiceAccountFile, "google-service-account-file", cfg.BigQuery.ServiceAccountFile, "path of the JSON key of the service account used for BigQuery instead of oauth-config")
+
+	fs.BoolVar(&cfg.Archive.Enabled, "archive", cfg.Archive.Enabled, "archive stats to the configured archive-sinks")
+	fs.BoolVar(&cfg.Archive.Enabled, "archive-to-bigquery", cfg.Archive.Enabled, "deprecated alias of -archive")
+	fs.Var(&cfg.Archive.Schedule, "archive-schedule", "comma-separated dim=interval pairs to archive, e.g. country=1h,user=24h")
+	fs.BoolVar(&cfg.Archive.AllDims, "archive-all-dims", cfg.Archive.AllDims, "archive every known dimension, not just those in the schedule")
+	fs.Var(&cfg.Archive.DefaultInterval, "archive-default-interval", "archive interval for dimensions that aren't in the schedule")
+	fs.Var((*listValue)(&cfg.Archive.Exclude), "archive-exclude", "comma-separated dimensions that are never archived")
+	fs.Var(&cfg.Archive.DiscoveryInterval, "archive-discovery-interval", "how frequently new dimensions are discovered for archiving")
+	fs.Var(&cfg.Archive.IdsInterval, "archive-ids-interval", "interval at which the detail stats of every id are archived, 0 to not archive them")
+	fs.BoolVar(&cfg.Archive.GaugesCurrent, "archive-gauges-current", cfg.Archive.GaugesCurrent, "archive the gauges of the current period as gaugeCurrent.*")
+	fs.BoolVar(&cfg.Archive.Members, "archive-members", cfg.Archive.Members, "archive member cardinalities as member.* rather than gauge.*")
+	fs.Var((*listValue)(&cfg.Archive.Sinks), "archive-sinks", "comma-separated sinks to archive to: "+strings.Join(ArchiveSinks, ", "))
+	fs.BoolVar(&cfg.Archive.Rollups, "archive-rollups", cfg.Archive.Rollups, "maintain hourly and daily rollup tables in BigQuery for history queries")
+	fs.BoolVar(&cfg.Archive.SchemaDryRun, "archive-schema-dry-run", cfg.Archive.SchemaDryRun, "log the BigQuery schema changes that archiving would make without making them or inserting rows")
+	fs.StringVar(&cfg.Archive.Dir, "archive-dir", cfg.Archive.Dir, "directory of the ndjson and csv archive sinks")
+	fs.Var(&cfg.Archive.Rotation, "archive-rotation", "how frequently the ndjson and csv archive sinks start a new file")
+	fs.StringVar(&cfg.Archive.SQLDriver, "archive-sql-driver", cfg.Archive.SQLDriver, "database/sql driver of the sql archive sink")
+	fs.StringVar(&cfg.Archive.SQLDSN, "archive-sql-dsn", cfg.Archive.SQLDSN, "data source name of the sql archive sink")
+	fs.StringVar(&cfg.Archive.SpoolDir, "archive-spool-dir", cfg.Archive.SpoolDir, "directory where archive snapshots are spooled before shipping, empty to disable")
+	fs.IntVar(&cfg.Archive.MaxRetries, "archive-max-retries", cfg.Archive.MaxRetries, "how many times shipping an archive snapshot is retried")
+	fs.Var(&cfg.Archive.InitialBackoff, "archive-initial-backoff", "how long to wait before the first retry of an archive snapshot")
+	fs.Var(&cfg.Archive.MaxBackoff, "archive-max-backoff", "longest wait between retries of an archive snapshot")
+	fs.Var(&cfg.Archive.ReplayInterval, "archive-replay-interval", "how frequently spooled archive snapshots are replayed")
+	fs.BoolVar(&cfg.Archive.LeaderElection, "archive-leader-election", cfg.Archive.LeaderElection, "elect a single instance to archive among those sharing redis")
+	fs.Var(&cfg.Archive.LeaderTTL, "archive-leader-ttl", "how long the archive leader's lease lasts, which is how long failover takes")
+	fs.StringVar(&cfg.Archive.InstanceId, "archive-instance-id", cfg.Archive.InstanceId, "id of this instance in archive leader election, defaults to hostname:pid")
+	return fs
+}
+
+func (cfg *Config) loadFile(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("Unable to read config file %s: %s", filename, err)
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return fmt.Errorf("Unable to parse config file %s: %s", filename, err)
+	}
+	return nil
+}
+
+// Validate checks that the configuration is usable, reporting all problems at
+// once.
+func (cfg *Config) Validate() error {
+	var problems []string
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if port, err := strconv.Atoi(cfg.Port); err != nil || port <= 0 || port > 65535 {
+		problem("port %s is not a valid port", cfg.Port)
+	}
+	if cfg.Redis.Addr == "" {
+		problem("redis-addr is required")
+	}
+	if cfg.Redis.MaxIdle < 0 {
+		problem("redis-max-idle must not be negative")
+	}
+	if cfg.Redis.MaxActive <= 0 {
+		problem("redis-max-active must be positive")
+	}
+	if cfg.StreamingQueueSize <= 0 {
+		problem("streaming-queue-size must be positive")
+	}
+	knownPolicy := false
+	for _, policy := range StreamingQueuePolicies {
+		knownPolicy = knownPolicy || cfg.StreamingQueuePolicy == policy
+	}
+	if !knownPolicy {
+		problem("unknown streaming-queue-policy %s", cfg.StreamingQueuePolicy)
+	}
+	if cfg.StreamingMaxOverflows <= 0 {
+		problem("streaming-max-overflows must be positive")
+	}
+	if cfg.Metrics.MaxSeries <= 0 {
+		problem("metrics-max-series must be positive")
+	}
+	for name, d := range map[string]Duration{
+		"cache-expiration":           cfg.CacheExpiration,
+		"streaming-interval":         cfg.StreamingInterval,
+		"streaming-write-timeout":    cfg.StreamingWriteTimeout,
+		"push-interval":              cfg.PushInterval,
+		"redis-idle-timeout":         cfg.Redis.IdleTimeout,
+		"metrics-cache-expiration":   cfg.Metrics.CacheExpiration,
+		"statsd-flush-interval":      cfg.Statsd.FlushInterval,
+		"archive-default-interval":   cfg.Archive.DefaultInterval,
+		"archive-discovery-interval": cfg.Archive.DiscoveryInterval,
+		"archive-rotation":           cfg.Archive.Rotation,
+		"archive-initial-backoff":    cfg.Archive.InitialBackoff,
+		"archive-max-backoff":        cfg.Archive.MaxBackoff,
+		"archive-replay-interval":    cfg.Archive.ReplayInterval,
+		"archive-leader-ttl":         cfg.Archive.LeaderTTL,
+	} {
+		if d <= 0 {
+			problem("%s must be positive", name)
+		}
+	}
+	if cfg.Archive.IdsInterval < 0 {
+		problem("archive-ids-interval must not be negative")
+	}
+	if cfg.Archive.MaxRetries < 0 {
+		problem("archive-max-retries must not be negative")
+	}
+	if cfg.Statsd.IdTag == "" {
+		problem("statsd-id-tag is required")
+	}
+	if cfg.Influx.IdTag == "" {
+		problem("influx-id-tag is required")
+	}
+	if cfg.Archive.Enabled {
+		if len(cfg.Archive.Sinks) == 0 {
+			problem("archive-sinks is required when archiving")
+		}
+		listed := make(map[string]bool)
+		for _, sink := range cfg.Archive.Sinks {
+			if listed[sink] {
+				problem("archive sink %s is listed more than once", sink)
+			}
+			listed[sink] = true
+			known := false
+			for _, archiveSink := range ArchiveSinks {
+				known = known || sink == archiveSink
+			}
+			if !known {
+				problem("unknown archive sink %s", sink)
+			}
+		}
+		if cfg.Archive.HasSink("bigquery") {
+			if cfg.BigQuery.Project == "" {
+				problem("google-project is required when archiving to BigQuery")
+			}
+			if cfg.BigQuery.OAuthConfig == "" && cfg.BigQuery.ServiceAccount == "" && cfg.BigQuery.ServiceAccountFile == "" {
+				problem("oauth-config, google-service-account or google-service-account-file is required when archiving to BigQuery")
+			}
+		}
+		if (cfg.Archive.HasSink("ndjson") || cfg.Archive.HasSink("csv")) && cfg.Archive.Dir == "" {
+			problem("archive-dir is required when archiving to files")
+		}
+		if cfg.Archive.HasSink("sql") && (cfg.Archive.SQLDriver == "" || cfg.Archive.SQLDSN == "") {
+			problem("archive-sql-driver and archive-sql-dsn are required when archiving to sql")
+		} else if cfg.Archive.HasSink("sql") && !driverLinked(cfg.Archive.SQLDriver) {
+			// Otherwise archiving would only fail once the first snapshot is
+			// taken
+			problem("archive-sql-driver %s isn't linked into this binary, which has %s", cfg.Archive.SQLDriver, strings.Join(sql.Drivers(), ", "))
+		}
+	}
+	for dim, interval := range cfg.Archive.Schedule {
+		if interval <= 0 {
+			problem("archive interval for %s must be positive", dim)
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	return fmt.Errorf("Invalid configuration: %s", strings.Join(problems, "; "))
+}
+
+// Redacted returns a copy of the configuration with secrets redacted
+func (cfg *Config) Redacted() *Config {
+	copied := *cfg
+	if copied.AdminToken != "" {
+		copied.AdminToken = redacted
+	}
+	if copied.Redis.Password != "" {
+		copied.Redis.Password = redacted
+	}
+	if copied.BigQuery.OAuthConfig != "" {
+		copied.BigQuery.OAuthConfig = redacted
+	}
+	if copied.BigQuery.ServiceAccount != "" {
+		copied.BigQuery.ServiceAccount = redacted
+	}
+	if copied.Archive.SQLDSN != "" {
+		// DSNs often include passwords
+		copied.Archive.SQLDSN = redacted
+	}
+	return &copied
+}
+
+// String returns the configuration as indented JSON, with secrets redacted
+func (cfg *Config) String() string {
+	data, err := json.MarshalIndent(cfg.Redacted(), "", "    ")
+	if err != nil {
+		return fmt.Sprintf("Unable to encode configuration: %s", err)
+	}
+	return string(data)
+}
+
+// configFileFromArgs finds the value of the -config flag in args, which needs
+// to be known before the other flags can be parsed.
+func configFileFromArgs(args []string) (configFile string, found bool) {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		name := strings.TrimLeft(arg, "-")
+		if name == arg {
+			continue
+		}
+		if name == "config" && i+1 < len(args) {
+			configFile, found = args[i+1], true
+		} else if strings.HasPrefix(name, "config=") {
+			configFile, found = strings.TrimPrefix(name, "config="), true
+		}
+	}
+	return
+}
+
+// Duration is a time.Duration that's encoded as a string like "1m30s" in
+// JSON and on the command-line.
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d *Duration) Set(value string) error {
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return fmt.Errorf("Duration should be a string like \"1m30s\", got %s", data)
+	}
+	return d.Set(str)
+}
+
+// Schedule maps dimension names to archive intervals
+type Schedule map[string]Duration
+
+func (s Schedule) String() string {
+	dims := make([]string, 0, len(s))
+	for dim := range s {
+		dims = append(dims, dim)
+	}
+	sort.Strings(dims)
+	pairs := make([]string, len(dims))
+	for i, dim := range dims {
+		pairs[i] = dim + "=" + s[dim].String()
+	}
+	return strings.Join(pairs, ",")
+}
+
+// UnmarshalJSON replaces (rather than merging into) the schedule
+func (s *Schedule) UnmarshalJSON(data []byte) error {
+	var schedule map[string]Duration
+	if err := json.Unmarshal(data, &schedule); err != nil {
+		return err
+	}
+	*s = Schedule(schedule)
+	return nil
+}
+
+// Set replaces the schedule with the given comma-separated dim=interval pairs
+func (s *Schedule) Set(value string) error {
+	schedule := make(Schedule)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("expected dim=interval, got %s", pair)
+		}
+		var interval Duration
+		if err := interval.Set(parts[1]); err != nil {
+			return err
+		}
+		schedule[strings.ToLower(parts[0])] = interval
+	}
+	*s = schedule
+	return nil
+}
+
+// listValue is a comma-separated list of dimension names
+type listValue []string
+
+func (l *listValue) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listValue) Set(value string) error {
+	list := []string{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	*l = list
+	return nil
+}
@@ -0,0 +1,181 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadPrecedence(t *testing.T) {
+	file, err := ioutil.TempFile("", "statshub-config")
+	if err != nil {
+		t.Fatalf("Unable to create config file: %s", err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`{
+		"port": "8000",
+		"cachedDims": ["country", "user"],
+		"redis": {"addr": "file:6379", "password": "filepass", "maxActive": 50},
+		"statsd": {"flushInterval": "5s"},
+		"archive": {"schedule": {"country": "2h"}}
+	}`)
+	file.Close()
+
+	env := map[string]string{
+		"REDIS_ADDR":         "env:6379",
+		"METRICS_MAX_SERIES": "20",
+	}
+	getenv := func(name string) string { return env[name] }
+
+	cfg, err := load([]string{"-config", file.Name(), "-redis-addr", "flag:6379"}, getenv)
+	if err != nil {
+		t.Fatalf("Unable to load: %s", err)
+	}
+
+	if cfg.Port != "8000" {
+		t.Errorf("Port should come from file, got %s", cfg.Port)
+	}
+	if strings.Join(cfg.CachedDims, ",") != "country,user" {
+		t.Errorf("CachedDims should come from file, got %v", cfg.CachedDims)
+	}
+	if cfg.Redis.Addr != "flag:6379" {
+		t.Errorf("Flag should override env and file, got %s", cfg.Redis.Addr)
+	}
+	if cfg.Redis.Password != "filepass" {
+		t.Errorf("Password should come from file, got %s", cfg.Redis.Password)
+	}
+	if cfg.Redis.MaxActive != 50 {
+		t.Errorf("MaxActive should come from file, got %d", cfg.Redis.MaxActive)
+	}
+	if cfg.Redis.MaxIdle != 100 {
+		t.Errorf("MaxIdle should be defaulted, got %d", cfg.Redis.MaxIdle)
+	}
+	if cfg.Metrics.MaxSeries != 20 {
+		t.Errorf("MaxSeries should come from env, got %d", cfg.Metrics.MaxSeries)
+	}
+	if time.Duration(cfg.Statsd.FlushInterval) != 5*time.Second {
+		t.Errorf("FlushInterval should come from file, got %s", cfg.Statsd.FlushInterval)
+	}
+	if len(cfg.Archive.Schedule) != 1 || time.Duration(cfg.Archive.Schedule["country"]) != 2*time.Hour {
+		t.Errorf("Schedule should come from file, got %s", cfg.Archive.Schedule)
+	}
+}
+
+func TestEnvAndFlagValues(t *testing.T) {
+	env := map[string]string{
+		"REDIS_ADDR":     "localhost:6379",
+		"ARCHIVE":        "true",
+		"GOOGLE_PROJECT": "myproject",
+		"OAUTH_CONFIG":   "{}",
+		"METRICS_DIMS":   "Country, user",
+	}
+	getenv := func(name string) string { return env[name] }
+
+	cfg, err := load([]string{"-archive-schedule", "country=1h,user=24h", "-cached-dims="}, getenv)
+	if err != nil {
+		t.Fatalf("Unable to load: %s", err)
+	}
+	if !cfg.Archive.Enabled {
+		t.Errorf("Archiving should be enabled")
+	}
+	if cfg.Archive.Schedule.String() != "country=1h0m0s,user=24h0m0s" {
+		t.Errorf("Wrong schedule: %s", cfg.Archive.Schedule)
+	}
+	if strings.Join(cfg.Metrics.Dims, ",") != "country,user" {
+		t.Errorf("Wrong metrics dims: %v", cfg.Metrics.Dims)
+	}
+	if cfg.CachedDims == nil || len(cfg.CachedDims) != 0 {
+		t.Errorf("An empty flag should disable caching, got %v", cfg.CachedDims)
+	}
+
+	delete(env, "ARCHIVE")
+	cfg, err = load([]string{"-archive-to-bigquery"}, getenv)
+	if err != nil {
+		t.Fatalf("Unable to load: %s", err)
+	}
+	if !cfg.Archive.Enabled {
+		t.Errorf("archive-to-bigquery should still enable archiving")
+	}
+	if cfg.Archive.SpoolDir != "" || cfg.Archive.LeaderElection {
+		t.Errorf("Spooling and leader election should be off by default")
+	}
+
+	env["STATSD_FLUSH_INTERVAL"] = "soon"
+	if _, err := load(nil, getenv); err == nil || !strings.Contains(err.Error(), "STATSD_FLUSH_INTERVAL") {
+		t.Errorf("Invalid env var should have been reported, got %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cfg := Default()
+	cfg.Port = "abc"
+	cfg.Archive.Enabled = true
+	cfg.StreamingInterval = 0
+	cfg.StreamingQueuePolicy = "block"
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatalf("Config should have been invalid")
+	}
+	for _, expected := range []string{"port abc", "redis-addr is required", "streaming-interval", "streaming-queue-policy block", "google-project", "oauth-config"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Error should mention %s: %s", expected, err)
+		}
+	}
+
+	cfg = Default()
+	cfg.Redis.Addr = "localhost:6379"
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Default config with redis-addr should be valid: %s", err)
+	}
+
+	cfg.Archive.Enabled = true
+	cfg.Archive.Sinks = []string{"sql"}
+	cfg.Archive.SQLDriver = "sqlite3"
+	cfg.Archive.SQLDSN = "archive.db"
+	err = cfg.Validate()
+	if err == nil || !strings.Contains(err.Error(), "sqlite3 isn't linked") {
+		t.Errorf("Unlinked sql driver should have been reported, got %v", err)
+	}
+}
+
+func TestPrintConfigRedactsSecrets(t *testing.T) {
+	getenv := func(name string) string {
+		if name == "REDIS_PASS" {
+			return "supersecret"
+		}
+		return ""
+	}
+	cfg, err := load([]string{"-print-config", "-oauth-config", `{"secret": "oauthsecret"}`, "-google-service-account", `{"private_key": "keysecret"}`}, getenv)
+	if err != nil {
+		t.Fatalf("Config with -print-config should load even if invalid: %s", err)
+	}
+	if !cfg.PrintConfig {
+		t.Errorf("PrintConfig should be set")
+	}
+	printed := cfg.String()
+	if strings.Contains(printed, "supersecret") || strings.Contains(printed, "oauthsecret") || strings.Contains(printed, "keysecret") {
+		t.Errorf("Secrets should have been redacted: %s", printed)
+	}
+	if !strings.Contains(printed, redacted) {
+		t.Errorf("Redacted secrets should be shown as %s: %s", redacted, printed)
+	}
+	if cfg.Redis.Password != "supersecret" {
+		t.Errorf("Redacting should not modify the original config")
+	}
+}
@@ -46,25 +46,215 @@
 package main
 
 import (
-	"github.com/getlantern/statshub/archive"
-	_ "github.com/getlantern/statshub/statshub"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"runtime"
+	"time"
+
+	"github.com/getlantern/statshub/archive"
+	"github.com/getlantern/statshub/bigquery"
+	"github.com/getlantern/statshub/config"
+	"github.com/getlantern/statshub/statshub"
+
+	// Registers the postgres driver for the sql archive sink
+	_ "github.com/lib/pq"
 )
 
 func main() {
+	cfg, err := config.Load(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(2)
+	}
+	if cfg.PrintConfig {
+		fmt.Println(cfg)
+		if err := cfg.Validate(); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	numcores := runtime.NumCPU()
 	log.Printf("Using all %d cores on machine", numcores)
 	runtime.GOMAXPROCS(numcores)
 
-	archive.StartArchiving()
+	log.Printf("Connecting to redis at: %s", cfg.Redis.Addr)
+	redisOpts := statshub.RedisOptions{
+		Addr:        cfg.Redis.Addr,
+		Password:    cfg.Redis.Password,
+		MaxIdle:     cfg.Redis.MaxIdle,
+		MaxActive:   cfg.Redis.MaxActive,
+		IdleTimeout: time.Duration(cfg.Redis.IdleTimeout),
+	}
+	store := statshub.NewRedisPoolWithOptions(redisOpts)
+	server := statshub.NewServer(statshub.Options{
+		Store:                  store,
+		CachedDims:             cfg.CachedDims,
+		CacheExpiration:        time.Duration(cfg.CacheExpiration),
+		StreamingInterval:      time.Duration(cfg.StreamingInterval),
+		StreamingQueueSize:     cfg.StreamingQueueSize,
+		StreamingQueuePolicy:   cfg.StreamingQueuePolicy,
+		StreamingWriteTimeout:  time.Duration(cfg.StreamingWriteTimeout),
+		StreamingMaxOverflows:  cfg.StreamingMaxOverflows,
+		PushInterval:           time.Duration(cfg.PushInterval),
+		LocalChangesOnly:       cfg.LocalChangesOnly,
+		PubSubDial:             statshub.NewRedisPubSubDial(redisOpts),
+		HistoryRollups:         cfg.Archive.Rollups,
+		MetricsDims:            cfg.Metrics.Dims,
+		MetricsMaxSeries:       cfg.Metrics.MaxSeries,
+		MetricsCacheExpiration: time.Duration(cfg.Metrics.CacheExpiration),
+		StatsdAddr:             cfg.Statsd.Addr,
+		StatsdIdTag:            cfg.Statsd.IdTag,
+		StatsdFlushInterval:    time.Duration(cfg.Statsd.FlushInterval),
+		InfluxIdTag:            cfg.Influx.IdTag,
+	})
+	if err := server.Start(); err != nil {
+		log.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", server)
 
-	port := os.Getenv("PORT")
-	log.Printf("About to listen at port: %s", port)
-	err := http.ListenAndServe(":"+port, nil)
+	if err := configureBigQuery(cfg); err != nil {
+		log.Fatal(err)
+	}
+	if cfg.Archive.Enabled {
+		plan := archive.Plan{
+			AllDims:           cfg.Archive.AllDims,
+			DefaultInterval:   time.Duration(cfg.Archive.DefaultInterval),
+			Intervals:         make(map[string]time.Duration),
+			Exclude:           cfg.Archive.Exclude,
+			DiscoveryInterval: time.Duration(cfg.Archive.DiscoveryInterval),
+			IdsInterval:       time.Duration(cfg.Archive.IdsInterval),
+			GaugesCurrent:     cfg.Archive.GaugesCurrent,
+			Members:           cfg.Archive.Members,
+		}
+		for dim, interval := range cfg.Archive.Schedule {
+			plan.Intervals[dim] = time.Duration(interval)
+		}
+		sinks, err := sinksFor(cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var archiver archive.Archiver
+		if cfg.Archive.SpoolDir != "" {
+			maxRetries := cfg.Archive.MaxRetries
+			if maxRetries == 0 {
+				// A zero MaxRetries would mean the default
+				maxRetries = -1
+			}
+			// Each sink gets its own spool so that a failing sink doesn't
+			// make the others archive the same snapshot again
+			spools, err := archive.NewSpools(sinks, archive.SpoolOptions{
+				Dir:            cfg.Archive.SpoolDir,
+				MaxRetries:     maxRetries,
+				InitialBackoff: time.Duration(cfg.Archive.InitialBackoff),
+				MaxBackoff:     time.Duration(cfg.Archive.MaxBackoff),
+				ReplayInterval: time.Duration(cfg.Archive.ReplayInterval),
+			})
+			if err != nil {
+				log.Fatal(err)
+			}
+			spools.Start()
+			handleAdmin(mux, cfg, "/admin/archive/spool", spools)
+			archiver = spools
+		} else {
+			var archivers archive.MultiArchiver
+			for _, sink := range cfg.Archive.Sinks {
+				archivers = append(archivers, sinks[sink])
+			}
+			archiver = archivers
+		}
+		scheduler := archive.NewScheduler(server, plan, archiver)
+		if cfg.Archive.LeaderElection {
+			leader := archive.NewLeader(store, archive.LeaderOptions{
+				Id:  cfg.Archive.InstanceId,
+				TTL: time.Duration(cfg.Archive.LeaderTTL),
+			})
+			leader.Start()
+			scheduler.RequireLeadership(leader)
+		}
+		scheduler.Start()
+		// The status is read-only, so it doesn't need the admin token
+		mux.Handle("/admin/archive", scheduler)
+	} else {
+		log.Printf("Archiving is disabled")
+	}
+
+	log.Printf("About to listen at port: %s", cfg.Port)
+	err = http.ListenAndServe(":"+cfg.Port, mux)
 	if err != nil {
 		panic(err)
 	}
 }
+
+// handleAdmin mounts an admin endpoint whose GET requests are open to anyone
+// and whose other requests require the admin token.  Without an admin token,
+// only the GET requests are served.
+func handleAdmin(mux *http.ServeMux, cfg *config.Config, path string, handler http.Handler) {
+	if cfg.AdminToken == "" {
+		log.Printf("Only serving GET %s without an admin token", path)
+	}
+	mux.Handle(path, statshub.RequireTokenToModify(cfg.AdminToken, handler))
+}
+
+// configureBigQuery authenticates to BigQuery as the configured service
+// account or, if there isn't one, with the configured OAuth config
+func configureBigQuery(cfg *config.Config) error {
+	jsonKey := []byte(cfg.BigQuery.ServiceAccount)
+	if cfg.BigQuery.ServiceAccountFile != "" {
+		var err error
+		if jsonKey, err = ioutil.ReadFile(cfg.BigQuery.ServiceAccountFile); err != nil {
+			return fmt.Errorf("Unable to read service account key: %s", err)
+		}
+	}
+	if len(jsonKey) == 0 {
+		bigquery.Configure(cfg.BigQuery.Project, cfg.BigQuery.OAuthConfig)
+		return nil
+	}
+	return bigquery.ConfigureServiceAccount(cfg.BigQuery.Project, jsonKey)
+}
+
+// sinksFor builds an Archiver for each configured archive sink, keyed by the
+// name of the sink
+func sinksFor(cfg *config.Config) (map[string]archive.Archiver, error) {
+	archivers := make(map[string]archive.Archiver)
+	for _, sink := range cfg.Archive.Sinks {
+		log.Printf("Archiving to %s", sink)
+		switch sink {
+		case "bigquery":
+			archivers[sink] = &archive.BigQueryArchiver{
+				ProjectId: cfg.BigQuery.Project,
+				DatasetId: bigquery.DATASET_ID,
+				DryRun:    cfg.Archive.SchemaDryRun,
+				Rollups:   cfg.Archive.Rollups,
+			}
+		case "ndjson":
+			archivers[sink] = &archive.NDJSONArchiver{
+				Dir:      cfg.Archive.Dir,
+				Rotation: time.Duration(cfg.Archive.Rotation),
+			}
+		case "csv":
+			archivers[sink] = &archive.CSVArchiver{
+				Dir:      cfg.Archive.Dir,
+				Rotation: time.Duration(cfg.Archive.Rotation),
+			}
+		case "sql":
+			db, err := sql.Open(cfg.Archive.SQLDriver, cfg.Archive.SQLDSN)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to open archive database: %s", err)
+			}
+			archivers[sink] = &archive.SQLArchiver{DB: db, Driver: cfg.Archive.SQLDriver}
+		}
+	}
+	return archivers, nil
+}
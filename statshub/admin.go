@@ -0,0 +1,53 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+//
+
+package statshub
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// RequireToken only passes requests on to handler if they have the given
+// token as a bearer token, e.g. "Authorization: Bearer <token>".  Admin
+// endpoints, which can trigger work like archive runs, are wrapped in it so
+// that they're not open to the clients of the stats API.
+func RequireToken(token string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			fail(w, 401, fmt.Errorf("A valid admin token is required"))
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// RequireTokenToModify is like RequireToken, but passes GET and HEAD requests,
+// which only read status, on to handler without a token.
+func RequireTokenToModify(token string, handler http.Handler) http.Handler {
+	protected := RequireToken(token, handler)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" || r.Method == "HEAD" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		protected.ServeHTTP(w, r)
+	})
+}
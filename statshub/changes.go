@@ -0,0 +1,182 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+//
+
+package statshub
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	// changesRetryInterval is how long to wait before subscribing to changes
+	// again after the subscription fails
+	changesRetryInterval = 5 * time.Second
+)
+
+// statsChange is published whenever a StatsUpdate is written, naming the
+// stats that it changed and the Server that wrote it.  Members are named as
+// gauges, which is how they're streamed.
+type statsChange struct {
+	Origin   string            `json:"origin"`
+	Dims     map[string]string `json:"dims"`
+	Counters []string          `json:"counters,omitempty"`
+	Gauges   []string          `json:"gauges,omitempty"`
+}
+
+// change builds the statsChange for a StatsUpdate that's been written by the
+// Server identified by origin
+func (stats *StatsUpdate) change(origin string) *statsChange {
+	change := &statsChange{Origin: origin, Dims: stats.Dims}
+	for key := range stats.Counters {
+		change.Counters = append(change.Counters, removeDashes(key))
+	}
+	for key := range stats.Increments {
+		change.Counters = append(change.Counters, removeDashes(key))
+	}
+	for key := range stats.Gauges {
+		change.Gauges = append(change.Gauges, removeDashes(key))
+	}
+	for key := range stats.Members {
+		change.Gauges = append(change.Gauges, removeDashes(key))
+	}
+	for key := range stats.MultiMembers {
+		change.Gauges = append(change.Gauges, removeDashes(key))
+	}
+	return change
+}
+
+// changedStats are the stats named by any number of statsChanges
+type changedStats struct {
+	keys map[string]bool // the dimension, dimension key, stat type and stat of every change
+	dims map[string]bool // the dimension, stat type and stat of every change
+}
+
+func newChangedStats() *changedStats {
+	return &changedStats{keys: make(map[string]bool), dims: make(map[string]bool)}
+}
+
+func (changed *changedStats) add(change *statsChange) {
+	for dimName, dimKey := range change.Dims {
+		for _, statName := range change.Counters {
+			changed.keys[strings.Join([]string{dimName, dimKey, "counter", statName}, ":")] = true
+			changed.dims[strings.Join([]string{dimName, "counter", statName}, ":")] = true
+		}
+		for _, statName := range change.Gauges {
+			changed.keys[strings.Join([]string{dimName, dimKey, "gauge", statName}, ":")] = true
+			changed.dims[strings.Join([]string{dimName, "gauge", statName}, ":")] = true
+		}
+	}
+}
+
+// affects tells whether a subscription's values could have changed.  A change
+// to any key of a dimension affects subscriptions to all keys and the total.
+func (changed *changedStats) affects(sub *subscription) bool {
+	if sub.dimKey == ANY || sub.dimKey == "total" {
+		return changed.dims[strings.Join([]string{sub.dimName, sub.statType, sub.statName}, ":")]
+	}
+	return changed.keys[strings.Join([]string{sub.dimName, sub.dimKey, sub.statType, sub.statName}, ":")]
+}
+
+// notifyChange passes a change on to the streaming clients, unless too many
+// changes are already waiting, in which case the next streaming interval
+// brings the clients up to date.
+func (s *Server) notifyChange(change *statsChange) {
+	select {
+	case s.changes <- change:
+	default:
+	}
+}
+
+// receiveChanges subscribes to the changes published by every Server that
+// shares the Store, passing on those of other Servers to streaming clients,
+// until the Server stops.
+func (s *Server) receiveChanges() {
+	for {
+		if c, err := s.dialPubSub(); err != nil {
+			s.log.Printf("Unable to connect for changes: %s", err)
+		} else {
+			conn := redis.PubSubConn{Conn: c}
+			done := make(chan bool)
+			go func() {
+				// Closing the connection is the only way to stop receiving
+				select {
+				case <-s.stop:
+				case <-done:
+				}
+				conn.Close()
+			}()
+
+			if err := conn.Subscribe(s.opts.ChangesChannel); err != nil {
+				s.log.Printf("Unable to subscribe to changes: %s", err)
+			} else {
+				s.receiveChangesFrom(conn)
+			}
+			close(done)
+		}
+
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(changesRetryInterval):
+		}
+	}
+}
+
+// dialPubSub gets the connection on which to receive changes
+func (s *Server) dialPubSub() (redis.Conn, error) {
+	if s.opts.PubSubDial != nil {
+		return s.opts.PubSubDial()
+	}
+	return s.store.Get(), nil
+}
+
+// receiveChangesFrom receives changes until receiving fails, which without a
+// read timeout only happens when the connection breaks (or is closed)
+func (s *Server) receiveChangesFrom(conn redis.PubSubConn) {
+	for {
+		switch msg := conn.Receive().(type) {
+		case redis.Message:
+			change := &statsChange{}
+			if err := json.Unmarshal(msg.Data, change); err != nil {
+				s.log.Printf("Unable to decode change: %s", err)
+			} else if change.Origin != s.instanceId {
+				// This Server's own changes were passed on when they were
+				// written
+				s.notifyChange(change)
+			}
+		case error:
+			select {
+			case <-s.stop:
+			default:
+				s.log.Printf("Unable to receive changes: %s", msg)
+			}
+			return
+		}
+	}
+}
+
+// newInstanceId generates a random id for a Server, which identifies its own
+// changes
+func newInstanceId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,171 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+//
+
+package statshub
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestStatsChange(t *testing.T) {
+	stats := &StatsUpdate{Dims: map[string]string{"country": "es"}}
+	stats.Counters = map[string]int64{"bytes-given": 5}
+	stats.Increments = map[string]int64{"requests": 1}
+	stats.Gauges = map[string]int64{"online": 1}
+	stats.Members = map[string]string{"users": "bob"}
+	change := stats.change("a")
+	sort.Strings(change.Counters)
+	sort.Strings(change.Gauges)
+	encoded, _ := json.Marshal(change)
+	expected := `{"origin":"a","dims":{"country":"es"},"counters":["bytes_given","requests"],"gauges":["online","users"]}`
+	if string(encoded) != expected {
+		t.Errorf("Wrong change.  Expected:\n%s\nGot:\n%s", expected, encoded)
+	}
+}
+
+func TestChangedStats(t *testing.T) {
+	changed := newChangedStats()
+	changed.add(&statsChange{Dims: map[string]string{"country": "es", "fallback": "fp1"}, Counters: []string{"bytesGiven"}})
+	changed.add(&statsChange{Dims: map[string]string{"country": "de"}, Gauges: []string{"online"}})
+	for _, test := range []struct {
+		sub      *subscription
+		expected bool
+	}{
+		{&subscription{dimName: "country", dimKey: "es", statType: "counter", statName: "bytesGiven"}, true},
+		{&subscription{dimName: "country", dimKey: "de", statType: "counter", statName: "bytesGiven"}, false},
+		{&subscription{dimName: "country", dimKey: "total", statType: "counter", statName: "bytesGiven"}, true},
+		{&subscription{dimName: "fallback", dimKey: ANY, statType: "counter", statName: "bytesGiven"}, true},
+		{&subscription{dimName: "country", dimKey: "de", statType: "gauge", statName: "online"}, true},
+		{&subscription{dimName: "country", dimKey: ANY, statType: "counter", statName: "online"}, false},
+	} {
+		if changed.affects(test.sub) != test.expected {
+			t.Errorf("%v should be affected: %v", test.sub, test.expected)
+		}
+	}
+
+	filters := streamingFilters(map[int]*streamingClient{
+		1: subscribedClient(
+			&subscription{id: "a", dimName: "country", dimKey: "es", statType: "counter", statName: "bytesGiven"},
+			&subscription{id: "b", dimName: "country", dimKey: "es", statType: "gauge", statName: "online"},
+		),
+		2: subscribedClient(&subscription{dimName: "fallback", dimKey: "fp2", statType: "counter", statName: "bytesGiven"}),
+	}, changed)
+	if len(filters) != 1 || strings.Join(filters["country"].Keys, ",") != "es" || filters["country"].Gauges != nil {
+		t.Errorf("Only changed stats should be queried: %v", filters)
+	}
+}
+
+func TestIdleSubscriptionSurvivesReadTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer l.Close()
+
+	// A fake redis that publishes a change long after the subscription, and
+	// counts subscriptions
+	var mutex sync.Mutex
+	subscriptions := 0
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					command, err := readCommand(r)
+					if err != nil {
+						return
+					}
+					switch strings.ToUpper(command[0]) {
+					case "AUTH":
+						fmt.Fprint(conn, "+OK\r\n")
+					case "SUBSCRIBE":
+						mutex.Lock()
+						subscriptions++
+						mutex.Unlock()
+						fmt.Fprintf(conn, "*3\r\n$9\r\nsubscribe\r\n$%d\r\n%s\r\n:1\r\n", len(command[1]), command[1])
+						time.Sleep(300 * time.Millisecond)
+						msg := `{"origin":"other","dims":{"country":"es"},"counters":["bytesGiven"]}`
+						fmt.Fprintf(conn, "*3\r\n$7\r\nmessage\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(command[1]), command[1], len(msg), msg)
+					}
+				}
+			}()
+		}
+	}()
+
+	opts := RedisOptions{Addr: l.Addr().String()}
+	store := &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			// Pooled connections time out well before the change is published
+			return dialRedis(opts, 100*time.Millisecond)
+		},
+	}
+	s := NewServer(Options{Store: store, PubSubDial: NewRedisPubSubDial(opts)})
+	s.goUntilStopped(s.receiveChanges)
+	defer s.Shutdown()
+
+	select {
+	case change := <-s.changes:
+		if change.Origin != "other" || change.Dims["country"] != "es" {
+			t.Errorf("Wrong change: %v", change)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Change should have been received")
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if subscriptions != 1 {
+		t.Errorf("Should have subscribed once, subscribed %d times", subscriptions)
+	}
+}
+
+// readCommand reads a command in the redis protocol
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	command := make([]string, n)
+	for i := range command {
+		if _, err := r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		arg, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		command[i] = strings.TrimSpace(arg)
+	}
+	return command, nil
+}
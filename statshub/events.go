@@ -0,0 +1,187 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+//
+
+package statshub
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// streamEvents streams the stat given by the path (e.g.
+// /events/country/*/counter/bytesGiven) as Server-Sent Events, for clients that
+// can't use websockets.  The events are the same StreamingQueryResponses as
+// those of streamStats, history first and then live updates.  Each event's id
+// is the as of time of its latest interval, so a client that reconnects with a
+// Last-Event-ID only gets the intervals that it missed.
+func (s *Server) streamEvents(w http.ResponseWriter, r *http.Request) {
+	if "GET" != r.Method {
+		w.WriteHeader(405)
+		return
+	}
+
+	singleSlashPath := strings.Replace(r.URL.Path, "//", "/", -1)
+	pathParts := strings.Split(singleSlashPath, "/")
+	if len(pathParts) < 6 {
+		w.Header().Set("Content-Type", "application/json")
+		fail(w, 400, fmt.Errorf("Wrong path: %s. Expected something like: %s", singleSlashPath, "/events/country/*/counter/bytesGiven"))
+		return
+	}
+	since, err := lastEventId(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		fail(w, 400, err)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		fail(w, 500, fmt.Errorf("Unable to stream events"))
+		return
+	}
+
+	sub := &subscription{
+		dimName:     pathParts[2],
+		dimKey:      pathParts[3],
+		statType:    pathParts[4],
+		statName:    pathParts[5],
+		aggregation: r.URL.Query().Get("aggregation"),
+		historyDays: ONE_YEAR_DAYS,
+		since:       since,
+	}
+	if err := s.checkSubscription(sub); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		fail(w, 400, err)
+		return
+	}
+	// History is loaded before the response is committed, so that failing
+	// to load it is an error response rather than an event
+	intervals, err := s.loadHistory(sub)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		fail(w, 500, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	flusher.Flush()
+	conn := newSSEConn(w, s.opts.StreamingWriteTimeout)
+
+	client := s.streamingClientFor(conn)
+	if err := client.startWithHistory(sub, intervals); err != nil {
+		return
+	}
+
+	select {
+	case s.newStreamingClient <- client:
+	case <-s.stop:
+		return
+	}
+	id := <-client.id
+
+	go func() {
+		// The client disconnecting or the server stopping ends the stream
+		select {
+		case <-r.Context().Done():
+		case <-s.stop:
+		case <-conn.closed:
+		}
+		conn.Close()
+		close(client.done)
+	}()
+	// Updates are written on this goroutine, since the ResponseWriter can't be
+	// used once the handler returns
+	client.writeUpdates()
+	conn.Close()
+
+	select {
+	case s.closedStreamingClient <- id:
+	case <-s.stop:
+	}
+}
+
+// lastEventId parses the Last-Event-ID header (the as of time in seconds of
+// the last interval that the client got), which is 0 if there isn't one
+func lastEventId(r *http.Request) (int64, error) {
+	header := r.Header.Get("Last-Event-ID")
+	if header == "" {
+		return 0, nil
+	}
+	since, err := strconv.ParseInt(header, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to parse Last-Event-ID %q: %s", header, err)
+	}
+	return since, nil
+}
+
+// sseConn is a streamingConn that sends Server-Sent Events to a ResponseWriter,
+// whose writes time out after timeout (if it supports write deadlines)
+type sseConn struct {
+	w          http.ResponseWriter
+	flusher    http.Flusher
+	controller *http.ResponseController
+	timeout    time.Duration
+	mutex      sync.Mutex
+	closeOnce  sync.Once
+	closed     chan bool
+}
+
+func newSSEConn(w http.ResponseWriter, timeout time.Duration) *sseConn {
+	return &sseConn{
+		w:          w,
+		flusher:    w.(http.Flusher),
+		controller: http.NewResponseController(w),
+		timeout:    timeout,
+		closed:     make(chan bool),
+	}
+}
+
+func (conn *sseConn) send(msg []byte, asOfSeconds int64) error {
+	var event bytes.Buffer
+	if asOfSeconds > 0 {
+		fmt.Fprintf(&event, "id: %d\n", asOfSeconds)
+	}
+	fmt.Fprintf(&event, "data: %s\n\n", msg)
+
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	select {
+	case <-conn.closed:
+		return fmt.Errorf("Connection closed")
+	default:
+	}
+	conn.controller.SetWriteDeadline(time.Now().Add(conn.timeout))
+	if _, err := conn.w.Write(event.Bytes()); err != nil {
+		return err
+	}
+	conn.flusher.Flush()
+	return nil
+}
+
+// Close stops sending events.  The response itself ends when streamEvents
+// returns.
+func (conn *sseConn) Close() error {
+	conn.closeOnce.Do(func() {
+		close(conn.closed)
+	})
+	return nil
+}
@@ -0,0 +1,173 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+//
+
+package statshub
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	bq "code.google.com/p/ox-google-api-go-client/bigquery/v2"
+	"github.com/garyburd/redigo/redis"
+	"github.com/getlantern/statshub/bigquery"
+	"github.com/getlantern/statshub/bigquery/fake"
+)
+
+func TestSSEConn(t *testing.T) {
+	w := httptest.NewRecorder()
+	conn := newSSEConn(w, 50*time.Millisecond)
+	conn.send([]byte(`{"succeeded":true}`), 0)
+	conn.send([]byte(`{"succeeded":true,"intervals":[]}`), 1398945600)
+	conn.Close()
+	if err := conn.send([]byte(`{}`), 0); err == nil {
+		t.Errorf("Closed connections shouldn't send")
+	}
+	expected := "data: {\"succeeded\":true}\n\nid: 1398945600\ndata: {\"succeeded\":true,\"intervals\":[]}\n\n"
+	if events := w.Body.String(); events != expected {
+		t.Errorf("Wrong events.  Expected:\n%s\nGot:\n%s", expected, events)
+	}
+	if !w.Flushed {
+		t.Errorf("Events should have been flushed")
+	}
+}
+
+// setsStore is a Store that only has sets, which is enough to check
+// subscriptions
+type setsStore map[string][]string
+
+func (store setsStore) Get() redis.Conn {
+	return &setsConn{sets: store}
+}
+
+type setsConn struct {
+	failingConn
+	sets setsStore
+}
+
+func (conn *setsConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	if commandName != "SMEMBERS" {
+		return nil, nil
+	}
+	var members []interface{}
+	for _, member := range conn.sets[args[0].(string)] {
+		members = append(members, []byte(member))
+	}
+	return members, nil
+}
+
+func TestStreamEventsResumes(t *testing.T) {
+	client := fake.New()
+	client.InsertTable("p", bigquery.DATASET_ID, &bq.Table{
+		TableReference: &bq.TableReference{TableId: "country_hourly_20140501"},
+		Schema: &bq.TableSchema{Fields: []*bq.TableFieldSchema{
+			&bq.TableFieldSchema{Name: "_dim", Type: "STRING"},
+			&bq.TableFieldSchema{Name: "_ts", Type: "TIMESTAMP"},
+			&bq.TableFieldSchema{Name: "counter_bytesGiven", Type: "INTEGER"},
+		}},
+	})
+	client.InsertAll("p", bigquery.DATASET_ID, "country_hourly_20140501", &bq.TableDataInsertAllRequest{
+		Rows: []*bq.TableDataInsertAllRequestRows{
+			&bq.TableDataInsertAllRequestRows{InsertId: "1", Json: map[string]interface{}{"_dim": "es", "_ts": 1398945600, "counter_bytesGiven": 5}},
+			&bq.TableDataInsertAllRequestRows{InsertId: "2", Json: map[string]interface{}{"_dim": "es", "_ts": 1398949200, "counter_bytesGiven": 7}},
+		},
+	})
+
+	now := time.Unix(1398956400, 0)
+	s := NewServer(Options{
+		Store:          setsStore{"dim": {"country"}, "key:counter": {"bytesGiven"}},
+		Clock:          fixedClock(now),
+		HistoryRollups: true,
+		BigQuery:       client,
+	})
+	server := httptest.NewServer(http.HandlerFunc(s.streamEvents))
+	defer server.Close()
+	defer s.Shutdown()
+
+	// The client reconnects having seen the first interval
+	req, _ := http.NewRequest("GET", server.URL+"/events/country/*/counter/bytesGiven", nil)
+	req.Header.Set("Last-Event-ID", "1398945600")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Unable to stream events: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Wrong response: %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	events := bufio.NewReader(resp.Body)
+	readEvent := func() string {
+		var event string
+		for {
+			line, err := events.ReadString('\n')
+			if err != nil {
+				t.Fatalf("Unable to read event: %s", err)
+			}
+			if line == "\n" {
+				return event
+			}
+			event += line
+		}
+	}
+
+	expected := "id: 1398949200\n" + `data: {"succeeded":true,"error":"","intervals":[{"asOfSeconds":1398949200,"values":{"es":7}}]}` + "\n"
+	if event := readEvent(); event != expected {
+		t.Errorf("Should only have gotten the missed interval.  Expected:\n%s\nGot:\n%s", expected, event)
+	}
+
+	// Then it gets live updates, like handleStreamingClients would send
+	streamingClient := <-s.newStreamingClient
+	s.streamingClients[1] = streamingClient
+	streamingClient.id <- 1
+	s.publishUpdate(&streamingUpdate{asOf: now, dims: map[string]map[string]*Stats{
+		"country": map[string]*Stats{"es": &Stats{Counters: map[string]int64{"bytesGiven": 9}}},
+	}})
+	expected = "id: 1398956400\n" + `data: {"succeeded":true,"error":"","intervals":[{"asOfSeconds":1398956400,"values":{"es":9}}]}` + "\n"
+	if event := readEvent(); event != expected {
+		t.Errorf("Wrong update.  Expected:\n%s\nGot:\n%s", expected, event)
+	}
+}
+
+func TestStreamEventsRequests(t *testing.T) {
+	s := NewServer(Options{StreamingInterval: time.Hour})
+	for _, test := range []struct {
+		method      string
+		path        string
+		lastEventId string
+		code        int
+	}{
+		{"POST", "/events/country/*/counter/bytesGiven", "", 405},
+		{"GET", "/events/country/*", "", 400},
+		{"GET", "/events/country/*/counter/bytesGiven", "yesterday", 400},
+	} {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest(test.method, test.path, nil)
+		if test.lastEventId != "" {
+			r.Header.Set("Last-Event-ID", test.lastEventId)
+		}
+		s.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("%s %s should have been %d, got %d: %s", test.method, test.path, test.code, w.Code, w.Body)
+		}
+	}
+
+	r, _ := http.NewRequest("GET", "/events/country/*/counter/bytesGiven", nil)
+	r.Header.Set("Last-Event-ID", "1398945600")
+	if since, err := lastEventId(r); err != nil || since != 1398945600 {
+		t.Errorf("Wrong last event id: %d %v", since, err)
+	}
+}
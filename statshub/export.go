@@ -0,0 +1,353 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+//
+
+package statshub
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	formatJSON   = "json"
+	formatCSV    = "csv"
+	formatNDJSON = "ndjson"
+
+	// exportFlushRows is how many rows are written between flushes to the client
+	exportFlushRows = 100
+
+	// exportPageKeys is how many keys of a dimension are queried at a time
+	exportPageKeys = 500
+)
+
+// ExportRow is a single row of exported stats, corresponding to one key of a
+// dimension.  It is the format of each line of an NDJSON export.
+type ExportRow struct {
+	Dim           string           `json:"dim"`
+	Key           string           `json:"key"`
+	Counters      map[string]int64 `json:"counters"`
+	Gauges        map[string]int64 `json:"gauges"`
+	GaugesCurrent map[string]int64 `json:"gaugesCurrent"`
+}
+
+// exportFormatFor determines the requested export format from the format
+// query parameter or, failing that, the Accept header.
+func exportFormatFor(r *http.Request) (string, error) {
+	format := strings.ToLower(r.URL.Query().Get("format"))
+	switch format {
+	case formatJSON, formatCSV, formatNDJSON:
+		return format, nil
+	case "":
+		accept := r.Header.Get("Accept")
+		if strings.Contains(accept, "text/csv") {
+			return formatCSV, nil
+		}
+		if strings.Contains(accept, "application/x-ndjson") || strings.Contains(accept, "application/ndjson") {
+			return formatNDJSON, nil
+		}
+		return formatJSON, nil
+	default:
+		return "", fmt.Errorf("Unknown format %s, expected one of json, csv or ndjson", format)
+	}
+}
+
+// exportStats handles a GET request to /stats for the CSV and NDJSON formats.
+// Keys are queried exportPageKeys at a time so that large dimensions aren't
+// held in memory.
+func (s *Server) exportStats(w http.ResponseWriter, dim string, format string) {
+	source, columns, err := s.exportSourceFor(dimNamesFor(dim))
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		fail(w, 500, fmt.Errorf("Unable to query stats: %s", err))
+		return
+	}
+
+	var exporter rowExporter
+	if format == formatCSV {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		exporter = newCSVExporter(w, columns)
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		exporter = newNDJSONExporter(w)
+	}
+	w.WriteHeader(200)
+
+	flusher, _ := w.(http.Flusher)
+	err = exportRows(source, exporter, func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	})
+	if err != nil {
+		// The status has already been sent, so all we can do is stop
+		s.log.Printf("Unable to export stats as %s: %s", format, err)
+	}
+}
+
+// exportSource supplies the stats that exportRows exports, one page of keys
+// at a time
+type exportSource struct {
+	// dimNames are the dimensions to export
+	dimNames []string
+
+	// listKeys lists the keys of a dimension
+	listKeys func(dimName string) ([]string, error)
+
+	// queryKeys queries the stats of some keys of a dimension
+	queryKeys func(dimName string, dimKeys []string) (map[string]*Stats, error)
+}
+
+// exportColumns are the names of the counters, gauges and current gauges
+// that are exported as CSV columns
+type exportColumns struct {
+	counters      []string
+	gauges        []string
+	gaugesCurrent []string
+}
+
+// exportSourceFor returns an exportSource that reads the given dimensions
+// from Redis, or all of them if dimNames is empty, along with the names of
+// every stat that may be exported.
+func (s *Server) exportSourceFor(dimNames []string) (*exportSource, *exportColumns, error) {
+	conn := s.connect()
+	defer conn.Close()
+
+	var err error
+	if len(dimNames) == 0 {
+		if dimNames, err = listDimNames(conn); err != nil {
+			return nil, nil, err
+		}
+	}
+	columns := &exportColumns{}
+	if columns.counters, err = listStatKeys(conn, "counter"); err != nil {
+		return nil, nil, err
+	}
+	if columns.gaugesCurrent, err = listStatKeys(conn, "gauge"); err != nil {
+		return nil, nil, err
+	}
+	var members []string
+	if members, err = listStatKeys(conn, "member"); err != nil {
+		return nil, nil, err
+	}
+	// Member counts are exported as gauges
+	columns.gauges = append(append([]string{}, columns.gaugesCurrent...), members...)
+
+	source := &exportSource{
+		dimNames: dimNames,
+		listKeys: func(dimName string) ([]string, error) {
+			conn := s.connect()
+			defer conn.Close()
+			return listDimKeys(conn, dimName)
+		},
+		queryKeys: func(dimName string, dimKeys []string) (map[string]*Stats, error) {
+			conn := s.connect()
+			defer conn.Close()
+			return s.queryDimKeys(conn, dimName, dimKeys)
+		},
+	}
+	return source, columns, nil
+}
+
+// rowExporter writes rows of stats in a specific format
+type rowExporter interface {
+	writeRow(row *ExportRow) error
+	flush() error
+}
+
+// exportRows writes a row for every key of every dimension in source, ordered
+// by dimension and key with the total for each dimension last.  Keys are
+// queried exportPageKeys at a time.  afterFlush is called every
+// exportFlushRows rows, once the exporter has been flushed.
+func exportRows(source *exportSource, exporter rowExporter, afterFlush func()) error {
+	numRows := 0
+	writeRow := func(row *ExportRow) error {
+		if err := exporter.writeRow(row); err != nil {
+			return err
+		}
+		numRows++
+		if numRows%exportFlushRows == 0 {
+			if err := exporter.flush(); err != nil {
+				return err
+			}
+			afterFlush()
+		}
+		return nil
+	}
+
+	dimNames := append([]string{}, source.dimNames...)
+	sort.Strings(dimNames)
+	for _, dimName := range dimNames {
+		allKeys, err := source.listKeys(dimName)
+		if err != nil {
+			return fmt.Errorf("Unable to list keys for dimension %s: %s", dimName, err)
+		}
+		dimKeys := make([]string, 0, len(allKeys))
+		for _, dimKey := range allKeys {
+			if dimKey != "total" {
+				dimKeys = append(dimKeys, dimKey)
+			}
+		}
+		sort.Strings(dimKeys)
+
+		// The total is summed as the pages go by, like doQuery does
+		total := newStats()
+		for start := 0; start < len(dimKeys); start += exportPageKeys {
+			end := start + exportPageKeys
+			if end > len(dimKeys) {
+				end = len(dimKeys)
+			}
+			page := dimKeys[start:end]
+			dimStats, err := source.queryKeys(dimName, page)
+			if err != nil {
+				return fmt.Errorf("Unable to query keys of dimension %s: %s", dimName, err)
+			}
+			for _, dimKey := range page {
+				stats := dimStats[dimKey]
+				addTo(total.Counters, stats.Counters)
+				addTo(total.Gauges, stats.Gauges)
+				addTo(total.GaugesCurrent, stats.GaugesCurrent)
+				if err := writeRow(exportRowFor(dimName, dimKey, stats)); err != nil {
+					return err
+				}
+			}
+		}
+		if err := writeRow(exportRowFor(dimName, "total", total)); err != nil {
+			return err
+		}
+	}
+	if err := exporter.flush(); err != nil {
+		return err
+	}
+	afterFlush()
+	return nil
+}
+
+func exportRowFor(dimName string, dimKey string, stats *Stats) *ExportRow {
+	return &ExportRow{
+		Dim:           dimName,
+		Key:           dimKey,
+		Counters:      stats.Counters,
+		Gauges:        stats.Gauges,
+		GaugesCurrent: stats.GaugesCurrent,
+	}
+}
+
+// addTo adds each of values to totals
+func addTo(totals map[string]int64, values map[string]int64) {
+	for key, val := range values {
+		totals[key] += val
+	}
+}
+
+// csvExporter writes rows as CSV, with a column for each counter, gauge and
+// current gauge that appears in any row.
+type csvExporter struct {
+	out           *csv.Writer
+	counters      []string
+	gauges        []string
+	gaugesCurrent []string
+	headerWritten bool
+}
+
+func newCSVExporter(out io.Writer, columns *exportColumns) *csvExporter {
+	return &csvExporter{
+		out:           csv.NewWriter(out),
+		counters:      sortedNames(columns.counters),
+		gauges:        sortedNames(columns.gauges),
+		gaugesCurrent: sortedNames(columns.gaugesCurrent),
+	}
+}
+
+func (exporter *csvExporter) writeRow(row *ExportRow) error {
+	if !exporter.headerWritten {
+		header := []string{"dim", "key"}
+		header = appendPrefixed(header, "counter.", exporter.counters)
+		header = appendPrefixed(header, "gauge.", exporter.gauges)
+		header = appendPrefixed(header, "gaugeCurrent.", exporter.gaugesCurrent)
+		if err := exporter.out.Write(header); err != nil {
+			return err
+		}
+		exporter.headerWritten = true
+	}
+
+	record := []string{row.Dim, row.Key}
+	record = appendValues(record, row.Counters, exporter.counters)
+	record = appendValues(record, row.Gauges, exporter.gauges)
+	record = appendValues(record, row.GaugesCurrent, exporter.gaugesCurrent)
+	return exporter.out.Write(record)
+}
+
+func (exporter *csvExporter) flush() error {
+	exporter.out.Flush()
+	return exporter.out.Error()
+}
+
+// ndjsonExporter writes each row as a JSON object on its own line
+type ndjsonExporter struct {
+	encoder *json.Encoder
+}
+
+func newNDJSONExporter(out io.Writer) *ndjsonExporter {
+	return &ndjsonExporter{json.NewEncoder(out)}
+}
+
+func (exporter *ndjsonExporter) writeRow(row *ExportRow) error {
+	// json.Encoder terminates each value with a newline
+	return exporter.encoder.Encode(row)
+}
+
+func (exporter *ndjsonExporter) flush() error {
+	return nil
+}
+
+func appendPrefixed(record []string, prefix string, names []string) []string {
+	for _, name := range names {
+		record = append(record, prefix+name)
+	}
+	return record
+}
+
+// appendValues appends the value for each of names, leaving the column empty
+// if the value wasn't found.
+func appendValues(record []string, values map[string]int64, names []string) []string {
+	for _, name := range names {
+		if val, found := values[name]; found {
+			record = append(record, strconv.FormatInt(val, 10))
+		} else {
+			record = append(record, "")
+		}
+	}
+	return record
+}
+
+// sortedNames returns the distinct names in sorted order
+func sortedNames(names []string) []string {
+	distinct := make(map[string]bool)
+	sorted := make([]string, 0, len(names))
+	for _, name := range names {
+		if !distinct[name] {
+			distinct[name] = true
+			sorted = append(sorted, name)
+		}
+	}
+	sort.Strings(sorted)
+	return sorted
+}
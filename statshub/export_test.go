@@ -0,0 +1,158 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+//
+
+package statshub
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// exportSourceOf returns an exportSource that reads statsByDim, counting the
+// pages that are queried.
+func exportSourceOf(statsByDim map[string]map[string]*Stats, pages *int) *exportSource {
+	dimNames := make([]string, 0, len(statsByDim))
+	for dimName := range statsByDim {
+		dimNames = append(dimNames, dimName)
+	}
+	return &exportSource{
+		dimNames: dimNames,
+		listKeys: func(dimName string) ([]string, error) {
+			dimKeys := make([]string, 0, len(statsByDim[dimName]))
+			for dimKey := range statsByDim[dimName] {
+				dimKeys = append(dimKeys, dimKey)
+			}
+			return dimKeys, nil
+		},
+		queryKeys: func(dimName string, dimKeys []string) (map[string]*Stats, error) {
+			*pages++
+			dimStats := make(map[string]*Stats)
+			for _, dimKey := range dimKeys {
+				dimStats[dimKey] = statsByDim[dimName][dimKey]
+			}
+			return dimStats, nil
+		},
+	}
+}
+
+func TestExportRows(t *testing.T) {
+	statsByDim := map[string]map[string]*Stats{
+		"country": map[string]*Stats{
+			"es": &Stats{
+				Counters:      map[string]int64{"bytesGiven": 50},
+				Gauges:        map[string]int64{"online": 7},
+				GaugesCurrent: map[string]int64{"online": 8},
+			},
+			"de": &Stats{
+				Counters:      map[string]int64{"bytesGiven": 20},
+				Gauges:        map[string]int64{},
+				GaugesCurrent: map[string]int64{},
+			},
+		},
+	}
+	columns := &exportColumns{
+		counters:      []string{"bytesGiven"},
+		gauges:        []string{"online", "online"},
+		gaugesCurrent: []string{"online"},
+	}
+
+	var buf bytes.Buffer
+	pages := 0
+	if err := exportRows(exportSourceOf(statsByDim, &pages), newCSVExporter(&buf, columns), func() {}); err != nil {
+		t.Fatalf("Unable to export CSV: %s", err)
+	}
+	expectedCSV := `dim,key,counter.bytesGiven,gauge.online,gaugeCurrent.online
+country,de,20,,
+country,es,50,7,8
+country,total,70,7,8
+`
+	if buf.String() != expectedCSV {
+		t.Errorf("Wrong CSV, expected:\n%s\ngot:\n%s", expectedCSV, buf.String())
+	}
+
+	buf.Reset()
+	if err := exportRows(exportSourceOf(statsByDim, &pages), newNDJSONExporter(&buf), func() {}); err != nil {
+		t.Fatalf("Unable to export NDJSON: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 lines, got %d:\n%s", len(lines), buf.String())
+	}
+	expectedLine := `{"dim":"country","key":"total","counters":{"bytesGiven":70},"gauges":{"online":7},"gaugesCurrent":{"online":8}}`
+	if lines[2] != expectedLine {
+		t.Errorf("Wrong total line, expected:\n%s\ngot:\n%s", expectedLine, lines[2])
+	}
+}
+
+func TestExportRowsPaged(t *testing.T) {
+	dimStats := make(map[string]*Stats)
+	numKeys := 2*exportPageKeys + 1
+	for i := 0; i < numKeys; i++ {
+		stats := newStats()
+		stats.Counters["requests"] = 1
+		dimStats[fmt.Sprintf("key%04d", i)] = stats
+	}
+	statsByDim := map[string]map[string]*Stats{"user": dimStats}
+
+	var buf bytes.Buffer
+	pages := 0
+	if err := exportRows(exportSourceOf(statsByDim, &pages), newNDJSONExporter(&buf), func() {}); err != nil {
+		t.Fatalf("Unable to export: %s", err)
+	}
+	if pages != 3 {
+		t.Errorf("Expected 3 pages to be queried, got %d", pages)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != numKeys+1 {
+		t.Fatalf("Expected %d lines, got %d", numKeys+1, len(lines))
+	}
+	expectedLine := fmt.Sprintf(`{"dim":"user","key":"total","counters":{"requests":%d},"gauges":{},"gaugesCurrent":{}}`, numKeys)
+	if lines[numKeys] != expectedLine {
+		t.Errorf("Wrong total line, expected:\n%s\ngot:\n%s", expectedLine, lines[numKeys])
+	}
+
+	source := exportSourceOf(statsByDim, &pages)
+	source.queryKeys = func(dimName string, dimKeys []string) (map[string]*Stats, error) {
+		return nil, fmt.Errorf("Connection reset")
+	}
+	if err := exportRows(source, newNDJSONExporter(&buf), func() {}); err == nil || !strings.Contains(err.Error(), "Connection reset") {
+		t.Errorf("Query error should have been returned, got %v", err)
+	}
+}
+
+func TestExportFormatFor(t *testing.T) {
+	check := func(url string, accept string, expected string) {
+		r, _ := http.NewRequest("GET", url, nil)
+		r.Header.Set("Accept", accept)
+		format, err := exportFormatFor(r)
+		if err != nil {
+			t.Errorf("Unexpected error for %s: %s", url, err)
+		} else if format != expected {
+			t.Errorf("Wrong format for %s (Accept %s), expected %s, got %s", url, accept, expected, format)
+		}
+	}
+	check("/stats/country", "", formatJSON)
+	check("/stats/country", "text/csv", formatCSV)
+	check("/stats/country", "application/x-ndjson", formatNDJSON)
+	check("/stats/country?format=ndjson", "text/csv", formatNDJSON)
+
+	r, _ := http.NewRequest("GET", "/stats/country?format=xml", nil)
+	if _, err := exportFormatFor(r); err == nil {
+		t.Errorf("Unknown format should have been rejected")
+	}
+}
@@ -0,0 +1,280 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+//
+
+package statshub
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxInfluxLineSize = 1024 * 1024
+)
+
+// WriteResponse is a Response to a line protocol write, which reports errors
+// for individual lines.
+type WriteResponse struct {
+	Response
+	Written    int         `json:"written"`
+	LineErrors []LineError `json:"lineErrors,omitempty"`
+}
+
+// LineError is an error processing a single line of a line protocol write.
+// Lines are numbered starting at 1.
+type LineError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// influxPoint is a single parsed line of InfluxDB line protocol
+type influxPoint struct {
+	id     string
+	update *StatsUpdate
+}
+
+// writeHandler handles requests to /write, which accepts InfluxDB line
+// protocol.  Each line is written as its own StatsUpdate.  The id comes from
+// the tag named by InfluxIdTag (or the idTag query parameter), all other
+// tags become dims.  Stats are named after the measurement and field, with the
+// field type determining the kind of stat:
+//
+//	integer (123i)   - counter
+//	unsigned (123u)  - increment
+//	float (1.5)      - gauge
+//	boolean (true)   - gauge of 1 or 0
+//	string ("bob")   - member
+func (s *Server) writeHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if "POST" != r.Method {
+		w.WriteHeader(405)
+		return
+	}
+
+	idTag := r.URL.Query().Get("idTag")
+	if idTag == "" {
+		idTag = s.opts.InfluxIdTag
+	}
+
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gzipped, err := gzip.NewReader(r.Body)
+		if err != nil {
+			fail(w, 400, fmt.Errorf("Unable to decompress request: %s", err))
+			return
+		}
+		defer gzipped.Close()
+		body = gzipped
+	}
+
+	statusCode, resp := s.writeLines(body, idTag)
+	write(w, statusCode, resp)
+}
+
+// writeLines parses and writes each line from the given reader, reporting
+// errors per line.
+func (s *Server) writeLines(body io.Reader, idTag string) (statusCode int, resp *WriteResponse) {
+	resp = &WriteResponse{}
+	statusCode = 200
+	addError := func(lineNum int, code int, err error) {
+		resp.LineErrors = append(resp.LineErrors, LineError{lineNum, err.Error()})
+		if code > statusCode {
+			statusCode = code
+		}
+	}
+
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), maxInfluxLineSize)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		point, err := parseInfluxLine(line, idTag)
+		if err != nil {
+			addError(lineNum, 400, err)
+			continue
+		}
+		if err = s.Write(point.id, point.update); err != nil {
+			s.log.Printf("Unable to write line %d: %s", lineNum, err)
+			addError(lineNum, 500, fmt.Errorf("Unable to post stats: %s", err))
+			continue
+		}
+		resp.Written++
+	}
+	if err := scanner.Err(); err != nil {
+		addError(lineNum+1, 400, fmt.Errorf("Unable to read request: %s", err))
+	}
+
+	resp.Succeeded = len(resp.LineErrors) == 0
+	if !resp.Succeeded {
+		resp.Error = fmt.Sprintf("%d line(s) failed", len(resp.LineErrors))
+	}
+	return
+}
+
+// parseInfluxLine parses a single line of line protocol, e.g.
+//
+//	traffic,country=es,id=myid1 bytesGiven=500i,online=5 1465839830100400200
+//
+// Timestamps are validated but otherwise ignored, since statshub only tracks
+// current values.
+func parseInfluxLine(line string, idTag string) (point *influxPoint, err error) {
+	sections := splitUnescaped(line, ' ', true)
+	if len(sections) < 2 {
+		return nil, fmt.Errorf("Missing fields")
+	}
+	if len(sections) > 3 {
+		return nil, fmt.Errorf("Unexpected content after timestamp")
+	}
+	if len(sections) == 3 {
+		if _, err = strconv.ParseInt(sections[2], 10, 64); err != nil {
+			return nil, fmt.Errorf("Invalid timestamp %s", sections[2])
+		}
+	}
+
+	seriesParts := splitUnescaped(sections[0], ',', false)
+	measurement := unescapeInflux(seriesParts[0])
+	if measurement == "" {
+		return nil, fmt.Errorf("Missing measurement")
+	}
+
+	point = &influxPoint{
+		update: &StatsUpdate{
+			Dims: make(map[string]string),
+			Stats: Stats{
+				Counters:   make(map[string]int64),
+				Increments: make(map[string]int64),
+				Gauges:     make(map[string]int64),
+				Members:    make(map[string]string),
+			},
+		},
+	}
+
+	for _, tag := range seriesParts[1:] {
+		kv := splitUnescaped(tag, '=', false)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("Invalid tag %s", tag)
+		}
+		name, value := unescapeInflux(kv[0]), unescapeInflux(kv[1])
+		if name == idTag {
+			point.id = value
+		} else {
+			point.update.Dims[name] = value
+		}
+	}
+
+	if point.id == "" {
+		// Points from different sources would otherwise be merged into one id
+		return nil, fmt.Errorf("Missing %s tag", idTag)
+	}
+
+	for _, field := range splitUnescaped(sections[1], ',', true) {
+		kv := splitUnescaped(field, '=', true)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("Invalid field %s", field)
+		}
+		fieldName := unescapeInflux(kv[0])
+		statName := measurement + "_" + fieldName
+		if fieldName == "value" {
+			statName = measurement
+		}
+		if err = point.recordField(statName, kv[1]); err != nil {
+			return nil, fmt.Errorf("Invalid value for field %s: %s", fieldName, err)
+		}
+	}
+
+	return point, nil
+}
+
+// recordField records a field value on the point's StatsUpdate according to
+// its type.
+func (point *influxPoint) recordField(statName string, raw string) error {
+	stats := point.update
+	last := raw[len(raw)-1]
+	switch {
+	case raw[0] == '"':
+		if len(raw) < 2 || last != '"' {
+			return fmt.Errorf("Unterminated string %s", raw)
+		}
+		member := raw[1 : len(raw)-1]
+		member = strings.Replace(member, `\"`, `"`, -1)
+		member = strings.Replace(member, `\\`, `\`, -1)
+		stats.Members[statName] = member
+	case last == 'i':
+		val, err := strconv.ParseInt(raw[:len(raw)-1], 10, 64)
+		if err != nil {
+			return err
+		}
+		stats.Counters[statName] = val
+	case last == 'u':
+		val, err := strconv.ParseUint(raw[:len(raw)-1], 10, 63)
+		if err != nil {
+			return err
+		}
+		stats.Increments[statName] = int64(val)
+	default:
+		switch raw {
+		case "t", "T", "true", "True", "TRUE":
+			stats.Gauges[statName] = 1
+		case "f", "F", "false", "False", "FALSE":
+			stats.Gauges[statName] = 0
+		default:
+			val, err := strconv.ParseFloat(raw, 64)
+			if err != nil {
+				return err
+			}
+			stats.Gauges[statName] = int64(math.Floor(val + 0.5))
+		}
+	}
+	return nil
+}
+
+// splitUnescaped splits s on every occurrence of sep that isn't escaped with a
+// backslash (and, if honorQuotes is true, isn't inside a double quoted string).
+// Escape sequences are left in place.
+func splitUnescaped(s string, sep byte, honorQuotes bool) []string {
+	var parts []string
+	inQuotes := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\':
+			i++
+		case c == '"' && honorQuotes:
+			inQuotes = !inQuotes
+		case c == sep && !inQuotes:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// unescapeInflux removes the backslashes that escape commas, equals signs and
+// spaces in measurements, tags and field keys.
+func unescapeInflux(s string) string {
+	s = strings.Replace(s, `\,`, ",", -1)
+	s = strings.Replace(s, `\=`, "=", -1)
+	return strings.Replace(s, `\ `, " ", -1)
+}
@@ -0,0 +1,89 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+//
+
+package statshub
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseInfluxLine(t *testing.T) {
+	point, err := parseInfluxLine(`traffic,country=es,id=myid1,os=mac\ os bytesGiven=500i,requests=3u,online=4.6,up=true,user="bob \"b\"",value=7 1465839830100400200`, "id")
+	if err != nil {
+		t.Fatalf("Unable to parse line: %s", err)
+	}
+	if point.id != "myid1" {
+		t.Errorf("Wrong id: %s", point.id)
+	}
+	update := point.update
+	if len(update.Dims) != 2 || update.Dims["country"] != "es" || update.Dims["os"] != "mac os" {
+		t.Errorf("Wrong dims: %v", update.Dims)
+	}
+	if update.Counters["traffic_bytesGiven"] != 500 {
+		t.Errorf("Wrong counter: %v", update.Counters)
+	}
+	if update.Increments["traffic_requests"] != 3 {
+		t.Errorf("Wrong increment: %v", update.Increments)
+	}
+	if update.Gauges["traffic_online"] != 5 || update.Gauges["traffic_up"] != 1 || update.Gauges["traffic"] != 7 {
+		t.Errorf("Wrong gauges: %v", update.Gauges)
+	}
+	if update.Members["traffic_user"] != `bob "b"` {
+		t.Errorf("Wrong member: %v", update.Members)
+	}
+
+	point, err = parseInfluxLine("traffic,host=a bytesGiven=1i", "host")
+	if err != nil {
+		t.Fatalf("Unable to parse line with only an id tag: %s", err)
+	}
+	if point.id != "a" || len(point.update.Dims) != 0 {
+		t.Errorf("Wrong id or dims: %s %v", point.id, point.update.Dims)
+	}
+
+	if _, err = parseInfluxLine("traffic,country=es bytesGiven=1i", "id"); err == nil || err.Error() != "Missing id tag" {
+		t.Errorf("Line without an id should be rejected, got %v", err)
+	}
+}
+
+func TestParseInfluxLineErrors(t *testing.T) {
+	for _, bad := range []string{
+		"traffic",
+		"traffic,id=a,country bytesGiven=1i",
+		"traffic,id=a bytesGiven",
+		"traffic,id=a bytesGiven=abc",
+		"traffic,id=a bytesGiven=1i notatimestamp",
+		`traffic,id=a user="bob`,
+		"traffic bytesGiven=1i",
+	} {
+		if _, err := parseInfluxLine(bad, "id"); err == nil {
+			t.Errorf("Parsing %s should have failed", bad)
+		}
+	}
+}
+
+func TestWriteLinesReportsErrorsPerLine(t *testing.T) {
+	// Only unparseable lines are included so that nothing is written to redis
+	statusCode, resp := NewServer(Options{}).writeLines(strings.NewReader("# comment\n\ntraffic\ntraffic,id=a bytesGiven=abc\ntraffic bytesGiven=1i\n"), "id")
+	if statusCode != 400 {
+		t.Errorf("Expected 400, got %d", statusCode)
+	}
+	if resp.Succeeded || len(resp.LineErrors) != 3 {
+		t.Fatalf("Expected 3 line errors, got %+v", resp)
+	}
+	if resp.LineErrors[0].Line != 3 || resp.LineErrors[1].Line != 4 || resp.LineErrors[2].Line != 5 {
+		t.Errorf("Wrong line numbers: %+v", resp.LineErrors)
+	}
+}
@@ -0,0 +1,349 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+//
+
+package statshub
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	prometheusContentType  = "text/plain; version=0.0.4; charset=utf-8"
+	openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+	// metricsPageKeys is how many keys of a dimension are read at a time
+	metricsPageKeys = 100
+)
+
+// metricsSnapshot is the result of a single query for metrics, which is cached
+// for MetricsCacheExpiration so that frequent scrapes don't hammer redis.
+type metricsSnapshot struct {
+	statsByDim map[string]map[string]*Stats
+	memberKeys map[string]bool
+
+	// skippedKeys is the number of dimension keys that weren't read because
+	// MetricsMaxSeries had been reached
+	skippedKeys int
+
+	// streaming are the Server's own streaming metrics, which aren't cached
+	streaming *streamingMetrics
+}
+
+// streamingMetrics describe the Server's streaming clients
+type streamingMetrics struct {
+	clients        int64
+	droppedUpdates int64
+	evictedClients int64
+}
+
+// metricsHandler handles requests to /metrics by rendering the rollups for
+// the configured MetricsDims in the Prometheus text exposition format (or
+// OpenMetrics if the scraper asks for it).
+func (s *Server) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if "GET" != r.Method {
+		w.WriteHeader(405)
+		return
+	}
+
+	snapshot, err := s.cachedMetrics()
+	if err != nil {
+		s.log.Printf("Unable to query metrics: %s", err)
+		http.Error(w, fmt.Sprintf("Unable to query metrics: %s", err), 500)
+		return
+	}
+
+	openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+	if openMetrics {
+		w.Header().Set("Content-Type", openMetricsContentType)
+	} else {
+		w.Header().Set("Content-Type", prometheusContentType)
+	}
+
+	withStreaming := *snapshot
+	withStreaming.streaming = &streamingMetrics{
+		clients:        atomic.LoadInt64(&s.numStreamingClients),
+		droppedUpdates: atomic.LoadInt64(&s.droppedStreamingUpdates),
+		evictedClients: atomic.LoadInt64(&s.evictedStreamingClients),
+	}
+
+	var buf bytes.Buffer
+	dropped := writeMetrics(&buf, &withStreaming, s.opts.MetricsMaxSeries, openMetrics)
+	if dropped > 0 || snapshot.skippedKeys > 0 {
+		s.log.Printf("Dropped %d metrics series and skipped %d keys in excess of MetricsMaxSeries (%d)", dropped, snapshot.skippedKeys, s.opts.MetricsMaxSeries)
+	}
+	w.WriteHeader(200)
+	w.Write(buf.Bytes())
+}
+
+// cachedMetrics returns the cached metricsSnapshot, querying redis if the
+// cache has expired.
+func (s *Server) cachedMetrics() (*metricsSnapshot, error) {
+	s.metricsMutex.Lock()
+	defer s.metricsMutex.Unlock()
+
+	if s.metricsCache != nil && s.clock.Now().Sub(s.metricsCachedAt) < s.opts.MetricsCacheExpiration {
+		return s.metricsCache, nil
+	}
+
+	snapshot, err := s.queryMetrics()
+	if err != nil {
+		return nil, err
+	}
+	s.metricsCache = snapshot
+	s.metricsCachedAt = s.clock.Now()
+	return snapshot, nil
+}
+
+// queryMetrics queries the rollups for the configured dims along with the
+// list of member stat keys, which are reported as gauges by QueryDims.  Keys
+// are read metricsPageKeys at a time and reading stops once MetricsMaxSeries
+// series have been read, so a dimension with many keys doesn't make every
+// scrape read all of them.  The total of a dimension that wasn't read
+// completely is omitted.
+func (s *Server) queryMetrics() (snapshot *metricsSnapshot, err error) {
+	snapshot = &metricsSnapshot{
+		statsByDim: make(map[string]map[string]*Stats),
+		memberKeys: make(map[string]bool),
+	}
+
+	conn := s.connect()
+	defer conn.Close()
+
+	var memberKeys []string
+	if memberKeys, err = listStatKeys(conn, "member"); err != nil {
+		return nil, fmt.Errorf("Unable to list member keys: %s", err)
+	}
+	for _, key := range memberKeys {
+		snapshot.memberKeys[key] = true
+	}
+
+	dimNames := append([]string{}, s.opts.MetricsDims...)
+	sort.Strings(dimNames)
+	numSeries := 0
+	for _, dimName := range dimNames {
+		var allKeys []string
+		if allKeys, err = listDimKeys(conn, dimName); err != nil {
+			return nil, fmt.Errorf("Unable to list keys for dimension %s: %s", dimName, err)
+		}
+		dimKeys := make([]string, 0, len(allKeys))
+		for _, dimKey := range allKeys {
+			if dimKey != "total" {
+				dimKeys = append(dimKeys, dimKey)
+			}
+		}
+		sort.Strings(dimKeys)
+
+		dimStats := make(map[string]*Stats)
+		total := newStats()
+		complete := true
+		for start := 0; start < len(dimKeys); start += metricsPageKeys {
+			if numSeries >= s.opts.MetricsMaxSeries {
+				snapshot.skippedKeys += len(dimKeys) - start
+				complete = false
+				break
+			}
+			end := start + metricsPageKeys
+			if end > len(dimKeys) {
+				end = len(dimKeys)
+			}
+			var pageStats map[string]*Stats
+			if pageStats, err = s.queryDimKeys(conn, dimName, dimKeys[start:end]); err != nil {
+				return nil, err
+			}
+			for dimKey, stats := range pageStats {
+				dimStats[dimKey] = stats
+				numSeries += numStatSeries(stats)
+				addTo(total.Counters, stats.Counters)
+				addTo(total.Gauges, stats.Gauges)
+				addTo(total.GaugesCurrent, stats.GaugesCurrent)
+			}
+		}
+		if complete {
+			dimStats["total"] = total
+			numSeries += numStatSeries(total)
+		}
+		snapshot.statsByDim[dimName] = dimStats
+	}
+	return
+}
+
+// numStatSeries returns the number of series that writeMetrics writes for
+// stats
+func numStatSeries(stats *Stats) int {
+	return len(stats.Counters) + len(stats.Gauges) + len(stats.GaugesCurrent)
+}
+
+// metricFamily is a group of samples that share a metric name and type
+type metricFamily struct {
+	name    string
+	help    string
+	samples []string
+}
+
+// writeMetrics writes the given snapshot to out in the Prometheus text
+// exposition format.  At most maxSeries samples are written, the number of
+// samples that were omitted is returned as dropped.
+func writeMetrics(out io.Writer, snapshot *metricsSnapshot, maxSeries int, openMetrics bool) (dropped int) {
+	counters := &metricFamily{name: "statshub_counter", help: "Counters rolled up by dimension key."}
+	gauges := &metricFamily{name: "statshub_gauge", help: "Gauges rolled up by dimension key, for the prior and current periods."}
+	members := &metricFamily{name: "statshub_member", help: "Count of unique members rolled up by dimension key."}
+
+	counterName := counters.name
+	if openMetrics {
+		// OpenMetrics requires counter samples to carry the _total suffix
+		counterName += "_total"
+	}
+
+	numSeries := 0
+	add := func(family *metricFamily, name string, labels string, val int64) {
+		if numSeries >= maxSeries {
+			dropped++
+			return
+		}
+		numSeries++
+		family.samples = append(family.samples, fmt.Sprintf("%s{%s} %d", name, labels, val))
+	}
+
+	for _, dimName := range sortedKeys(snapshot.statsByDim) {
+		dimStats := snapshot.statsByDim[dimName]
+		dimKeys := make([]string, 0, len(dimStats))
+		for dimKey := range dimStats {
+			dimKeys = append(dimKeys, dimKey)
+		}
+		sort.Strings(dimKeys)
+
+		for _, dimKey := range dimKeys {
+			stats := dimStats[dimKey]
+			for _, stat := range sortedStatNames(stats.Counters) {
+				add(counters, counterName, metricLabels(stat, dimName, dimKey, ""), stats.Counters[stat])
+			}
+			for _, stat := range sortedStatNames(stats.Gauges) {
+				if snapshot.memberKeys[stat] {
+					add(members, members.name, metricLabels(stat, dimName, dimKey, ""), stats.Gauges[stat])
+				} else {
+					add(gauges, gauges.name, metricLabels(stat, dimName, dimKey, "prior"), stats.Gauges[stat])
+				}
+			}
+			for _, stat := range sortedStatNames(stats.GaugesCurrent) {
+				add(gauges, gauges.name, metricLabels(stat, dimName, dimKey, "current"), stats.GaugesCurrent[stat])
+			}
+		}
+	}
+
+	writeFamily(out, counters, "counter")
+	writeFamily(out, gauges, "gauge")
+	writeFamily(out, members, "gauge")
+
+	fmt.Fprintf(out, "# HELP statshub_metrics_dropped_series Series omitted because of the series limit.\n")
+	fmt.Fprintf(out, "# TYPE statshub_metrics_dropped_series gauge\n")
+	fmt.Fprintf(out, "statshub_metrics_dropped_series %d\n", dropped)
+	fmt.Fprintf(out, "# HELP statshub_metrics_skipped_keys Dimension keys that weren't read because of the series limit.\n")
+	fmt.Fprintf(out, "# TYPE statshub_metrics_skipped_keys gauge\n")
+	fmt.Fprintf(out, "statshub_metrics_skipped_keys %d\n", snapshot.skippedKeys)
+
+	if snapshot.streaming != nil {
+		writeStreamingMetrics(out, snapshot.streaming, openMetrics)
+	}
+
+	if openMetrics {
+		fmt.Fprint(out, "# EOF\n")
+	}
+	return
+}
+
+func writeStreamingMetrics(out io.Writer, streaming *streamingMetrics, openMetrics bool) {
+	suffix := ""
+	if openMetrics {
+		suffix = "_total"
+	}
+	fmt.Fprintf(out, "# HELP statshub_streaming_clients Connected streaming clients.\n")
+	fmt.Fprintf(out, "# TYPE statshub_streaming_clients gauge\n")
+	fmt.Fprintf(out, "statshub_streaming_clients %d\n", streaming.clients)
+	fmt.Fprintf(out, "# HELP statshub_streaming_dropped_updates Updates dropped because streaming clients fell behind.\n")
+	fmt.Fprintf(out, "# TYPE statshub_streaming_dropped_updates counter\n")
+	fmt.Fprintf(out, "statshub_streaming_dropped_updates%s %d\n", suffix, streaming.droppedUpdates)
+	fmt.Fprintf(out, "# HELP statshub_streaming_evicted_clients Streaming clients evicted for falling behind.\n")
+	fmt.Fprintf(out, "# TYPE statshub_streaming_evicted_clients counter\n")
+	fmt.Fprintf(out, "statshub_streaming_evicted_clients%s %d\n", suffix, streaming.evictedClients)
+}
+
+func writeFamily(out io.Writer, family *metricFamily, metricType string) {
+	if len(family.samples) == 0 {
+		return
+	}
+	fmt.Fprintf(out, "# HELP %s %s\n", family.name, family.help)
+	fmt.Fprintf(out, "# TYPE %s %s\n", family.name, metricType)
+	for _, sample := range family.samples {
+		fmt.Fprintln(out, sample)
+	}
+}
+
+// metricLabels builds the label set for a sample, omitting the period label
+// if it's empty.
+func metricLabels(stat string, dimName string, dimKey string, period string) string {
+	labels := fmt.Sprintf("stat=\"%s\",dim=\"%s\",key=\"%s\"",
+		escapeLabelValue(stat),
+		escapeLabelValue(dimName),
+		escapeLabelValue(dimKey))
+	if period != "" {
+		labels += fmt.Sprintf(",period=\"%s\"", period)
+	}
+	return labels
+}
+
+// escapeLabelValue escapes backslashes, double quotes and line feeds as
+// required by the exposition format.
+func escapeLabelValue(val string) string {
+	val = strings.Replace(val, `\`, `\\`, -1)
+	val = strings.Replace(val, `"`, `\"`, -1)
+	return strings.Replace(val, "\n", `\n`, -1)
+}
+
+func sortedKeys(statsByDim map[string]map[string]*Stats) []string {
+	keys := make([]string, 0, len(statsByDim))
+	for key := range statsByDim {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedStatNames(values map[string]int64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// DimNamesFromList parses a comma-separated list of dimension names, returning
+// nil (meaning all dimensions) if the list is empty.
+func DimNamesFromList(list string) []string {
+	var dimNames []string
+	for _, dimName := range strings.Split(list, ",") {
+		dimName = strings.ToLower(strings.TrimSpace(dimName))
+		if dimName != "" {
+			dimNames = append(dimNames, dimName)
+		}
+	}
+	return dimNames
+}
@@ -0,0 +1,134 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+//
+
+package statshub
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	snapshot := &metricsSnapshot{
+		statsByDim: map[string]map[string]*Stats{
+			"country": map[string]*Stats{
+				"es": &Stats{
+					Counters:      map[string]int64{"bytesGiven": 50},
+					Gauges:        map[string]int64{"online": 5, "users": 2},
+					GaugesCurrent: map[string]int64{"online": 6},
+				},
+				"total": &Stats{
+					Counters:      map[string]int64{"bytesGiven": 50},
+					Gauges:        map[string]int64{"online": 5, "users": 2},
+					GaugesCurrent: map[string]int64{"online": 6},
+				},
+			},
+		},
+		memberKeys: map[string]bool{"users": true},
+	}
+
+	var buf bytes.Buffer
+	dropped := writeMetrics(&buf, snapshot, 100, false)
+	if dropped != 0 {
+		t.Errorf("Nothing should have been dropped, got %d", dropped)
+	}
+	out := buf.String()
+	expected := []string{
+		"# TYPE statshub_counter counter",
+		`statshub_counter{stat="bytesGiven",dim="country",key="es"} 50`,
+		`statshub_counter{stat="bytesGiven",dim="country",key="total"} 50`,
+		`statshub_gauge{stat="online",dim="country",key="es",period="prior"} 5`,
+		`statshub_gauge{stat="online",dim="country",key="es",period="current"} 6`,
+		`statshub_member{stat="users",dim="country",key="es"} 2`,
+		"statshub_metrics_dropped_series 0",
+	}
+	for _, line := range expected {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("Missing line %s in:\n%s", line, out)
+		}
+	}
+	if strings.Contains(out, `statshub_gauge{stat="users"`) {
+		t.Errorf("Members should not be reported as plain gauges:\n%s", out)
+	}
+
+	buf.Reset()
+	snapshot.streaming = &streamingMetrics{clients: 2, droppedUpdates: 4, evictedClients: 1}
+	dropped = writeMetrics(&buf, snapshot, 3, true)
+	if dropped != 5 {
+		t.Errorf("Expected 5 dropped series, got %d", dropped)
+	}
+	out = buf.String()
+	if !strings.Contains(out, `statshub_counter_total{stat="bytesGiven",dim="country",key="es"} 50`) {
+		t.Errorf("OpenMetrics counters should have _total suffix:\n%s", out)
+	}
+	for _, line := range []string{
+		"statshub_streaming_clients 2",
+		"statshub_streaming_dropped_updates_total 4",
+		"statshub_streaming_evicted_clients_total 1",
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("Missing line %s in:\n%s", line, out)
+		}
+	}
+	if !strings.HasSuffix(out, "# EOF\n") {
+		t.Errorf("OpenMetrics output should end with # EOF:\n%s", out)
+	}
+}
+
+func TestEscapeLabelValue(t *testing.T) {
+	escaped := escapeLabelValue("a\"b\\c\nd")
+	if escaped != `a\"b\\c\nd` {
+		t.Errorf("Wrong escaping: %s", escaped)
+	}
+}
+
+func TestQueryMetricsStopsAtMaxSeries(t *testing.T) {
+	var users []string
+	for i := 0; i < 250; i++ {
+		users = append(users, fmt.Sprintf("user%03d", i))
+	}
+	s := NewServer(Options{
+		Store: setsStore{
+			"dim:country": {"es"},
+			"dim:user":    users,
+			"key:counter": {"requests"},
+		},
+		MetricsDims:      []string{"user", "country"},
+		MetricsMaxSeries: 150,
+	})
+	snapshot, err := s.queryMetrics()
+	if err != nil {
+		t.Fatalf("Unable to query metrics: %s", err)
+	}
+	if country := snapshot.statsByDim["country"]; len(country) != 2 || country["total"] == nil {
+		t.Errorf("country should have been read completely: %v", country)
+	}
+	// country's 2 series plus 2 pages of users reach the cap
+	user := snapshot.statsByDim["user"]
+	if len(user) != 200 || snapshot.skippedKeys != 50 {
+		t.Errorf("Expected 200 users to be read and 50 skipped, got %d and %d", len(user), snapshot.skippedKeys)
+	}
+	if user["total"] != nil {
+		t.Errorf("Incomplete dimension shouldn't have a total")
+	}
+
+	var buf bytes.Buffer
+	writeMetrics(&buf, snapshot, 150, false)
+	if !strings.Contains(buf.String(), "statshub_metrics_skipped_keys 50\n") {
+		t.Errorf("Skipped keys should have been reported:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,363 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+//
+
+package statshub
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	otlpInstanceIdAttribute = "service.instance.id"
+
+	// Values of aggregationTemporality
+	otlpTemporalityDelta      = 1
+	otlpTemporalityCumulative = 2
+)
+
+// otlpRequest is the JSON encoding of an OTLP ExportMetricsServiceRequest,
+// limited to the parts that statshub understands.
+type otlpRequest struct {
+	ResourceMetrics []struct {
+		Resource struct {
+			Attributes []otlpAttribute `json:"attributes"`
+		} `json:"resource"`
+		ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+		// InstrumentationLibraryMetrics is the pre 0.15 name for ScopeMetrics
+		InstrumentationLibraryMetrics []otlpScopeMetrics `json:"instrumentationLibraryMetrics"`
+	} `json:"resourceMetrics"`
+}
+
+type otlpScopeMetrics struct {
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpMetric struct {
+	Name string `json:"name"`
+	Sum  *struct {
+		DataPoints             []otlpDataPoint `json:"dataPoints"`
+		AggregationTemporality otlpTemporality `json:"aggregationTemporality"`
+	} `json:"sum"`
+	Gauge *struct {
+		DataPoints []otlpDataPoint `json:"dataPoints"`
+	} `json:"gauge"`
+}
+
+type otlpDataPoint struct {
+	Attributes []otlpAttribute `json:"attributes"`
+	AsInt      *otlpInt        `json:"asInt"`
+	AsDouble   *float64        `json:"asDouble"`
+}
+
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue *string  `json:"stringValue"`
+		IntValue    *otlpInt `json:"intValue"`
+		DoubleValue *float64 `json:"doubleValue"`
+		BoolValue   *bool    `json:"boolValue"`
+	} `json:"value"`
+}
+
+// otlpInt is an int64, which the OTLP JSON encoding represents as a string
+// but which some exporters send as a number.
+type otlpInt int64
+
+func (i *otlpInt) UnmarshalJSON(data []byte) error {
+	str := strings.Trim(string(data), `"`)
+	val, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid int64 %s", data)
+	}
+	*i = otlpInt(val)
+	return nil
+}
+
+// otlpTemporality is an AggregationTemporality, which is normally encoded as
+// an integer but is also accepted by its enum name.
+type otlpTemporality int
+
+func (t *otlpTemporality) UnmarshalJSON(data []byte) error {
+	switch strings.Trim(string(data), `"`) {
+	case "1", "AGGREGATION_TEMPORALITY_DELTA":
+		*t = otlpTemporalityDelta
+	case "2", "AGGREGATION_TEMPORALITY_CUMULATIVE":
+		*t = otlpTemporalityCumulative
+	default:
+		*t = 0
+	}
+	return nil
+}
+
+// otlpResponse is the JSON encoding of an OTLP ExportMetricsServiceResponse
+type otlpResponse struct {
+	PartialSuccess *otlpPartialSuccess `json:"partialSuccess,omitempty"`
+}
+
+type otlpPartialSuccess struct {
+	RejectedDataPoints int64  `json:"rejectedDataPoints"`
+	ErrorMessage       string `json:"errorMessage,omitempty"`
+}
+
+// otlpStatus is the body of an unsuccessful OTLP/HTTP response
+type otlpStatus struct {
+	Message string `json:"message"`
+}
+
+// otlpHandler handles OTLP/HTTP metric exports (JSON encoding only) to
+// /v1/metrics.
+func (s *Server) otlpHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if "POST" != r.Method {
+		w.WriteHeader(405)
+		return
+	}
+	if contentType := r.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "application/json") {
+		write(w, 415, &otlpStatus{Message: fmt.Sprintf("Unsupported Content-Type %s, only application/json is supported", contentType)})
+		return
+	}
+
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gzipped, err := gzip.NewReader(r.Body)
+		if err != nil {
+			write(w, 400, &otlpStatus{Message: fmt.Sprintf("Unable to decompress request: %s", err)})
+			return
+		}
+		defer gzipped.Close()
+		body = gzipped
+	}
+
+	req := &otlpRequest{}
+	if err := json.NewDecoder(body).Decode(req); err != nil {
+		write(w, 400, &otlpStatus{Message: fmt.Sprintf("Unable to decode request: %s", err)})
+		return
+	}
+
+	updates, rejected, rejectedReason := updatesFromOTLP(req)
+	if len(updates) == 0 && rejected > 0 {
+		// Retrying wouldn't help
+		write(w, 400, &otlpStatus{Message: rejectedReason})
+		return
+	}
+
+	// The updates are valid, so writing them only fails if Redis does
+	written := 0
+	var writeErr error
+	for _, update := range updates {
+		if err := s.Write(update.id, update.StatsUpdate); err != nil {
+			writeErr = fmt.Errorf("Unable to post stats: %s", err)
+			s.log.Println(writeErr)
+			rejected += update.points
+			rejectedReason = writeErr.Error()
+			continue
+		}
+		written++
+	}
+	if writeErr != nil && written == 0 {
+		// Nothing was written, so the exporter can safely retry
+		write(w, 503, &otlpStatus{Message: writeErr.Error()})
+		return
+	}
+
+	// Otherwise retrying would apply the written increments again, so the
+	// points that weren't written are rejected instead, which isn't retried
+	resp := &otlpResponse{}
+	if rejected > 0 {
+		resp.PartialSuccess = &otlpPartialSuccess{rejected, rejectedReason}
+	}
+	write(w, 200, resp)
+}
+
+// otlpUpdate is a StatsUpdate along with the id to which it should be written
+// and the number of data points in it
+type otlpUpdate struct {
+	id     string
+	points int64
+	*StatsUpdate
+}
+
+// updatesFromOTLP converts an OTLP request into StatsUpdates, one for each
+// combination of id and dims, in the order in which they first appear.  Sums
+// become counters (if cumulative) or increments (if delta) and gauges become
+// gauges.  Other metric types and the points of invalid updates are rejected.
+func updatesFromOTLP(req *otlpRequest) (updates []*otlpUpdate, rejected int64, rejectedReason string) {
+	updatesByKey := make(map[string]*otlpUpdate)
+	reject := func(count int, reason string) {
+		rejected += int64(count)
+		rejectedReason = reason
+	}
+
+	for _, resourceMetrics := range req.ResourceMetrics {
+		id := ""
+		resourceDims := make(map[string]string)
+		for _, attribute := range resourceMetrics.Resource.Attributes {
+			if value, ok := attribute.stringValue(); ok {
+				if attribute.Key == otlpInstanceIdAttribute {
+					id = value
+				} else {
+					resourceDims[otlpName(attribute.Key)] = value
+				}
+			}
+		}
+
+		scopeMetrics := append(resourceMetrics.ScopeMetrics, resourceMetrics.InstrumentationLibraryMetrics...)
+		if id == "" {
+			// Points from different sources would otherwise be merged into
+			// one id
+			for _, scope := range scopeMetrics {
+				for _, metric := range scope.Metrics {
+					reject(metric.numDataPoints(), fmt.Sprintf("Resource has no %s attribute", otlpInstanceIdAttribute))
+				}
+			}
+			continue
+		}
+
+		updateFor := func(point otlpDataPoint) *StatsUpdate {
+			dims := make(map[string]string)
+			for name, value := range resourceDims {
+				dims[name] = value
+			}
+			for _, attribute := range point.Attributes {
+				if value, ok := attribute.stringValue(); ok {
+					dims[otlpName(attribute.Key)] = value
+				}
+			}
+			key := updateKey(id, dims)
+			update := updatesByKey[key]
+			if update == nil {
+				update = &otlpUpdate{
+					id: id,
+					StatsUpdate: &StatsUpdate{
+						Dims: dims,
+						Stats: Stats{
+							Counters:   make(map[string]int64),
+							Increments: make(map[string]int64),
+							Gauges:     make(map[string]int64),
+						},
+					},
+				}
+				updatesByKey[key] = update
+				updates = append(updates, update)
+			}
+			update.points++
+			return update.StatsUpdate
+		}
+
+		for _, scope := range scopeMetrics {
+			for _, metric := range scope.Metrics {
+				name := otlpName(metric.Name)
+				switch {
+				case metric.Sum != nil:
+					temporality := metric.Sum.AggregationTemporality
+					if temporality != otlpTemporalityDelta && temporality != otlpTemporalityCumulative {
+						reject(len(metric.Sum.DataPoints), fmt.Sprintf("Sum %s has unspecified aggregationTemporality", metric.Name))
+						continue
+					}
+					for _, point := range metric.Sum.DataPoints {
+						val, ok := point.value()
+						if !ok {
+							reject(1, fmt.Sprintf("Data point for %s has no value", metric.Name))
+							continue
+						}
+						if temporality == otlpTemporalityDelta {
+							updateFor(point).Increments[name] += val
+						} else {
+							updateFor(point).Counters[name] = val
+						}
+					}
+				case metric.Gauge != nil:
+					for _, point := range metric.Gauge.DataPoints {
+						val, ok := point.value()
+						if !ok {
+							reject(1, fmt.Sprintf("Data point for %s has no value", metric.Name))
+							continue
+						}
+						updateFor(point).Gauges[name] = val
+					}
+				default:
+					reject(1, fmt.Sprintf("Metric %s has an unsupported type, only sum and gauge are supported", metric.Name))
+				}
+			}
+		}
+	}
+
+	// Validating up front means that an invalid update can't stop valid ones
+	// from being written
+	valid := updates[:0]
+	for _, update := range updates {
+		if err := update.validate(); err != nil {
+			reject(int(update.points), err.Error())
+		} else {
+			valid = append(valid, update)
+		}
+	}
+	updates = valid
+
+	return
+}
+
+// numDataPoints returns the number of data points of a metric, counting
+// metrics of unsupported types as one
+func (metric otlpMetric) numDataPoints() int {
+	switch {
+	case metric.Sum != nil:
+		return len(metric.Sum.DataPoints)
+	case metric.Gauge != nil:
+		return len(metric.Gauge.DataPoints)
+	}
+	return 1
+}
+
+// value returns the data point's value as an int64, rounding doubles
+func (point otlpDataPoint) value() (int64, bool) {
+	if point.AsInt != nil {
+		return int64(*point.AsInt), true
+	}
+	if point.AsDouble != nil {
+		return int64(math.Floor(*point.AsDouble + 0.5)), true
+	}
+	return 0, false
+}
+
+// stringValue returns the attribute's scalar value as a string.  Array and
+// key/value list values aren't supported.
+func (attribute otlpAttribute) stringValue() (string, bool) {
+	value := attribute.Value
+	switch {
+	case value.StringValue != nil:
+		return *value.StringValue, *value.StringValue != ""
+	case value.IntValue != nil:
+		return strconv.FormatInt(int64(*value.IntValue), 10), true
+	case value.DoubleValue != nil:
+		return strconv.FormatFloat(*value.DoubleValue, 'f', -1, 64), true
+	case value.BoolValue != nil:
+		return strconv.FormatBool(*value.BoolValue), true
+	}
+	return "", false
+}
+
+// otlpName converts OpenTelemetry's dotted names (e.g. service.name) into
+// names that are safe to use as dims and stats (e.g. service_name).
+func otlpName(name string) string {
+	return strings.Replace(name, ".", "_", -1)
+}
@@ -0,0 +1,224 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+//
+
+package statshub
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const otlpTestRequest = `{
+  "resourceMetrics": [{
+    "resource": {
+      "attributes": [
+        {"key": "service.instance.id", "value": {"stringValue": "myid1"}},
+        {"key": "service.name", "value": {"stringValue": "flashlight"}}
+      ]
+    },
+    "scopeMetrics": [{
+      "metrics": [
+        {
+          "name": "bytes.given",
+          "sum": {
+            "aggregationTemporality": 2,
+            "isMonotonic": true,
+            "dataPoints": [{"attributes": [{"key": "country", "value": {"stringValue": "es"}}], "asInt": "500"}]
+          }
+        },
+        {
+          "name": "requests",
+          "sum": {
+            "aggregationTemporality": "AGGREGATION_TEMPORALITY_DELTA",
+            "dataPoints": [
+              {"attributes": [{"key": "country", "value": {"stringValue": "es"}}], "asInt": 3},
+              {"attributes": [{"key": "country", "value": {"stringValue": "es"}}], "asInt": "4"}
+            ]
+          }
+        },
+        {
+          "name": "online",
+          "gauge": {
+            "dataPoints": [{"attributes": [{"key": "country", "value": {"stringValue": "de"}}], "asDouble": 4.6}]
+          }
+        },
+        {
+          "name": "latency",
+          "histogram": {"dataPoints": [{}]}
+        }
+      ]
+    }]
+  }]
+}`
+
+func TestUpdatesFromOTLP(t *testing.T) {
+	req := &otlpRequest{}
+	if err := json.Unmarshal([]byte(otlpTestRequest), req); err != nil {
+		t.Fatalf("Unable to decode request: %s", err)
+	}
+
+	updates, rejected, _ := updatesFromOTLP(req)
+	if rejected != 1 {
+		t.Errorf("Histogram should have been rejected, rejected %d", rejected)
+	}
+	if len(updates) != 2 {
+		t.Fatalf("Expected 2 updates, got %d", len(updates))
+	}
+
+	// Updates are in the order in which they first appear
+	es := updates[0]
+	if es.Dims["country"] != "es" || es.Dims["service_name"] != "flashlight" {
+		t.Fatalf("Wrong dims for es: %v", es.Dims)
+	}
+	if es.id != "myid1" {
+		t.Errorf("Wrong id: %s", es.id)
+	}
+	if es.Counters["bytes_given"] != 500 {
+		t.Errorf("Wrong counters: %v", es.Counters)
+	}
+	if es.Increments["requests"] != 7 {
+		t.Errorf("Wrong increments: %v", es.Increments)
+	}
+
+	de := updates[1]
+	if de.Dims["country"] != "de" {
+		t.Fatalf("Wrong dims for de: %v", de.Dims)
+	}
+	if de.Gauges["online"] != 5 {
+		t.Errorf("Wrong gauges: %v", de.Gauges)
+	}
+
+	// Invalid updates are rejected without affecting the others
+	totalReq := &otlpRequest{}
+	if err := json.Unmarshal([]byte(strings.Replace(otlpTestRequest, `"es"`, `"Total"`, -1)), totalReq); err != nil {
+		t.Fatalf("Unable to decode request: %s", err)
+	}
+	updates, rejected, reason := updatesFromOTLP(totalReq)
+	if len(updates) != 1 || updates[0].Dims["country"] != "de" || rejected != 4 || !strings.Contains(reason, "'total' is not allowed") {
+		t.Errorf("Only the points of the total update should be rejected, got %d updates and %d rejected: %s", len(updates), rejected, reason)
+	}
+
+	// Without an instance id, every point is rejected
+	req.ResourceMetrics[0].Resource.Attributes = req.ResourceMetrics[0].Resource.Attributes[1:]
+	updates, rejected, reason = updatesFromOTLP(req)
+	if len(updates) != 0 || rejected != 5 || reason != "Resource has no service.instance.id attribute" {
+		t.Errorf("Points without an id should be rejected, got %d updates and %d rejected: %s", len(updates), rejected, reason)
+	}
+}
+
+// failingStore is a Store whose connections fail once working connections
+// have been handed out
+type failingStore struct {
+	working int
+}
+
+func (store *failingStore) Get() redis.Conn {
+	store.working--
+	return &failingConn{store.working < 0}
+}
+
+// failingConn pretends to write to redis, unless it fails
+type failingConn struct {
+	fails bool
+}
+
+func (conn *failingConn) Close() error { return nil }
+func (conn *failingConn) Err() error   { return conn.err() }
+func (conn *failingConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	return nil, conn.err()
+}
+func (conn *failingConn) Send(commandName string, args ...interface{}) error { return conn.err() }
+func (conn *failingConn) Flush() error                                       { return conn.err() }
+func (conn *failingConn) Receive() (interface{}, error)                      { return int64(0), conn.err() }
+
+func (conn *failingConn) err() error {
+	if conn.fails {
+		return fmt.Errorf("Connection refused")
+	}
+	return nil
+}
+
+func TestOTLPPartialWrite(t *testing.T) {
+	export := func(store Store) *httptest.ResponseRecorder {
+		s := NewServer(Options{Store: store, LocalChangesOnly: true})
+		req := httptest.NewRequest("POST", "/v1/metrics", strings.NewReader(otlpTestRequest))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		s.otlpHandler(w, req)
+		return w
+	}
+
+	// If nothing was written, the exporter should retry
+	if w := export(&failingStore{0}); w.Code != 503 {
+		t.Errorf("Expected 503 when nothing was written, got %d", w.Code)
+	}
+
+	// Otherwise, the unwritten points are rejected so that the written ones
+	// aren't written again
+	w := export(&failingStore{1})
+	if w.Code != 200 {
+		t.Fatalf("Expected 200 for a partial write, got %d", w.Code)
+	}
+	resp := &otlpResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil {
+		t.Fatalf("Unable to decode response: %s", err)
+	}
+	// The es update is written first, leaving the 1 point of the de update
+	// plus the histogram
+	if resp.PartialSuccess == nil || resp.PartialSuccess.RejectedDataPoints != 2 {
+		t.Fatalf("Wrong partial success: %v", resp.PartialSuccess)
+	}
+	if !strings.Contains(resp.PartialSuccess.ErrorMessage, "Connection refused") {
+		t.Errorf("Wrong error message: %s", resp.PartialSuccess.ErrorMessage)
+	}
+}
+
+func TestOTLPHandler(t *testing.T) {
+	export := func(body []byte, gzipped bool) *httptest.ResponseRecorder {
+		s := NewServer(Options{Store: &failingStore{100}, LocalChangesOnly: true})
+		req := httptest.NewRequest("POST", "/v1/metrics", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if gzipped {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+		w := httptest.NewRecorder()
+		s.otlpHandler(w, req)
+		return w
+	}
+
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write([]byte(otlpTestRequest))
+	gz.Close()
+	w := export(gzipped.Bytes(), true)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"rejectedDataPoints":1`) {
+		t.Errorf("Gzipped request should have been accepted, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// A request whose points are all invalid shouldn't be retried
+	invalid := `{"resourceMetrics": [{"resource": {"attributes": [{"key": "service.instance.id", "value": {"stringValue": "myid1"}}]},
+		"scopeMetrics": [{"metrics": [{"name": "online", "gauge": {"dataPoints": [{"attributes": [{"key": "country", "value": {"stringValue": "total"}}], "asInt": 1}]}}]}]}]}`
+	w = export([]byte(invalid), false)
+	if w.Code != 400 || !strings.Contains(w.Body.String(), "'total' is not allowed") {
+		t.Errorf("Expected 400 for an invalid request, got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -33,15 +33,25 @@ type statReader struct {
 	recordVal func(stats *Stats, key string, val int64)
 }
 
+// DimNames lists the names of all known dimensions
+func (s *Server) DimNames() ([]string, error) {
+	conn := s.connect()
+	defer conn.Close()
+	return listDimNames(conn)
+}
+
+// MemberNames lists the names of all member stats, whose counts QueryDims and
+// QueryIds report as Gauges
+func (s *Server) MemberNames() ([]string, error) {
+	conn := s.connect()
+	defer conn.Close()
+	return listStatKeys(conn, "member")
+}
+
 // QueryDims runs a query for values from the requested dimensions.  If dimNames is empty,
 // QueryDims will query all dimensions.
-func QueryDims(dimNames []string) (statsByDim map[string]map[string]*Stats, err error) {
-	var conn redis.Conn
-	conn, err = connectToRedis()
-	if err != nil {
-		err = fmt.Errorf("Unable to connect to redis: %s", err)
-		return
-	}
+func (s *Server) QueryDims(dimNames []string) (statsByDim map[string]map[string]*Stats, err error) {
+	conn := s.connect()
 	defer conn.Close()
 
 	if dimNames == nil || len(dimNames) == 0 {
@@ -67,24 +77,171 @@ func QueryDims(dimNames []string) (statsByDim map[string]map[string]*Stats, err
 		statsByDim[dimName] = dimStats
 	}
 
-	if err = queryCounters(conn, statsByDim); err != nil {
+	if err = queryCounters(conn, statsByDim, dimGroup, nil); err != nil {
+		return
+	}
+
+	if err = queryGauges(conn, statsByDim, dimGroup, nil, s.clock.Now()); err != nil {
+		return
+	}
+
+	err = queryMembers(conn, statsByDim, dimGroup, nil)
+
+	return
+}
+
+// DimFilter limits a query of a dimension to some of its keys and stats
+type DimFilter struct {
+	// Keys are the dimension keys to read, nil for all of them.  The total is
+	// included if Keys is nil or includes "total", which needs all keys.
+	Keys []string
+
+	// Counters are the names of the counters to read
+	Counters []string
+
+	// Gauges are the names of the gauges (or members, whose counts are
+	// reported as gauges) to read
+	Gauges []string
+}
+
+// QueryDimsFiltered runs a query for only the keys and stats of the
+// dimensions that are given by filters.
+func (s *Server) QueryDimsFiltered(filters map[string]*DimFilter) (statsByDim map[string]map[string]*Stats, err error) {
+	conn := s.connect()
+	defer conn.Close()
+
+	now := s.clock.Now()
+	statsByDim = make(map[string]map[string]*Stats)
+	for dimName, filter := range filters {
+		dimKeys := filter.Keys
+		withTotal := dimKeys == nil
+		for _, dimKey := range dimKeys {
+			withTotal = withTotal || dimKey == "total"
+		}
+		if withTotal {
+			if dimKeys, err = listDimKeys(conn, dimName); err != nil {
+				return nil, fmt.Errorf("Unable to list keys for dimension %s: %s", dimName, err)
+			}
+		}
+
+		dimStats := make(map[string]*Stats)
+		for _, dimKey := range dimKeys {
+			if dimKey != "total" {
+				dimStats[dimKey] = newStats()
+			}
+		}
+		if withTotal {
+			dimStats["total"] = newStats()
+		}
+
+		// Each dimension has its own stats, so it's queried on its own
+		statsByGroup := map[string]map[string]*Stats{dimName: dimStats}
+		counters, gauges := nonNil(filter.Counters), nonNil(filter.Gauges)
+		if err = queryCounters(conn, statsByGroup, dimGroup, counters); err != nil {
+			return
+		}
+		if err = queryGauges(conn, statsByGroup, dimGroup, gauges, now); err != nil {
+			return
+		}
+		if err = queryMembers(conn, statsByGroup, dimGroup, gauges); err != nil {
+			return
+		}
+		statsByDim[dimName] = dimStats
+	}
+	return
+}
+
+// queryDimKeys queries every stat of the given keys of a dimension, without a
+// total
+func (s *Server) queryDimKeys(conn redis.Conn, dimName string, dimKeys []string) (map[string]*Stats, error) {
+	dimStats := make(map[string]*Stats)
+	for _, dimKey := range dimKeys {
+		dimStats[dimKey] = newStats()
+	}
+	statsByGroup := map[string]map[string]*Stats{dimName: dimStats}
+	if err := queryCounters(conn, statsByGroup, dimGroup, nil); err != nil {
+		return nil, err
+	}
+	if err := queryGauges(conn, statsByGroup, dimGroup, nil, s.clock.Now()); err != nil {
+		return nil, err
+	}
+	if err := queryMembers(conn, statsByGroup, dimGroup, nil); err != nil {
+		return nil, err
+	}
+	return dimStats, nil
+}
+
+// nonNil returns values or, if it's nil, an empty slice
+func nonNil(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
+
+// intersect returns the values that are also in others
+func intersect(values []string, others []string) []string {
+	result := make([]string, 0)
+	for _, value := range values {
+		if contains(others, value) {
+			result = append(result, value)
+		}
+	}
+	return result
+}
+
+// QueryIds runs a query for the detail values of the requested ids.  If ids is
+// empty, QueryIds will query all ids.
+func (s *Server) QueryIds(ids []string) (statsById map[string]*Stats, err error) {
+	conn := s.connect()
+	defer conn.Close()
+
+	if ids == nil || len(ids) == 0 {
+		if ids, err = listIds(conn); err != nil {
+			return
+		}
+	}
+
+	statsById = make(map[string]*Stats)
+	for _, id := range ids {
+		statsById[id] = newStats()
+	}
+	// The detail values are queried like a dimension whose keys are the ids,
+	// just without a total.
+	statsByGroup := map[string]map[string]*Stats{"id": statsById}
+
+	if err = queryCounters(conn, statsByGroup, detailGroup, nil); err != nil {
 		return
 	}
 
-	if err = queryGauges(conn, statsByDim); err != nil {
+	if err = queryGauges(conn, statsByGroup, detailGroup, nil, s.clock.Now()); err != nil {
 		return
 	}
 
-	err = queryMembers(conn, statsByDim)
+	err = queryMembers(conn, statsByGroup, detailGroup, nil)
 
 	return
 }
 
+// dimGroup returns the group under which rollups for the given dimension name
+// and key are stored (e.g. dim:country:es).
+func dimGroup(dimName string, dimKey string) string {
+	return fmt.Sprintf("dim:%s:%s", dimName, dimKey)
+}
+
+// detailGroup returns the group under which the detail values for the given
+// id are stored (e.g. detail:myid1).
+func detailGroup(_ string, id string) string {
+	return fmt.Sprintf("detail:%s", id)
+}
+
 // queryCounters queries simple counter statistics
-func queryCounters(conn redis.Conn, statsByDim map[string]map[string]*Stats) (err error) {
+func queryCounters(conn redis.Conn, statsByDim map[string]map[string]*Stats, groupFor func(string, string) string, only []string) (err error) {
 	return doQuery(
 		conn,
 		statsByDim,
+		groupFor,
+		only,
 		&statReader{
 			statType: "counter",
 			prepareRead: func(redisKey string) error {
@@ -97,15 +254,17 @@ func queryCounters(conn redis.Conn, statsByDim map[string]map[string]*Stats) (er
 	)
 }
 
-// queryGauges queries simple gauge statistics
-func queryGauges(conn redis.Conn, statsByDim map[string]map[string]*Stats) (err error) {
-	currentPeriod := time.Now().Truncate(statsPeriod)
+// queryGauges queries simple gauge statistics as of now
+func queryGauges(conn redis.Conn, statsByDim map[string]map[string]*Stats, groupFor func(string, string) string, only []string, now time.Time) (err error) {
+	currentPeriod := now.Truncate(statsPeriod)
 	priorPeriod := currentPeriod.Add(-1 * statsPeriod)
 
 	// Query gauges from prior period
 	err = doQuery(
 		conn,
 		statsByDim,
+		groupFor,
+		only,
 		&statReader{
 			statType: "gauge",
 			prepareRead: func(redisKey string) error {
@@ -125,6 +284,8 @@ func queryGauges(conn redis.Conn, statsByDim map[string]map[string]*Stats) (err
 	return doQuery(
 		conn,
 		statsByDim,
+		groupFor,
+		only,
 		&statReader{
 			statType: "gauge",
 			prepareRead: func(redisKey string) error {
@@ -138,10 +299,12 @@ func queryGauges(conn redis.Conn, statsByDim map[string]map[string]*Stats) (err
 }
 
 // queryMembers queries member statistics and returns their counts as Gauges
-func queryMembers(conn redis.Conn, statsByDim map[string]map[string]*Stats) (err error) {
+func queryMembers(conn redis.Conn, statsByDim map[string]map[string]*Stats, groupFor func(string, string) string, only []string) (err error) {
 	return doQuery(
 		conn,
 		statsByDim,
+		groupFor,
+		only,
 		&statReader{
 			statType: "member",
 			prepareRead: func(redisKey string) error {
@@ -160,11 +323,20 @@ func queryMembers(conn redis.Conn, statsByDim map[string]map[string]*Stats) (err
 // 2. For each dimension, dimension key and stat key, prepare a query (e.g. issue a GET)
 // 3. Flush the connection to execute the query
 // 4. Read the responses and populate a Stats object with the key/value pairs for each dimension and dimension key
-func doQuery(conn redis.Conn, statsByDim map[string]map[string]*Stats, reader *statReader) (err error) {
+//
+// groupFor determines the redis group (e.g. dim:country:es) for each dimension and dimension key.
+// If only isn't nil, only the stat keys in it are read.
+func doQuery(conn redis.Conn, statsByDim map[string]map[string]*Stats, groupFor func(string, string) string, only []string, reader *statReader) (err error) {
+	if only != nil && len(only) == 0 {
+		return
+	}
 	var keys []string
 	if keys, err = listStatKeys(conn, reader.statType); err != nil {
 		return
 	}
+	if only != nil {
+		keys = intersect(keys, only)
+	}
 
 	// dimNames and dimKeys are needed for consistent iteration order on statsByDim
 	dimNames := make([]string, len(statsByDim))
@@ -178,7 +350,7 @@ func doQuery(conn redis.Conn, statsByDim map[string]map[string]*Stats, reader *s
 		for dimKey, _ := range dimStats {
 			keysForDim[j] = dimKey
 			for _, key := range keys {
-				fullDimKey := redisKey(reader.statType, fmt.Sprintf("dim:%s:%s", dimName, dimKey), key)
+				fullDimKey := redisKey(reader.statType, groupFor(dimName, dimKey), key)
 				err = reader.prepareRead(fullDimKey)
 			}
 			j++
@@ -207,8 +379,10 @@ func doQuery(conn redis.Conn, statsByDim map[string]map[string]*Stats, reader *s
 			}
 		}
 
-		for key, total := range totalByKey {
-			reader.recordVal(dimStats["total"], key, total)
+		if totalStats, hasTotal := dimStats["total"]; hasTotal {
+			for key, total := range totalByKey {
+				reader.recordVal(totalStats, key, total)
+			}
 		}
 	}
 
@@ -18,42 +18,53 @@ package statshub
 import (
 	"fmt"
 	"github.com/garyburd/redigo/redis"
-	"os"
 	"time"
 )
 
 const (
+	DefaultRedisMaxIdle     = 100
+	DefaultRedisMaxActive   = 1000
+	DefaultRedisIdleTimeout = 240 * time.Second
+
 	redisConnectTimeout = 10 * time.Second
 	redisReadTimeout    = 10 * time.Second
 	redisWriteTimeout   = 10 * time.Second
 )
 
-var (
-	pool *redis.Pool
-)
+// RedisOptions configures a pool of redis connections.  Zero values of
+// everything but Addr and Password are replaced with defaults.
+type RedisOptions struct {
+	Addr        string
+	Password    string
+	MaxIdle     int
+	MaxActive   int
+	IdleTimeout time.Duration
+}
+
+// NewRedisPool creates a pool of connections to the redis server at addr,
+// authenticating with password.
+func NewRedisPool(addr string, password string) *redis.Pool {
+	return NewRedisPoolWithOptions(RedisOptions{Addr: addr, Password: password})
+}
 
-// init() initializes our redis environment by setting up a connection pool
-func init() {
-	pool = &redis.Pool{
-		MaxIdle:     100,
-		MaxActive:   1000,
-		IdleTimeout: 240 * time.Second,
+// NewRedisPoolWithOptions creates a pool of redis connections configured by
+// opts.
+func NewRedisPoolWithOptions(opts RedisOptions) *redis.Pool {
+	if opts.MaxIdle <= 0 {
+		opts.MaxIdle = DefaultRedisMaxIdle
+	}
+	if opts.MaxActive <= 0 {
+		opts.MaxActive = DefaultRedisMaxActive
+	}
+	if opts.IdleTimeout <= 0 {
+		opts.IdleTimeout = DefaultRedisIdleTimeout
+	}
+	return &redis.Pool{
+		MaxIdle:     opts.MaxIdle,
+		MaxActive:   opts.MaxActive,
+		IdleTimeout: opts.IdleTimeout,
 		Dial: func() (redis.Conn, error) {
-			c, err := redis.DialTimeout(
-				"tcp",
-				os.Getenv("REDIS_ADDR"),
-				redisConnectTimeout,
-				redisReadTimeout,
-				redisWriteTimeout)
-
-			if err != nil {
-				return nil, fmt.Errorf("Unable to dial redis: %s", err)
-			}
-			if _, err := c.Do("AUTH", os.Getenv("REDIS_PASS")); err != nil {
-				c.Close()
-				return nil, fmt.Errorf("Unable to authenticate to redis: %s", err)
-			}
-			return c, err
+			return dialRedis(opts, redisReadTimeout)
 		},
 		TestOnBorrow: func(c redis.Conn, t time.Time) error {
 			_, err := c.Do("PING")
@@ -62,6 +73,35 @@ func init() {
 	}
 }
 
+// NewRedisPubSubDial returns a function that dials dedicated connections to the
+// redis server given by opts for pub/sub.  Unlike pooled connections, these
+// never time out while waiting for messages.
+func NewRedisPubSubDial(opts RedisOptions) func() (redis.Conn, error) {
+	return func() (redis.Conn, error) {
+		return dialRedis(opts, 0)
+	}
+}
+
+// dialRedis dials and authenticates to the redis server given by opts, with
+// the given read timeout (0 for none)
+func dialRedis(opts RedisOptions, readTimeout time.Duration) (redis.Conn, error) {
+	c, err := redis.DialTimeout(
+		"tcp",
+		opts.Addr,
+		redisConnectTimeout,
+		readTimeout,
+		redisWriteTimeout)
+
+	if err != nil {
+		return nil, fmt.Errorf("Unable to dial redis: %s", err)
+	}
+	if _, err := c.Do("AUTH", opts.Password); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("Unable to authenticate to redis: %s", err)
+	}
+	return c, err
+}
+
 // redisConn is a wrapper for a redis.Conn that itself implements the
 // redis.Conn interface. Unlike a normal redis.Conn, redisConn stops processing
 // new commands after it encountersits first error.
@@ -70,11 +110,6 @@ type redisConn struct {
 	err  error
 }
 
-// connectToRedis() connects to our cloud Redis server and authenticates
-func connectToRedis() (conn redis.Conn, err error) {
-	return &redisConn{orig: pool.Get()}, nil
-}
-
 func (conn *redisConn) Close() (err error) {
 	return conn.orig.Close()
 }
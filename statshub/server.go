@@ -0,0 +1,376 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+//
+
+package statshub
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"code.google.com/p/go.net/websocket"
+	"github.com/garyburd/redigo/redis"
+
+	"github.com/getlantern/statshub/bigquery"
+)
+
+const (
+	DefaultCacheExpiration        = 1 * time.Minute
+	DefaultStreamingInterval      = 30 * time.Second
+	DefaultStreamingQueueSize     = 10
+	DefaultStreamingQueuePolicy   = QUEUE_COALESCE
+	DefaultStreamingWriteTimeout  = 10 * time.Second
+	DefaultStreamingMaxOverflows  = 3
+	DefaultPushInterval           = 1 * time.Second
+	DefaultChangesChannel         = "changes"
+	DefaultMetricsCacheExpiration = 15 * time.Second
+	DefaultMetricsMaxSeries       = 10000
+	DefaultStatsdIdTag            = "id"
+	DefaultStatsdFlushInterval    = 10 * time.Second
+	DefaultInfluxIdTag            = "id"
+)
+
+// Store is where statshub keeps its stats.  A *redis.Pool is a Store.
+type Store interface {
+	Get() redis.Conn
+}
+
+// Clock tells statshub what time it is
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// Options configures a Server.  Only Store is required, zero values of
+// everything else are replaced with defaults.
+type Options struct {
+	// Store is where stats are kept
+	Store Store
+
+	// Clock tells the Server what time it is, defaults to the system clock
+	Clock Clock
+
+	// Logger is where the Server logs to, defaults to stderr
+	Logger *log.Logger
+
+	// CachedDims are the dimensions whose queries are cached, defaults to
+	// country.  Set this to an empty (non-nil) slice to disable caching.
+	CachedDims []string
+
+	// CacheExpiration is how frequently cached queries are refreshed
+	CacheExpiration time.Duration
+
+	// StreamingInterval is how frequently updates are sent to streaming clients
+	StreamingInterval time.Duration
+
+	// StreamingQueueSize is how many updates are queued for each streaming
+	// client
+	StreamingQueueSize int
+
+	// StreamingQueuePolicy is what happens to updates for a streaming client
+	// whose queue is full: QUEUE_DROP or QUEUE_COALESCE
+	StreamingQueuePolicy string
+
+	// StreamingWriteTimeout is how long a write to a streaming client may take
+	// before the client is disconnected
+	StreamingWriteTimeout time.Duration
+
+	// StreamingMaxOverflows is how many updates in a row may find a streaming
+	// client's queue full before the client is evicted
+	StreamingMaxOverflows int
+
+	// PushInterval is how long changes are collected before streaming clients
+	// whose stats they changed are sent an update, which also limits how often
+	// each subscription gets one
+	PushInterval time.Duration
+
+	// ChangesChannel is the redis channel on which every write is announced
+	// to all Servers sharing the Store
+	ChangesChannel string
+
+	// LocalChangesOnly only pushes updates for the writes of this Server, for
+	// Stores that don't support redis pub/sub
+	LocalChangesOnly bool
+
+	// PubSubDial dials the dedicated connection on which changes are received
+	// (see NewRedisPubSubDial).  It mustn't have a read timeout, or an idle
+	// channel fails and changes are lost while resubscribing.  If nil, a
+	// connection is taken from the Store, which then mustn't time out either.
+	PubSubDial func() (redis.Conn, error)
+
+	// HistoryRollups indicates that the BigQuery archive maintains rollup
+	// tables, which history queries for the maximum read when they can
+	HistoryRollups bool
+
+	// BigQuery is the client that history queries run with.  If nil, they use
+	// the shared BigQuery service (see bigquery.OpenClient).
+	BigQuery bigquery.Client
+
+	// MetricsDims are the dimensions exposed at /metrics, none if empty
+	MetricsDims []string
+
+	// MetricsMaxSeries caps the number of series exposed at /metrics, which
+	// stops reading keys once it's reached
+	MetricsMaxSeries int
+
+	// MetricsCacheExpiration is how long the results for /metrics are cached
+	MetricsCacheExpiration time.Duration
+
+	// StatsdAddr is the UDP and TCP address at which to listen for StatsD
+	// metrics.  If empty, the Server doesn't listen for StatsD.
+	StatsdAddr string
+
+	// StatsdIdTag is the StatsD tag that supplies the stat id
+	StatsdIdTag string
+
+	// StatsdFlushInterval is how frequently aggregated StatsD metrics are
+	// written
+	StatsdFlushInterval time.Duration
+
+	// InfluxIdTag is the line protocol tag that supplies the stat id
+	InfluxIdTag string
+}
+
+// Server is a statshub server.  It is an http.Handler that serves the statshub
+// API, and also runs background work (caching, streaming and StatsD) between
+// calls to Start and Shutdown.
+type Server struct {
+	opts  Options
+	store Store
+	clock Clock
+	log   *log.Logger
+	mux   *http.ServeMux
+
+	// Cache of dimension queries
+	cacheRequests chan *cacheRequest
+
+	// Streaming clients
+	nextStreamingClientId int
+	streamingClients      map[int]*streamingClient
+	newStreamingClient    chan *streamingClient
+	closedStreamingClient chan int
+
+	// Counts of streaming clients and their dropped updates and evictions,
+	// for /metrics (accessed atomically)
+	numStreamingClients     int64
+	droppedStreamingUpdates int64
+	evictedStreamingClients int64
+
+	// Changes written by this and (over pub/sub) other Servers, to push to
+	// streaming clients
+	instanceId string
+	changes    chan *statsChange
+
+	// Cache for /metrics
+	metricsMutex    sync.Mutex
+	metricsCache    *metricsSnapshot
+	metricsCachedAt time.Time
+
+	statsd *statsdAggregator
+
+	// Times of the last rows in the legacy history tables, by dimension
+	legacyEndsMutex sync.Mutex
+	legacyEnds      map[string]time.Time
+
+	started   chan bool
+	startOnce sync.Once
+	stop      chan bool
+	stopOnce  sync.Once
+	wg        sync.WaitGroup
+}
+
+// NewServer constructs a Server with the given Options.
+func NewServer(opts Options) *Server {
+	if opts.Clock == nil {
+		opts.Clock = systemClock{}
+	}
+	if opts.Logger == nil {
+		opts.Logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	if opts.CachedDims == nil {
+		opts.CachedDims = []string{"country"}
+	}
+	if opts.CacheExpiration <= 0 {
+		opts.CacheExpiration = DefaultCacheExpiration
+	}
+	if opts.StreamingInterval <= 0 {
+		opts.StreamingInterval = DefaultStreamingInterval
+	}
+	if opts.StreamingQueueSize <= 0 {
+		opts.StreamingQueueSize = DefaultStreamingQueueSize
+	}
+	if opts.StreamingQueuePolicy == "" {
+		opts.StreamingQueuePolicy = DefaultStreamingQueuePolicy
+	}
+	if opts.StreamingWriteTimeout <= 0 {
+		opts.StreamingWriteTimeout = DefaultStreamingWriteTimeout
+	}
+	if opts.StreamingMaxOverflows <= 0 {
+		opts.StreamingMaxOverflows = DefaultStreamingMaxOverflows
+	}
+	if opts.PushInterval <= 0 {
+		opts.PushInterval = DefaultPushInterval
+	}
+	if opts.ChangesChannel == "" {
+		opts.ChangesChannel = DefaultChangesChannel
+	}
+	if opts.MetricsMaxSeries <= 0 {
+		opts.MetricsMaxSeries = DefaultMetricsMaxSeries
+	}
+	if opts.MetricsCacheExpiration <= 0 {
+		opts.MetricsCacheExpiration = DefaultMetricsCacheExpiration
+	}
+	if opts.StatsdIdTag == "" {
+		opts.StatsdIdTag = DefaultStatsdIdTag
+	}
+	if opts.StatsdFlushInterval <= 0 {
+		opts.StatsdFlushInterval = DefaultStatsdFlushInterval
+	}
+	if opts.InfluxIdTag == "" {
+		opts.InfluxIdTag = DefaultInfluxIdTag
+	}
+
+	s := &Server{
+		opts:                  opts,
+		store:                 opts.Store,
+		clock:                 opts.Clock,
+		log:                   opts.Logger,
+		mux:                   http.NewServeMux(),
+		cacheRequests:         make(chan *cacheRequest, 1000),
+		streamingClients:      make(map[int]*streamingClient),
+		newStreamingClient:    make(chan *streamingClient),
+		closedStreamingClient: make(chan int),
+		instanceId:            newInstanceId(),
+		changes:               make(chan *statsChange, 1000),
+		legacyEnds:            make(map[string]time.Time),
+		started:               make(chan bool),
+		stop:                  make(chan bool),
+	}
+
+	s.mux.HandleFunc("/stats/", s.statsHandler)
+	s.mux.HandleFunc("/ids/", s.idsHandler)
+	s.mux.Handle("/stream", websocket.Handler(s.streamStats))
+	s.mux.Handle("/stream/", websocket.Handler(s.streamStats))
+	s.mux.HandleFunc("/events/", s.streamEvents)
+	s.mux.HandleFunc("/metrics", s.metricsHandler)
+	s.mux.HandleFunc("/write", s.writeHandler)
+	s.mux.HandleFunc("/v1/metrics", s.otlpHandler)
+
+	return s
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Start starts the Server's background work: caching queries, streaming
+// updates and (if configured) listening for StatsD.  A Server can only be
+// started once, later calls return an error.
+func (s *Server) Start() error {
+	err := fmt.Errorf("Server can only be started once")
+	s.startOnce.Do(func() {
+		err = s.start()
+	})
+	return err
+}
+
+func (s *Server) start() error {
+	if s.opts.StatsdAddr != "" {
+		s.statsd = newStatsdAggregator(s, s.opts.StatsdIdTag, s.opts.StatsdFlushInterval)
+		if err := s.statsd.listen(s.opts.StatsdAddr); err != nil {
+			return fmt.Errorf("Unable to listen for StatsD at %s: %s", s.opts.StatsdAddr, err)
+		}
+		s.log.Printf("Listening for StatsD at %s, flushing every %s", s.opts.StatsdAddr, s.opts.StatsdFlushInterval)
+		s.goUntilStopped(s.statsd.aggregate)
+	}
+
+	s.goUntilStopped(s.cacheDims)
+	s.goUntilStopped(s.handleStreamingClients)
+	if !s.opts.LocalChangesOnly {
+		s.goUntilStopped(s.receiveChanges)
+	}
+	close(s.started)
+	return nil
+}
+
+// isRunning indicates whether the Server has been started and not yet shut
+// down
+func (s *Server) isRunning() bool {
+	select {
+	case <-s.stop:
+		return false
+	default:
+	}
+	select {
+	case <-s.started:
+		return true
+	default:
+		return false
+	}
+}
+
+// Shutdown stops the Server's background work and disconnects any streaming
+// clients.  It does not close the Store.
+func (s *Server) Shutdown() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+		if s.statsd != nil {
+			s.statsd.close()
+		}
+	})
+	s.wg.Wait()
+}
+
+// goUntilStopped runs fn on a goroutine that Shutdown waits for.  fn must
+// return once s.stop is closed.
+func (s *Server) goUntilStopped(fn func()) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		fn()
+	}()
+}
+
+// Write writes a StatsUpdate for the given id, and lets streaming clients
+// whose stats it changed know.
+func (s *Server) Write(id string, stats *StatsUpdate) error {
+	conn := s.connect()
+	defer conn.Close()
+	changesChannel := s.opts.ChangesChannel
+	if s.opts.LocalChangesOnly {
+		changesChannel = ""
+	}
+	if err := stats.write(conn, s.clock.Now(), id, s.instanceId, changesChannel); err != nil {
+		return err
+	}
+	if len(stats.Dims) > 0 {
+		s.notifyChange(stats.change(s.instanceId))
+	}
+	return nil
+}
+
+// connect gets a connection from the Store
+func (s *Server) connect() redis.Conn {
+	return &redisConn{orig: s.store.Get()}
+}
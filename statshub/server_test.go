@@ -0,0 +1,162 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+//
+
+package statshub
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestServerStartAndShutdown(t *testing.T) {
+	// A store that's always unavailable
+	store := &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return nil, fmt.Errorf("Unavailable")
+		},
+	}
+	s := NewServer(Options{Store: store, StreamingInterval: time.Hour})
+	if s.isRunning() {
+		t.Errorf("Server should not be running before Start")
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Unable to start: %s", err)
+	}
+	if !s.isRunning() {
+		t.Errorf("Server should be running after Start")
+	}
+	if err := s.Start(); err == nil {
+		t.Errorf("Starting twice should have failed")
+	}
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("PUT", "/stats/", nil)
+	s.ServeHTTP(w, r)
+	if w.Code != 405 {
+		t.Errorf("Expected 405, got %d", w.Code)
+	}
+
+	// Cached dims are served from the cache, which is empty because the store
+	// is unavailable
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "/stats/country", nil)
+	s.ServeHTTP(w, r)
+	if w.Code != 500 {
+		t.Errorf("Expected 500, got %d", w.Code)
+	}
+
+	stopped := make(chan bool)
+	go func() {
+		s.Shutdown()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Shutdown should have returned")
+	}
+	if s.isRunning() {
+		t.Errorf("Server should not be running after Shutdown")
+	}
+}
+
+func TestRequireToken(t *testing.T) {
+	handler := RequireToken("secret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+	for authorization, expected := range map[string]int{
+		"":              401,
+		"Bearer wrong":  401,
+		"secret":        200,
+		"Bearer secret": 200,
+	} {
+		req, _ := http.NewRequest("POST", "/admin/archive/spool", nil)
+		req.Header.Set("Authorization", authorization)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != expected {
+			t.Errorf("Expected %d for %q, got %d", expected, authorization, w.Code)
+		}
+	}
+
+	// Without a token, nothing is allowed
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/admin/archive", nil)
+	RequireToken("", http.NotFoundHandler()).ServeHTTP(w, req)
+	if w.Code != 401 {
+		t.Errorf("Expected 401 without a token, got %d", w.Code)
+	}
+}
+
+func TestRequireTokenToModify(t *testing.T) {
+	handler := RequireTokenToModify("secret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+	for method, expected := range map[string]int{
+		"GET":  200,
+		"HEAD": 200,
+		"POST": 401,
+	} {
+		req, _ := http.NewRequest(method, "/admin/archive/spool", nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != expected {
+			t.Errorf("Expected %d for %s without a token, got %d", expected, method, w.Code)
+		}
+	}
+
+	req, _ := http.NewRequest("POST", "/admin/archive/spool", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Errorf("Expected 200 for POST with the token, got %d", w.Code)
+	}
+}
+
+func TestQueryAllDims(t *testing.T) {
+	s := NewServer(Options{Store: setsStore{
+		"dim":         {"country", "user"},
+		"dim:country": {"es"},
+		"dim:user":    {"bob"},
+		"key:counter": {"bytesGiven"},
+	}})
+	query := func(url string) map[string]map[string]*Stats {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", url, nil)
+		s.ServeHTTP(w, r)
+		if w.Code != 200 {
+			t.Fatalf("Expected 200 for %s, got %d: %s", url, w.Code, w.Body.String())
+		}
+		resp := &ClientQueryResponse{}
+		if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil {
+			t.Fatalf("Unable to decode response for %s: %s", url, err)
+		}
+		return resp.Dims
+	}
+
+	if dims := query("/stats/"); len(dims) != 2 || dims["country"]["es"] == nil || dims["user"]["bob"] == nil {
+		t.Errorf("/stats/ should query all dims, got %v", dims)
+	}
+	if dims := query("/stats/country"); len(dims) != 1 || dims["country"]["es"] == nil {
+		t.Errorf("/stats/country should only query country, got %v", dims)
+	}
+}
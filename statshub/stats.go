@@ -137,3 +137,17 @@ func listDimKeys(conn redis.Conn, name string) (values []string, err error) {
 	}
 	return
 }
+
+// listIds lists all ids for which stats have been written.
+func listIds(conn redis.Conn) (values []string, err error) {
+	var ivalues interface{}
+	if ivalues, err = conn.Do("SMEMBERS", "id"); err != nil {
+		return
+	}
+	iavalues := ivalues.([]interface{})
+	values = make([]string, len(iavalues))
+	for i, value := range iavalues {
+		values[i] = string(value.([]uint8))
+	}
+	return
+}
@@ -0,0 +1,324 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+//
+
+package statshub
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxStatsdPacketSize = 65535
+)
+
+// statsdMetric is a single parsed StatsD line, e.g.
+//
+//	bytesGiven:500|c|@0.5|#country:es,id:myid1
+type statsdMetric struct {
+	name       string
+	metricType string // "c", "g" or "s"
+	value      int64
+	relative   bool   // true for gauges like "+5" or "-5" that adjust the prior value
+	member     string // the value of set ("s") metrics
+	id         string
+	dims       map[string]string
+}
+
+// statsdAggregator accumulates StatsD metrics in memory and periodically
+// flushes them to redis as StatsUpdates.
+type statsdAggregator struct {
+	server        *Server
+	idTag         string
+	flushInterval time.Duration
+	metrics       chan *statsdMetric
+	updates       map[string]*statsdUpdate
+	udpConn       *net.UDPConn
+	tcpListener   net.Listener
+
+	// gauges is the last value of every gauge, by update key and name, which
+	// relative gauges adjust
+	gauges map[string]map[string]int64
+}
+
+// statsdUpdate is the StatsUpdate for a single id and set of dims, along with
+// the id to which it should be written.
+type statsdUpdate struct {
+	id string
+	*StatsUpdate
+	members map[string]map[string]bool
+}
+
+func newStatsdAggregator(server *Server, idTag string, flushInterval time.Duration) *statsdAggregator {
+	return &statsdAggregator{
+		server:        server,
+		idTag:         idTag,
+		flushInterval: flushInterval,
+		metrics:       make(chan *statsdMetric, 10000),
+		updates:       make(map[string]*statsdUpdate),
+		gauges:        make(map[string]map[string]int64),
+	}
+}
+
+// listen starts listening for StatsD packets over UDP and lines over TCP.
+func (aggregator *statsdAggregator) listen(addr string) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	udpConn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return err
+	}
+	tcpListener, err := net.Listen("tcp", addr)
+	if err != nil {
+		udpConn.Close()
+		return err
+	}
+
+	aggregator.udpConn = udpConn
+	aggregator.tcpListener = tcpListener
+	go aggregator.readUDP(udpConn)
+	go aggregator.acceptTCP(tcpListener)
+	return nil
+}
+
+// close stops listening for StatsD
+func (aggregator *statsdAggregator) close() {
+	if aggregator.udpConn != nil {
+		aggregator.udpConn.Close()
+	}
+	if aggregator.tcpListener != nil {
+		aggregator.tcpListener.Close()
+	}
+}
+
+func (aggregator *statsdAggregator) stopped() bool {
+	select {
+	case <-aggregator.server.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (aggregator *statsdAggregator) readUDP(conn *net.UDPConn) {
+	buf := make([]byte, maxStatsdPacketSize)
+	for {
+		n, remoteAddr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if aggregator.stopped() {
+				return
+			}
+			aggregator.server.log.Printf("Unable to read StatsD packet: %s", err)
+			continue
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			aggregator.receive(line, remoteAddr.IP.String())
+		}
+	}
+}
+
+func (aggregator *statsdAggregator) acceptTCP(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !aggregator.stopped() {
+				aggregator.server.log.Printf("Unable to accept StatsD connection: %s", err)
+			}
+			return
+		}
+		go func() {
+			defer conn.Close()
+			host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+			scanner := bufio.NewScanner(conn)
+			for scanner.Scan() {
+				aggregator.receive(scanner.Text(), host)
+			}
+		}()
+	}
+}
+
+// receive parses a single line and queues it for aggregation
+func (aggregator *statsdAggregator) receive(line string, sourceHost string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+	metric, err := parseStatsdLine(line, aggregator.idTag)
+	if err != nil {
+		aggregator.server.log.Printf("Unable to parse StatsD line %s: %s", line, err)
+		return
+	}
+	if metric.id == "" {
+		metric.id = sourceHost
+	}
+	select {
+	case aggregator.metrics <- metric:
+	case <-aggregator.server.stop:
+	}
+}
+
+// aggregate accumulates received metrics and flushes them every
+// flushInterval.  Whatever has been accumulated is flushed one last time when
+// the server stops.
+func (aggregator *statsdAggregator) aggregate() {
+	clock := aggregator.server.clock
+	for {
+		nextInterval := clock.Now().Truncate(aggregator.flushInterval).Add(aggregator.flushInterval)
+		waitTime := nextInterval.Sub(clock.Now())
+		select {
+		case metric := <-aggregator.metrics:
+			aggregator.add(metric)
+		case <-time.After(waitTime):
+			updates := aggregator.updates
+			aggregator.updates = make(map[string]*statsdUpdate)
+			aggregator.server.goUntilStopped(func() {
+				aggregator.flush(updates)
+			})
+		case <-aggregator.server.stop:
+			aggregator.flush(aggregator.updates)
+			return
+		}
+	}
+}
+
+// add adds a metric to the StatsUpdate for its id and dims
+func (aggregator *statsdAggregator) add(metric *statsdMetric) {
+	key := updateKey(metric.id, metric.dims)
+	update := aggregator.updates[key]
+	if update == nil {
+		update = &statsdUpdate{
+			id: metric.id,
+			StatsUpdate: &StatsUpdate{
+				Dims: metric.dims,
+				Stats: Stats{
+					Increments:   make(map[string]int64),
+					Gauges:       make(map[string]int64),
+					MultiMembers: make(map[string][]string),
+				},
+			},
+			members: make(map[string]map[string]bool),
+		}
+		aggregator.updates[key] = update
+	}
+
+	switch metric.metricType {
+	case "c":
+		update.Increments[metric.name] += metric.value
+	case "g":
+		gauges := aggregator.gauges[key]
+		if gauges == nil {
+			gauges = make(map[string]int64)
+			aggregator.gauges[key] = gauges
+		}
+		// Gauges are stored per period, so a relative gauge adjusts the last
+		// value received rather than the stored one, which resets every
+		// period
+		if metric.relative {
+			gauges[metric.name] += metric.value
+		} else {
+			gauges[metric.name] = metric.value
+		}
+		update.Gauges[metric.name] = gauges[metric.name]
+	case "s":
+		members := update.members[metric.name]
+		if members == nil {
+			members = make(map[string]bool)
+			update.members[metric.name] = members
+		}
+		if !members[metric.member] {
+			members[metric.member] = true
+			update.MultiMembers[metric.name] = append(update.MultiMembers[metric.name], metric.member)
+		}
+	}
+}
+
+// flush writes aggregated updates to the server
+func (aggregator *statsdAggregator) flush(updates map[string]*statsdUpdate) {
+	for _, update := range updates {
+		if err := aggregator.server.Write(update.id, update.StatsUpdate); err != nil {
+			aggregator.server.log.Printf("Unable to write StatsD stats for %s: %s", update.id, err)
+		}
+	}
+}
+
+// parseStatsdLine parses a line in the StatsD format with DogStatsD style
+// tags, e.g. "bytesGiven:500|c|@0.5|#country:es,id:myid1".  Tags become dims,
+// except for the one named by idTag, which becomes the id.
+func parseStatsdLine(line string, idTag string) (metric *statsdMetric, err error) {
+	colon := strings.Index(line, ":")
+	if colon <= 0 {
+		return nil, fmt.Errorf("Missing metric name")
+	}
+	metric = &statsdMetric{
+		name: line[:colon],
+		dims: make(map[string]string),
+	}
+
+	parts := strings.Split(line[colon+1:], "|")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("Missing metric type")
+	}
+	valueString := parts[0]
+	metric.metricType = parts[1]
+
+	sampleRate := 1.0
+	for _, part := range parts[2:] {
+		if strings.HasPrefix(part, "@") {
+			if sampleRate, err = strconv.ParseFloat(part[1:], 64); err != nil || sampleRate <= 0 || sampleRate > 1 {
+				return nil, fmt.Errorf("Invalid sample rate %s", part)
+			}
+		} else if strings.HasPrefix(part, "#") {
+			for _, tag := range strings.Split(part[1:], ",") {
+				kv := strings.SplitN(tag, ":", 2)
+				if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+					// Tags without values can't be mapped to dims
+					continue
+				}
+				if kv[0] == idTag {
+					metric.id = kv[1]
+				} else {
+					metric.dims[kv[0]] = kv[1]
+				}
+			}
+		}
+	}
+
+	switch metric.metricType {
+	case "c":
+		var val float64
+		if val, err = strconv.ParseFloat(valueString, 64); err != nil {
+			return nil, fmt.Errorf("Invalid counter value %s", valueString)
+		}
+		metric.value = int64(val / sampleRate)
+	case "g":
+		var val float64
+		if val, err = strconv.ParseFloat(valueString, 64); err != nil {
+			return nil, fmt.Errorf("Invalid gauge value %s", valueString)
+		}
+		metric.value = int64(val)
+		metric.relative = strings.HasPrefix(valueString, "+") || strings.HasPrefix(valueString, "-")
+	case "s":
+		metric.member = valueString
+	default:
+		return nil, fmt.Errorf("Unsupported metric type %s", metric.metricType)
+	}
+	return metric, nil
+}
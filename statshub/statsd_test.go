@@ -0,0 +1,103 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+//
+
+package statshub
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseStatsdLine(t *testing.T) {
+	metric, err := parseStatsdLine("bytesGiven:50|c|@0.5|#country:es,id:myid1,beta", "id")
+	if err != nil {
+		t.Fatalf("Unable to parse counter: %s", err)
+	}
+	if metric.name != "bytesGiven" || metric.metricType != "c" || metric.value != 100 {
+		t.Errorf("Wrong counter: %+v", metric)
+	}
+	if metric.id != "myid1" {
+		t.Errorf("Wrong id: %s", metric.id)
+	}
+	if len(metric.dims) != 1 || metric.dims["country"] != "es" {
+		t.Errorf("Wrong dims: %v", metric.dims)
+	}
+
+	metric, err = parseStatsdLine("online:-3|g", "id")
+	if err != nil {
+		t.Fatalf("Unable to parse gauge: %s", err)
+	}
+	if metric.value != -3 || !metric.relative {
+		t.Errorf("Wrong relative gauge: %+v", metric)
+	}
+
+	for _, bad := range []string{"noValue", "bytesGiven:50", "bytesGiven:abc|c", "latency:5|ms", "bytesGiven:5|c|@2"} {
+		if _, err := parseStatsdLine(bad, "id"); err == nil {
+			t.Errorf("Parsing %s should have failed", bad)
+		}
+	}
+}
+
+func TestStatsdAggregation(t *testing.T) {
+	aggregator := newStatsdAggregator(NewServer(Options{}), "id", time.Minute)
+	lines := []string{
+		"bytesGiven:50|c|#country:es",
+		"bytesGiven:25|c|#country:es",
+		"online:5|g|#country:es",
+		"online:+2|g|#country:es",
+		"users:bob|s|#country:es",
+		"users:bob|s|#country:es",
+		"users:alice|s|#country:es",
+		"bytesGiven:10|c|#country:de",
+	}
+	for _, line := range lines {
+		metric, err := parseStatsdLine(line, "id")
+		if err != nil {
+			t.Fatalf("Unable to parse %s: %s", line, err)
+		}
+		metric.id = "10.0.0.1"
+		aggregator.add(metric)
+	}
+
+	if len(aggregator.updates) != 2 {
+		t.Fatalf("Expected 2 updates, got %d", len(aggregator.updates))
+	}
+	es := aggregator.updates["10.0.0.1|country=es"]
+	if es == nil {
+		t.Fatalf("Missing update for es")
+	}
+	if es.Increments["bytesGiven"] != 75 {
+		t.Errorf("Wrong increment: %d", es.Increments["bytesGiven"])
+	}
+	if es.Gauges["online"] != 7 {
+		t.Errorf("Wrong gauge: %d", es.Gauges["online"])
+	}
+	if len(es.MultiMembers["users"]) != 2 {
+		t.Errorf("Wrong members: %v", es.MultiMembers["users"])
+	}
+
+	// A window with only relative updates adjusts the last value received in
+	// an earlier window
+	aggregator.updates = make(map[string]*statsdUpdate)
+	for _, line := range []string{"online:-1|g|#country:es", "online:-2|g|#country:es"} {
+		metric, _ := parseStatsdLine(line, "id")
+		metric.id = "10.0.0.1"
+		aggregator.add(metric)
+	}
+	es = aggregator.updates["10.0.0.1|country=es"]
+	if es.Gauges["online"] != 4 {
+		t.Errorf("Relative gauge should adjust the last value: %v", es.Gauges)
+	}
+}
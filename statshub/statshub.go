@@ -21,39 +21,42 @@ import (
 	"log"
 	"net/http"
 	"path"
+	"strings"
 	"time"
 )
 
-const (
-	cacheExpiration = 1 * time.Minute
-)
-
-var (
-	countriesCached     bool
-	countryStats        []byte
-	countryStatsRequest = make(chan chan []byte, 1000)
-)
-
 // ClientQueryResponse is a Response to a StatsQuery
 type ClientQueryResponse struct {
 	Response
 	Dims map[string]map[string]*Stats `json:"dims"`
 }
 
+// IdQueryResponse is a Response to a query for the detail of specific ids
+type IdQueryResponse struct {
+	Response
+	Ids map[string]*Stats `json:"ids"`
+}
+
 // Response is a response to a stats request (update or query)
 type Response struct {
 	Succeeded bool   `json:"succeeded"`
 	Error     string `json:"error"`
 }
 
-func init() {
-	http.HandleFunc("/stats/", statsHandler)
-	go cacheCountries()
+// cacheRequest is a request for the cached query of a dimension
+type cacheRequest struct {
+	dim  string
+	resp chan []byte
 }
 
 // statsHandler handles requests to /stats
-func statsHandler(w http.ResponseWriter, r *http.Request) {
-	id := path.Base(r.URL.Path)
+func (s *Server) statsHandler(w http.ResponseWriter, r *http.Request) {
+	// The last segment of the path is the id to update or the dimension to
+	// query, with none (i.e. /stats/) querying all dimensions
+	id := ""
+	if rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/stats"), "/"); rest != "" {
+		id = path.Base(rest)
+	}
 
 	if "POST" == r.Method {
 		if id == "" {
@@ -62,34 +65,39 @@ func statsHandler(w http.ResponseWriter, r *http.Request) {
 
 		w.Header().Set("Content-Type", "application/json")
 
-		statusCode, resp, err := postStats(r, id)
+		statusCode, resp, err := s.postStats(r, id)
 		if err != nil {
 			fail(w, statusCode, err)
 		} else {
 			write(w, 200, resp)
 		}
 	} else if "GET" == r.Method {
+		format, err := exportFormatFor(r)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			fail(w, 400, err)
+			return
+		}
+		if format != formatJSON {
+			s.exportStats(w, id, format)
+			return
+		}
+
 		w.Header().Set("Content-Type", "application/json")
 
 		// check cache
-		// TODO: should probably cache more than just the 1 url
-		path := r.URL.Path
-		requestedCountryStats := path == "/stats/country" || path == "/stats/country/"
-		if requestedCountryStats {
-			countryResponse := make(chan []byte)
-			countryStatsRequest <- countryResponse
-			cached := <-countryResponse
+		if cached, isCached := s.cached(id); isCached {
 			if cached == nil {
-				fail(w, 500, fmt.Errorf("No countries cached"))
+				fail(w, 500, fmt.Errorf("No %s stats cached", id))
 			} else {
 				w.WriteHeader(200)
 				w.Write(cached)
-				return
 			}
+			return
 		} else {
-			log.Printf("Not using cache for path: %s", path)
+			s.log.Printf("Not using cache for path: %s", r.URL.Path)
 		}
-		statusCode, resp, err := getStats(id)
+		statusCode, resp, err := s.getStats(id)
 		if err != nil {
 			fail(w, statusCode, err)
 		} else {
@@ -98,53 +106,111 @@ func statsHandler(w http.ResponseWriter, r *http.Request) {
 			if err == nil {
 				w.Write(bytes)
 			} else {
-				log.Printf("Unable to respond to client: %s", err)
+				s.log.Printf("Unable to respond to client: %s", err)
 			}
 		}
 	} else {
-		log.Printf("Query: %s", r.URL.Query())
+		s.log.Printf("Query: %s", r.URL.Query())
+		w.WriteHeader(405)
+	}
+}
+
+// idsHandler handles requests to /ids, which returns the detail stats for the
+// id given in the path (e.g. /ids/myid1), or for all ids if none is given.
+func (s *Server) idsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if "GET" != r.Method {
 		w.WriteHeader(405)
+		return
+	}
+
+	var ids []string
+	if id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/ids/"), "/"); id != "" {
+		ids = []string{id}
+	}
+
+	statsById, err := s.QueryIds(ids)
+	if err != nil {
+		fail(w, 500, fmt.Errorf("Unable to query ids: %s", err))
+		return
 	}
+	write(w, 200, &IdQueryResponse{
+		Response: Response{Succeeded: true},
+		Ids:      statsById,
+	})
 }
 
-func cacheCountries() {
-	queryCountries()
+// cached returns the cached response for the given dimension.  isCached is
+// false if the dimension isn't cached or the Server isn't running, in which
+// case the dimension should be queried directly.
+func (s *Server) cached(dim string) (cached []byte, isCached bool) {
+	for _, cachedDim := range s.opts.CachedDims {
+		if dim == cachedDim {
+			isCached = true
+		}
+	}
+	if !isCached || !s.isRunning() {
+		return nil, false
+	}
+
+	req := &cacheRequest{dim, make(chan []byte, 1)}
+	select {
+	case s.cacheRequests <- req:
+	case <-s.stop:
+		return nil, false
+	}
+	select {
+	case cached = <-req.resp:
+		return cached, true
+	case <-s.stop:
+		return nil, false
+	}
+}
+
+// cacheDims periodically queries the CachedDims and serves the results to
+// cacheRequests.
+func (s *Server) cacheDims() {
+	cache := make(map[string][]byte)
+	refresh := func() {
+		for _, dim := range s.opts.CachedDims {
+			cache[dim] = s.queryForCache(dim)
+		}
+	}
+
+	refresh()
 	for {
-		nextInterval := time.Now().Truncate(cacheExpiration).Add(cacheExpiration)
-		waitTime := nextInterval.Sub(time.Now())
+		nextInterval := s.clock.Now().Truncate(s.opts.CacheExpiration).Add(s.opts.CacheExpiration)
+		waitTime := nextInterval.Sub(s.clock.Now())
 		select {
-		case req := <-countryStatsRequest:
-			if countriesCached {
-				req <- countryStats
-			} else {
-				req <- nil
-			}
+		case req := <-s.cacheRequests:
+			req.resp <- cache[req.dim]
 		case <-time.After(waitTime):
-			queryCountries()
+			refresh()
+		case <-s.stop:
+			return
 		}
 	}
 }
 
-func queryCountries() {
-	log.Printf("Querying countries for cache")
-	_, resp, err := getStats("country")
+// queryForCache queries a dimension for the cache, returning nil if the query
+// failed.
+func (s *Server) queryForCache(dim string) []byte {
+	s.log.Printf("Querying %s for cache", dim)
+	_, resp, err := s.getStats(dim)
 	if err != nil {
-		log.Printf("Unable to cache countries: %s", err)
-		countriesCached = false
-	} else {
-		bytes, err := json.Marshal(resp)
-		if err == nil {
-			countryStats = bytes
-			countriesCached = true
-		} else {
-			countriesCached = false
-			log.Printf("Unable to cache countries: %s", err)
-		}
+		s.log.Printf("Unable to cache %s: %s", dim, err)
+		return nil
+	}
+	bytes, err := json.Marshal(resp)
+	if err != nil {
+		s.log.Printf("Unable to cache %s: %s", dim, err)
+		return nil
 	}
+	return bytes
 }
 
 // postStats handles a POST request to /stats
-func postStats(r *http.Request, id string) (statusCode int, resp interface{}, err error) {
+func (s *Server) postStats(r *http.Request, id string) (statusCode int, resp interface{}, err error) {
 	decoder := json.NewDecoder(r.Body)
 	stats := &StatsUpdate{}
 	err = decoder.Decode(stats)
@@ -152,9 +218,9 @@ func postStats(r *http.Request, id string) (statusCode int, resp interface{}, er
 		return 400, nil, fmt.Errorf("Unable to decode request: %s", err)
 	}
 
-	if err = stats.write(id); err != nil {
+	if err = s.Write(id, stats); err != nil {
 		formattedError := fmt.Errorf("Unable to post stats: %s", err)
-		log.Println(formattedError)
+		s.log.Println(formattedError)
 		return 500, nil, formattedError
 	}
 
@@ -162,14 +228,14 @@ func postStats(r *http.Request, id string) (statusCode int, resp interface{}, er
 }
 
 // getStats handles a GET request to /stats
-func getStats(dim string) (statusCode int, resp interface{}, err error) {
+func (s *Server) getStats(dim string) (statusCode int, resp interface{}, err error) {
 	clientResp := &ClientQueryResponse{
 		Response: Response{Succeeded: true},
 	}
 
 	dimNames := dimNamesFor(dim)
 
-	if clientResp.Dims, err = QueryDims(dimNames); err != nil {
+	if clientResp.Dims, err = s.QueryDims(dimNames); err != nil {
 		return 500, nil, fmt.Errorf("Unable to query stats: %s", err)
 	}
 
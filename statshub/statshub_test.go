@@ -16,6 +16,7 @@
 package statshub
 
 import (
+	"os"
 	"strings"
 	"testing"
 	"time"
@@ -37,14 +38,12 @@ func TestUpdateAndQuery(t *testing.T) {
 		time.Sleep(sleepAmount)
 	}
 
-	conn, err := connectToRedis()
-	if err != nil {
-		t.Fatalf("Unable to connect to redis: %s", err)
-	}
+	server := NewServer(Options{Store: NewRedisPool(os.Getenv("REDIS_ADDR"), os.Getenv("REDIS_PASS"))})
+	conn := server.connect()
 	defer conn.Close()
 
 	// Clear out the test database before starting
-	_, err = conn.Do("FLUSHDB")
+	_, err := conn.Do("FLUSHDB")
 	if err != nil {
 		t.Fatalf("Unable to flush db: %s", err)
 	}
@@ -61,7 +60,7 @@ func TestUpdateAndQuery(t *testing.T) {
 		},
 	}
 
-	err = update.write("myid1")
+	err = server.Write("myid1", update)
 	if err == nil {
 		t.Fatalf("Attempting to post a stat with a dimension key of 'total' should not have been allowed")
 	}
@@ -93,7 +92,7 @@ func TestUpdateAndQuery(t *testing.T) {
 	}
 
 	writeStats := func(id string) {
-		if err = update.write(id); err != nil {
+		if err = server.Write(id, update); err != nil {
 			t.Fatalf("Unable to post to redis: %s", err)
 		}
 	}
@@ -101,7 +100,7 @@ func TestUpdateAndQuery(t *testing.T) {
 	sleepTillNextBucket()
 	writeStats("myid1")
 	sleepTillNextBucket()
-	statsByDim, err := QueryDims([]string{"country", "user"})
+	statsByDim, err := server.QueryDims([]string{"country", "user"})
 	if err != nil {
 		t.Fatalf("Unable to query: %s", err)
 	}
@@ -166,7 +165,7 @@ func TestUpdateAndQuery(t *testing.T) {
 	sleepTillNextBucket()
 	writeStats("myid1")
 	sleepTillNextBucket()
-	statsByDim, err = QueryDims([]string{"country", "user"})
+	statsByDim, err = server.QueryDims([]string{"country", "user"})
 	if err != nil {
 		t.Fatalf("Unable to query: %s", err)
 	}
@@ -216,7 +215,7 @@ func TestUpdateAndQuery(t *testing.T) {
 	sleepTillNextBucket()
 	writeStats("myid1")
 	sleepTillNextBucket()
-	statsByDim, err = QueryDims([]string{"country", "user"})
+	statsByDim, err = server.QueryDims([]string{"country", "user"})
 	if err != nil {
 		t.Fatalf("Unable to query: %s", err)
 	}
@@ -272,7 +271,7 @@ func TestUpdateAndQuery(t *testing.T) {
 	}
 	writeStats("myid2")
 	sleepTillNextBucket()
-	statsByDim, err = QueryDims([]string{"country", "user"})
+	statsByDim, err = server.QueryDims([]string{"country", "user"})
 	if err != nil {
 		t.Fatalf("Unable to query: %s", err)
 	}
@@ -316,7 +315,7 @@ func TestUpdateAndQuery(t *testing.T) {
 	assertGaugeEquals(t, statsByDim, "user:total:gaugeC", 4)
 
 	sleepTillNextBucket()
-	statsByDim, err = QueryDims([]string{"country", "user"})
+	statsByDim, err = server.QueryDims([]string{"country", "user"})
 	if err != nil {
 		t.Fatalf("Unable to query: %s", err)
 	}
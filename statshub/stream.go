@@ -18,13 +18,10 @@ package statshub
 import (
 	"encoding/json"
 	"fmt"
-	"io"
-	"log"
-	"math"
-	"net/http"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"code.google.com/p/go.net/websocket"
@@ -33,23 +30,11 @@ import (
 )
 
 const (
-	ANY                = "*"
-	STREAMING_INTERVAL = 30 * time.Second
-
-	INTERVAL_QUERY_TEMPL = `
-SELECT
-    INTEGER(TIMESTAMP_TO_SEC(_ts) / %d) AS period,
-	_dim,
-	MAX(%s.%s) AS value
-FROM [%s]
-WHERE
-	_ts <= DATE_ADD(CURRENT_TIMESTAMP(), -%d, "DAY")
-    AND _ts > DATE_ADD(CURRENT_TIMESTAMP(), -%d, "DAY")
-    %s
-GROUP BY period, _dim
-ORDER BY period`
-
-	DIM_WHERE_TEMPL = "AND _dim = '%s'"
+	ANY = "*"
+
+	// Policies for updates to streaming clients whose queues are full
+	QUEUE_DROP     = "drop"     // drop the new update
+	QUEUE_COALESCE = "coalesce" // drop the queued updates, keeping only the new (latest) one
 
 	ONE_MINUTE_SECS = 60
 	ONE_HOUR_SECS   = 60 * ONE_MINUTE_SECS
@@ -62,26 +47,58 @@ ORDER BY period`
 	ONE_YEAR_DAYS   = 365
 )
 
-var (
-	nextStreamingClientId = 0
-	streamingClients      = make(map[int]*streamingClient)
-	newStreamingClient    = make(chan *streamingClient)
-	closedStreamingClient = make(chan int)
-)
-
 type streamingClient struct {
-	ws       *websocket.Conn
-	updates  chan *streamingUpdate
-	id       chan int
-	dimName  string // the name of the dimension that this client is querying (e.g. "fallback")
-	dimKey   string // the key of the dimension that this client is querying (e.g. "instance_fp-afisk-at-getlantern-dot-org-50e8-4-2014-2-24" or "total")
-	statType string // the type of stat being queried (e.g. "counter" or "gauge")
-	statName string // the name of the stat being queried (e.g. "bytesGiven")
+	server      *Server
+	conn        streamingConn
+	updates     chan *streamingUpdate // the queue of updates not yet sent
+	overflows   int                   // how many updates in a row have found updates full, only used by handleStreamingClients
+	evicted     chan string           // the reason that the client is evicted
+	id          chan int
+	done        chan bool
+	multiplexed bool // whether the client subscribes with messages, rather than to the single stat in its path
+
+	subscriptionsMutex sync.Mutex
+	subscriptions      map[string]*subscription // by subscription id
+}
+
+// subscription is a stat that a streaming client is subscribed to
+type subscription struct {
+	id          string // the id given by the client ("" for clients that aren't multiplexed)
+	dimName     string // the name of the dimension that this client is querying (e.g. "fallback")
+	dimKey      string // the key of the dimension that this client is querying (e.g. "instance_fp-afisk-at-getlantern-dot-org-50e8-4-2014-2-24" or "total")
+	statType    string // the type of stat being queried (e.g. "counter" or "gauge")
+	statName    string // the name of the stat being queried (e.g. "bytesGiven")
+	aggregation string // how values are aggregated within each interval of history (e.g. "MAX")
+	historyDays int    // how many days of history to load, at most ONE_YEAR_DAYS
+	since       int64  // if set, only intervals after this (in seconds) are loaded into history
+}
+
+// streamingConn is the connection to a streaming client
+type streamingConn interface {
+	// send sends an encoded message, whose latest interval is asOfSeconds (or 0
+	// if it has no intervals)
+	send(msg []byte, asOfSeconds int64) error
+
+	Close() error
+}
+
+// wsConn is a streamingConn over a websocket, whose writes time out after
+// timeout
+type wsConn struct {
+	*websocket.Conn
+	timeout time.Duration
+}
+
+func (conn *wsConn) send(msg []byte, asOfSeconds int64) error {
+	conn.SetWriteDeadline(time.Now().Add(conn.timeout))
+	_, err := conn.Write(msg)
+	return err
 }
 
 type streamingUpdate struct {
-	asOf time.Time
-	dims map[string]map[string]*Stats
+	asOf    time.Time
+	dims    map[string]map[string]*Stats
+	changed *changedStats // if set, only subscriptions affected by these changes are updated
 }
 
 // ClientQueryResponse is a Response to a StatsQuery
@@ -95,221 +112,782 @@ type StreamingQueryResponseInterval struct {
 	Values      map[string]int64 `json:"values"`
 }
 
-func init() {
-	http.Handle("/stream/", websocket.Handler(streamStats))
-	go handleStreamingClients()
+// StreamingRequest is a message from a client of a multiplexed stream.  Type
+// is one of:
+//
+//	subscribe   - subscribes to a stat under the given Id, which is answered
+//	              with its history
+//	unsubscribe - ends the subscription with the given Id
+//	ping        - is answered with a pong with the same Id
+type StreamingRequest struct {
+	Type        string `json:"type"`
+	Id          string `json:"id"`
+	Dim         string `json:"dim"`
+	Key         string `json:"key"`         // a dimension key, "total" or ANY (the default)
+	StatType    string `json:"statType"`    // counter or gauge
+	Stat        string `json:"stat"`        // the name of the stat
+	Aggregation string `json:"aggregation"` // how history is aggregated, see bigquery.Aggregations
+	HistoryDays int    `json:"historyDays"` // how many days of history to load, 0 for a year and -1 for none
 }
 
-// handleStreamingClients handles streaming updates to subscribed streaming clients
-func handleStreamingClients() {
+// StreamingMessage is a message to a client of a multiplexed stream.  Type is
+// one of:
+//
+//	history      - the history of a new subscription
+//	update       - the latest interval of a subscription
+//	unsubscribed - confirms that a subscription has ended
+//	pong         - answers a ping
+//	error        - a request failed, with the reason in Error
+//	closed       - the connection is being closed, with the reason in Error
+//
+// Id is the id of the subscription or request that the message is about.
+type StreamingMessage struct {
+	StreamingQueryResponse
+	Type string `json:"type"`
+	Id   string `json:"id"`
+}
+
+// handleStreamingClients handles streaming updates to subscribed streaming
+// clients.  When the server stops, all streaming clients are disconnected.
+func (s *Server) handleStreamingClients() {
+	// Changes are collected for PushInterval and then pushed together
+	var changed *changedStats
+	var push <-chan time.Time
 	for {
-		nextInterval := time.Now().Truncate(STREAMING_INTERVAL).Add(STREAMING_INTERVAL)
-		waitTime := nextInterval.Sub(time.Now())
+		nextInterval := s.clock.Now().Truncate(s.opts.StreamingInterval).Add(s.opts.StreamingInterval)
+		waitTime := nextInterval.Sub(s.clock.Now())
 		select {
-		case client := <-newStreamingClient:
+		case client := <-s.newStreamingClient:
 			// Add new client to map
-			nextStreamingClientId++
-			streamingClients[nextStreamingClientId] = client
-			client.id <- nextStreamingClientId
-		case closedId := <-closedStreamingClient:
+			s.nextStreamingClientId++
+			s.streamingClients[s.nextStreamingClientId] = client
+			client.id <- s.nextStreamingClientId
+			atomic.StoreInt64(&s.numStreamingClients, int64(len(s.streamingClients)))
+		case closedId := <-s.closedStreamingClient:
 			// Remove disconnected client from map
-			delete(streamingClients, closedId)
+			delete(s.streamingClients, closedId)
+			atomic.StoreInt64(&s.numStreamingClients, int64(len(s.streamingClients)))
+		case change := <-s.changes:
+			if changed == nil {
+				changed = newChangedStats()
+				push = time.After(s.opts.PushInterval)
+			}
+			changed.add(change)
+		case <-push:
+			s.pushChanges(changed)
+			changed, push = nil, nil
 		case <-time.After(waitTime):
-			// Query fallback and country dims
-			// TODO: only query for the stuff that clients have asked for
-			dims, err := QueryDims([]string{"fallback", "country"})
+			// Query only the stats that clients are subscribed to
+			filters := streamingFilters(s.streamingClients, nil)
+			if len(filters) == 0 {
+				continue
+			}
+			dims, err := s.QueryDimsFiltered(filters)
 			if err != nil {
-				log.Printf("Unable to query dims: %s", err)
+				s.log.Printf("Unable to query dims: %s", err)
 			} else {
 				// Publish update to clients
-				update := &streamingUpdate{asOf: nextInterval, dims: dims}
-				for _, client := range streamingClients {
-					client.updates <- update
+				s.publishUpdate(&streamingUpdate{asOf: nextInterval, dims: dims})
+			}
+		case <-s.stop:
+			for _, client := range s.streamingClients {
+				client.conn.Close()
+			}
+			return
+		}
+	}
+}
+
+// pushChanges sends an update to the streaming clients whose subscriptions are
+// affected by changes
+func (s *Server) pushChanges(changed *changedStats) {
+	filters := streamingFilters(s.streamingClients, changed)
+	if len(filters) == 0 {
+		return
+	}
+	dims, err := s.QueryDimsFiltered(filters)
+	if err != nil {
+		s.log.Printf("Unable to query changed dims: %s", err)
+		return
+	}
+	s.publishUpdate(&streamingUpdate{asOf: s.clock.Now(), dims: dims, changed: changed})
+}
+
+// publishUpdate queues an update for every streaming client, without waiting
+// for slow ones.  Clients that keep falling behind are evicted.
+func (s *Server) publishUpdate(update *streamingUpdate) {
+	for id, client := range s.streamingClients {
+		dropped := client.enqueue(update, s.opts.StreamingQueuePolicy)
+		if dropped == 0 {
+			client.overflows = 0
+			continue
+		}
+		atomic.AddInt64(&s.droppedStreamingUpdates, int64(dropped))
+		client.overflows++
+		if client.overflows >= s.opts.StreamingMaxOverflows {
+			s.log.Printf("Evicting streaming client %d, which has fallen behind", id)
+			delete(s.streamingClients, id)
+			atomic.StoreInt64(&s.numStreamingClients, int64(len(s.streamingClients)))
+			atomic.AddInt64(&s.evictedStreamingClients, 1)
+			client.evicted <- fmt.Sprintf("Evicted for falling more than %d updates behind", cap(client.updates))
+		}
+	}
+}
+
+// enqueue queues an update for the client without blocking.  If the queue is
+// full, updates are dropped according to policy and the number of dropped
+// updates is returned.
+func (client *streamingClient) enqueue(update *streamingUpdate, policy string) (dropped int) {
+	select {
+	case client.updates <- update:
+		return 0
+	default:
+	}
+	if policy == QUEUE_DROP {
+		return 1
+	}
+	// Every update has the latest values of all subscribed stats, so the new
+	// one supersedes the queued ones
+	for {
+		select {
+		case <-client.updates:
+			dropped++
+		default:
+			// handleStreamingClients is the only sender, so this can't block
+			client.updates <- update
+			return
+		}
+	}
+}
+
+// streamingFilters builds the filters for querying the dimension keys and
+// stats that the given clients are subscribed to, only those affected by
+// changed if it's not nil
+func streamingFilters(clients map[int]*streamingClient, changed *changedStats) map[string]*DimFilter {
+	filters := make(map[string]*DimFilter)
+	for _, client := range clients {
+		for _, sub := range client.subscribed() {
+			if changed != nil && !changed.affects(sub) {
+				continue
+			}
+			filter := filters[sub.dimName]
+			if filter == nil {
+				filter = &DimFilter{Keys: make([]string, 0)}
+				filters[sub.dimName] = filter
+			}
+			if sub.dimKey == ANY {
+				filter.Keys = nil
+			} else if filter.Keys != nil && !contains(filter.Keys, sub.dimKey) {
+				filter.Keys = append(filter.Keys, sub.dimKey)
+			}
+			switch sub.statType {
+			case "counter":
+				if !contains(filter.Counters, sub.statName) {
+					filter.Counters = append(filter.Counters, sub.statName)
+				}
+			case "gauge":
+				if !contains(filter.Gauges, sub.statName) {
+					filter.Gauges = append(filter.Gauges, sub.statName)
 				}
 			}
 		}
 	}
+	return filters
 }
 
-// streamStats streams stats over a websocket
-func streamStats(ws *websocket.Conn) {
+// streamStats streams stats over a websocket.  Clients either connect to the
+// path of a single stat (e.g. /stream/country/*/counter/bytesGiven), or to
+// /stream/ and then send StreamingRequests to subscribe to any number of stats.
+func (s *Server) streamStats(ws *websocket.Conn) {
 	singleSlashPath := strings.Replace(ws.Request().URL.Path, "//", "/", -1)
 	pathParts := strings.Split(singleSlashPath, "/")
 
-	if len(pathParts) < 6 {
-		data, err := json.Marshal(&Response{Succeeded: false, Error: fmt.Sprintf("Wrong path: %s. Expected something like: %s", singleSlashPath, "/stream/country/*/counter/bytesGiven")})
-		if err == nil {
-			ws.Write(data)
+	client := s.streamingClientFor(&wsConn{ws, s.opts.StreamingWriteTimeout})
+	client.multiplexed = strings.Trim(singleSlashPath, "/") == "stream"
+
+	if !client.multiplexed {
+		if len(pathParts) < 6 {
+			writeError(ws, fmt.Sprintf("Wrong path: %s. Expected something like: %s", singleSlashPath, "/stream/country/*/counter/bytesGiven"))
+			return
+		}
+		sub := &subscription{
+			dimName:     pathParts[2],
+			dimKey:      pathParts[3],
+			statType:    pathParts[4],
+			statName:    pathParts[5],
+			aggregation: ws.Request().URL.Query().Get("aggregation"),
+			historyDays: ONE_YEAR_DAYS,
+		}
+		if err := client.subscribe(sub); err != nil {
+			writeError(ws, err.Error())
+			return
 		}
-		return
 	}
 
-	client := &streamingClient{
-		ws:       ws,
-		updates:  make(chan *streamingUpdate, 100),
-		id:       make(chan int),
-		dimName:  pathParts[2],
-		dimKey:   pathParts[3],
-		statType: pathParts[4],
-		statName: pathParts[5],
+	select {
+	case s.newStreamingClient <- client:
+	case <-s.stop:
+		ws.Close()
+		return
 	}
-
-	client.loadHistory()
+	id := <-client.id
 
 	go client.writeUpdates()
+	defer close(client.done)
 
-	var wg sync.WaitGroup
-	wg.Add(1)
-
-	// Read from the client (we don't expect to get anything, but this allows us
-	// to check for closed connections)
-	go func() {
-		id := <-client.id
+	if client.multiplexed {
+		client.readRequests(ws)
+	} else {
+		// Read from the client (we don't expect to get anything, but this
+		// allows us to check for closed connections, including ones closed by
+		// Shutdown)
 		msg := make([]byte, 1)
 		for {
-			_, err := ws.Read(msg)
-			if err == io.EOF {
-				closedStreamingClient <- id
-				ws.Close()
-				wg.Done()
-				return
+			if _, err := ws.Read(msg); err != nil {
+				break
 			}
 		}
-	}()
+	}
+	select {
+	case s.closedStreamingClient <- id:
+	case <-s.stop:
+	}
+	ws.Close()
+}
+
+// streamingClientFor builds a streamingClient for the given connection
+func (s *Server) streamingClientFor(conn streamingConn) *streamingClient {
+	return &streamingClient{
+		server:        s,
+		conn:          conn,
+		updates:       make(chan *streamingUpdate, s.opts.StreamingQueueSize),
+		evicted:       make(chan string, 1),
+		id:            make(chan int, 1),
+		done:          make(chan bool),
+		subscriptions: make(map[string]*subscription),
+	}
+}
+
+// readRequests handles the StreamingRequests of a multiplexed client, in the
+// order that they arrive, until the connection is closed.
+func (client *streamingClient) readRequests(ws *websocket.Conn) {
+	for {
+		var data []byte
+		if err := websocket.Message.Receive(ws, &data); err != nil {
+			return
+		}
+		req := &StreamingRequest{}
+		if err := json.Unmarshal(data, req); err != nil {
+			client.writeMessage(&StreamingMessage{
+				StreamingQueryResponse: StreamingQueryResponse{Response: Response{Error: fmt.Sprintf("Unable to decode request: %s", err)}},
+				Type:                   "error",
+			})
+			continue
+		}
+		if err := client.handleRequest(req); err != nil {
+			client.writeMessage(&StreamingMessage{
+				StreamingQueryResponse: StreamingQueryResponse{Response: Response{Error: err.Error()}},
+				Type:                   "error",
+				Id:                     req.Id,
+			})
+		}
+	}
+}
+
+// handleRequest handles a single StreamingRequest
+func (client *streamingClient) handleRequest(req *StreamingRequest) error {
+	switch req.Type {
+	case "subscribe":
+		sub, err := req.subscription()
+		if err != nil {
+			return err
+		}
+		if client.subscription(req.Id) != nil {
+			return fmt.Errorf("Already subscribed as %q", req.Id)
+		}
+		return client.subscribe(sub)
+	case "unsubscribe":
+		client.subscriptionsMutex.Lock()
+		_, found := client.subscriptions[req.Id]
+		delete(client.subscriptions, req.Id)
+		client.subscriptionsMutex.Unlock()
+		if !found {
+			return fmt.Errorf("Not subscribed as %q", req.Id)
+		}
+		client.writeMessage(&StreamingMessage{
+			StreamingQueryResponse: StreamingQueryResponse{Response: Response{Succeeded: true}},
+			Type:                   "unsubscribed",
+			Id:                     req.Id,
+		})
+		return nil
+	case "ping":
+		client.writeMessage(&StreamingMessage{
+			StreamingQueryResponse: StreamingQueryResponse{Response: Response{Succeeded: true}},
+			Type:                   "pong",
+			Id:                     req.Id,
+		})
+		return nil
+	default:
+		return fmt.Errorf("Unknown request type %q, expected subscribe, unsubscribe or ping", req.Type)
+	}
+}
+
+// subscription builds the subscription that a subscribe request asks for
+func (req *StreamingRequest) subscription() (*subscription, error) {
+	if req.Id == "" {
+		return nil, fmt.Errorf("Subscriptions need an id")
+	}
+	sub := &subscription{
+		id:          req.Id,
+		dimName:     req.Dim,
+		dimKey:      req.Key,
+		statType:    req.StatType,
+		statName:    req.Stat,
+		aggregation: req.Aggregation,
+		historyDays: req.HistoryDays,
+	}
+	if sub.dimKey == "" {
+		sub.dimKey = ANY
+	}
+	if sub.historyDays == 0 || sub.historyDays > ONE_YEAR_DAYS {
+		sub.historyDays = ONE_YEAR_DAYS
+	}
+	return sub, nil
+}
+
+// subscribe checks a subscription, sends its history to the client and then
+// adds it to the client's subscriptions
+func (client *streamingClient) subscribe(sub *subscription) error {
+	if err := client.server.checkSubscription(sub); err != nil {
+		return err
+	}
+	return client.start(sub)
+}
+
+// start sends the history of a checked subscription to the client and then
+// adds it to the client's subscriptions
+func (client *streamingClient) start(sub *subscription) error {
+	intervals, err := client.server.loadHistory(sub)
+	if err != nil {
+		return err
+	}
+	return client.startWithHistory(sub, intervals)
+}
+
+// startWithHistory sends the already loaded history of a checked subscription
+// to the client and then adds it to the client's subscriptions
+func (client *streamingClient) startWithHistory(sub *subscription, intervals []StreamingQueryResponseInterval) error {
+	if err := client.writeIntervals(sub, "history", intervals); err != nil {
+		return fmt.Errorf("Unable to write history: %s", err)
+	}
+
+	client.subscriptionsMutex.Lock()
+	defer client.subscriptionsMutex.Unlock()
+	client.subscriptions[sub.id] = sub
+	return nil
+}
+
+// subscription returns the client's subscription with the given id, or nil
+func (client *streamingClient) subscription(id string) *subscription {
+	client.subscriptionsMutex.Lock()
+	defer client.subscriptionsMutex.Unlock()
+	return client.subscriptions[id]
+}
+
+// subscribed returns all of the client's subscriptions
+func (client *streamingClient) subscribed() []*subscription {
+	client.subscriptionsMutex.Lock()
+	defer client.subscriptionsMutex.Unlock()
+	subs := make([]*subscription, 0, len(client.subscriptions))
+	for _, sub := range client.subscriptions {
+		subs = append(subs, sub)
+	}
+	return subs
+}
+
+// checkSubscription checks that a subscription is to a known stat of a known
+// dimension, with a history query that's well-formed.
+func (s *Server) checkSubscription(sub *subscription) error {
+	now := s.clock.Now()
+	if err := sub.historyQuery(ONE_HOUR_SECS, now.Add(-time.Hour), now).Validate(); err != nil {
+		return err
+	}
+
+	conn := s.connect()
+	defer conn.Close()
+	dimNames, err := listDimNames(conn)
+	if err != nil {
+		return fmt.Errorf("Unable to list dimensions: %s", err)
+	}
+	statNames, err := listStatKeys(conn, sub.statType)
+	if err != nil {
+		return fmt.Errorf("Unable to list stats: %s", err)
+	}
+	if sub.statType == "gauge" {
+		// The cardinalities of members are reported as gauges
+		memberNames, err := listStatKeys(conn, "member")
+		if err != nil {
+			return fmt.Errorf("Unable to list stats: %s", err)
+		}
+		statNames = append(statNames, memberNames...)
+	}
+	return checkKnown(sub, dimNames, statNames)
+}
 
-	newStreamingClient <- client
-	wg.Wait()
+// checkKnown checks that a subscription is to one of the given stats of one of
+// the given dimensions.
+func checkKnown(sub *subscription, dimNames []string, statNames []string) error {
+	if sub.statType != "counter" && sub.statType != "gauge" {
+		return fmt.Errorf("Unable to stream stat type %q, expected counter or gauge", sub.statType)
+	}
+	if !contains(dimNames, sub.dimName) {
+		return fmt.Errorf("Unknown dimension %q", sub.dimName)
+	}
+	if !contains(statNames, sub.statName) {
+		return fmt.Errorf("Unknown %s %q", sub.statType, sub.statName)
+	}
+	return nil
 }
 
-// loadHistory loads historical data based on the specified query and sends it
-// to the client
-func (client *streamingClient) loadHistory() {
+func contains(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+// loadHistory loads the historical data for a subscription, going back at
+// most its historyDays
+func (s *Server) loadHistory(sub *subscription) ([]StreamingQueryResponseInterval, error) {
+	now := s.clock.Now()
+	daysAgo := func(days int) time.Time {
+		if days > sub.historyDays {
+			days = sub.historyDays
+		}
+		return now.Add(-time.Duration(days) * 24 * time.Hour)
+	}
+
 	intervals := []StreamingQueryResponseInterval{}
+	if sub.historyDays <= 0 {
+		return intervals, nil
+	}
+	var err error
 	// Weekly figures for 1 month back to 1 year back
-	intervals = client.loadHistoryForRange(intervals, ONE_WEEK_SECS, ONE_MONTH_DAYS, ONE_YEAR_DAYS)
+	if intervals, err = s.loadHistoryForRange(sub, intervals, ONE_WEEK_SECS, daysAgo(ONE_YEAR_DAYS), daysAgo(ONE_MONTH_DAYS)); err != nil {
+		return intervals, err
+	}
 	// Daily figures for 1 week back to 1 month back
-	intervals = client.loadHistoryForRange(intervals, ONE_DAY_SECS, ONE_WEEK_DAYS, ONE_MONTH_DAYS)
+	if intervals, err = s.loadHistoryForRange(sub, intervals, ONE_DAY_SECS, daysAgo(ONE_MONTH_DAYS), daysAgo(ONE_WEEK_DAYS)); err != nil {
+		return intervals, err
+	}
 	// Hourly figures for the last 1 week
-	intervals = client.loadHistoryForRange(intervals, ONE_HOUR_SECS, 0, ONE_WEEK_DAYS)
+	if intervals, err = s.loadHistoryForRange(sub, intervals, ONE_HOUR_SECS, daysAgo(ONE_WEEK_DAYS), now); err != nil {
+		return intervals, err
+	}
 
-	resp := &StreamingQueryResponse{
-		Response:  Response{Succeeded: true},
-		Intervals: intervals,
+	if sub.since > 0 {
+		// Intervals that began before since were (at least partially) seen
+		// already
+		for len(intervals) > 0 && intervals[0].AsOfSeconds <= sub.since {
+			intervals = intervals[1:]
+		}
 	}
-	client.writeResponse(resp)
+	return intervals, nil
 }
 
-// loadHistoryForRange loads history for a date range
-func (client *streamingClient) loadHistoryForRange(
+// historyQuery builds the query for the history of the subscription's stat in
+// the time range (start, end]
+func (sub *subscription) historyQuery(intervalInSeconds int, start time.Time, end time.Time) *bigquery.HistoryQuery {
+	dimKey := sub.dimKey
+	if dimKey == ANY {
+		dimKey = ""
+	}
+	return &bigquery.HistoryQuery{
+		DimName:     sub.dimName,
+		DimKey:      dimKey,
+		StatType:    sub.statType,
+		StatName:    sub.statName,
+		Aggregation: sub.aggregation,
+		Start:       start,
+		End:         end,
+		Resolution:  time.Duration(intervalInSeconds) * time.Second,
+	}
+}
+
+// loadHistoryForRange loads history for the time range (start, end], which is
+// skipped if it's empty.  The part of the range up to the end of the legacy
+// table is read from it and the rest from the day tables.  Only invalid
+// queries are errors, failures to run them are logged.
+func (s *Server) loadHistoryForRange(
+	sub *subscription,
 	intervals []StreamingQueryResponseInterval,
 	intervalInSeconds int,
-	startOffsetInDays int,
-	endOffsetInDays int) []StreamingQueryResponseInterval {
-
-	additionalWhereClause := ""
-	if client.dimKey != ANY {
-		additionalWhereClause = fmt.Sprintf(DIM_WHERE_TEMPL, client.dimKey)
-	}
-
-	// Yup, this allows SQL injection, but the BigQuery database doesn't allow
-	// any updates of the database, only queries, so we don't worry about it
-	queryString := fmt.Sprintf(
-		INTERVAL_QUERY_TEMPL,
-		intervalInSeconds,
-		client.statType,
-		client.statName,
-		client.dimName,
-		startOffsetInDays,
-		endOffsetInDays,
-		additionalWhereClause)
-	rows, err := bigquery.Query(queryString, math.MaxInt32)
+	start time.Time,
+	end time.Time) ([]StreamingQueryResponseInterval, error) {
+
+	if sub.since > 0 && start.Unix() < sub.since {
+		start = time.Unix(sub.since, 0)
+	}
+	if !start.Before(end) {
+		return intervals, nil
+	}
+	q := sub.historyQuery(intervalInSeconds, start, end)
+	q.Rollups = s.opts.HistoryRollups
+	if err := q.Validate(); err != nil {
+		return intervals, err
+	}
+	if legacyEnd := s.legacyHistoryEnd(q.DimName); start.Before(legacyEnd) {
+		legacy := *q
+		legacy.Legacy = true
+		if legacyEnd.Before(end) {
+			legacy.End = legacyEnd
+			q.Start = legacyEnd
+		} else {
+			q = nil
+		}
+		intervals = s.appendHistory(intervals, &legacy, intervalInSeconds)
+	}
+	if q != nil {
+		intervals = s.appendHistory(intervals, q, intervalInSeconds)
+	}
+	return intervals, nil
+}
+
+// appendHistory runs a validated history query and appends its intervals,
+// logging any failure.
+func (s *Server) appendHistory(
+	intervals []StreamingQueryResponseInterval,
+	q *bigquery.HistoryQuery,
+	intervalInSeconds int) []StreamingQueryResponseInterval {
+
+	rows, err := s.queryHistory(q)
 	if err != nil {
-		log.Printf("Unable to run query: %s\n%s\n\n", err, queryString)
+		s.log.Printf("Unable to run query: %s", err)
+		return intervals
 	}
 
-	if len(rows) > 0 {
-		lastCutoff := int64(0) // will cause first row to be seen as a new cutoff
-		var interval StreamingQueryResponseInterval
-		for _, row := range rows {
-			cutoff, err := strconv.ParseInt(row[0].(string), 10, 64)
+	lastCutoff := int64(0) // will cause first row to be seen as a new cutoff
+	var interval StreamingQueryResponseInterval
+	for _, row := range rows {
+		cutoff, err := strconv.ParseInt(row[0].(string), 10, 64)
+		if err != nil {
+			s.log.Printf("Unable to read cutoff %s: %s", row[0], err)
+			return intervals
+		}
+		if cutoff != lastCutoff {
+			// Start a new interval
+			asOf := cutoff * int64(intervalInSeconds)
+			interval = StreamingQueryResponseInterval{asOf, make(map[string]int64)}
+			l := len(intervals)
+			if l > 0 && intervals[l-1].AsOfSeconds == asOf {
+				// When switching from one periodicity to another (e.g. week
+				// to day), it's possible that we see an interval that's
+				// already been seen.  If that happens, we replace the
+				// existing one with the new one (which is assumed to be
+				// more precise).
+				intervals[l-1] = interval
+			} else {
+				// Totally new interval, just append
+				intervals = append(intervals, interval)
+			}
+		}
+		lastCutoff = cutoff
+
+		dim := row[1].(string)
+
+		value := int64(0)
+		valueIf := row[2]
+		if valueIf != nil {
+			value, err = strconv.ParseInt(valueIf.(string), 10, 64)
 			if err != nil {
-				log.Printf("Unable to read cutoff %s: %s", row[0], err)
+				s.log.Printf("Unable to read value %s: %s", row[2], err)
 				return intervals
 			}
-			if cutoff != lastCutoff {
-				// Start a new interval
-				asOf := cutoff * int64(intervalInSeconds)
-				interval = StreamingQueryResponseInterval{asOf, make(map[string]int64)}
-				l := len(intervals)
-				if l > 0 && intervals[l-1].AsOfSeconds == asOf {
-					// When switching from one periodicity to another (e.g. week
-					// to day), it's possible that we see an interval that's
-					// already been seen.  If that happens, we replace the
-					// existing one with the new one (which is assumed to be
-					// more precise).
-					intervals[l-1] = interval
-				} else {
-					// Totally new interval, just append
-					intervals = append(intervals, interval)
-				}
-			}
-			lastCutoff = cutoff
+		}
+		interval.Values[dim] = value
+	}
 
-			dim := row[1].(string)
+	return intervals
+}
 
-			value := int64(0)
-			valueIf := row[2]
-			if valueIf != nil {
-				value, err = strconv.ParseInt(valueIf.(string), 10, 64)
-				if err != nil {
-					log.Printf("Unable to read value %s: %s", row[2], err)
-					return intervals
-				}
+// legacyHistoryEnd returns the time of the last row in the legacy table of
+// the given dimension, or the zero time if there's no legacy table.  Archives
+// don't write to legacy tables any more, so this is cached once it's known.
+func (s *Server) legacyHistoryEnd(dimName string) time.Time {
+	s.legacyEndsMutex.Lock()
+	defer s.legacyEndsMutex.Unlock()
+	if end, found := s.legacyEnds[dimName]; found {
+		return end
+	}
+	queryString, err := bigquery.LegacyEndSQL(dimName)
+	if err != nil {
+		return time.Time{}
+	}
+	var end time.Time
+	it, err := s.queryRows(queryString)
+	if err == nil {
+		defer it.Close()
+		if it.Next() && it.Row()[0] != nil {
+			secs, parseErr := strconv.ParseInt(it.Row()[0].(string), 10, 64)
+			if parseErr != nil {
+				s.log.Printf("Unable to read end of legacy table %s: %s", dimName, parseErr)
+				return time.Time{}
 			}
-			interval.Values[dim] = value
+			end = time.Unix(secs, 0)
 		}
+		err = it.Err()
+	}
+	if err != nil && !bigquery.IsMissingTables(err) {
+		// Try again next time
+		s.log.Printf("Unable to find end of legacy table %s: %s", dimName, err)
+		return time.Time{}
 	}
+	s.legacyEnds[dimName] = end
+	return end
+}
 
-	return intervals
+// queryRows starts running a query with the BigQuery client of the Options
+func (s *Server) queryRows(queryString string) (*bigquery.Rows, error) {
+	c := s.opts.BigQuery
+	if c == nil {
+		var err error
+		if c, err = bigquery.OpenClient(); err != nil {
+			return nil, err
+		}
+	}
+	return bigquery.QueryRows(c, queryString, bigquery.QueryOptions{Cancel: s.stop})
 }
 
-// writeUpdates grabs streaming updates and sends them to the client
+// queryHistory runs a history query and reads all of its rows.  Rollups are
+// only made once archiving with rollups is enabled, so if a query's rollup
+// tables don't exist, it reads the archived rows instead.  If those don't exist
+// either, because nothing was archived in the query's time range, there are
+// no rows.
+func (s *Server) queryHistory(q *bigquery.HistoryQuery) ([][]interface{}, error) {
+	queryString, err := q.SQL()
+	if err != nil {
+		return nil, err
+	}
+	var rows [][]interface{}
+	it, err := s.queryRows(queryString)
+	if err == nil {
+		defer it.Close()
+		for it.Next() {
+			rows = append(rows, it.Row())
+		}
+		err = it.Err()
+	}
+	if err != nil && bigquery.IsMissingTables(err) && q.ReadsRollups() {
+		withoutRollups := *q
+		withoutRollups.Rollups = false
+		return s.queryHistory(&withoutRollups)
+	}
+	if err != nil && bigquery.IsMissingTables(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s\n%s\n", err, queryString)
+	}
+	return rows, nil
+}
+
+// writeUpdates grabs streaming updates and sends them to the client, until the
+// client disconnects, a write fails or the client is evicted.  Either of the
+// latter closes the connection.
 func (client *streamingClient) writeUpdates() {
 	for {
 		// This gets data for all dims
-		update := <-client.updates
-		values := make(map[string]int64)
-		dim := update.dims[client.dimName]
-		queryingSpecificDimKey := client.dimKey != ANY
-		if dim != nil {
-			for dimKey, stats := range dim {
-				if !queryingSpecificDimKey || dimKey == client.dimKey {
-					switch client.statType {
-					case "counter":
-						values[dimKey] = stats.Counters[client.statName]
-					case "gauge":
-						values[dimKey] = stats.Gauges[client.statName]
-					default:
-						log.Printf("Client has unknown statType: %s", client.statType)
-					}
-				}
+		var update *streamingUpdate
+		select {
+		case update = <-client.updates:
+		case reason := <-client.evicted:
+			client.writeClosed(reason)
+			client.conn.Close()
+			return
+		case <-client.done:
+			return
+		}
+		for _, sub := range client.subscribed() {
+			if update.changed != nil && !update.changed.affects(sub) {
+				continue
+			}
+			err := client.writeIntervals(sub, "update", []StreamingQueryResponseInterval{
+				StreamingQueryResponseInterval{update.asOf.Unix(), sub.values(update)},
+			})
+			if err != nil {
+				client.server.log.Printf("Unable to write to streaming client, disconnecting: %s", err)
+				client.conn.Close()
+				return
 			}
 		}
-		resp := &StreamingQueryResponse{
-			Response: Response{Succeeded: true},
-			Intervals: []StreamingQueryResponseInterval{
-				StreamingQueryResponseInterval{update.asOf.Unix(), values},
-			},
+	}
+}
+
+// writeClosed tells the client the reason that its connection is being closed
+func (client *streamingClient) writeClosed(reason string) error {
+	resp := StreamingQueryResponse{Response: Response{Succeeded: false, Error: reason}}
+	if client.multiplexed {
+		return client.writeMessage(&StreamingMessage{StreamingQueryResponse: resp, Type: "closed"})
+	}
+	return client.writeMessage(&resp.Response)
+}
+
+// values picks the values of the subscription's stat out of an update
+func (sub *subscription) values(update *streamingUpdate) map[string]int64 {
+	values := make(map[string]int64)
+	queryingSpecificDimKey := sub.dimKey != ANY
+	for dimKey, stats := range update.dims[sub.dimName] {
+		if !queryingSpecificDimKey || dimKey == sub.dimKey {
+			switch sub.statType {
+			case "counter":
+				values[dimKey] = stats.Counters[sub.statName]
+			case "gauge":
+				values[dimKey] = stats.Gauges[sub.statName]
+			}
 		}
-		client.writeResponse(resp)
 	}
+	return values
+}
+
+// writeIntervals writes intervals of a subscription to the client, as a
+// StreamingMessage of the given type if the client is multiplexed
+func (client *streamingClient) writeIntervals(sub *subscription, msgType string, intervals []StreamingQueryResponseInterval) error {
+	resp := StreamingQueryResponse{
+		Response:  Response{Succeeded: true},
+		Intervals: intervals,
+	}
+	asOfSeconds := int64(0)
+	if len(intervals) > 0 {
+		asOfSeconds = intervals[len(intervals)-1].AsOfSeconds
+	}
+	if client.multiplexed {
+		return client.send(&StreamingMessage{StreamingQueryResponse: resp, Type: msgType, Id: sub.id}, asOfSeconds)
+	}
+	return client.send(&resp, asOfSeconds)
 }
 
-func (client *streamingClient) writeResponse(resp *StreamingQueryResponse) {
-	encoded, err := json.Marshal(resp)
+// writeMessage writes a message without intervals to the client as JSON
+func (client *streamingClient) writeMessage(msg interface{}) error {
+	return client.send(msg, 0)
+}
+
+// send sends a message to the client as JSON.  Only failures to write are
+// returned, failures to marshal are logged.
+func (client *streamingClient) send(msg interface{}, asOfSeconds int64) error {
+	encoded, err := json.Marshal(msg)
 	if err != nil {
-		log.Printf("Unable to marshal json: %s", err)
-	} else {
-		client.ws.Write(encoded)
+		client.server.log.Printf("Unable to marshal json: %s", err)
+		return nil
+	}
+	return client.conn.send(encoded, asOfSeconds)
+}
+
+// writeError writes a failed Response to a streaming client
+func writeError(ws *websocket.Conn, msg string) {
+	data, err := json.Marshal(&Response{Succeeded: false, Error: msg})
+	if err == nil {
+		ws.Write(data)
 	}
 }
@@ -0,0 +1,329 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+//
+
+package statshub
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"testing"
+	"time"
+
+	bq "code.google.com/p/ox-google-api-go-client/bigquery/v2"
+
+	"github.com/getlantern/statshub/bigquery"
+	"github.com/getlantern/statshub/bigquery/fake"
+)
+
+func TestCheckKnown(t *testing.T) {
+	dimNames := []string{"country", "fallback"}
+	statNames := []string{"bytesGiven"}
+	for _, test := range []struct {
+		sub      *subscription
+		expected string
+	}{
+		{&subscription{dimName: "country", statType: "counter", statName: "bytesGiven"}, ""},
+		{&subscription{dimName: "country", statType: "member", statName: "bytesGiven"}, `Unable to stream stat type "member", expected counter or gauge`},
+		{&subscription{dimName: "user", statType: "counter", statName: "bytesGiven"}, `Unknown dimension "user"`},
+		{&subscription{dimName: "country", statType: "gauge", statName: "online"}, `Unknown gauge "online"`},
+	} {
+		err := checkKnown(test.sub, dimNames, statNames)
+		if test.expected == "" && err != nil {
+			t.Errorf("Unexpected error: %s", err)
+		} else if test.expected != "" && (err == nil || err.Error() != test.expected) {
+			t.Errorf("Expected error %s, got %v", test.expected, err)
+		}
+	}
+}
+
+func TestStreamingFilters(t *testing.T) {
+	if filters := streamingFilters(map[int]*streamingClient{}, nil); len(filters) != 0 {
+		t.Errorf("Without clients, nothing should be queried: %v", filters)
+	}
+
+	filters := streamingFilters(map[int]*streamingClient{
+		1: subscribedClient(
+			&subscription{id: "a", dimName: "country", dimKey: "es", statType: "counter", statName: "bytesGiven"},
+			&subscription{id: "b", dimName: "country", dimKey: "es", statType: "gauge", statName: "online"},
+		),
+		2: subscribedClient(&subscription{dimName: "country", dimKey: "total", statType: "counter", statName: "bytesGiven"}),
+		3: subscribedClient(&subscription{dimName: "fallback", dimKey: ANY, statType: "counter", statName: "bytesGotten"}),
+		4: subscribedClient(&subscription{dimName: "fallback", dimKey: "fp1", statType: "counter", statName: "bytesGotten"}),
+		5: subscribedClient(),
+	}, nil)
+	if len(filters) != 2 {
+		t.Fatalf("Wrong number of filtered dims: %v", filters)
+	}
+	country := filters["country"]
+	if len(country.Keys) != 2 || !contains(country.Keys, "es") || !contains(country.Keys, "total") {
+		t.Errorf("Wrong keys for country: %v", country.Keys)
+	}
+	if fmt.Sprint(country.Counters) != "[bytesGiven]" || fmt.Sprint(country.Gauges) != "[online]" {
+		t.Errorf("Wrong stats for country: %v %v", country.Counters, country.Gauges)
+	}
+	fallback := filters["fallback"]
+	if fallback.Keys != nil {
+		t.Errorf("Subscribing to any key should read all keys of fallback: %v", fallback.Keys)
+	}
+	if fmt.Sprint(fallback.Counters) != "[bytesGotten]" || fallback.Gauges != nil {
+		t.Errorf("Wrong stats for fallback: %v %v", fallback.Counters, fallback.Gauges)
+	}
+}
+
+func subscribedClient(subs ...*subscription) *streamingClient {
+	client := &streamingClient{subscriptions: make(map[string]*subscription)}
+	for _, sub := range subs {
+		client.subscriptions[sub.id] = sub
+	}
+	return client
+}
+
+func TestStreamingRequests(t *testing.T) {
+	client := subscribedClient(&subscription{id: "a"})
+	for _, test := range []struct {
+		req      *StreamingRequest
+		expected string
+	}{
+		{&StreamingRequest{Type: "subscribe", Dim: "country", StatType: "counter", Stat: "bytesGiven"}, "Subscriptions need an id"},
+		{&StreamingRequest{Type: "subscribe", Id: "a", Dim: "country", StatType: "counter", Stat: "bytesGiven"}, `Already subscribed as "a"`},
+		{&StreamingRequest{Type: "unsubscribe", Id: "b"}, `Not subscribed as "b"`},
+		{&StreamingRequest{Type: "publish", Id: "c"}, `Unknown request type "publish", expected subscribe, unsubscribe or ping`},
+	} {
+		if err := client.handleRequest(test.req); err == nil || err.Error() != test.expected {
+			t.Errorf("Expected error %s, got %v", test.expected, err)
+		}
+	}
+
+	sub, err := (&StreamingRequest{Type: "subscribe", Id: "b", Dim: "country", StatType: "gauge", Stat: "online", HistoryDays: 7}).subscription()
+	if err != nil {
+		t.Fatalf("Unable to build subscription: %s", err)
+	}
+	if sub.dimKey != ANY || sub.historyDays != 7 {
+		t.Errorf("Wrong subscription: %v", sub)
+	}
+	sub, _ = (&StreamingRequest{Type: "subscribe", Id: "c", Dim: "country", Key: "es", StatType: "member", Stat: "online", HistoryDays: 1000}).subscription()
+	if sub.dimKey != "es" || sub.historyDays != ONE_YEAR_DAYS {
+		t.Errorf("History should be limited to a year: %v", sub)
+	}
+
+	update := &streamingUpdate{dims: map[string]map[string]*Stats{
+		"country": map[string]*Stats{
+			"es":    &Stats{Counters: map[string]int64{"bytesGiven": 5}, Gauges: map[string]int64{"online": 2}},
+			"total": &Stats{Counters: map[string]int64{"bytesGiven": 5}, Gauges: map[string]int64{"online": 2}},
+		},
+	}}
+	if values := sub.values(update); len(values) != 0 {
+		t.Errorf("Stats of other types shouldn't be streamed: %v", values)
+	}
+	sub.statType = "gauge"
+	if values := sub.values(update); len(values) != 1 || values["es"] != 2 {
+		t.Errorf("Wrong values: %v", values)
+	}
+}
+
+func TestPublishUpdate(t *testing.T) {
+	s := NewServer(Options{StreamingQueueSize: 2, StreamingMaxOverflows: 2})
+	coalescing := s.streamingClientFor(nil)
+	dropping := s.streamingClientFor(nil)
+	s.streamingClients[1] = coalescing
+	s.streamingClients[2] = dropping
+
+	update := func(seconds int64) *streamingUpdate {
+		return &streamingUpdate{asOf: time.Unix(seconds, 0)}
+	}
+	s.publishUpdate(update(1))
+	s.publishUpdate(update(2))
+	if dropped := coalescing.enqueue(update(3), QUEUE_COALESCE); dropped != 2 {
+		t.Errorf("Coalescing should have dropped both queued updates, dropped %d", dropped)
+	}
+	if len(coalescing.updates) != 1 || (<-coalescing.updates).asOf.Unix() != 3 {
+		t.Errorf("Only the latest update should be queued")
+	}
+	if dropped := dropping.enqueue(update(3), QUEUE_DROP); dropped != 1 {
+		t.Errorf("Dropping should have dropped the new update, dropped %d", dropped)
+	}
+	if len(dropping.updates) != 2 {
+		t.Errorf("Queued updates should have been kept")
+	}
+
+	// The dropping client has already overflowed once, the coalescing one has
+	// room to spare
+	dropping.overflows = 1
+	s.opts.StreamingQueuePolicy = QUEUE_DROP
+	s.publishUpdate(update(4))
+	s.publishUpdate(update(5))
+	if s.streamingClients[1] != coalescing || s.streamingClients[2] != nil {
+		t.Errorf("Only the client that overflowed twice in a row should have been evicted: %v", s.streamingClients)
+	}
+	select {
+	case reason := <-dropping.evicted:
+		if reason != "Evicted for falling more than 2 updates behind" {
+			t.Errorf("Wrong reason: %s", reason)
+		}
+	default:
+		t.Errorf("Evicted client should have been told why")
+	}
+	if s.droppedStreamingUpdates != 1 || s.evictedStreamingClients != 1 {
+		t.Errorf("Wrong counts of dropped updates (%d) and evicted clients (%d)", s.droppedStreamingUpdates, s.evictedStreamingClients)
+	}
+}
+
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time {
+	return time.Time(c)
+}
+
+func TestLoadHistoryForRange(t *testing.T) {
+	client := fake.New()
+
+	client.InsertTable("p", bigquery.DATASET_ID, &bq.Table{
+		TableReference: &bq.TableReference{TableId: "country_hourly_20140501"},
+		Schema: &bq.TableSchema{Fields: []*bq.TableFieldSchema{
+			&bq.TableFieldSchema{Name: "_dim", Type: "STRING"},
+			&bq.TableFieldSchema{Name: "_ts", Type: "TIMESTAMP"},
+			&bq.TableFieldSchema{Name: "counter_bytesGiven", Type: "INTEGER"},
+		}},
+	})
+	req := &bq.TableDataInsertAllRequest{}
+	for i, row := range []map[string]interface{}{
+		{"_dim": "es", "_ts": 1398945600, "counter_bytesGiven": 5},
+		{"_dim": "de", "_ts": 1398945600, "counter_bytesGiven": 3},
+		{"_dim": "es", "_ts": 1398949200, "counter_bytesGiven": 7},
+	} {
+		req.Rows = append(req.Rows, &bq.TableDataInsertAllRequestRows{InsertId: fmt.Sprint(i), Json: row})
+	}
+	client.InsertAll("p", bigquery.DATASET_ID, "country_hourly_20140501", req)
+
+	now := time.Unix(1398956400, 0)
+	s := NewServer(Options{Clock: fixedClock(now), HistoryRollups: true, BigQuery: client})
+	sub := &subscription{dimName: "country", dimKey: ANY, statType: "counter", statName: "bytesGiven"}
+	intervals, err := s.loadHistoryForRange(sub, nil, ONE_HOUR_SECS, now.Add(-24*time.Hour), now)
+	if err != nil {
+		t.Fatalf("Unable to load history: %s", err)
+	}
+	if len(intervals) != 2 || intervals[0].AsOfSeconds != 1398945600 || intervals[0].Values["de"] != 3 || intervals[1].Values["es"] != 7 {
+		t.Errorf("Wrong intervals: %v", intervals)
+	}
+
+	// A reconnecting client only gets what it missed
+	sub.historyDays, sub.since = 1, 1398945600
+	if intervals, err = s.loadHistory(sub); err != nil {
+		t.Fatalf("Unable to load history: %s", err)
+	}
+	if len(intervals) != 1 || intervals[0].AsOfSeconds != 1398949200 || intervals[0].Values["es"] != 7 {
+		t.Errorf("Wrong intervals since last event: %v", intervals)
+	}
+
+	sub.statName = "bytes given"
+	if _, err := s.loadHistoryForRange(sub, nil, ONE_HOUR_SECS, now.Add(-24*time.Hour), now); err == nil {
+		t.Errorf("Invalid stat names should be rejected")
+	}
+}
+
+func TestLoadHistoryWithoutRollupTables(t *testing.T) {
+	client := fake.New()
+
+	client.InsertTable("p", bigquery.DATASET_ID, &bq.Table{
+		TableReference: &bq.TableReference{TableId: "country_20140501"},
+		Schema: &bq.TableSchema{Fields: []*bq.TableFieldSchema{
+			&bq.TableFieldSchema{Name: "_dim", Type: "STRING"},
+			&bq.TableFieldSchema{Name: "_ts", Type: "TIMESTAMP"},
+			&bq.TableFieldSchema{Name: "counter", Type: "RECORD", Fields: []*bq.TableFieldSchema{
+				&bq.TableFieldSchema{Name: "bytesGiven", Type: "INTEGER"},
+			}},
+		}},
+	})
+	client.InsertAll("p", bigquery.DATASET_ID, "country_20140501", &bq.TableDataInsertAllRequest{
+		Rows: []*bq.TableDataInsertAllRequestRows{
+			&bq.TableDataInsertAllRequestRows{Json: map[string]interface{}{"_dim": "es", "_ts": 1398945600, "counter": map[string]interface{}{"bytesGiven": 5}}},
+		},
+	})
+
+	now := time.Unix(1398956400, 0)
+	sub := &subscription{dimName: "country", dimKey: ANY, statType: "counter", statName: "bytesGiven"}
+	for _, rollups := range []bool{true, false} {
+		s := NewServer(Options{Clock: fixedClock(now), HistoryRollups: rollups, BigQuery: client})
+		intervals, err := s.loadHistoryForRange(sub, nil, ONE_HOUR_SECS, now.Add(-24*time.Hour), now)
+		if err != nil {
+			t.Fatalf("Unable to load history: %s", err)
+		}
+		if len(intervals) != 1 || intervals[0].Values["es"] != 5 {
+			t.Errorf("Wrong intervals with rollups %v: %v", rollups, intervals)
+		}
+	}
+	// Each server looks for a legacy table once, and with rollups, the rollup
+	// tables are tried first
+	if queries := client.Queries(); len(queries) != 5 {
+		t.Errorf("Expected 5 queries, got %d: %v", len(queries), queries)
+	}
+
+	// Nothing was archived a month later, which isn't an error
+	var logged bytes.Buffer
+	s := NewServer(Options{Clock: fixedClock(now), Logger: log.New(&logged, "", 0), BigQuery: client})
+	later := now.Add(30 * 24 * time.Hour)
+	intervals, err := s.loadHistoryForRange(sub, nil, ONE_HOUR_SECS, later.Add(-24*time.Hour), later)
+	if err != nil || len(intervals) != 0 {
+		t.Errorf("Expected no intervals, got %v: %v", intervals, err)
+	}
+	if logged.Len() > 0 {
+		t.Errorf("Missing tables shouldn't be logged: %s", logged.String())
+	}
+}
+
+func TestLoadHistoryFromLegacyTable(t *testing.T) {
+	client := fake.New()
+
+	schema := &bq.TableSchema{Fields: []*bq.TableFieldSchema{
+		&bq.TableFieldSchema{Name: "_dim", Type: "STRING"},
+		&bq.TableFieldSchema{Name: "_ts", Type: "TIMESTAMP"},
+		&bq.TableFieldSchema{Name: "counter", Type: "RECORD", Fields: []*bq.TableFieldSchema{
+			&bq.TableFieldSchema{Name: "bytesGiven", Type: "INTEGER"},
+		}},
+	}}
+	// Rows were archived to the legacy table until 1398945600 and to day
+	// tables since then
+	for table, row := range map[string]map[string]interface{}{
+		"country":          {"_dim": "es", "_ts": 1398945600, "counter": map[string]interface{}{"bytesGiven": 5}},
+		"country_20140501": {"_dim": "es", "_ts": 1398952800, "counter": map[string]interface{}{"bytesGiven": 9}},
+	} {
+		client.InsertTable("p", bigquery.DATASET_ID, &bq.Table{TableReference: &bq.TableReference{TableId: table}, Schema: schema})
+		client.InsertAll("p", bigquery.DATASET_ID, table, &bq.TableDataInsertAllRequest{
+			Rows: []*bq.TableDataInsertAllRequestRows{&bq.TableDataInsertAllRequestRows{Json: row}},
+		})
+	}
+
+	now := time.Unix(1398956400, 0)
+	s := NewServer(Options{Clock: fixedClock(now), BigQuery: client})
+	sub := &subscription{dimName: "country", dimKey: ANY, statType: "counter", statName: "bytesGiven"}
+	intervals, err := s.loadHistoryForRange(sub, nil, ONE_HOUR_SECS, now.Add(-24*time.Hour), now)
+	if err != nil {
+		t.Fatalf("Unable to load history: %s", err)
+	}
+	if len(intervals) != 2 || intervals[0].AsOfSeconds != 1398945600 || intervals[0].Values["es"] != 5 || intervals[1].Values["es"] != 9 {
+		t.Errorf("Wrong intervals: %v", intervals)
+	}
+
+	// Ranges after the legacy table only read the day tables, and the end of
+	// the legacy table is only looked up once
+	intervals, err = s.loadHistoryForRange(sub, nil, ONE_HOUR_SECS, time.Unix(1398949200, 0), now)
+	if err != nil || len(intervals) != 1 || intervals[0].Values["es"] != 9 {
+		t.Errorf("Wrong intervals after the legacy table: %v: %v", intervals, err)
+	}
+	if queries := client.Queries(); len(queries) != 4 {
+		t.Errorf("Expected 4 queries, got %d: %v", len(queries), queries)
+	}
+}
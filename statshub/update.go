@@ -16,6 +16,7 @@
 package statshub
 
 import (
+	"encoding/json"
 	"fmt"
 	"sort"
 	"strings"
@@ -52,24 +53,22 @@ type statWriter struct {
 }
 
 // write posts Counters, Increments, and Gauges and Members for the given id to redis,
-// precalculating rollups for each dimension in stats.Dims.
-func (stats *StatsUpdate) write(id string) (err error) {
+// precalculating rollups for each dimension in stats.Dims.  Gauges are written to
+// the period containing now.  If changesChannel isn't empty, the statsChange
+// (from origin) is published to it.
+func (stats *StatsUpdate) write(conn redis.Conn, now time.Time, id string, origin string, changesChannel string) (err error) {
+	if err = stats.validate(); err != nil {
+		return
+	}
+
 	// Always treat dimensions as lower case
 	lowercasedDims := make(map[string]string)
 	for name, key := range stats.Dims {
-		dimName := strings.ToLower(name)
-		dimKey := strings.ToLower(key)
-		if dimKey == "total" {
-			return fmt.Errorf("Dimension key 'total' is not allowed because it is a reserved word")
-		}
-		lowercasedDims[dimName] = dimKey
+		lowercasedDims[strings.ToLower(name)] = strings.ToLower(key)
 	}
 	stats.Dims = lowercasedDims
 
-	if stats.conn, err = connectToRedis(); err != nil {
-		return
-	}
-	defer stats.conn.Close()
+	stats.conn = conn
 
 	if err = stats.writeCounters(id); err != nil {
 		return
@@ -77,7 +76,7 @@ func (stats *StatsUpdate) write(id string) (err error) {
 	if err = stats.writeIncrements(id); err != nil {
 		return
 	}
-	if err = stats.writeGauges(id); err != nil {
+	if err = stats.writeGauges(id, now); err != nil {
 		return
 	}
 	if err = stats.writeMembers(id); err != nil {
@@ -92,11 +91,30 @@ func (stats *StatsUpdate) write(id string) (err error) {
 		err = stats.conn.Send("SADD", "dim", name)
 		err = stats.conn.Send("SADD", "dim:"+name, value)
 	}
+	// Save id so that its detail can be queried
+	err = stats.conn.Send("SADD", "id", id)
+	if changesChannel != "" && len(stats.Dims) > 0 {
+		var change []byte
+		if change, err = json.Marshal(stats.change(origin)); err != nil {
+			return
+		}
+		err = stats.conn.Send("PUBLISH", changesChannel, change)
+	}
 	err = stats.conn.Flush()
 
 	return
 }
 
+// validate checks that the update can be written
+func (stats *StatsUpdate) validate() error {
+	for _, key := range stats.Dims {
+		if strings.ToLower(key) == "total" {
+			return fmt.Errorf("Dimension key 'total' is not allowed because it is a reserved word")
+		}
+	}
+	return nil
+}
+
 // writeIncrements increments counters in redis
 func (stats *StatsUpdate) writeIncrements(id string) (err error) {
 	return stats.doWriteInt(id, stats.Increments, &statWriter{
@@ -135,8 +153,7 @@ func (stats *StatsUpdate) writeCounters(id string) (err error) {
 }
 
 // writeGauges sets gauges in redis
-func (stats *StatsUpdate) writeGauges(id string) (err error) {
-	now := time.Now()
+func (stats *StatsUpdate) writeGauges(id string, now time.Time) (err error) {
 	now = now.Truncate(statsPeriod)
 	expiration := now.Add(3 * statsPeriod)
 
@@ -371,6 +388,21 @@ func (stats *StatsUpdate) drainReceiveBuffer() (err error) {
 	return
 }
 
+// updateKey identifies the StatsUpdate to which a stat belongs by its id and
+// dims, for use when aggregating multiple stats into a single update.
+func updateKey(id string, dims map[string]string) string {
+	dimNames := make([]string, 0, len(dims))
+	for name := range dims {
+		dimNames = append(dimNames, name)
+	}
+	sort.Strings(dimNames)
+	parts := []string{id}
+	for _, name := range dimNames {
+		parts = append(parts, name+"="+dims[name])
+	}
+	return strings.Join(parts, "|")
+}
+
 // withLowerCaseKeys converts the keys in a map to lower case, returning a new
 // map with the lower cased keys.
 func withLowerCaseKeys(values map[string]uint64) (lowerCased map[string]uint64) {